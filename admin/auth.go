@@ -0,0 +1,50 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RequireToken makes the server refuse requests without token. It's passed
+// either as a bearer token, or as the password of basic authentication
+// with any user name so browsers can prompt for it.
+func (s *Server) RequireToken(token string) {
+	s.token = token
+}
+
+// authorized returns whether r carries the token, if one is required.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	var given string
+	if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) == 1
+}
+
+// crossOrigin returns whether r is a request changing state that a browser
+// sent on behalf of another site. Browsers send the credentials of basic
+// authentication along with those too.
+func crossOrigin(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
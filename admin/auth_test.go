@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerToken(t *testing.T) {
+	s, _, _ := newTestServer()
+	s.RequireToken("secret")
+
+	rec := do(s, "GET", "/api/devices", "")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 asking for basic authentication, got %d", rec.Code)
+	}
+
+	for _, auth := range []func(*http.Request){
+		func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+		func(r *http.Request) { r.SetBasicAuth("admin", "secret") },
+	} {
+		req := httptest.NewRequest("GET", "/api/devices", nil)
+		auth(req)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected 200 with the token, got %d", rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/devices", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", rec.Code)
+	}
+}
+
+func TestServerCrossOrigin(t *testing.T) {
+	s, _, discovered := newTestServer()
+
+	for _, tt := range []struct {
+		header, value string
+		code          int
+	}{
+		{"Origin", "http://evil.example", http.StatusForbidden},
+		{"Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		{"Origin", "http://example.com", http.StatusAccepted},
+		{"Sec-Fetch-Site", "same-origin", http.StatusAccepted},
+	} {
+		*discovered = false
+		req := httptest.NewRequest("POST", "/api/discover", nil)
+		req.Header.Set(tt.header, tt.value)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.code || *discovered != (tt.code == http.StatusAccepted) {
+			t.Errorf("Expected %d with %s %s, got %d", tt.code, tt.header, tt.value, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/devices", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected reading from another origin to be left to CORS, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,223 @@
+package admin
+
+import (
+	"net/http"
+)
+
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboard))
+}
+
+// dashboard is a page showing the devices and the HomeKit pairing state,
+// built on the API without any external dependencies.
+const dashboard = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Hemtjänst</title>
+<style>
+body { font-family: -apple-system, system-ui, sans-serif; margin: 0; background: #f4f4f6; color: #222; }
+header { background: #2b2d42; color: #fff; padding: 1em 1.5em; display: flex; justify-content: space-between; align-items: center; }
+header h1 { margin: 0; font-size: 1.4em; }
+main { padding: 1em 1.5em; max-width: 70em; }
+section { margin-bottom: 2em; }
+h2 { font-size: 1.1em; text-transform: capitalize; border-bottom: 1px solid #ccc; padding-bottom: .3em; }
+.devices { display: grid; grid-template-columns: repeat(auto-fill, minmax(18em, 1fr)); gap: 1em; }
+.device { background: #fff; border-radius: 8px; padding: 1em; box-shadow: 0 1px 3px rgba(0,0,0,.1); }
+.device.unreachable { opacity: .6; border-left: 4px solid #d62828; }
+.device h3 { margin: 0 0 .2em; font-size: 1em; }
+.meta { color: #777; font-size: .8em; margin-bottom: .6em; word-break: break-all; }
+.status { font-size: .8em; font-weight: bold; }
+.status.ok { color: #2a9d8f; }
+.status.bad { color: #d62828; }
+table { width: 100%; border-collapse: collapse; font-size: .9em; }
+td { padding: .2em 0; vertical-align: middle; }
+td.value { font-family: monospace; text-align: right; padding-right: .5em; }
+td.set { text-align: right; white-space: nowrap; }
+input { width: 5em; }
+#homekit { background: #fff; border-radius: 8px; padding: 1em; box-shadow: 0 1px 3px rgba(0,0,0,.1); }
+#homekit img { width: 12em; display: block; }
+#connection { font-size: .8em; }
+</style>
+</head>
+<body>
+<header><h1>Hemtjänst</h1><span id="connection">Connecting…</span></header>
+<main>
+<section>
+<h2>HomeKit</h2>
+<div id="homekit">HomeKit pairing information is not available.</div>
+</section>
+<div id="devices"></div>
+</main>
+<script>
+var devices = {};
+
+function el(tag, attrs, children) {
+	var e = document.createElement(tag);
+	for (var k in attrs || {}) {
+		if (k === "class") e.className = attrs[k]; else e.setAttribute(k, attrs[k]);
+	}
+	(children || []).forEach(function(c) {
+		e.appendChild(typeof c === "string" ? document.createTextNode(c) : c);
+	});
+	return e;
+}
+
+function ago(t) {
+	var d = new Date(t);
+	if (isNaN(d) || d.getFullYear() < 2000) return "never";
+	var s = Math.round((Date.now() - d) / 1000);
+	if (s < 60) return s + "s ago";
+	if (s < 3600) return Math.round(s / 60) + "m ago";
+	if (s < 86400) return Math.round(s / 3600) + "h ago";
+	return d.toLocaleString();
+}
+
+function setFeature(topic, key, value) {
+	fetch("/api/devices/" + topic + "?feature=" + encodeURIComponent(key), {method: "PUT", body: String(value)})
+		.then(function(r) { if (!r.ok) r.json().then(function(e) { alert(e.error); }); });
+}
+
+function featureRow(d, key) {
+	var f = d.features[key];
+	var value = f.value === null || f.value === undefined ? "–" : f.value;
+	var set = el("td", {class: "set"});
+	if (f.setTopic && !f.readOnly) {
+		if (f.value === "0" || f.value === "1" || f.value === "true" || f.value === "false") {
+			var on = f.value === "1" || f.value === "true";
+			var b = el("button", {}, [on ? "Turn off" : "Turn on"]);
+			b.onclick = function() { setFeature(d.topic, key, on ? "0" : "1"); };
+			set.appendChild(b);
+		} else {
+			var input = el("input", {type: "text", value: f.value || ""});
+			var b = el("button", {}, ["Set"]);
+			b.onclick = function() { setFeature(d.topic, key, input.value); };
+			set.appendChild(input);
+			set.appendChild(b);
+		}
+	}
+	return el("tr", {title: "Updated " + ago(f.updated)}, [el("td", {}, [key]), el("td", {class: "value"}, [value]), set]);
+}
+
+function render() {
+	var byType = {};
+	Object.keys(devices).sort().forEach(function(topic) {
+		var d = devices[topic];
+		var t = d.type || "other";
+		(byType[t] = byType[t] || []).push(d);
+	});
+	var root = document.getElementById("devices");
+	root.innerHTML = "";
+	Object.keys(byType).sort().forEach(function(t) {
+		var grid = el("div", {class: "devices"});
+		byType[t].forEach(function(d) {
+			var rows = Object.keys(d.features).sort().map(function(key) { return featureRow(d, key); });
+			grid.appendChild(el("div", {class: "device" + (d.reachable ? "" : " unreachable")}, [
+				el("h3", {}, [d.name || d.topic]),
+				el("div", {class: "meta"}, [d.topic + " · last seen " + ago(d.lastSeen)]),
+				el("div", {class: "status " + (d.reachable ? "ok" : "bad")}, [d.reachable ? "Reachable" : "No response"]),
+				el("table", {}, rows)
+			]));
+		});
+		root.appendChild(el("section", {}, [el("h2", {}, [t]), grid]));
+	});
+}
+
+function loadDevices() {
+	fetch("/api/devices").then(function(r) { return r.json(); }).then(function(list) {
+		devices = {};
+		list.forEach(function(d) { devices[d.topic] = d; });
+		render();
+	});
+}
+
+function loadHomekit() {
+	fetchBridge(1).then(function(first) {
+		var rest = [];
+		for (var n = 2; n <= first.bridges; n++) rest.push(fetchBridge(n));
+		return Promise.all([first].concat(rest));
+	}).then(function(bridges) {
+		var root = document.getElementById("homekit");
+		root.innerHTML = "";
+		bridges.forEach(function(hk) { root.appendChild(renderBridge(hk, bridges.length > 1)); });
+	}).catch(function() {});
+}
+
+function fetchBridge(n) {
+	return fetch("/api/homekit?bridge=" + n).then(function(r) {
+		if (!r.ok) throw new Error();
+		return r.json();
+	});
+}
+
+function renderBridge(hk, numbered) {
+	var root = el("div", {});
+	if (numbered) root.appendChild(el("h3", {}, ["Bridge " + hk.bridge]));
+	if (hk.paired) {
+		root.appendChild(el("p", {class: "status ok"}, ["Paired"]));
+	} else {
+		root.appendChild(el("p", {class: "status bad"}, ["Not paired, scan the code with the Home app to add the bridge"]));
+		root.appendChild(el("img", {src: "/api/homekit/qr.svg?bridge=" + hk.bridge + "&" + Date.now(), alt: hk.setupURI || ""}));
+	}
+	if (hk.setupURI) root.appendChild(el("p", {class: "meta"}, [hk.setupURI]));
+	if (hk.pairings.length > 0) {
+		root.appendChild(el("p", {}, ["Paired controllers:"]));
+		root.appendChild(el("ul", {}, hk.pairings.map(function(p) {
+			var b = el("button", {}, ["Remove"]);
+			b.onclick = function() { removePairing(hk.bridge, "/" + encodeURIComponent(p.id), "Remove the pairing with " + p.id + "?"); };
+			return el("li", {}, [p.id + (p.admin ? " (admin) " : " "), b]);
+		})));
+		var reset = el("button", {}, ["Reset all pairings"]);
+		reset.onclick = function() { removePairing(hk.bridge, "", "Remove all pairings? The bridge has to be added to the Home app again."); };
+		root.appendChild(reset);
+	}
+	return root;
+}
+
+function removePairing(bridge, path, question) {
+	if (!confirm(question)) return;
+	fetch("/api/homekit/pairings" + path + "?bridge=" + bridge, {method: "DELETE"}).then(loadHomekit);
+}
+
+function connect() {
+	var conn = document.getElementById("connection");
+	var es = new EventSource("/api/events");
+	es.onopen = function() { conn.textContent = "Live"; };
+	es.onerror = function() { conn.textContent = "Reconnecting…"; };
+	es.addEventListener("snapshot", function() { loadDevices(); });
+	["announced", "removed"].forEach(function(t) {
+		es.addEventListener(t, function() { loadDevices(); });
+	});
+	es.addEventListener("reachability", function(e) {
+		var ev = JSON.parse(e.data);
+		if (devices[ev.topic]) { devices[ev.topic].reachable = ev.reachable; render(); }
+	});
+	es.addEventListener("value", function(e) {
+		var ev = JSON.parse(e.data);
+		var d = devices[ev.topic];
+		if (d && d.features[ev.feature]) {
+			d.features[ev.feature].value = ev.value === undefined ? null : ev.value;
+			d.features[ev.feature].updated = ev.time;
+			d.lastSeen = ev.time;
+			render();
+		}
+	});
+}
+
+loadHomekit();
+setInterval(loadHomekit, 30000);
+connect();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,153 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/device"
+)
+
+// keepAlive is how often a comment is sent on idle event streams, so that
+// proxies don't close the connection.
+var keepAlive = 30 * time.Second
+
+// streamBuffer is how many events are queued for a client before further
+// events to it are dropped.
+const streamBuffer = 64
+
+// Event is a change to a device as sent on the event stream.
+type Event struct {
+	Type      string    `json:"type"`
+	Topic     string    `json:"topic"`
+	Feature   string    `json:"feature,omitempty"`
+	Value     *string   `json:"value,omitempty"`
+	Old       *string   `json:"old,omitempty"`
+	Reachable *bool     `json:"reachable,omitempty"`
+	Origin    string    `json:"origin,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// stream is a device.EventHandler that passes events on to every connected
+// client. Clients that can't keep up miss events rather than blocking the
+// manager.
+type stream struct {
+	device.NopEventHandler
+	sync.Mutex
+	clients map[chan Event]bool
+}
+
+func newStream() *stream {
+	return &stream{clients: map[chan Event]bool{}}
+}
+
+func (s *stream) subscribe() chan Event {
+	s.Lock()
+	defer s.Unlock()
+	c := make(chan Event, streamBuffer)
+	s.clients[c] = true
+	return c
+}
+
+func (s *stream) unsubscribe(c chan Event) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.clients, c)
+}
+
+func (s *stream) send(ev Event) {
+	ev.Time = time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.clients {
+		select {
+		case c <- ev:
+		default:
+			log.Printf("Event stream client too slow, dropping %s event for %s", ev.Type, ev.Topic)
+		}
+	}
+}
+
+func (s *stream) Announced(d *device.Device) {
+	s.send(Event{Type: "announced", Topic: d.Topic})
+}
+
+func (s *stream) Removed(d *device.Device) {
+	s.send(Event{Type: "removed", Topic: d.Topic})
+}
+
+func (s *stream) ReachabilityChanged(d *device.Device, reachable bool) {
+	s.send(Event{Type: "reachability", Topic: d.Topic, Reachable: &reachable})
+}
+
+func (s *stream) FeatureValueChanged(d *device.Device, key string, old, new []byte) {
+	ev := Event{Type: "value", Topic: d.Topic, Feature: key}
+	if new != nil {
+		v := string(new)
+		ev.Value = &v
+	}
+	if old != nil {
+		o := string(old)
+		ev.Old = &o
+	}
+	s.send(ev)
+}
+
+func (s *stream) FeatureSet(d *device.Device, key, value, origin string) {
+	s.send(Event{Type: "set", Topic: d.Topic, Feature: key, Value: &value, Origin: origin})
+}
+
+// handleEvents streams events as server-sent events. The stream starts with
+// a snapshot event holding the state of all devices.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := writeEvent(w, "snapshot", s.manager.Snapshot()); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if err := writeEvent(w, ev.Type, ev); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
@@ -0,0 +1,74 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readEvent(t *testing.T, r *bufio.Reader) (string, []byte) {
+	var name string
+	var data []byte
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, data
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = []byte(strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	s, _, _ := newTestServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("Expected an event stream, got ", ct)
+	}
+	r := bufio.NewReader(res.Body)
+
+	name, data := readEvent(t, r)
+	if name != "snapshot" || !strings.Contains(string(data), `"topic":"lightbulb/kitchen"`) {
+		t.Fatalf("Expected a snapshot with the kitchen light, got %s: %s", name, data)
+	}
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/api/devices/lightbulb/kitchen?feature=on", strings.NewReader("1"))
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan Event)
+	go func() {
+		name, data := readEvent(t, r)
+		var ev Event
+		json.Unmarshal(data, &ev)
+		ev.Type = name
+		done <- ev
+	}()
+	select {
+	case ev := <-done:
+		if ev.Type != "set" || ev.Feature != "on" || ev.Origin != "admin" || ev.Value == nil || *ev.Value != "1" {
+			t.Errorf("Expected set event for on from admin, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for set event")
+	}
+}
@@ -0,0 +1,150 @@
+package admin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+	"github.com/hemtjanst/hemtjanst/homekit/qrcode"
+)
+
+type homekitResponse struct {
+	Bridge   int              `json:"bridge"`
+	Bridges  int              `json:"bridges"`
+	Paired   bool             `json:"paired"`
+	SetupURI string           `json:"setupURI,omitempty"`
+	Pairings []bridge.Pairing `json:"pairings"`
+}
+
+const pairingsPath = "/api/homekit/pairings"
+
+// SetBridges makes the pairing state of the HomeKit bridges available on
+// /api/homekit and their setup QR code on /api/homekit/qr.svg. Pairings are
+// managed through:
+//
+//	GET    /api/homekit/pairings        list the paired controllers
+//	DELETE /api/homekit/pairings/<id>   remove a pairing
+//	DELETE /api/homekit/pairings        remove all pairings
+//
+// All of these are about the first bridge, unless another is picked with
+// ?bridge=<n>.
+func (s *Server) SetBridges(bridges ...bridge.Bridge) {
+	s.bridges = bridges
+	s.mux.HandleFunc("/api/homekit", s.handleHomekit)
+	s.mux.HandleFunc("/api/homekit/qr.svg", s.handleQR)
+	s.mux.HandleFunc(pairingsPath, s.handlePairings)
+	s.mux.HandleFunc(pairingsPath+"/", s.handlePairing)
+}
+
+// bridge returns the bridge picked by the request and its number.
+func (s *Server) bridge(w http.ResponseWriter, r *http.Request) (bridge.Bridge, int, bool) {
+	n := 1
+	if v := r.URL.Query().Get("bridge"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid bridge "+v)
+			return nil, 0, false
+		}
+	}
+	if n < 1 || n > len(s.bridges) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown bridge %d", n))
+		return nil, 0, false
+	}
+	return s.bridges[n-1], n, true
+}
+
+func (s *Server) handleHomekit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	b, n, ok := s.bridge(w, r)
+	if !ok {
+		return
+	}
+	pairings, err := b.Pairings()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res := homekitResponse{
+		Bridge:   n,
+		Bridges:  len(s.bridges),
+		Paired:   len(pairings) > 0,
+		Pairings: pairings,
+	}
+	if uri, err := b.SetupURI(); err == nil {
+		res.SetupURI = uri
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleQR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	b, _, ok := s.bridge(w, r)
+	if !ok {
+		return
+	}
+	uri, err := b.SetupURI()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	code, err := qrcode.Encode([]byte(uri))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(code.SVG(8))
+}
+
+func (s *Server) handlePairings(w http.ResponseWriter, r *http.Request) {
+	b, n, ok := s.bridge(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		pairings, err := b.Pairings()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, pairings)
+	case http.MethodDelete:
+		log.Printf("Resetting HomeKit pairings of bridge %d through the admin API", n)
+		if err := b.ResetPairings(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) handlePairing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	b, n, ok := s.bridge(w, r)
+	if !ok {
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, pairingsPath+"/"), "/")
+	log.Printf("Removing HomeKit pairing of bridge %d through the admin API: %s", n, id)
+	if err := b.RemovePairing(id); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,135 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+)
+
+type testBridge struct {
+	pairings []bridge.Pairing
+}
+
+func (b *testBridge) AddAccessory(*accessory.Accessory)              {}
+func (b *testBridge) RemoveAccessory(*accessory.Accessory)           {}
+func (b *testBridge) ReplaceAccessory(old, new *accessory.Accessory) {}
+func (b *testBridge) Start()                                         {}
+func (b *testBridge) Stop()                                          {}
+func (b *testBridge) SetupURI() (string, error)                      { return "X-HM://0023ISYWYHOME", nil }
+func (b *testBridge) Pairings() ([]bridge.Pairing, error)            { return b.pairings, nil }
+func (b *testBridge) ResetPairings() error                           { b.pairings = nil; return nil }
+func (b *testBridge) IDs() *bridge.IDMap                             { return nil }
+func (b *testBridge) HandleSnapshots(bridge.SnapshotFunc)            {}
+
+func (b *testBridge) RemovePairing(id string) error {
+	for i, p := range b.pairings {
+		if p.ID == id {
+			b.pairings = append(b.pairings[:i], b.pairings[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown pairing %s", id)
+}
+
+func TestServerHomekit(t *testing.T) {
+	s, _, _ := newTestServer()
+	rec := do(s, "GET", "/api/homekit", "")
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 without a bridge, got ", rec.Code)
+	}
+
+	b := &testBridge{pairings: []bridge.Pairing{}}
+	s.SetBridges(b)
+	rec = do(s, "GET", "/api/homekit", "")
+	var hk homekitResponse
+	json.Unmarshal(rec.Body.Bytes(), &hk)
+	if rec.Code != http.StatusOK || hk.Paired || hk.SetupURI != "X-HM://0023ISYWYHOME" {
+		t.Errorf("Expected unpaired bridge with setup URI, got %d %+v", rec.Code, hk)
+	}
+
+	rec = do(s, "GET", "/api/homekit/qr.svg", "")
+	if rec.Header().Get("Content-Type") != "image/svg+xml" || !strings.HasPrefix(rec.Body.String(), "<svg") {
+		t.Errorf("Expected an SVG, got %s", rec.Body.String())
+	}
+
+	b.pairings = []bridge.Pairing{{ID: "controller"}}
+	rec = do(s, "GET", "/api/homekit", "")
+	hk = homekitResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &hk)
+	if !hk.Paired || len(hk.Pairings) != 1 {
+		t.Errorf("Expected paired bridge, got %+v", hk)
+	}
+}
+
+func TestServerDashboard(t *testing.T) {
+	s, _, _ := newTestServer()
+	rec := do(s, "GET", "/", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<title>Hemtjänst</title>") {
+		t.Error("Expected the dashboard, got ", rec.Code)
+	}
+	rec = do(s, "GET", "/nothing", "")
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected 404, got ", rec.Code)
+	}
+}
+
+func TestServerPairings(t *testing.T) {
+	s, _, _ := newTestServer()
+	admin := true
+	b := &testBridge{pairings: []bridge.Pairing{{ID: "a", Admin: &admin}, {ID: "b"}, {ID: "c"}}}
+	s.SetBridges(b)
+
+	rec := do(s, "GET", "/api/homekit/pairings", "")
+	var ps []bridge.Pairing
+	json.Unmarshal(rec.Body.Bytes(), &ps)
+	if rec.Code != http.StatusOK || len(ps) != 3 || ps[0].Admin == nil || !*ps[0].Admin || ps[1].Admin != nil {
+		t.Errorf("Expected 3 pairings, got %d %+v", rec.Code, ps)
+	}
+
+	rec = do(s, "DELETE", "/api/homekit/pairings/b", "")
+	if rec.Code != http.StatusNoContent || len(b.pairings) != 2 {
+		t.Errorf("Expected pairing to be removed, got %d %+v", rec.Code, b.pairings)
+	}
+	rec = do(s, "DELETE", "/api/homekit/pairings/b", "")
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 for unknown pairing, got ", rec.Code)
+	}
+
+	rec = do(s, "DELETE", "/api/homekit/pairings", "")
+	if rec.Code != http.StatusNoContent || len(b.pairings) != 0 {
+		t.Errorf("Expected pairings to be reset, got %d %+v", rec.Code, b.pairings)
+	}
+}
+
+func TestServerBridges(t *testing.T) {
+	s, _, _ := newTestServer()
+	first := &testBridge{pairings: []bridge.Pairing{}}
+	second := &testBridge{pairings: []bridge.Pairing{{ID: "a"}}}
+	s.SetBridges(first, second)
+
+	rec := do(s, "GET", "/api/homekit?bridge=2", "")
+	var hk homekitResponse
+	json.Unmarshal(rec.Body.Bytes(), &hk)
+	if hk.Bridge != 2 || hk.Bridges != 2 || !hk.Paired {
+		t.Errorf("Expected paired second bridge, got %+v", hk)
+	}
+
+	rec = do(s, "DELETE", "/api/homekit/pairings/a?bridge=2", "")
+	if rec.Code != http.StatusNoContent || len(second.pairings) != 0 {
+		t.Errorf("Expected pairing of the second bridge to be removed, got %d", rec.Code)
+	}
+
+	rec = do(s, "GET", "/api/homekit?bridge=3", "")
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 for unknown bridge, got ", rec.Code)
+	}
+	rec = do(s, "GET", "/api/homekit?bridge=x", "")
+	if rec.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for invalid bridge, got ", rec.Code)
+	}
+}
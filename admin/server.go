@@ -0,0 +1,223 @@
+// Package admin provides an HTTP API to inspect and control the devices
+// known to a device.Manager.
+//
+// The API has the following endpoints, all of which respond with JSON:
+//
+//	GET    /api/devices                          list all devices
+//	GET    /api/devices/<topic>                  get a device
+//	DELETE /api/devices/<topic>                  remove a device and its announcement
+//	GET    /api/devices/<topic>?feature=<key>    get the value of a feature
+//	PUT    /api/devices/<topic>?feature=<key>    set a feature to the body
+//	POST   /api/discover                         ask devices to announce
+//
+// GET /api/events streams changes to devices as server-sent events, see
+// Event. Once SetBridges is called, GET /api/homekit returns the pairing
+// state of the bridges. A dashboard built on the API is served on /.
+//
+// Requests need a token once RequireToken is called. Requests changing
+// state from another origin than the server's are always refused.
+//
+// Features of additional services are identified by <service>/<feature>.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/device"
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+)
+
+const devicesPath = "/api/devices"
+
+// setTimeout is how long setting a feature may take to reach the broker.
+const setTimeout = 5 * time.Second
+
+// Server serves the admin API.
+type Server struct {
+	manager  *device.Manager
+	discover func()
+	retract  func(topic string)
+	mux      *http.ServeMux
+	events   *stream
+	bridges  []bridge.Bridge
+	token    string
+}
+
+// deviceResponse is a device's state along with its metadata.
+type deviceResponse struct {
+	device.DeviceState
+	Meta json.RawMessage `json:"meta"`
+}
+
+type featureResponse struct {
+	Topic   string `json:"topic"`
+	Feature string `json:"feature"`
+	device.FeatureState
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewServer returns a Server for the devices in m. discover is called to
+// (re)start discovery of devices and retract with the topic of a device
+// removed through the API, to clear its retained announcement so it doesn't
+// come back. Both may be nil.
+func NewServer(m *device.Manager, discover func(), retract func(topic string)) *Server {
+	s := &Server{
+		manager:  m,
+		discover: discover,
+		retract:  retract,
+		mux:      http.NewServeMux(),
+		events:   newStream(),
+	}
+	m.AddEventHandler(s.events)
+	s.mux.HandleFunc(devicesPath, s.handleDevices)
+	s.mux.HandleFunc(devicesPath+"/", s.handleDevice)
+	s.mux.HandleFunc("/api/discover", s.handleDiscover)
+	s.mux.HandleFunc("/api/events", s.handleEvents)
+	s.mux.HandleFunc("/", s.handleDashboard)
+	return s
+}
+
+// Handle registers an additional handler on the server, for example to
+// serve a user interface next to the API.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="hemtjanst"`)
+		writeError(w, http.StatusUnauthorized, "missing or wrong token")
+		return
+	}
+	if crossOrigin(r) {
+		writeError(w, http.StatusForbidden, "cross-origin requests are not allowed")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	res := []deviceResponse{}
+	for _, state := range s.manager.Snapshot() {
+		d, err := s.manager.Get(state.Topic)
+		if err != nil {
+			// Removed since the snapshot was taken
+			continue
+		}
+		meta, _ := d.Metadata()
+		res = append(res, deviceResponse{DeviceState: state, Meta: meta})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleDevice(w http.ResponseWriter, r *http.Request) {
+	topic := strings.Trim(strings.TrimPrefix(r.URL.Path, devicesPath+"/"), "/")
+	d, err := s.manager.Get(topic)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if key := r.URL.Query().Get("feature"); key != "" {
+		s.handleFeature(w, r, d, key)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		meta, _ := d.Metadata()
+		writeJSON(w, http.StatusOK, deviceResponse{DeviceState: d.State(), Meta: meta})
+	case http.MethodDelete:
+		log.Print("Removing device through the admin API: ", topic)
+		s.manager.Remove(topic)
+		if s.retract != nil {
+			s.retract(topic)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) handleFeature(w http.ResponseWriter, r *http.Request, d *device.Device, key string) {
+	ft, err := d.LookupFeature(key)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, featureResponse{
+			Topic:        d.Topic,
+			Feature:      key,
+			FeatureState: d.State().Features[key],
+		})
+	case http.MethodPut, http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		value := strings.TrimSpace(string(body))
+		if value == "" {
+			writeError(w, http.StatusBadRequest, "missing value")
+			return
+		}
+		log.Printf("Setting %s on %s to %s through the admin API", key, d.Topic, value)
+		ctx, cancel := context.WithTimeout(r.Context(), setTimeout)
+		defer cancel()
+		if err := ft.SetFromContext(ctx, "admin", value); err == device.ErrReadOnly {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		} else if err == context.DeadlineExceeded {
+			writeError(w, http.StatusGatewayTimeout, "the broker didn't take the change in time")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) handleDiscover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.discover == nil {
+		writeError(w, http.StatusNotImplemented, "discovery is not available")
+		return
+	}
+	log.Print("Starting discovery through the admin API")
+	s.discover()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print("Could not write response: ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
@@ -0,0 +1,125 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hemtjanst/hemtjanst/device"
+	"github.com/hemtjanst/hemtjanst/messaging"
+)
+
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+}
+
+func newTestServer() (*Server, *messaging.TestingMessenger, *bool) {
+	m := &messaging.TestingMessenger{}
+	mn := device.NewManager(m, nil)
+	mn.Add("lightbulb/kitchen", []byte(`{"name": "kitchen", "type": "lightbulb", "feature": {"on": {}}}`))
+	discovered := false
+	retract := func(topic string) { m.Publish("announce/"+topic, nil, 1, true) }
+	return NewServer(mn, func() { discovered = true }, retract), m, &discovered
+}
+
+func do(s *Server, method, url, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServerDevices(t *testing.T) {
+	s, m, _ := newTestServer()
+
+	rec := do(s, "GET", "/api/devices", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected 200, got ", rec.Code)
+	}
+	var devs []deviceResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &devs); err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 1 || devs[0].Topic != "lightbulb/kitchen" || !devs[0].Reachable {
+		t.Errorf("Expected reachable lightbulb/kitchen, got %+v", devs)
+	}
+
+	rec = do(s, "GET", "/api/devices/lightbulb/kitchen", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected 200, got ", rec.Code)
+	}
+	var dev deviceResponse
+	json.Unmarshal(rec.Body.Bytes(), &dev)
+	if dev.Name != "kitchen" || len(dev.Meta) == 0 {
+		t.Errorf("Expected device with metadata, got %+v", dev)
+	}
+
+	rec = do(s, "GET", "/api/devices/lightbulb/bathroom", "")
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 for unknown device, got ", rec.Code)
+	}
+
+	rec = do(s, "DELETE", "/api/devices/lightbulb/kitchen", "")
+	if rec.Code != http.StatusNoContent {
+		t.Error("Expected 204, got ", rec.Code)
+	}
+	if !reflect.DeepEqual(m.Topic, []string{"announce/lightbulb/kitchen"}) || len(m.Message) != 0 || !m.Persist {
+		t.Errorf("Expected the retained announcement to be cleared, got %q on %v", m.Message, m.Topic)
+	}
+	rec = do(s, "GET", "/api/devices/lightbulb/kitchen", "")
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected device to be removed, got ", rec.Code)
+	}
+}
+
+func TestServerFeature(t *testing.T) {
+	s, m, _ := newTestServer()
+
+	rec := do(s, "GET", "/api/devices/lightbulb/kitchen?feature=on", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected 200, got ", rec.Code)
+	}
+	var ft featureResponse
+	json.Unmarshal(rec.Body.Bytes(), &ft)
+	if ft.Feature != "on" || ft.GetTopic != "lightbulb/kitchen/on/get" || ft.Value != nil {
+		t.Errorf("Expected feature on without value, got %+v", ft)
+	}
+
+	rec = do(s, "PUT", "/api/devices/lightbulb/kitchen?feature=on", "1")
+	if rec.Code != http.StatusAccepted {
+		t.Fatal("Expected 202, got ", rec.Code)
+	}
+	if !reflect.DeepEqual(m.Topic, []string{"lightbulb/kitchen/on/set"}) || string(m.Message) != "1" {
+		t.Errorf("Expected 1 to be published on the set topic, got %s on %v", m.Message, m.Topic)
+	}
+
+	rec = do(s, "PUT", "/api/devices/lightbulb/kitchen?feature=brightness", "1")
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 for unknown feature, got ", rec.Code)
+	}
+
+	m.Err = errors.New("not connected")
+	rec = do(s, "PUT", "/api/devices/lightbulb/kitchen?feature=on", "0")
+	if rec.Code != http.StatusBadGateway {
+		t.Error("Expected 502 when the set can't be published, got ", rec.Code)
+	}
+}
+
+func TestServerDiscover(t *testing.T) {
+	s, _, discovered := newTestServer()
+	rec := do(s, "GET", "/api/discover", "")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Error("Expected 405, got ", rec.Code)
+	}
+	rec = do(s, "POST", "/api/discover", "")
+	if rec.Code != http.StatusAccepted || !*discovered {
+		t.Error("Expected discovery to be started, got ", rec.Code)
+	}
+}
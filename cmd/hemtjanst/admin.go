@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// adminTokenFile is the file in the db.path holding the token of the admin
+// API when none is passed with -http.token.
+const adminTokenFile = "http.token"
+
+// adminAddress returns addr, listening on localhost when it has no host.
+func adminAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// adminToken returns the token of the admin API stored in path. A random
+// one is generated and stored when there's none yet.
+func adminToken(path string) (string, error) {
+	if token, err := readAdminToken(path); err == nil && token != "" {
+		return token, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	return token, ioutil.WriteFile(path, []byte(token+"\n"), 0600)
+}
+
+func readAdminToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
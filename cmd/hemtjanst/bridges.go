@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+)
+
+// bridgeFiles are the files hc and the bridge store, which used to be kept
+// in the -db.path itself for the first bridge.
+var bridgeFiles = []string{"uuid", "version", "configHash", "ids", "pairings", "setup.png", "setup.svg", "*.entity", "*.serial"}
+
+// moveFirstBridge moves the storage of the first bridge from dir into dest,
+// unless dest exists already, so it keeps its pairings.
+func moveFirstBridge(dir, dest string) error {
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "uuid")); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	for _, pattern := range bridgeFiles {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, m := range matches {
+			if err := os.Rename(m, filepath.Join(dest, filepath.Base(m))); err != nil {
+				return err
+			}
+		}
+	}
+	log.Print("Moved the HomeKit bridge storage to ", dest)
+	return nil
+}
+
+// newBridges creates n HomeKit bridges, each with its own bridge-<n>
+// directory in -db.path. The first one is configured by the flags as is,
+// the others get a number appended to their name and their own port
+// following -port.
+func newBridges(n int) ([]bridge.Bridge, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("need at least 1 bridge, got %d", n)
+	}
+	if err := moveFirstBridge(*dbPath, filepath.Join(*dbPath, "bridge-1")); err != nil {
+		return nil, err
+	}
+	bridges := make([]bridge.Bridge, 0, n)
+	for i := 0; i < n; i++ {
+		config := bridge.Config{
+			Pin:         *pin,
+			SetupId:     *setupID,
+			Port:        *port,
+			IP:          *addr,
+			StoragePath: filepath.Join(*dbPath, fmt.Sprintf("bridge-%d", i+1)),
+		}
+		info := accessory.Info{
+			Name:         *name,
+			SerialNumber: "12345",
+			Manufacturer: "BEDS Inc.",
+			Model:        "v0.1",
+		}
+		if i > 0 {
+			if p, err := strconv.Atoi(*port); err == nil {
+				config.Port = strconv.Itoa(p + i)
+			}
+			info.Name = fmt.Sprintf("%s %d", *name, i+1)
+			info.SerialNumber = fmt.Sprintf("%s-%d", info.SerialNumber, i+1)
+		}
+
+		b, err := bridge.NewBridge(config, info)
+		if err != nil {
+			return nil, err
+		}
+		if n > 1 {
+			log.Printf("Created HomeKit bridge %d: %s", i+1, info.Name)
+		}
+		if *replayPath == "" || *replayHK {
+			// There's nothing to pair with when the bridges don't start
+			showSetupCode(b, *pin, config.StoragePath, *setupQR)
+		}
+		bridges = append(bridges, b)
+	}
+	return bridges, nil
+}
+
+func startBridges(bridges []bridge.Bridge) {
+	for _, b := range bridges {
+		go b.Start()
+	}
+}
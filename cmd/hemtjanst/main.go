@@ -3,15 +3,18 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/brutella/hc/accessory"
+	"github.com/hemtjanst/hemtjanst/admin"
 	"github.com/hemtjanst/hemtjanst/device"
 	"github.com/hemtjanst/hemtjanst/homekit"
-	"github.com/hemtjanst/hemtjanst/homekit/bridge"
 	"github.com/hemtjanst/hemtjanst/messaging"
+	"github.com/hemtjanst/hemtjanst/messaging/broker"
 	"github.com/hemtjanst/hemtjanst/messaging/flagmqtt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -22,9 +25,27 @@ var (
 	addr     = flag.String("address", "", "IP or hostname for Hemtjänst to bind on")
 	port     = flag.String("port", "12345", "Port for Hemtjänst to bind on")
 	pin      = flag.String("pin", "01020304", "Pairing pin for the HomeKit bridge")
+	nBridges = flag.Int("bridges", 1, "Number of HomeKit bridges to spread the devices over, each bridge takes up to 149 devices")
+	setupID  = flag.String("setup-id", "HOME", "Setup ID of the HomeKit bridge, 4 characters of 0-9 and A-Z")
+	setupQR  = flag.Bool("setup-qr", false, "Write the setup QR code to setup.png and setup.svg in the directory of the bridge in the db.path when unpaired")
 	dbPath   = flag.String("db.path", "./db", "Path to store the database with HomeKit key pairs etc.")
+	httpAddr = flag.String("http.address", "", "Address for the admin HTTP API to listen on, e.g. :8080 for localhost or 0.0.0.0:8080 for all interfaces. Disabled when empty")
+	httpTok  = flag.String("http.token", "", "Token the admin HTTP API requires, as bearer token or basic authentication password. When empty one is generated and stored as "+adminTokenFile+" in the db.path")
 	hVersion = flag.Bool("version", false, "Print the version")
 
+	brokerAddr = flag.String("broker.listen", "", "Address for an embedded MQTT broker to listen on, e.g. :1883. Hemtjänst uses it instead of connecting to mqtt.address. Disabled when empty")
+	brokerUser = flag.String("broker.username", "", "User name clients of the embedded MQTT broker must connect with")
+	brokerPass = flag.String("broker.password", "", "Password clients of the embedded MQTT broker must connect with")
+	brokerAnon = flag.Bool("broker.anonymous", false, "Let clients connect to the embedded MQTT broker without a user name and password when it listens on more than localhost")
+	brokerCert = flag.String("broker.tls.cert", "", "Path to the certificate the embedded MQTT broker serves TLS with")
+	brokerKey  = flag.String("broker.tls.key", "", "Path to the key of the certificate the embedded MQTT broker serves TLS with")
+	brokerMax  = flag.Int("broker.max-packet-size", broker.DefaultMaxPacketSize, "Largest packet in bytes clients of the embedded MQTT broker may send")
+
+	recordPath  = flag.String("record", "", "File to record all MQTT messages Hemtjänst publishes and receives to")
+	replayPath  = flag.String("replay", "", "File with a recording to replay instead of connecting to an MQTT broker")
+	replaySpeed = flag.Float64("replay.speed", 1, "How many times faster than recorded to replay")
+	replayHK    = flag.Bool("replay.homekit", false, "Start the HomeKit bridges during a replay, so it can be followed in the Home app. They're advertised on the network like those of a real installation")
+
 	version = "master"
 )
 
@@ -35,8 +56,14 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "pairing" {
+		os.Exit(pairingCommand(os.Args[2:]))
+	}
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [parameters]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pairing [parameters] list|remove <id>|reset\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Parameters:\n\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\n")
@@ -48,26 +75,30 @@ func main() {
 	}
 
 	log.Print("Initialing Hemtjänst")
-	quit := make(chan os.Signal)
+	var replayDB string
+	if *replayPath != "" {
+		// A replay gets a database of its own, so it doesn't change the
+		// devices, pairings and HomeKit IDs of the real one
+		var err error
+		if replayDB, err = ioutil.TempDir("", "hemtjanst-replay"); err != nil {
+			log.Fatal("Could not create a database for the replay: ", err)
+		}
+		*dbPath = replayDB
+		log.Print("Using a temporary database for the replay in ", replayDB)
+		if !*replayHK {
+			log.Print("Not starting the HomeKit bridges during the replay, pass -replay.homekit to start them")
+		}
+	}
+	// A replay doesn't advertise its bridges on the network unless asked to,
+	// so the Home app doesn't run into them next to the real ones
+	startHomekit := replayDB == "" || *replayHK
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	announce := make(chan messaging.Message)
 	leave := make(chan messaging.Message)
 	handlerInit := make(chan bool)
 	managerInit := make(chan bool)
 
-	bridgeConfig := bridge.Config{
-		Pin:         *pin,
-		Port:        *port,
-		IP:          *addr,
-		StoragePath: *dbPath,
-	}
-	bridgeInfo := accessory.Info{
-		Name:         *name,
-		SerialNumber: "12345",
-		Manufacturer: "BEDS Inc.",
-		Model:        "v0.1",
-	}
-
 	log.Print("Attempting to connect to MQTT broker")
 	handler := &messaging.Handler{
 		Ann:           announce,
@@ -82,37 +113,87 @@ func main() {
 	}
 	cID := flagmqtt.NewUniqueIdentifier()
 	conf := flagmqtt.ClientConfig{
-		ClientID:                fmt.Sprintf("hemtjanst-%s", cID),
-		OnConnectHandler:        handler.OnConnect,
-		OnConnectionLostHandler: handler.OnConnectionLost,
-		WillTopic:               "leave",
-		WillPayload:             fmt.Sprintf("hemtjanst-%s", cID),
-		WillRetain:              false,
-		WillQoS:                 0,
+		ClientID:    fmt.Sprintf("hemtjanst-%s", cID),
+		WillTopic:   "leave",
+		WillPayload: fmt.Sprintf("hemtjanst-%s", cID),
+		WillRetain:  false,
+		WillQoS:     0,
 	}
 
-	c, err := flagmqtt.NewPersistentMqtt(conf)
+	var recording *os.File
+	if *recordPath != "" {
+		var err error
+		recording, err = os.Create(*recordPath)
+		if err != nil {
+			log.Fatal("Could not create recording: ", err)
+		}
+		handler.Recorder = messaging.NewRecorder(recording)
+		log.Print("Recording MQTT messages to ", *recordPath)
+	}
+
+	messenger, disconnect, err := connectMQTT(handler, conf)
 	if err != nil {
 		log.Fatal("Could not configure the MQTT client: ", err)
 	}
+	if handler.Recorder != nil {
+		messenger = handler.Recorder.PublishSubscriber(messenger)
+	}
 
-	go func() {
-		if token := c.Connect(); token.Wait() && token.Error() != nil {
-			log.Fatal("Failed to establish connection with broker: ", token.Error())
-		}
-	}()
-
-	hkBridge, err := bridge.NewBridge(bridgeConfig, bridgeInfo)
+	hkBridges, err := newBridges(*nBridges)
 	if err != nil {
 		log.Fatal("Could not start HomeKit bridge: ", err)
 	}
 
-	manager := device.NewManager(messaging.NewMQTTMessenger(c), managerInit)
+	manager := device.NewManager(messenger, managerInit)
+	restored := 0
+	if replayDB == "" {
+		restored, err = manager.UseStore(device.NewFileStore(filepath.Join(*dbPath, "devices.json")))
+		if err != nil {
+			log.Print("Could not restore devices, starting without them: ", err)
+		}
+	}
 	log.Print("Started device manager")
 
-	hk := homekit.NewHomekit(hkBridge, manager)
+	hk := homekit.NewShardedHomekit(hkBridges, manager)
+	if replayDB == "" {
+		if err := hk.UseAssignments(filepath.Join(*dbPath, "bridges.json")); err != nil {
+			log.Print("Could not restore bridge assignments: ", err)
+		}
+	}
 	manager.AddHandler(hk)
 
+	if *httpAddr != "" {
+		api := admin.NewServer(manager, func() {
+			messenger.Publish(discoverTopic, []byte("1"), 1, true)
+		}, func(topic string) {
+			messenger.Publish(announceTopicPrefix+topic, nil, 1, true)
+		})
+		api.SetBridges(hkBridges...)
+		token := *httpTok
+		if token == "" {
+			path := filepath.Join(*dbPath, adminTokenFile)
+			if token, err = adminToken(path); err != nil {
+				log.Fatal("Could not create a token for the admin API: ", err)
+			}
+			log.Print("Admin API token is stored in ", path)
+		}
+		api.RequireToken(token)
+		address := adminAddress(*httpAddr)
+		go func() {
+			log.Print("Starting admin API on ", address)
+			if err := http.ListenAndServe(address, api); err != nil {
+				log.Print("Admin API stopped: ", err)
+			}
+		}()
+	}
+
+	if restored > 0 && startHomekit {
+		// We already know about the devices so there's no need to wait
+		// for their announcements before starting the bridge
+		log.Printf("Restored %d devices, starting HomeKit bridge", restored)
+		startBridges(hkBridges)
+	}
+
 	go func() {
 		// Wait for handler to have sent its discover
 		<-handlerInit
@@ -120,10 +201,22 @@ func main() {
 		// Tell manager that we're initialised
 		managerInit <- true
 
-		// Wait a few more seconds before starting bridge
+		// Wait a few more seconds for devices to answer the discover
 		<-time.After(5 * time.Second)
+		if restored > 0 {
+			if n := manager.ExpireRestored(); n > 0 {
+				log.Printf("Removed %d restored devices that weren't announced again", n)
+			}
+		}
+		if n := hk.ExpireAssignments(); n > 0 {
+			log.Printf("Freed the bridges of %d devices that weren't announced again", n)
+		}
+		if restored > 0 || !startHomekit {
+			return
+		}
+
 		log.Print("Starting HomeKit bridge")
-		hkBridge.Start()
+		startBridges(hkBridges)
 	}()
 
 loop:
@@ -170,8 +263,17 @@ loop:
 		recover()
 	}()
 
-	c.Disconnect(250)
-	hkBridge.Stop()
+	manager.Flush()
+	disconnect()
+	if recording != nil {
+		recording.Close()
+	}
+	for _, b := range hkBridges {
+		b.Stop()
+	}
+	if replayDB != "" {
+		os.RemoveAll(replayDB)
+	}
 	log.Print("Disconnected from broker. Bye!")
 	os.Exit(0)
 }
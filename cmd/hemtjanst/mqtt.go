@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+	"github.com/hemtjanst/hemtjanst/messaging/broker"
+	"github.com/hemtjanst/hemtjanst/messaging/flagmqtt"
+	"github.com/hemtjanst/hemtjanst/messaging/mqtt5"
+)
+
+// connectMQTT starts connecting to the broker with the protocol version set
+// by -mqtt.protocol, or starts the embedded broker when -broker.listen is
+// set or replays the recording given by -replay, with handler taking care
+// of the connection. It returns
+// the messenger to use and a function that disconnects.
+func connectMQTT(handler *messaging.Handler, conf flagmqtt.ClientConfig) (messaging.PublishSubscriber, func(), error) {
+	if *replayPath != "" {
+		return startReplay(handler)
+	}
+	if *brokerAddr != "" {
+		return startBroker(handler, conf)
+	}
+	if flagmqtt.ProtocolVersion() == 5 {
+		conf.OnConnect5Handler = func(c *mqtt5.Client) {
+			handler.Connected(c)
+		}
+		conf.OnConnectionLost5Handler = func(c *mqtt5.Client, err error) {
+			log.Print("Unexpectedly lost connection to MQTT broker, attempting to reconnect: ", err)
+		}
+		c, err := flagmqtt.NewMqtt5(conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		go func() {
+			if err := c.Connect(); err != nil {
+				log.Fatal("Failed to establish connection with broker: ", err)
+			}
+		}()
+		return mqtt5.NewMessenger(c), c.Disconnect, nil
+	}
+
+	conf.OnConnectHandler = handler.OnConnect
+	conf.OnConnectionLostHandler = handler.OnConnectionLost
+	c, err := flagmqtt.NewPersistentMqtt(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		if token := c.Connect(); token.Wait() && token.Error() != nil {
+			log.Fatal("Failed to establish connection with broker: ", token.Error())
+		}
+	}()
+	return messaging.NewMQTTMessenger(c), func() { c.Disconnect(250) }, nil
+}
+
+// startBroker starts the embedded broker and connects to it in-process.
+// Unless it only listens on localhost it requires clients to log in, or
+// -broker.anonymous to be set.
+func startBroker(handler *messaging.Handler, conf flagmqtt.ClientConfig) (messaging.PublishSubscriber, func(), error) {
+	if (*brokerCert == "") != (*brokerKey == "") {
+		return nil, nil, errors.New("the embedded broker needs both -broker.tls.cert and -broker.tls.key for TLS")
+	}
+	auth := *brokerUser != "" || *brokerPass != ""
+	if !loopback(*brokerAddr) {
+		if !auth && !*brokerAnon {
+			return nil, nil, fmt.Errorf("the embedded broker would let anyone connect on %s, set -broker.username and -broker.password or -broker.anonymous", *brokerAddr)
+		}
+		if auth && *brokerCert == "" {
+			log.Print("The embedded MQTT broker receives passwords unencrypted, set -broker.tls.cert and -broker.tls.key to use TLS")
+		}
+	}
+
+	b := broker.New()
+	b.MaxPacketSize = *brokerMax
+	if auth {
+		b.Authenticate = func(username, password string) bool {
+			return username == *brokerUser && password == *brokerPass
+		}
+	}
+	c, err := b.NewClient(conf.ClientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		var err error
+		if *brokerCert != "" {
+			log.Print("Starting embedded MQTT broker with TLS on ", *brokerAddr)
+			err = b.ListenAndServeTLS(*brokerAddr, *brokerCert, *brokerKey)
+		} else {
+			log.Print("Starting embedded MQTT broker on ", *brokerAddr)
+			err = b.ListenAndServe(*brokerAddr)
+		}
+		if err != broker.ErrClosed {
+			log.Fatal("Embedded MQTT broker stopped: ", err)
+		}
+	}()
+	go handler.Connected(messaging.AsConnection(c))
+	return c, func() { b.Close() }, nil
+}
+
+// loopback returns whether addr only listens on localhost.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// startReplay replays the recording at -replay through an in-memory broker.
+func startReplay(handler *messaging.Handler) (messaging.PublishSubscriber, func(), error) {
+	if *replaySpeed <= 0 {
+		return nil, nil, fmt.Errorf("replay speed must be above 0, got %g", *replaySpeed)
+	}
+	f, err := os.Open(*replayPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, err := messaging.ReadRecords(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read recording: %s", err)
+	}
+
+	// Keep the discover at the same point of the recording
+	handler.DiscoverDelay = time.Duration(float64(handler.DiscoverDelay) / *replaySpeed)
+
+	b := messaging.NewMemoryBroker()
+	c := b.NewClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	go handler.Connected(messaging.AsConnection(c))
+	go func() {
+		log.Printf("Replaying %d messages from %s at %gx speed", len(records), *replayPath, *replaySpeed)
+		err := messaging.Replay(ctx, records, b.NewClient(), *replaySpeed)
+		if err != nil {
+			if err != context.Canceled {
+				log.Print("Replay stopped: ", err)
+			}
+			return
+		}
+		log.Print("Replay finished")
+	}()
+	return c, func() {
+		cancel()
+		c.Disconnect()
+	}, nil
+}
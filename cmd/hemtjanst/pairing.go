@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+)
+
+// pairingCommand manages the HomeKit pairings of a running hemtjanst
+// through its admin API. It returns the exit code.
+func pairingCommand(args []string) int {
+	fs := flag.NewFlagSet("pairing", flag.ExitOnError)
+	address := fs.String("http.address", "localhost:8080", "Address of the admin HTTP API of the running hemtjanst")
+	token := fs.String("http.token", "", "Token of the admin HTTP API. Read from "+adminTokenFile+" in the db.path when empty")
+	dbPath := fs.String("db.path", "./db", "Path of the database of the running hemtjanst")
+	bridgeN := fs.Int("bridge", 1, "Number of the bridge to manage when running several")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s pairing:\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  pairing [parameters] list          list paired controllers\n")
+		fmt.Fprintf(os.Stderr, "  pairing [parameters] remove <id>   remove the pairing with a controller\n")
+		fmt.Fprintf(os.Stderr, "  pairing [parameters] reset         remove all pairings\n\n")
+		fmt.Fprintf(os.Stderr, "Parameters:\n\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	fs.Parse(args)
+
+	if *token == "" {
+		if t, err := readAdminToken(filepath.Join(*dbPath, adminTokenFile)); err == nil {
+			*token = t
+		}
+	}
+	base := "http://" + *address + "/api/homekit/pairings"
+	query := fmt.Sprintf("?bridge=%d", *bridgeN)
+	client := &apiClient{client: &http.Client{Timeout: 10 * time.Second}, token: *token}
+	var err error
+	switch {
+	case fs.NArg() == 1 && fs.Arg(0) == "list":
+		err = listPairings(client, base+query)
+	case fs.NArg() == 2 && fs.Arg(0) == "remove":
+		err = deletePairings(client, base+"/"+url.PathEscape(fs.Arg(1))+query)
+	case fs.NArg() == 1 && fs.Arg(0) == "reset":
+		err = deletePairings(client, base+query)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// apiClient sends requests to the admin API with its token.
+type apiClient struct {
+	client *http.Client
+	token  string
+}
+
+func (c *apiClient) do(method, u string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.client.Do(req)
+}
+
+func listPairings(client *apiClient, u string) error {
+	res, err := client.do(http.MethodGet, u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return apiError(res)
+	}
+	var pairings []bridge.Pairing
+	if err := json.NewDecoder(res.Body).Decode(&pairings); err != nil {
+		return err
+	}
+	if len(pairings) == 0 {
+		fmt.Println("Not paired")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADMIN\tPAIRED")
+	for _, p := range pairings {
+		admin := "unknown"
+		if p.Admin != nil {
+			admin = fmt.Sprint(*p.Admin)
+		}
+		paired := "unknown"
+		if !p.Paired.IsZero() {
+			paired = p.Paired.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", p.ID, admin, paired)
+	}
+	return w.Flush()
+}
+
+func deletePairings(client *apiClient, u string) error {
+	res, err := client.do(http.MethodDelete, u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return apiError(res)
+	}
+	return nil
+}
+
+func apiError(res *http.Response) error {
+	var e struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error == "" {
+		return fmt.Errorf("admin API responded with %s", res.Status)
+	}
+	return fmt.Errorf("admin API responded with %s: %s", res.Status, e.Error)
+}
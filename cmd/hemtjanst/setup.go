@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+	"github.com/hemtjanst/hemtjanst/homekit/qrcode"
+)
+
+// showSetupCode prints the setup code and QR code to pair the bridge with,
+// unless it's paired already. When write is set the QR code is also saved
+// as setup.png and setup.svg in dir.
+func showSetupCode(b bridge.Bridge, pin string, dir string, write bool) {
+	pairings, err := b.Pairings()
+	if err != nil {
+		log.Print("Could not read HomeKit pairings: ", err)
+		return
+	}
+	if len(pairings) > 0 {
+		log.Printf("HomeKit bridge is paired with %d controllers", len(pairings))
+		return
+	}
+
+	uri, err := b.SetupURI()
+	if err != nil {
+		log.Print("Could not create HomeKit setup URI: ", err)
+		return
+	}
+	code, err := qrcode.Encode([]byte(uri))
+	if err != nil {
+		log.Print("Could not create HomeKit setup QR code: ", err)
+		return
+	}
+	if len(pin) == 8 {
+		pin = pin[0:3] + "-" + pin[3:5] + "-" + pin[5:]
+	}
+	log.Printf("HomeKit bridge isn't paired, scan the code below or enter %s in the Home app (%s)", pin, uri)
+	fmt.Fprint(os.Stderr, code.Terminal())
+
+	if !write {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "setup.svg"), code.SVG(8), 0644); err != nil {
+		log.Print("Could not write setup QR code: ", err)
+	}
+	png, err := code.PNG(8)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "setup.png"), png, 0644)
+	}
+	if err != nil {
+		log.Print("Could not write setup QR code: ", err)
+	}
+}
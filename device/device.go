@@ -1,39 +1,169 @@
 package device
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/hemtjanst/hemtjanst/messaging"
+	"log"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	devRefError = errors.New(`Feature is missing reference to device. Use .AddFeature()
 to add a feature to a device`)
+	detachedError = errors.New("Feature belongs to a copy of a device that has no transport")
+	// ErrReadOnly is returned when setting a feature that's read-only
+	ErrReadOnly = errors.New("Feature is read-only")
 )
 
+// SetExpiry is how long a broker that supports message expiry keeps a set
+// command for a device that isn't connected. Acting on it any later would
+// be more surprising than dropping it.
+var SetExpiry = 30 * time.Second
+
+// Timeout bounds how long the methods that don't take a context wait for
+// the transport.
+var Timeout = 10 * time.Second
+
+// timeout returns a context that's done after Timeout.
+func timeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), Timeout)
+}
+
 type Device struct {
-	Topic        string              `json:"topic"`
-	Name         string              `json:"name"`
-	Manufacturer string              `json:"manufacturer"`
-	Model        string              `json:"model"`
-	SerialNumber string              `json:"serialNumber"`
-	Type         string              `json:"type"`
-	LastWillID   string              `json:"lastWillID,omitempty"`
-	Features     map[string]*Feature `json:"feature"`
-	Reachable    bool                `json:"-"`
-	transport    messaging.PublishSubscriber
+	Topic         string              `json:"topic"`
+	ID            string              `json:"id,omitempty"`
+	PreviousTopic string              `json:"previousTopic,omitempty"`
+	Name          string              `json:"name"`
+	Manufacturer  string              `json:"manufacturer"`
+	Model         string              `json:"model"`
+	SerialNumber  string              `json:"serialNumber"`
+	Type          string              `json:"type"`
+	LastWillID    string              `json:"lastWillID,omitempty"`
+	StaleAfter    int                 `json:"staleAfter,omitempty"`
+	Bridge        int                 `json:"bridge,omitempty"`
+	Features      map[string]*Feature `json:"feature"`
+	Services      []*Service          `json:"services,omitempty"`
+	Snapshot      *Snapshot           `json:"snapshot,omitempty"`
+	Reachable     bool                `json:"-"`
+	LastSeen      time.Time           `json:"-"`
+	transport     messaging.PublishSubscriber
+	payloads      map[string]*Payload
+	onReceived    func()
+	staleTimer    *time.Timer
+	valueChanged  func(key string, old, new []byte)
+	valueSet      func(key, value, origin string)
+	// Devices of a Manager get the messages on their GetTopics from it,
+	// which is subscribed to the topics in subscribed. OnUpdate then
+	// registers a callback in listeners instead of subscribing itself.
+	managed    bool
+	subscribed map[string]bool
+	listeners  map[string]func(messaging.Message)
+	// dispatch keeps the callbacks of listeners from being called with a
+	// replayed payload and a new one at the same time
+	dispatch sync.Mutex
 	sync.RWMutex
 }
 
+// Service is an additional HomeKit service exposed on the same accessory
+// as the device. The device's own type and features make up the first
+// service, every entry in Services is added next to it.
+type Service struct {
+	ID      string   `json:"id"`
+	Type    string   `json:"type"`
+	Primary bool     `json:"primary,omitempty"`
+	Hidden  bool     `json:"hidden,omitempty"`
+	Linked  []string `json:"linked,omitempty"`
+	// LabelIndex numbers the service among others of the same type, like
+	// the buttons of a remote. It defaults to the order of the services.
+	LabelIndex int                 `json:"labelIndex,omitempty"`
+	Features   map[string]*Feature `json:"feature"`
+}
+
+// Feature is a single value of a device, read from the GetTopic and changed
+// by publishing to the SetTopic.
+//
+// When several values are published as one JSON object, GetPath is a JSON
+// path like $.state.brightness to the feature's value and SetTemplate the
+// payload to publish with every {{value}} replaced by the new value.
 type Feature struct {
-	Min      int    `json:"min,omitempty"`
-	Max      int    `json:"max,omitempty"`
-	Step     int    `json:"step,omitempty"`
-	GetTopic string `json:"getTopic,omitempty"`
-	SetTopic string `json:"setTopic,omitempty"`
-	devRef   *Device
+	Min         int        `json:"min,omitempty"`
+	Max         int        `json:"max,omitempty"`
+	Step        int        `json:"step,omitempty"`
+	GetTopic    string     `json:"getTopic,omitempty"`
+	SetTopic    string     `json:"setTopic,omitempty"`
+	GetPath     string     `json:"getPath,omitempty"`
+	SetTemplate string     `json:"setTemplate,omitempty"`
+	BoolStyle   string     `json:"boolStyle,omitempty"`
+	Transform   *Transform `json:"transform,omitempty"`
+	// Encoding of the payloads of data and TLV8 features, either raw (the
+	// default) or base64
+	Encoding string `json:"encoding,omitempty"`
+	// ReadOnly features are never set, WriteOnly features are never read.
+	// Hidden features are hidden from the user, and features with Notify
+	// set to false don't send events to HomeKit when their value changes.
+	ReadOnly  bool  `json:"readOnly,omitempty"`
+	WriteOnly bool  `json:"writeOnly,omitempty"`
+	Hidden    bool  `json:"hidden,omitempty"`
+	Notify    *bool `json:"notify,omitempty"`
+	// Characteristic declares a custom characteristic for the feature, in
+	// which case the feature's name doesn't have to be a known one
+	Characteristic *Characteristic `json:"characteristic,omitempty"`
+	devRef         *Device
+	value          []byte
+	updated        time.Time
+}
+
+// Transform describes how the payloads of a feature relate to the values
+// HomeKit expects. Incoming payloads are first looked up in Map, otherwise
+// converted from Unit and then multiplied by Scale before adding Offset.
+// Values set from HomeKit go through the same steps in reverse.
+type Transform struct {
+	// Scale multiplies the payload, 0 means no scaling
+	Scale float64 `json:"scale,omitempty"`
+	// Offset is added to the payload after scaling
+	Offset float64 `json:"offset,omitempty"`
+	// Map translates payloads to characteristic values, for example
+	// {"open": 0, "closed": 1}
+	Map map[string]interface{} `json:"map,omitempty"`
+	// Unit the payload is in, either kelvin (for mireds) or fahrenheit
+	// (for degrees Celsius)
+	Unit string `json:"unit,omitempty"`
+}
+
+// Characteristic describes a HomeKit characteristic that isn't built in,
+// like the power consumption characteristics of Eve. Type is its UUID and
+// Format, Unit and Perms are as in the HomeKit Accessory Protocol. Without
+// Perms the characteristic can be read and sends events.
+type Characteristic struct {
+	Type        string   `json:"type"`
+	Format      string   `json:"format"`
+	Unit        string   `json:"unit,omitempty"`
+	Perms       []string `json:"perms,omitempty"`
+	Description string   `json:"description,omitempty"`
+	MinValue    *float64 `json:"minValue,omitempty"`
+	MaxValue    *float64 `json:"maxValue,omitempty"`
+	MinStep     *float64 `json:"minStep,omitempty"`
+	// ValidValues restricts an integer characteristic to the listed values
+	ValidValues []int `json:"validValues,omitempty"`
+}
+
+// Snapshot describes where the still images of a camera come from.
+type Snapshot struct {
+	// Topic the camera publishes JPEG images on
+	Topic string `json:"topic"`
+	// RequestTopic, if set, is published to when a new image is wanted,
+	// which the camera then publishes on Topic. Without it the latest
+	// image published on Topic is used.
+	RequestTopic string `json:"requestTopic,omitempty"`
+	// Timeout is the number of seconds to wait for a requested image before
+	// falling back to the latest one. Defaults to 5.
+	Timeout int `json:"timeout,omitempty"`
 }
 
 func NewDevice(topic string, client messaging.PublishSubscriber) *Device {
@@ -71,7 +201,29 @@ func (d *Device) UnmarshalJSON(b []byte) error {
 	if val, ok := objmap["lastWillID"]; ok {
 		json.Unmarshal(*val, &d.LastWillID)
 	}
-	if val, ok := objmap["feature"]; ok {
+	if val, ok := objmap["staleAfter"]; ok {
+		json.Unmarshal(*val, &d.StaleAfter)
+	}
+	if val, ok := objmap["bridge"]; ok {
+		json.Unmarshal(*val, &d.Bridge)
+	}
+	if val, ok := objmap["snapshot"]; ok && val != nil {
+		snapshot := &Snapshot{}
+		if err = json.Unmarshal(*val, snapshot); err != nil {
+			return errors.New("Failed to decode snapshot")
+		}
+		if snapshot.Topic == "" {
+			snapshot.Topic = d.Topic + "/snapshot"
+		}
+		d.Snapshot = snapshot
+	}
+	if val, ok := objmap["id"]; ok {
+		json.Unmarshal(*val, &d.ID)
+	}
+	if val, ok := objmap["previousTopic"]; ok {
+		json.Unmarshal(*val, &d.PreviousTopic)
+	}
+	if val, ok := objmap["feature"]; ok && val != nil {
 		// We have features, lets add them
 		var ftmap map[string]*json.RawMessage
 		err = json.Unmarshal(*val, &ftmap)
@@ -87,9 +239,46 @@ func (d *Device) UnmarshalJSON(b []byte) error {
 			d.AddFeature(name, ftr)
 		}
 	}
+	if val, ok := objmap["services"]; ok && val != nil {
+		var svcs []*Service
+		err = json.Unmarshal(*val, &svcs)
+		if err != nil {
+			return errors.New("Failed to decode services list")
+		}
+		for _, svc := range svcs {
+			if err = d.AddService(svc); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// update replaces the metadata of d with that of from, a device decoded
+// from a new announcement, which describes the whole device. Anything left
+// out of it is removed. The values received for d are kept.
+func (d *Device) update(from *Device) {
+	d.Lock()
+	defer d.Unlock()
+	d.Topic = from.Topic
+	d.ID = from.ID
+	d.PreviousTopic = from.PreviousTopic
+	d.Name = from.Name
+	d.Manufacturer = from.Manufacturer
+	d.Model = from.Model
+	d.SerialNumber = from.SerialNumber
+	d.Type = from.Type
+	d.LastWillID = from.LastWillID
+	d.StaleAfter = from.StaleAfter
+	d.Bridge = from.Bridge
+	d.Features = from.Features
+	d.Services = from.Services
+	d.Snapshot = from.Snapshot
+	d.forEachFeature(func(_ *Service, _ string, ft *Feature) {
+		ft.devRef = d
+	})
+}
+
 func (d *Device) HasFeature(feature string) bool {
 	d.RLock()
 	defer d.RUnlock()
@@ -117,6 +306,77 @@ func (d *Device) AddFeature(name string, ft *Feature) {
 	}
 }
 
+// AddService adds an additional service to the device. If the service has
+// no ID its type is used instead. Features of the service get their devRef
+// populated and default to a GetTopic and SetTopic nested under the
+// service ID, e.g. <topic>/<service>/<feature>/get.
+func (d *Device) AddService(svc *Service) error {
+	d.Lock()
+	defer d.Unlock()
+	if svc.ID == "" {
+		svc.ID = svc.Type
+	}
+	for _, s := range d.Services {
+		if s.ID == svc.ID {
+			return fmt.Errorf("Device already has a service with ID %s", svc.ID)
+		}
+	}
+	for name, ft := range svc.Features {
+		ft.devRef = d
+		if ft.GetTopic == "" {
+			ft.GetTopic = fmt.Sprintf("%s/%s/%s/%s", d.Topic, svc.ID, name, "get")
+		}
+		if ft.SetTopic == "" {
+			ft.SetTopic = fmt.Sprintf("%s/%s/%s/%s", d.Topic, svc.ID, name, "set")
+		}
+	}
+	d.Services = append(d.Services, svc)
+	return nil
+}
+
+// GetService returns a *Service if a service with that ID is found
+// on the device.
+func (d *Device) GetService(id string) (*Service, error) {
+	d.RLock()
+	defer d.RUnlock()
+	for _, s := range d.Services {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("Device has no service: %s", id)
+}
+
+// ForEachFeature calls f for every feature of the device, including the
+// features of any additional services. svc is nil for the device's own
+// features.
+func (d *Device) ForEachFeature(f func(svc *Service, name string, ft *Feature)) {
+	d.RLock()
+	defer d.RUnlock()
+	d.forEachFeature(f)
+}
+
+func (d *Device) forEachFeature(f func(svc *Service, name string, ft *Feature)) {
+	for name, ft := range d.Features {
+		f(nil, name, ft)
+	}
+	for _, svc := range d.Services {
+		for name, ft := range svc.Features {
+			f(svc, name, ft)
+		}
+	}
+}
+
+// FeatureKey returns the key identifying a feature on a device. Features of
+// additional services are prefixed with the service ID, since the same
+// feature name can occur on more than one service.
+func FeatureKey(svc *Service, name string) string {
+	if svc == nil {
+		return name
+	}
+	return svc.ID + "/" + name
+}
+
 // GetFeature returns a *Feature if a feature by that name is found
 // on the device.
 func (d *Device) GetFeature(feature string) (*Feature, error) {
@@ -128,6 +388,33 @@ func (d *Device) GetFeature(feature string) (*Feature, error) {
 	return d.Features[feature], nil
 }
 
+// LookupFeature returns the feature identified by key, as returned by
+// FeatureKey, including features of additional services.
+func (d *Device) LookupFeature(key string) (*Feature, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if ft, ok := d.Features[key]; ok {
+		return ft, nil
+	}
+	for _, svc := range d.Services {
+		if !strings.HasPrefix(key, svc.ID+"/") {
+			continue
+		}
+		if ft, ok := svc.Features[strings.TrimPrefix(key, svc.ID+"/")]; ok {
+			return ft, nil
+		}
+	}
+	return nil, fmt.Errorf("Device has no feature: %s", key)
+}
+
+// Metadata returns the JSON representation of the device, as it would be
+// announced.
+func (d *Device) Metadata() (json.RawMessage, error) {
+	d.RLock()
+	defer d.RUnlock()
+	return json.Marshal(d)
+}
+
 // RemoveFeature removes a feature by that name from the device.
 // It returns an error if you try to remove a feature that does
 // not exist.
@@ -142,44 +429,421 @@ func (d *Device) RemoveFeature(name string) error {
 }
 
 func (d *Device) PublishMeta() error {
+	ctx, cancel := timeout()
+	defer cancel()
+	return d.PublishMetaContext(ctx)
+}
+
+// PublishMetaContext publishes the metadata of the device on its announce
+// topic, returning an error if that fails or ctx is done first.
+func (d *Device) PublishMetaContext(ctx context.Context) error {
+	if d.transport == nil {
+		return detachedError
+	}
 	d.RLock()
-	defer d.RUnlock()
 	js, err := json.Marshal(d)
+	d.RUnlock()
 	if err != nil {
 		return err
 	}
-	d.transport.Publish("announce/"+d.Topic, js, 1, true)
-	return nil
+	if pp, ok := d.transport.(messaging.PropertiesPublisher); ok {
+		return pp.PublishProperties(ctx, "announce/"+d.Topic, js, 1, true, &messaging.Properties{ContentType: "application/json"})
+	}
+	return messaging.WithContext(d.transport).PublishContext(ctx, "announce/"+d.Topic, js, 1, true)
 }
 
 func (f *Feature) Set(value string) error {
+	return f.SetFrom("", value)
+}
+
+// SetFrom sets the feature like Set. origin describes where the change came
+// from, like homekit, and is passed on to the FeatureSet event.
+func (f *Feature) SetFrom(origin, value string) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	return f.SetFromContext(ctx, origin, value)
+}
+
+// SetFromContext sets the feature like SetFrom. It returns an error when
+// the command can't be published, or when ctx is done before the transport
+// has taken it, in which case no FeatureSet event is sent.
+func (f *Feature) SetFromContext(ctx context.Context, origin, value string) error {
 	if f.devRef == nil {
 		return devRefError
 	}
-	f.devRef.transport.Publish(f.SetTopic, []byte(value), 1, false)
+	if f.devRef.transport == nil {
+		return detachedError
+	}
+	if f.ReadOnly {
+		return ErrReadOnly
+	}
+	d := f.devRef
+	var err error
+	if r, ok := d.transport.(messaging.Requester); ok {
+		topic := f.SetTopic
+		props := &messaging.Properties{MessageExpiry: SetExpiry}
+		err = r.Request(ctx, topic, f.render(value), 1, props, func(msg messaging.Message) {
+			if p := messaging.MessageProperties(msg); p != nil && p.UserProperties["error"] != "" {
+				log.Printf("Setting %s to %s was rejected: %s", topic, value, p.UserProperties["error"])
+			}
+		})
+	} else {
+		err = messaging.WithContext(d.transport).PublishContext(ctx, f.SetTopic, f.render(value), 1, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.RLock()
+	valueSet := d.valueSet
+	key := d.keyOf(f)
+	d.RUnlock()
+	if valueSet != nil && key != "" {
+		valueSet(key, value, origin)
+	}
 	return nil
 }
 
+// OnSnapshot subscribes to the topic the device publishes camera images on.
+// The images aren't kept, so callback is only called for new ones and the
+// one retained by the broker.
+func (d *Device) OnSnapshot(callback func(image []byte)) error {
+	if d.Snapshot == nil {
+		return errors.New("Device has no snapshot topic")
+	}
+	if d.transport == nil {
+		return detachedError
+	}
+	ctx, cancel := timeout()
+	defer cancel()
+	return messaging.WithContext(d.transport).SubscribeContext(ctx, d.Snapshot.Topic, 0, func(msg messaging.Message) {
+		callback(msg.Payload())
+	})
+}
+
+// RequestSnapshot asks the device to publish a new camera image of about
+// the given size. It does nothing if the device has no RequestTopic.
+func (d *Device) RequestSnapshot(width, height uint) error {
+	if d.Snapshot == nil {
+		return errors.New("Device has no snapshot topic")
+	}
+	if d.transport == nil {
+		return detachedError
+	}
+	if d.Snapshot.RequestTopic == "" {
+		return nil
+	}
+	payload, err := json.Marshal(map[string]uint{"width": width, "height": height})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := timeout()
+	defer cancel()
+	return messaging.WithContext(d.transport).PublishContext(ctx, d.Snapshot.RequestTopic, payload, 0, false)
+}
+
+// keyOf returns the FeatureKey of f. The device must be locked.
+func (d *Device) keyOf(f *Feature) string {
+	key := ""
+	d.forEachFeature(func(svc *Service, name string, ft *Feature) {
+		if ft == f {
+			key = FeatureKey(svc, name)
+		}
+	})
+	return key
+}
+
+// Notifies returns whether changes of the feature's value are sent as
+// events, which is the case unless Notify is false.
+func (f *Feature) Notifies() bool {
+	return f.Notify == nil || *f.Notify
+}
+
+// render returns the payload to publish on the SetTopic for value.
+func (f *Feature) render(value string) []byte {
+	if f.SetTemplate == "" {
+		return []byte(value)
+	}
+	return []byte(strings.Replace(f.SetTemplate, "{{value}}", value, -1))
+}
+
+// Extract returns the value of the feature from a payload received on the
+// GetTopic. If the feature has a GetPath the value is taken from the JSON
+// payload, ok is false if the payload doesn't contain it. Without a GetPath
+// the payload is returned as is.
+func (f *Feature) Extract(payload []byte) (value []byte, ok bool, err error) {
+	if f.GetPath == "" {
+		return payload, true, nil
+	}
+	return extractPath(payload, f.GetPath)
+}
+
 func (f *Feature) OnSet(callback func(msg messaging.Message)) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	return f.OnSetContext(ctx, callback)
+}
+
+// OnSetContext subscribes to the SetTopic of the feature, returning an
+// error if the subscription fails or ctx is done first.
+func (f *Feature) OnSetContext(ctx context.Context, callback func(msg messaging.Message)) error {
 	if f.devRef == nil {
 		return devRefError
 	}
-	f.devRef.transport.Subscribe(f.SetTopic, 1, callback)
-	return nil
+	if f.devRef.transport == nil {
+		return detachedError
+	}
+	return messaging.WithContext(f.devRef.transport).SubscribeContext(ctx, f.SetTopic, 1, callback)
 }
 
 func (f *Feature) Update(value string) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	return f.UpdateContext(ctx, value)
+}
+
+// UpdateContext publishes value on the GetTopic of the feature, returning
+// an error if that fails or ctx is done first.
+func (f *Feature) UpdateContext(ctx context.Context, value string) error {
 	if f.devRef == nil {
 		return devRefError
 	}
-	f.devRef.transport.Publish(f.GetTopic, []byte(value), 1, true)
-	return nil
+	if f.devRef.transport == nil {
+		return detachedError
+	}
+	return messaging.WithContext(f.devRef.transport).PublishContext(ctx, f.GetTopic, []byte(value), 1, true)
 }
 
+// OnUpdate subscribes to the GetTopic of the feature. If a payload has
+// been received on the topic before, callback is called with it right away
+// as a retained message, and not again when the broker has it retained.
+//
+// For devices of a Manager, which is already subscribed to the topic, the
+// callback gets the messages the manager receives on it. Like subscribing
+// to a topic again, calling OnUpdate again for a feature with the same
+// GetTopic replaces the callback.
 func (f *Feature) OnUpdate(callback func(msg messaging.Message)) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	return f.OnUpdateContext(ctx, callback)
+}
+
+// OnUpdateContext subscribes like OnUpdate. It returns an error if the
+// subscription fails or ctx is done first, callback is still called with
+// the payload received before.
+func (f *Feature) OnUpdateContext(ctx context.Context, callback func(msg messaging.Message)) error {
 	if f.devRef == nil {
 		return devRefError
 	}
-	f.devRef.transport.Subscribe(f.GetTopic, 1, callback)
-	return nil
+	if f.devRef.transport == nil {
+		return detachedError
+	}
+	d := f.devRef
+	topic := f.GetTopic
+	if d.managed {
+		d.listen(topic, callback)
+		return nil
+	}
+	last := d.lastPayload(topic)
+	if last != nil {
+		callback(&message{topic: topic, payload: last.Data})
+	}
+	// The broker sends the payload that was just replayed again when it's
+	// retained, which is skipped
+	var mutex sync.Mutex
+	replayed := last != nil
+	return messaging.WithContext(d.transport).SubscribeContext(ctx, topic, 1, func(msg messaging.Message) {
+		d.received(topic, msg.Payload())
+		mutex.Lock()
+		skip := replayed && messaging.Retained(msg) && bytes.Equal(msg.Payload(), last.Data)
+		replayed = false
+		mutex.Unlock()
+		if !skip {
+			callback(msg)
+		}
+	})
 }
+
+// StopUpdates undoes OnUpdate, so the callback for the GetTopic of the
+// feature isn't called anymore.
+func (f *Feature) StopUpdates() error {
+	ctx, cancel := timeout()
+	defer cancel()
+	return f.StopUpdatesContext(ctx)
+}
+
+// StopUpdatesContext stops the updates like StopUpdates. It returns an error
+// if unsubscribing fails or ctx is done first.
+func (f *Feature) StopUpdatesContext(ctx context.Context) error {
+	if f.devRef == nil {
+		return devRefError
+	}
+	if f.devRef.transport == nil {
+		return detachedError
+	}
+	d := f.devRef
+	if d.managed {
+		// The manager stays subscribed as long as the topic is one of the
+		// GetTopics of the device
+		d.Lock()
+		delete(d.listeners, f.GetTopic)
+		d.Unlock()
+		return nil
+	}
+	return messaging.WithContext(d.transport).UnsubscribeContext(ctx, f.GetTopic)
+}
+
+// listen makes callback get the messages on topic, starting with the last
+// payload received on it.
+func (d *Device) listen(topic string, callback func(messaging.Message)) {
+	d.dispatch.Lock()
+	defer d.dispatch.Unlock()
+	d.Lock()
+	if d.listeners == nil {
+		d.listeners = map[string]func(messaging.Message){}
+	}
+	d.listeners[topic] = callback
+	last := d.payloads[topic]
+	d.Unlock()
+	if last != nil {
+		callback(&message{topic: topic, payload: last.Data})
+	}
+}
+
+// deliver handles a message the manager received on topic, one of the
+// GetTopics of the device, and passes it on to the listener of the topic.
+func (d *Device) deliver(topic string, msg messaging.Message) {
+	d.dispatch.Lock()
+	defer d.dispatch.Unlock()
+	d.received(topic, msg.Payload())
+	d.RLock()
+	callback := d.listeners[topic]
+	d.RUnlock()
+	if callback != nil {
+		callback(msg)
+	}
+}
+
+// Value returns a copy of the last value received for the feature on its
+// GetTopic, or nil if nothing has been received yet.
+func (f *Feature) Value() []byte {
+	if f.devRef != nil {
+		f.devRef.RLock()
+		defer f.devRef.RUnlock()
+	}
+	if f.value == nil {
+		return nil
+	}
+	return append([]byte{}, f.value...)
+}
+
+// Updated returns when the feature's value was last received.
+func (f *Feature) Updated() time.Time {
+	if f.devRef == nil {
+		return f.updated
+	}
+	f.devRef.RLock()
+	defer f.devRef.RUnlock()
+	return f.updated
+}
+
+// setValue updates the cached value of the feature from a payload received
+// on its GetTopic. The device must be locked.
+func (f *Feature) setValue(p *Payload) {
+	value, ok, err := f.Extract(p.Data)
+	if err != nil || !ok {
+		return
+	}
+	f.value = value
+	f.updated = p.Received
+}
+
+// received remembers the last payload on one of the device's topics and
+// updates the value of every feature using that topic.
+func (d *Device) received(topic string, payload []byte) {
+	now := time.Now()
+	d.Lock()
+	if d.payloads == nil {
+		d.payloads = map[string]*Payload{}
+	}
+	p := &Payload{Data: payload, Received: now}
+	d.payloads[topic] = p
+	d.LastSeen = now
+	type change struct {
+		key      string
+		old, new []byte
+	}
+	var changes []change
+	d.forEachFeature(func(svc *Service, name string, ft *Feature) {
+		if ft.GetTopic != topic {
+			return
+		}
+		old := ft.value
+		ft.setValue(p)
+		if !bytes.Equal(old, ft.value) {
+			changes = append(changes, change{FeatureKey(svc, name), old, ft.value})
+		}
+	})
+	onReceived := d.onReceived
+	valueChanged := d.valueChanged
+	d.Unlock()
+	if onReceived != nil {
+		onReceived()
+	}
+	if valueChanged != nil {
+		for _, c := range changes {
+			valueChanged(c.key, c.old, c.new)
+		}
+	}
+}
+
+// applyPayloads sets the value of every feature from the last payload
+// received on its GetTopic. It's used after the features have been
+// replaced by a new announcement or restored from a Store.
+func (d *Device) applyPayloads() {
+	d.Lock()
+	defer d.Unlock()
+	d.forEachFeature(func(_ *Service, _ string, ft *Feature) {
+		if p, ok := d.payloads[ft.GetTopic]; ok {
+			ft.setValue(p)
+		}
+	})
+}
+
+func (d *Device) lastPayload(topic string) *Payload {
+	d.RLock()
+	defer d.RUnlock()
+	return d.payloads[topic]
+}
+
+// record returns the state of the device to persist.
+func (d *Device) record() (*Record, error) {
+	d.RLock()
+	defer d.RUnlock()
+	meta, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	payloads := make(map[string]*Payload, len(d.payloads))
+	for topic, p := range d.payloads {
+		payloads[topic] = p
+	}
+	return &Record{
+		Topic:     d.Topic,
+		Meta:      meta,
+		Reachable: d.Reachable,
+		LastSeen:  d.LastSeen,
+		Payloads:  payloads,
+	}, nil
+}
+
+// message is a messaging.Message for payloads replayed from memory. Like
+// retained messages they weren't published just now.
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m *message) Topic() string   { return m.topic }
+func (m *message) Payload() []byte { return m.payload }
+func (m *message) Retained() bool  { return true }
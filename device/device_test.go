@@ -2,8 +2,11 @@ package device
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"github.com/hemtjanst/hemtjanst/messaging"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -158,6 +161,19 @@ func TestFeatureSet(t *testing.T) {
 	}
 }
 
+func TestFeatureSetReadOnly(t *testing.T) {
+	m := &messaging.TestingMessenger{}
+	d := NewDevice("lock", m)
+	d.AddFeature("lockTargetState", &Feature{ReadOnly: true})
+
+	if err := d.Features["lockTargetState"].Set("1"); err != ErrReadOnly {
+		t.Error("Expected ErrReadOnly, got ", err)
+	}
+	if m.Action != "" {
+		t.Error("Expected nothing to be published, but tried to ", m.Action)
+	}
+}
+
 func TestFeatureOnSet(t *testing.T) {
 	m := &messaging.TestingMessenger{}
 	d := NewDevice("lightbulb", m)
@@ -230,3 +246,238 @@ func TestFeatureOnUpdate(t *testing.T) {
 		t.Error("Expected a callback, got nil")
 	}
 }
+
+func TestFeatureOnUpdateReplay(t *testing.T) {
+	b := messaging.NewMemoryBroker()
+	c := b.NewClient()
+	c.Publish("lightbulb/on/get", []byte("1"), 1, true)
+	d := NewDevice("lightbulb", c)
+	f := &Feature{GetTopic: "lightbulb/on/get", devRef: d}
+	d.Features = map[string]*Feature{"on": f}
+	d.received("lightbulb/on/get", []byte("1"))
+
+	var got []string
+	var mutex sync.Mutex
+	if err := f.OnUpdate(func(msg messaging.Message) {
+		mutex.Lock()
+		got = append(got, string(msg.Payload()))
+		mutex.Unlock()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c.Publish("lightbulb/on/get", []byte("1"), 1, true)
+	b.Wait()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(got, []string{"1", "1"}) {
+		t.Error("Expected the replayed and the published value, not the retained one, got ", got)
+	}
+}
+
+func TestDeviceUnMarshalJSONServices(t *testing.T) {
+	j := []byte(`
+	{
+		"topic": "fan/ceiling",
+		"name": "ceiling fan",
+		"type": "fan",
+		"feature": {
+			"on": {}
+		},
+		"services": [
+			{
+				"id": "light",
+				"type": "lightbulb",
+				"linked": ["speed"],
+				"feature": {
+					"on": {},
+					"brightness": {
+						"getTopic": "fan/ceiling/dim/get"
+					}
+				}
+			},
+			{
+				"type": "switch",
+				"hidden": true,
+				"feature": {
+					"on": {}
+				}
+			}
+		]
+	}
+	`)
+	m := &messaging.TestingMessenger{}
+	d := NewDevice("fan/ceiling", m)
+	err := d.UnmarshalJSON(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Services) != 2 {
+		t.Fatal("Expected 2 services, got ", len(d.Services))
+	}
+
+	svc, err := d.GetService("light")
+	if err != nil {
+		t.Fatal("Expected device to have service light")
+	}
+	if !reflect.DeepEqual(svc.Linked, []string{"speed"}) {
+		t.Error("Expected service to be linked to speed, got ", svc.Linked)
+	}
+	var results = []struct {
+		attr string
+		exp  string
+		got  string
+	}{
+		{"on getTopic", "fan/ceiling/light/on/get", svc.Features["on"].GetTopic},
+		{"on setTopic", "fan/ceiling/light/on/set", svc.Features["on"].SetTopic},
+		{"brightness getTopic", "fan/ceiling/dim/get", svc.Features["brightness"].GetTopic},
+		{"brightness setTopic", "fan/ceiling/light/brightness/set", svc.Features["brightness"].SetTopic},
+	}
+	for _, r := range results {
+		if r.exp != r.got {
+			t.Errorf("Expected %s to be %s, got %s", r.attr, r.exp, r.got)
+		}
+	}
+	if svc.Features["on"].devRef != d {
+		t.Error("Expected feature to reference the device")
+	}
+
+	svc, err = d.GetService("switch")
+	if err != nil {
+		t.Fatal("Expected service without ID to default to its type")
+	}
+	if !svc.Hidden {
+		t.Error("Expected service to be hidden")
+	}
+
+	count := 0
+	d.ForEachFeature(func(*Service, string, *Feature) {
+		count++
+	})
+	if count != 4 {
+		t.Error("Expected 4 features, got ", count)
+	}
+}
+
+func TestDeviceAddServiceDuplicate(t *testing.T) {
+	d := NewDevice("outlet/strip", &messaging.TestingMessenger{})
+	if err := d.AddService(&Service{ID: "one", Type: "outlet"}); err != nil {
+		t.Error("Expected to add service, got ", err)
+	}
+	if err := d.AddService(&Service{ID: "one", Type: "outlet"}); err == nil {
+		t.Error("Expected error when adding a service with a duplicate ID")
+	}
+}
+
+func TestFeatureExtract(t *testing.T) {
+	payload := []byte(`{"state": "ON", "brightness": 128, "color": {"x": 0.3}, "channels": [{"on": true}, {"on": false}], "empty": null}`)
+	var tests = []struct {
+		path string
+		exp  string
+		ok   bool
+	}{
+		{"", string(payload), true},
+		{"$.state", "ON", true},
+		{"$.brightness", "128", true},
+		{"brightness", "128", true},
+		{"$.color.x", "0.3", true},
+		{"$.channels[1].on", "false", true},
+		{"$['state']", "ON", true},
+		{"$.missing", "", false},
+		{"$.channels[5].on", "", false},
+		{"$.empty", "", false},
+	}
+	for _, tt := range tests {
+		f := &Feature{GetPath: tt.path}
+		got, ok, err := f.Extract(payload)
+		if err != nil {
+			t.Errorf("Extract(%s) returned error: %s", tt.path, err)
+			continue
+		}
+		if ok != tt.ok || string(got) != tt.exp {
+			t.Errorf("Extract(%s): expected %q (%v), got %q (%v)", tt.path, tt.exp, tt.ok, got, ok)
+		}
+	}
+
+	f := &Feature{GetPath: "$.channels[x]"}
+	if _, _, err := f.Extract(payload); err == nil {
+		t.Error("Expected error for invalid path")
+	}
+}
+
+func TestFeatureSetTemplate(t *testing.T) {
+	m := &messaging.TestingMessenger{}
+	d := NewDevice("zigbee2mqtt/bulb", m)
+	d.AddFeature("brightness", &Feature{
+		SetTopic:    "zigbee2mqtt/bulb/set",
+		SetTemplate: `{"brightness": {{value}}}`,
+	})
+	ft, _ := d.GetFeature("brightness")
+	ft.Set("42")
+
+	if !reflect.DeepEqual(m.Topic, []string{"zigbee2mqtt/bulb/set"}) {
+		t.Error("Expected topic to be zigbee2mqtt/bulb/set, got ", m.Topic)
+	}
+	if string(m.Message) != `{"brightness": 42}` {
+		t.Error("Expected templated payload, got ", string(m.Message))
+	}
+}
+
+// requestingMessenger is a TestingMessenger that can tie responses to
+// requests, like the MQTT 5 one.
+type requestingMessenger struct {
+	messaging.TestingMessenger
+	props    *messaging.Properties
+	response func(messaging.Message)
+}
+
+func (m *requestingMessenger) Request(ctx context.Context, topic string, message []byte, qos int, p *messaging.Properties, response func(messaging.Message)) error {
+	m.Publish(topic, message, qos, false)
+	m.props = p
+	m.response = response
+	return nil
+}
+
+func TestFeatureSetRequest(t *testing.T) {
+	m := &requestingMessenger{}
+	d := NewDevice("lock", m)
+	d.AddFeature("lockTargetState", &Feature{SetTopic: "lock/target/set"})
+
+	if err := d.Features["lockTargetState"].Set("1"); err != nil {
+		t.Fatal("Expected set to succeed, got ", err)
+	}
+	if m.Action != "publish" || !reflect.DeepEqual(m.Topic, []string{"lock/target/set"}) {
+		t.Errorf("Expected to publish on lock/target/set, but tried to %s on %s", m.Action, m.Topic)
+	}
+	if m.props == nil || m.props.MessageExpiry != SetExpiry {
+		t.Error("Expected set to expire after ", SetExpiry)
+	}
+	if m.response == nil {
+		t.Error("Expected a response to be waited for")
+	}
+}
+
+func TestFeatureSetError(t *testing.T) {
+	m := &messaging.TestingMessenger{Err: errors.New("not connected")}
+	d := NewDevice("lightbulb", m)
+	d.AddFeature("on", &Feature{SetTopic: "lightbulb/on/set"})
+	set := false
+	d.valueSet = func(feature, value, origin string) { set = true }
+
+	if err := d.Features["on"].Set("1"); err != m.Err {
+		t.Error("Expected the error of the transport, got ", err)
+	}
+	if set {
+		t.Error("Expected no FeatureSet for a set that failed")
+	}
+	if err := d.Features["on"].Update("1"); err != m.Err {
+		t.Error("Expected update to return the error of the transport, got ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d = NewDevice("lightbulb", &struct{ messaging.PublishSubscriber }{m})
+	d.AddFeature("on", &Feature{SetTopic: "lightbulb/on/set"})
+	if err := d.Features["on"].SetFromContext(ctx, "test", "1"); err != context.Canceled {
+		t.Error("Expected a transport without contexts to respect them, got ", err)
+	}
+}
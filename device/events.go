@@ -0,0 +1,129 @@
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// EventHandler receives fine-grained events about devices from a Manager.
+// Embed NopEventHandler to only implement the events you're interested in.
+//
+// Announced is sent every time a device is announced, the other events
+// describe what changed compared to before. FeatureSet is sent when a
+// feature is set through Feature.Set or Feature.SetFrom. Features are
+// identified by their FeatureKey.
+type EventHandler interface {
+	Announced(d *Device)
+	Removed(d *Device)
+	MetadataChanged(d *Device, old *Device)
+	FeatureAdded(d *Device, key string)
+	FeatureRemoved(d *Device, key string)
+	ReachabilityChanged(d *Device, reachable bool)
+	FeatureValueChanged(d *Device, key string, old, new []byte)
+	FeatureSet(d *Device, key, value, origin string)
+}
+
+// NopEventHandler implements every method of EventHandler by doing nothing.
+type NopEventHandler struct{}
+
+func (NopEventHandler) Announced(*Device)                                   {}
+func (NopEventHandler) Removed(*Device)                                     {}
+func (NopEventHandler) MetadataChanged(*Device, *Device)                    {}
+func (NopEventHandler) FeatureAdded(*Device, string)                        {}
+func (NopEventHandler) FeatureRemoved(*Device, string)                      {}
+func (NopEventHandler) ReachabilityChanged(*Device, bool)                   {}
+func (NopEventHandler) FeatureValueChanged(*Device, string, []byte, []byte) {}
+func (NopEventHandler) FeatureSet(*Device, string, string, string)          {}
+
+// HandlerAdapter turns a Handler into an EventHandler. Announcements and
+// reachability changes result in a call to Updated.
+type HandlerAdapter struct {
+	NopEventHandler
+	Handler Handler
+}
+
+func (a *HandlerAdapter) Announced(d *Device)                   { a.Handler.Updated(d) }
+func (a *HandlerAdapter) Removed(d *Device)                     { a.Handler.Removed(d) }
+func (a *HandlerAdapter) ReachabilityChanged(d *Device, _ bool) { a.Handler.Updated(d) }
+
+// event is a call to one of the methods of an EventHandler.
+type event func(EventHandler)
+
+// clone returns a copy of the device's metadata, reachability and feature
+// values. The copy is detached from the transport, so features on it can't
+// be set or subscribed to.
+func (d *Device) clone() *Device {
+	d.RLock()
+	b, err := json.Marshal(d)
+	c := &Device{
+		Topic:     d.Topic,
+		Reachable: d.Reachable,
+		LastSeen:  d.LastSeen,
+	}
+	values := map[string]*Feature{}
+	d.forEachFeature(func(svc *Service, name string, ft *Feature) {
+		values[FeatureKey(svc, name)] = ft
+	})
+	d.RUnlock()
+
+	if err == nil {
+		json.Unmarshal(b, c)
+	}
+	c.forEachFeature(func(svc *Service, name string, ft *Feature) {
+		if orig, ok := values[FeatureKey(svc, name)]; ok {
+			ft.value = orig.value
+			ft.updated = orig.updated
+		}
+	})
+	return c
+}
+
+// changes returns the events describing how dev differs from old.
+func changes(old, dev *Device) []event {
+	var events []event
+
+	oldMeta, _ := json.Marshal(old)
+	dev.RLock()
+	newMeta, _ := json.Marshal(dev)
+	dev.RUnlock()
+	if !bytes.Equal(oldMeta, newMeta) {
+		events = append(events, func(h EventHandler) {
+			h.MetadataChanged(dev, old)
+		})
+	}
+
+	oldKeys := featureKeys(old)
+	newKeys := featureKeys(dev)
+	for key := range newKeys {
+		if !oldKeys[key] {
+			k := key
+			events = append(events, func(h EventHandler) {
+				h.FeatureAdded(dev, k)
+			})
+		}
+	}
+	for key := range oldKeys {
+		if !newKeys[key] {
+			k := key
+			events = append(events, func(h EventHandler) {
+				h.FeatureRemoved(dev, k)
+			})
+		}
+	}
+
+	if old.Reachable != dev.Reachable {
+		reachable := dev.Reachable
+		events = append(events, func(h EventHandler) {
+			h.ReachabilityChanged(dev, reachable)
+		})
+	}
+	return events
+}
+
+func featureKeys(d *Device) map[string]bool {
+	keys := map[string]bool{}
+	d.ForEachFeature(func(svc *Service, name string, _ *Feature) {
+		keys[FeatureKey(svc, name)] = true
+	})
+	return keys
+}
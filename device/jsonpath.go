@@ -0,0 +1,99 @@
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is a single step in a JSON path, either a key in an object
+// or an index in an array.
+type pathSegment struct {
+	key   string
+	index int
+}
+
+// parsePath parses a JSON path of the form $.state.brightness or
+// $.channels[0].value. The leading $ is optional.
+func parsePath(path string) ([]pathSegment, error) {
+	p := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var segments []pathSegment
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end == -1 {
+				end = len(p)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in path %s", path)
+			}
+			segments = append(segments, pathSegment{key: p[:end], index: -1})
+			p = p[end:]
+		case '[':
+			end := strings.Index(p, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("missing ] in path %s", path)
+			}
+			inner := p[1:end]
+			if len(inner) > 1 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, pathSegment{key: inner[1 : len(inner)-1], index: -1})
+			} else {
+				i, err := strconv.Atoi(inner)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("invalid index %s in path %s", inner, path)
+				}
+				segments = append(segments, pathSegment{index: i})
+			}
+			p = p[end+1:]
+		default:
+			if len(segments) > 0 {
+				return nil, fmt.Errorf("unexpected %q in path %s", p[0], path)
+			}
+			// Allow the first key without a leading dot, as in state.brightness
+			p = "." + p
+		}
+	}
+	return segments, nil
+}
+
+// extractPath returns the value at path in the JSON document doc. Strings
+// are returned without quotes, everything else as its JSON representation.
+// ok is false if doc does not contain the path.
+func extractPath(doc []byte, path string) (value []byte, ok bool, err error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	var cur json.RawMessage = bytes.TrimSpace(doc)
+	for _, seg := range segments {
+		if seg.index >= 0 {
+			var arr []json.RawMessage
+			if json.Unmarshal(cur, &arr) != nil || seg.index >= len(arr) {
+				return nil, false, nil
+			}
+			cur = arr[seg.index]
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(cur, &obj) != nil {
+			return nil, false, nil
+		}
+		next, found := obj[seg.key]
+		if !found {
+			return nil, false, nil
+		}
+		cur = next
+	}
+	if bytes.Equal(cur, []byte("null")) {
+		return nil, false, nil
+	}
+	var str string
+	if json.Unmarshal(cur, &str) == nil {
+		return []byte(str), true, nil
+	}
+	return []byte(cur), true, nil
+}
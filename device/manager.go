@@ -6,18 +6,30 @@ import (
 	"github.com/hemtjanst/hemtjanst/messaging"
 	"log"
 	"sync"
+	"time"
 )
 
+// Handler is notified when a device is added or updated, including changes
+// in its reachability, and when it's removed. Use an EventHandler for more
+// detail on what changed.
 type Handler interface {
 	Updated(*Device)
 	Removed(*Device)
 }
 
+// saveDelay is how long the manager waits after a change before saving
+// to its store, so that a burst of updates results in a single save.
+var saveDelay = 5 * time.Second
+
 type Manager struct {
 	devices  map[string]*Device
-	handlers []Handler
+	handlers []EventHandler
 	client   messaging.PublishSubscriber
 	init     bool
+	store    Store
+	restored map[string]bool
+	saveLock sync.Mutex
+	saving   *time.Timer
 	sync.RWMutex
 }
 
@@ -25,7 +37,7 @@ func NewManager(c messaging.PublishSubscriber, initChan chan bool) *Manager {
 	m := &Manager{
 		client:   c,
 		devices:  make(map[string]*Device, 10),
-		handlers: []Handler{},
+		handlers: []EventHandler{},
 		// Set init to true if initChan is missing, otherwise wait for a init signal
 		init: initChan == nil,
 	}
@@ -40,30 +52,47 @@ func NewManager(c messaging.PublishSubscriber, initChan chan bool) *Manager {
 }
 
 func (m *Manager) Add(topic string, meta []byte) {
-	var dev *Device
-	var existing bool
-	if dev, existing = m.devices[topic]; !existing {
-		log.Print("Got announce for new device ", topic)
-		dev = &Device{Topic: topic, transport: m.client}
-	}
-	log.Print("Processing meta for device ", topic)
-
 	m.Lock()
 	defer m.Unlock()
-	err := json.Unmarshal(meta, dev)
-	dev.Reachable = m.init
-	if err != nil {
-		log.Print(err)
+
+	// Decode the announcement on its own first, so that a device stays as
+	// it was when it's invalid
+	log.Print("Processing meta for device ", topic)
+	announced := &Device{Topic: topic}
+	if err := json.Unmarshal(meta, announced); err != nil {
+		log.Printf("Ignoring announce for %s: %s", topic, err)
 		return
 	}
 
-	go m.forHandler(func(handler Handler) {
-		handler.Updated(dev)
-	})
-
+	var old *Device
+	dev, existing := m.devices[topic]
+	if !existing {
+		log.Print("Got announce for new device ", topic)
+		dev = m.newDevice(topic)
+	} else {
+		old = dev.clone()
+	}
+	dev.update(announced)
+	dev.Lock()
+	dev.Reachable = m.init
+	dev.LastSeen = time.Now()
+	dev.Unlock()
+	dev.applyPayloads()
+	m.scheduleSave()
+	delete(m.restored, topic)
 	if !existing {
 		m.devices[topic] = dev
 	}
+	m.subscribe(dev)
+	m.watch(dev)
+
+	events := []event{func(h EventHandler) {
+		h.Announced(dev)
+	}}
+	if existing {
+		events = append(events, changes(old, dev)...)
+	}
+	go m.emit(events...)
 }
 
 func (m *Manager) Get(id string) (*Device, error) {
@@ -93,25 +122,19 @@ func (m *Manager) Remove(msg string) {
 	}
 	log.Print("Got remove for device ", msg)
 	// Got empty payload, remove device
-	go m.forHandler(func(handler Handler) {
-		handler.Removed(dev)
+	go m.emit(func(h EventHandler) {
+		h.Removed(dev)
 	})
 
-	// Loop through all topics and add to slice first
-	// instead of calling unsubscribe() on every feature
-	topics := []string{}
-	for _, ft := range dev.Features {
-		if ft.GetTopic != "" {
-			log.Print("Unsubscribing from ", ft.GetTopic)
-			topics = append(topics, ft.GetTopic)
-		}
-	}
-	if len(topics) > 0 {
-		m.client.Unsubscribe(topics...)
+	m.unsubscribe(dev)
+	if dev.Snapshot != nil {
+		m.client.Unsubscribe(dev.Snapshot.Topic)
 	}
 
 	// Forget device
+	m.unwatch(dev)
 	delete(m.devices, msg)
+	m.scheduleSave()
 	return
 }
 
@@ -122,30 +145,320 @@ func (m *Manager) Leave(msg string) {
 	for _, d := range m.devices {
 		if d.LastWillID == msg || d.Topic == msg {
 			log.Printf("Found: %s, setting unreachable", d.Topic)
+			// It's subscribed to again when the device announces itself
+			m.unsubscribe(d)
+			if !d.Reachable {
+				continue
+			}
+			d.Lock()
 			d.Reachable = false
+			d.Unlock()
 			dev := d
-			go m.forHandler(func(handler Handler) {
-				handler.Updated(dev)
+			go m.emit(func(h EventHandler) {
+				h.ReachabilityChanged(dev, false)
 			})
+			m.scheduleSave()
+		}
+	}
+}
+
+func (m *Manager) newDevice(topic string) *Device {
+	d := &Device{Topic: topic, transport: m.client, managed: true}
+	d.onReceived = func() {
+		m.received(d)
+	}
+	d.valueChanged = func(key string, old, new []byte) {
+		m.emit(func(h EventHandler) {
+			h.FeatureValueChanged(d, key, old, new)
+		})
+	}
+	d.valueSet = func(key, value, origin string) {
+		go m.emit(func(h EventHandler) {
+			h.FeatureSet(d, key, value, origin)
+		})
+	}
+	return d
+}
+
+// subscribe subscribes to the GetTopic of every feature of d that isn't
+// write-only, and unsubscribes from the ones it no longer has. The values
+// of features and whether d went stale are then kept up to date whether
+// or not anyone calls OnUpdate. The manager must be locked.
+func (m *Manager) subscribe(d *Device) {
+	topics := map[string]bool{}
+	d.ForEachFeature(func(_ *Service, _ string, ft *Feature) {
+		if !ft.WriteOnly {
+			topics[ft.GetTopic] = true
+		}
+	})
+
+	d.Lock()
+	if d.subscribed == nil {
+		d.subscribed = map[string]bool{}
+	}
+	var added, removed []string
+	for topic := range topics {
+		if !d.subscribed[topic] {
+			d.subscribed[topic] = true
+			added = append(added, topic)
+		}
+	}
+	for topic := range d.subscribed {
+		if !topics[topic] {
+			delete(d.subscribed, topic)
+			delete(d.listeners, topic)
+			removed = append(removed, topic)
+		}
+	}
+	d.Unlock()
+
+	if len(removed) > 0 {
+		log.Printf("Unsubscribing from %v", removed)
+		m.client.Unsubscribe(removed...)
+	}
+	for _, topic := range added {
+		t := topic
+		m.client.Subscribe(t, 1, func(msg messaging.Message) {
+			d.deliver(t, msg)
+		})
+	}
+}
+
+// unsubscribe unsubscribes from all GetTopics of d. The manager must be
+// locked.
+func (m *Manager) unsubscribe(d *Device) {
+	d.Lock()
+	topics := make([]string, 0, len(d.subscribed))
+	for topic := range d.subscribed {
+		topics = append(topics, topic)
+	}
+	d.subscribed = nil
+	d.Unlock()
+	if len(topics) > 0 {
+		log.Printf("Unsubscribing from %v", topics)
+		m.client.Unsubscribe(topics...)
+	}
+}
+
+// received is called whenever a message is received on one of the topics of
+// d. Devices that went stale are reachable again once they publish.
+func (m *Manager) received(d *Device) {
+	m.scheduleSave()
+
+	m.Lock()
+	defer m.Unlock()
+	if m.devices[d.Topic] != d {
+		return
+	}
+	m.watch(d)
+	if d.StaleAfter > 0 && !d.Reachable && m.init {
+		log.Printf("Device %s published again, setting reachable", d.Topic)
+		d.Lock()
+		d.Reachable = true
+		d.Unlock()
+		go m.emit(func(h EventHandler) {
+			h.ReachabilityChanged(d, true)
+		})
+	}
+}
+
+// watch (re)starts the timer that marks d as unreachable once it hasn't
+// been seen for StaleAfter seconds. The manager must be locked.
+func (m *Manager) watch(d *Device) {
+	d.Lock()
+	defer d.Unlock()
+	if d.StaleAfter <= 0 {
+		if d.staleTimer != nil {
+			d.staleTimer.Stop()
+			d.staleTimer = nil
+		}
+		return
+	}
+	wait := d.LastSeen.Add(time.Duration(d.StaleAfter) * time.Second).Sub(time.Now())
+	if d.staleTimer == nil {
+		d.staleTimer = time.AfterFunc(wait, func() {
+			m.checkStale(d)
+		})
+	} else {
+		d.staleTimer.Reset(wait)
+	}
+}
+
+// unwatch stops the staleness timer of d.
+func (m *Manager) unwatch(d *Device) {
+	d.Lock()
+	defer d.Unlock()
+	if d.staleTimer != nil {
+		d.staleTimer.Stop()
+		d.staleTimer = nil
+	}
+}
+
+// checkStale marks d as unreachable if it hasn't been seen for StaleAfter
+// seconds, otherwise it waits for the remaining time.
+func (m *Manager) checkStale(d *Device) {
+	m.Lock()
+	defer m.Unlock()
+	if m.devices[d.Topic] != d || d.StaleAfter <= 0 {
+		return
+	}
+	d.RLock()
+	stale := time.Since(d.LastSeen) >= time.Duration(d.StaleAfter)*time.Second
+	d.RUnlock()
+	if !stale {
+		m.watch(d)
+		return
+	}
+	if !d.Reachable {
+		return
+	}
+	log.Printf("Device %s hasn't published for %ds, setting unreachable", d.Topic, d.StaleAfter)
+	d.Lock()
+	d.Reachable = false
+	d.Unlock()
+	go m.emit(func(h EventHandler) {
+		h.ReachabilityChanged(d, false)
+	})
+	m.scheduleSave()
+}
+
+// UseStore restores the devices persisted in s and keeps s up to date with
+// every change from then on. Call it before adding any handlers. It returns
+// the number of devices that were restored.
+func (m *Manager) UseStore(s Store) (int, error) {
+	records, err := s.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.store = s
+	m.restored = map[string]bool{}
+	for _, r := range records {
+		dev := m.newDevice(r.Topic)
+		if err := json.Unmarshal(r.Meta, dev); err != nil {
+			log.Printf("Could not restore device %s: %s", r.Topic, err)
+			continue
 		}
+		dev.Topic = r.Topic
+		dev.Reachable = r.Reachable
+		dev.LastSeen = r.LastSeen
+		dev.payloads = r.Payloads
+		dev.applyPayloads()
+		m.devices[r.Topic] = dev
+		m.restored[r.Topic] = true
+		m.subscribe(dev)
+		m.watch(dev)
 	}
+	return len(m.devices), nil
 }
 
-func (m *Manager) forHandler(f func(handler Handler)) {
+// ExpireRestored removes the devices restored by UseStore that haven't been
+// announced since, as they're gone or were removed while we weren't
+// running. Call it once devices had the time to answer the discover. It
+// returns the number of devices removed.
+func (m *Manager) ExpireRestored() int {
+	m.Lock()
+	topics := make([]string, 0, len(m.restored))
+	for topic := range m.restored {
+		topics = append(topics, topic)
+	}
+	m.restored = nil
+	m.Unlock()
+
+	for _, topic := range topics {
+		log.Printf("Device %s wasn't announced again, removing it", topic)
+		m.Remove(topic)
+	}
+	return len(topics)
+}
+
+// scheduleSave saves the devices to the store after saveDelay, unless a
+// save is already scheduled.
+func (m *Manager) scheduleSave() {
+	m.saveLock.Lock()
+	defer m.saveLock.Unlock()
+	if m.saving != nil {
+		return
+	}
+	m.saving = time.AfterFunc(saveDelay, func() {
+		m.saveLock.Lock()
+		m.saving = nil
+		m.saveLock.Unlock()
+		m.save()
+	})
+}
+
+// Flush saves the devices to the store right away. It should be called
+// before shutting down.
+func (m *Manager) Flush() error {
+	m.saveLock.Lock()
+	if m.saving != nil {
+		m.saving.Stop()
+		m.saving = nil
+	}
+	m.saveLock.Unlock()
+	return m.save()
+}
+
+func (m *Manager) save() error {
 	m.RLock()
-	defer m.RUnlock()
-	for _, h := range m.handlers {
-		f(h)
+	store := m.store
+	if store == nil {
+		m.RUnlock()
+		return nil
+	}
+	records := make([]*Record, 0, len(m.devices))
+	for _, dev := range m.devices {
+		r, err := dev.record()
+		if err != nil {
+			log.Printf("Could not persist device %s: %s", dev.Topic, err)
+			continue
+		}
+		records = append(records, r)
+	}
+	m.RUnlock()
+
+	err := store.Save(records)
+	if err != nil {
+		log.Print("Could not save devices: ", err)
+	}
+	return err
+}
+
+// emit sends the events, in order, to every handler.
+func (m *Manager) emit(events ...event) {
+	m.RLock()
+	handlers := make([]EventHandler, len(m.handlers))
+	copy(handlers, m.handlers)
+	m.RUnlock()
+	for _, ev := range events {
+		for _, h := range handlers {
+			ev(h)
+		}
 	}
 }
 
+// AddHandler adds a Handler, it's notified of all devices known so far
+// right away.
 func (m *Manager) AddHandler(handler Handler) {
+	m.AddEventHandler(&HandlerAdapter{Handler: handler})
+}
+
+// AddEventHandler adds an EventHandler, it gets an Announced event for all
+// devices known so far right away.
+func (m *Manager) AddEventHandler(handler EventHandler) {
 	m.Lock()
 	defer m.Unlock()
 	m.handlers = append(m.handlers, handler)
+	devices := make([]*Device, 0, len(m.devices))
+	for _, device := range m.devices {
+		devices = append(devices, device)
+	}
 	go func() {
-		for _, device := range m.devices {
-			handler.Updated(device)
+		for _, device := range devices {
+			handler.Announced(device)
 		}
 	}()
 }
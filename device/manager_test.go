@@ -4,7 +4,12 @@ import (
 	"github.com/hemtjanst/hemtjanst/messaging"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -125,3 +130,440 @@ func TestManagerAddHandler(t *testing.T) {
 		t.Error("Expected 1 device handler, got ", len(mn.handlers))
 	}
 }
+
+func TestManagerAddRemovesFeatures(t *testing.T) {
+	c := &messaging.TestingMQTTClient{}
+	m := messaging.NewTestingMessenger(c)
+	mn := NewManager(m, nil)
+
+	mn.Add("lightbulb/kitchen", []byte(`{"feature": {"on": {}, "brightness": {}}}`))
+	mn.Add("lightbulb/kitchen", []byte(`{"feature": {"on": {}}}`))
+
+	d, _ := mn.Get("lightbulb/kitchen")
+	if d.HasFeature("brightness") {
+		t.Error("Expected brightness to be removed on re-announce")
+	}
+	if !d.HasFeature("on") {
+		t.Error("Expected device to still have feature on")
+	}
+}
+
+func TestManagerAddInvalid(t *testing.T) {
+	c := &messaging.TestingMQTTClient{}
+	m := messaging.NewTestingMessenger(c)
+	mn := NewManager(m, nil)
+	r := &recordingEventHandler{events: make(chan string, 10)}
+	mn.AddEventHandler(r)
+
+	mn.Add("fan/ceiling", []byte(`{"name": "ceiling", "feature": {"on": {}}}`))
+	expectEvents(t, r, "announced fan/ceiling")
+	mn.Add("fan/ceiling", []byte(`{"name": "fan", "feature": {"on": {}}, "services": [{"id": "light"}, {"id": "light"}]}`))
+
+	d, _ := mn.Get("fan/ceiling")
+	if d.Name != "ceiling" || !d.HasFeature("on") || len(d.Services) != 0 {
+		t.Errorf("Expected the device to be left as it was, got %s with %v and %d services", d.Name, d.Features, len(d.Services))
+	}
+	select {
+	case ev := <-r.events:
+		t.Error("Expected no events for an invalid announce, got ", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestManagerStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hemtjanst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(filepath.Join(dir, "devices.json"))
+
+	c := &messaging.TestingMQTTClient{}
+	m := messaging.NewTestingMessenger(c)
+	mn := NewManager(m, nil)
+	if n, err := mn.UseStore(store); err != nil || n != 0 {
+		t.Fatalf("Expected empty store, got %d devices (%v)", n, err)
+	}
+
+	mn.Add("lightbulb/kitchen", []byte(`{"name": "kitchen", "type": "lightbulb", "feature": {"on": {}}}`))
+	d, _ := mn.Get("lightbulb/kitchen")
+	d.received("lightbulb/kitchen/on/get", []byte("1"))
+	if err := mn.Flush(); err != nil {
+		t.Fatal("Expected to save devices, got ", err)
+	}
+
+	mn = NewManager(m, nil)
+	if n, err := mn.UseStore(store); err != nil || n != 1 {
+		t.Fatalf("Expected 1 restored device, got %d (%v)", n, err)
+	}
+	d, err = mn.Get("lightbulb/kitchen")
+	if err != nil {
+		t.Fatal("Expected device to be restored")
+	}
+	if d.Name != "kitchen" || !d.Reachable || d.LastSeen.IsZero() {
+		t.Errorf("Expected name, reachability and last seen to be restored, got %s %v %s", d.Name, d.Reachable, d.LastSeen)
+	}
+
+	ft, _ := d.GetFeature("on")
+	var got string
+	ft.OnUpdate(func(msg messaging.Message) {
+		got = string(msg.Payload())
+	})
+	if got != "1" {
+		t.Error("Expected the last known value to be replayed, got ", got)
+	}
+}
+
+func TestManagerExpireRestored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hemtjanst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(filepath.Join(dir, "devices.json"))
+
+	c := &messaging.TestingMQTTClient{}
+	m := messaging.NewTestingMessenger(c)
+	mn := NewManager(m, nil)
+	mn.UseStore(store)
+	mn.Add("lightbulb/kitchen", []byte(`{"name": "kitchen", "type": "lightbulb", "feature": {"on": {}}}`))
+	mn.Add("lightbulb/hall", []byte(`{"name": "hall", "type": "lightbulb", "feature": {"on": {}}}`))
+	if err := mn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	mn = NewManager(m, nil)
+	if n, _ := mn.UseStore(store); n != 2 {
+		t.Fatalf("Expected 2 restored devices, got %d", n)
+	}
+	mn.Add("lightbulb/kitchen", []byte(`{"name": "kitchen", "type": "lightbulb", "feature": {"on": {}}}`))
+	if n := mn.ExpireRestored(); n != 1 {
+		t.Errorf("Expected 1 device to expire, got %d", n)
+	}
+	if _, err := mn.Get("lightbulb/hall"); err == nil {
+		t.Error("Expected the device that wasn't announced again to be removed")
+	}
+	if _, err := mn.Get("lightbulb/kitchen"); err != nil {
+		t.Error("Expected the announced device to be kept")
+	}
+	if n := mn.ExpireRestored(); n != 0 {
+		t.Errorf("Expected devices to expire only once, got %d", n)
+	}
+}
+
+func TestManagerSnapshot(t *testing.T) {
+	c := &messaging.TestingMQTTClient{}
+	m := messaging.NewTestingMessenger(c)
+	mn := NewManager(m, nil)
+
+	mn.Add("lightbulb/kitchen", []byte(`{"name": "kitchen", "feature": {"on": {}, "brightness": {"getTopic": "z2m/kitchen", "getPath": "$.brightness"}}}`))
+	mn.Add("contactSensor/door", []byte(`{"name": "door", "feature": {"contactSensorState": {}}}`))
+
+	d, _ := mn.Get("lightbulb/kitchen")
+	d.received("z2m/kitchen", []byte(`{"brightness": 42}`))
+
+	ft, _ := d.GetFeature("brightness")
+	if string(ft.Value()) != "42" {
+		t.Error("Expected value 42, got ", string(ft.Value()))
+	}
+	if ft.Updated().IsZero() {
+		t.Error("Expected feature to have an update time")
+	}
+
+	// Values survive a re-announce
+	mn.Add("lightbulb/kitchen", []byte(`{"name": "kitchen", "feature": {"on": {}, "brightness": {"getTopic": "z2m/kitchen", "getPath": "$.brightness"}}}`))
+
+	snap := mn.Snapshot()
+	if len(snap) != 2 {
+		t.Fatal("Expected 2 devices, got ", len(snap))
+	}
+	if snap[0].Topic != "contactSensor/door" || snap[1].Topic != "lightbulb/kitchen" {
+		t.Error("Expected devices to be sorted by topic, got ", snap[0].Topic, snap[1].Topic)
+	}
+	bri := snap[1].Features["brightness"]
+	if bri.Value == nil || *bri.Value != "42" {
+		t.Error("Expected brightness of 42 in snapshot, got ", bri.Value)
+	}
+	if snap[1].Features["on"].Value != nil {
+		t.Error("Expected no value for on, got ", *snap[1].Features["on"].Value)
+	}
+}
+
+type recordingEventHandler struct {
+	NopEventHandler
+	events chan string
+}
+
+func (r *recordingEventHandler) Announced(d *Device) {
+	r.events <- "announced " + d.Topic
+}
+func (r *recordingEventHandler) MetadataChanged(d *Device, old *Device) {
+	r.events <- "metadata " + old.Name + " -> " + d.Name
+}
+func (r *recordingEventHandler) FeatureAdded(d *Device, key string) {
+	r.events <- "added " + key
+}
+func (r *recordingEventHandler) FeatureRemoved(d *Device, key string) {
+	r.events <- "removed " + key
+}
+func (r *recordingEventHandler) ReachabilityChanged(d *Device, reachable bool) {
+	if reachable {
+		r.events <- "reachable"
+	} else {
+		r.events <- "unreachable"
+	}
+}
+func (r *recordingEventHandler) FeatureValueChanged(d *Device, key string, old, new []byte) {
+	r.events <- "value " + key + " " + string(old) + " -> " + string(new)
+}
+func (r *recordingEventHandler) FeatureSet(d *Device, key, value, origin string) {
+	r.events <- "set " + key + " " + value + " from " + origin
+}
+
+func expectEvents(t *testing.T, r *recordingEventHandler, exp ...string) {
+	t.Helper()
+	got := map[string]bool{}
+	for range exp {
+		select {
+		case ev := <-r.events:
+			got[ev] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for events, expected %v got %v", exp, got)
+		}
+	}
+	for _, e := range exp {
+		if !got[e] {
+			t.Errorf("Expected event %q, got %v", e, got)
+		}
+	}
+}
+
+func TestManagerEventHandler(t *testing.T) {
+	c := &messaging.TestingMQTTClient{}
+	m := messaging.NewTestingMessenger(c)
+	mn := NewManager(m, nil)
+	r := &recordingEventHandler{events: make(chan string, 10)}
+	mn.AddEventHandler(r)
+
+	mn.Add("lightbulb/kitchen", []byte(`{"name": "kitchen", "feature": {"on": {}}}`))
+	expectEvents(t, r, "announced lightbulb/kitchen")
+
+	mn.Add("lightbulb/kitchen", []byte(`{"name": "kitchen light", "feature": {"on": {}, "brightness": {}}}`))
+	expectEvents(t, r, "announced lightbulb/kitchen", "metadata kitchen -> kitchen light", "added brightness")
+
+	d, _ := mn.Get("lightbulb/kitchen")
+	d.received("lightbulb/kitchen/on/get", []byte("1"))
+	expectEvents(t, r, "value on  -> 1")
+	d.received("lightbulb/kitchen/on/get", []byte("1"))
+	d.received("lightbulb/kitchen/on/get", []byte("0"))
+	expectEvents(t, r, "value on 1 -> 0")
+
+	d.Features["on"].SetFrom("test", "1")
+	expectEvents(t, r, "set on 1 from test")
+
+	mn.Leave("lightbulb/kitchen")
+	expectEvents(t, r, "unreachable")
+
+	mn.Add("lightbulb/kitchen", []byte(`{"name": "kitchen light", "feature": {"on": {}}}`))
+	expectEvents(t, r, "announced lightbulb/kitchen", "metadata kitchen light -> kitchen light", "removed brightness", "reachable")
+}
+
+type countingHandler struct {
+	updated chan *Device
+}
+
+func (c *countingHandler) Updated(d *Device) { c.updated <- d }
+func (c *countingHandler) Removed(d *Device) {}
+
+func TestManagerHandlerAdapter(t *testing.T) {
+	c := &messaging.TestingMQTTClient{}
+	m := messaging.NewTestingMessenger(c)
+	mn := NewManager(m, nil)
+	h := &countingHandler{updated: make(chan *Device, 10)}
+	mn.AddHandler(h)
+
+	mn.Add("contactSensor/door", []byte(`{"feature": {"contactSensorState": {}}}`))
+	mn.Leave("contactSensor/door")
+	// Leaving again doesn't change reachability
+	mn.Leave("contactSensor/door")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-h.updated:
+		case <-time.After(time.Second):
+			t.Fatal("Expected Updated for announce and leave")
+		}
+	}
+	select {
+	case <-h.updated:
+		t.Error("Did not expect Updated when reachability didn't change")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestManagerStaleAfter(t *testing.T) {
+	c := &messaging.TestingMQTTClient{}
+	m := messaging.NewTestingMessenger(c)
+	mn := NewManager(m, nil)
+	r := &recordingEventHandler{events: make(chan string, 10)}
+	mn.AddEventHandler(r)
+
+	mn.Add("sensor/garden", []byte(`{"staleAfter": 60, "feature": {"currentTemperature": {}}}`))
+	expectEvents(t, r, "announced sensor/garden")
+	d, _ := mn.Get("sensor/garden")
+	if d.StaleAfter != 60 {
+		t.Fatal("Expected staleAfter of 60, got ", d.StaleAfter)
+	}
+
+	// Pretend the device was last seen long ago
+	mn.Lock()
+	d.LastSeen = time.Now().Add(-2 * time.Minute)
+	mn.watch(d)
+	mn.Unlock()
+	expectEvents(t, r, "unreachable")
+	if d.Reachable {
+		t.Error("Expected device to be unreachable")
+	}
+
+	d.received("sensor/garden/currentTemperature/get", []byte("12.5"))
+	expectEvents(t, r, "value currentTemperature  -> 12.5", "reachable")
+	if !d.Reachable {
+		t.Error("Expected device to be reachable again")
+	}
+}
+
+// announce hands announcements and leaves published through b to mn, like
+// hemtjanst does.
+func announce(b *messaging.MemoryBroker, mn *Manager) {
+	c := b.NewClient()
+	c.Subscribe("announce/#", 1, func(msg messaging.Message) {
+		mn.Add(msg.Topic()[len("announce/"):], msg.Payload())
+	})
+	c.Subscribe("leave", 1, func(msg messaging.Message) {
+		mn.Leave(string(msg.Payload()))
+	})
+}
+
+func TestManagerMemoryBroker(t *testing.T) {
+	b := messaging.NewMemoryBroker()
+	mn := NewManager(b.NewClient(), nil)
+	r := &recordingEventHandler{events: make(chan string, 10)}
+	mn.AddEventHandler(r)
+	announce(b, mn)
+
+	lamp := b.NewClient()
+	lamp.SetWill("leave", []byte("lightbulb/kitchen"), 1, false)
+	lamp.Publish("announce/lightbulb/kitchen", []byte(`{"name": "kitchen", "feature": {"on": {}}}`), 1, true)
+	lamp.Publish("lightbulb/kitchen/on/get", []byte("1"), 1, true)
+	var sets []string
+	lamp.Subscribe("lightbulb/kitchen/on/set", 1, func(msg messaging.Message) {
+		sets = append(sets, string(msg.Payload()))
+		lamp.Publish("lightbulb/kitchen/on/get", msg.Payload(), 1, true)
+	})
+	b.Wait()
+	expectEvents(t, r, "announced lightbulb/kitchen", "value on  -> 1")
+
+	d, err := mn.Get("lightbulb/kitchen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	on, _ := d.GetFeature("on")
+	if err := on.OnUpdate(func(messaging.Message) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := on.SetFrom("test", "0"); err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+	expectEvents(t, r, "set on 0 from test", "value on 1 -> 0")
+	if len(sets) != 1 || sets[0] != "0" {
+		t.Errorf("Expected the device to receive a set to 0, got %v", sets)
+	}
+
+	lamp.Drop()
+	b.Wait()
+	expectEvents(t, r, "unreachable")
+}
+
+func TestManagerSubscribes(t *testing.T) {
+	b := messaging.NewMemoryBroker()
+	mn := NewManager(b.NewClient(), nil)
+	r := &recordingEventHandler{events: make(chan string, 10)}
+	mn.AddEventHandler(r)
+	announce(b, mn)
+
+	lamp := b.NewClient()
+	lamp.Publish("lightbulb/kitchen/on/get", []byte("1"), 1, true)
+	lamp.Publish("announce/lightbulb/kitchen", []byte(`{"feature": {"on": {}, "color": {"writeOnly": true}}}`), 1, true)
+	b.Wait()
+	expectEvents(t, r, "announced lightbulb/kitchen", "value on  -> 1")
+
+	// Nobody called OnUpdate, the manager keeps the value up to date itself
+	d, _ := mn.Get("lightbulb/kitchen")
+	on, _ := d.GetFeature("on")
+	value := on.Value()
+	if string(value) != "1" {
+		t.Fatal("Expected value 1, got ", string(value))
+	}
+	value[0] = '0'
+	if string(on.Value()) != "1" {
+		t.Error("Expected Value to return a copy, got ", string(on.Value()))
+	}
+
+	var got []string
+	var mutex sync.Mutex
+	on.OnUpdate(func(msg messaging.Message) {
+		mutex.Lock()
+		got = append(got, string(msg.Payload()))
+		mutex.Unlock()
+	})
+	lamp.Publish("lightbulb/kitchen/on/get", []byte("0"), 1, true)
+	lamp.Publish("lightbulb/kitchen/color/get", []byte("red"), 1, true)
+	b.Wait()
+	expectEvents(t, r, "value on 1 -> 0")
+	mutex.Lock()
+	if !reflect.DeepEqual(got, []string{"1", "0"}) {
+		t.Error("Expected OnUpdate to get the replayed and the published value once, got ", got)
+	}
+	mutex.Unlock()
+
+	mn.Leave("lightbulb/kitchen")
+	expectEvents(t, r, "unreachable")
+	lamp.Publish("lightbulb/kitchen/on/get", []byte("1"), 1, true)
+	b.Wait()
+	if string(on.Value()) != "0" {
+		t.Error("Expected no updates after the device left, got ", string(on.Value()))
+	}
+
+	lamp.Publish("announce/lightbulb/kitchen", []byte(`{"feature": {"on": {}}}`), 1, true)
+	b.Wait()
+	expectEvents(t, r, "announced lightbulb/kitchen", "metadata  -> ", "reachable", "removed color", "value on 0 -> 1")
+	mutex.Lock()
+	if !reflect.DeepEqual(got, []string{"1", "0", "1"}) {
+		t.Error("Expected OnUpdate to keep getting values after the device came back, got ", got)
+	}
+	mutex.Unlock()
+
+	// The manager stays subscribed, only the callback stops
+	if err := on.StopUpdates(); err != nil {
+		t.Fatal(err)
+	}
+	lamp.Publish("lightbulb/kitchen/on/get", []byte("0"), 1, true)
+	b.Wait()
+	expectEvents(t, r, "value on 1 -> 0")
+	mutex.Lock()
+	if len(got) != 3 {
+		t.Error("Expected no more values after StopUpdates, got ", got)
+	}
+	mutex.Unlock()
+
+	mn.Remove("lightbulb/kitchen")
+	lamp.Publish("lightbulb/kitchen/on/get", []byte("1"), 1, true)
+	b.Wait()
+	select {
+	case ev := <-r.events:
+		t.Error("Expected no more values after the device was removed, got ", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,82 @@
+package device
+
+import (
+	"sort"
+	"time"
+)
+
+// DeviceState is a copy of a device and the values of its features at a
+// point in time. Unlike a *Device it's safe to hold on to and pass around.
+type DeviceState struct {
+	Topic        string                  `json:"topic"`
+	Name         string                  `json:"name"`
+	Manufacturer string                  `json:"manufacturer"`
+	Model        string                  `json:"model"`
+	SerialNumber string                  `json:"serialNumber"`
+	Type         string                  `json:"type"`
+	Reachable    bool                    `json:"reachable"`
+	LastSeen     time.Time               `json:"lastSeen"`
+	Features     map[string]FeatureState `json:"features"`
+}
+
+// FeatureState is the value of a feature at a point in time. Features of
+// additional services are keyed by FeatureKey in DeviceState.
+type FeatureState struct {
+	Service  string    `json:"service,omitempty"`
+	Name     string    `json:"name"`
+	GetTopic string    `json:"getTopic"`
+	SetTopic string    `json:"setTopic"`
+	ReadOnly bool      `json:"readOnly,omitempty"`
+	Value    *string   `json:"value"`
+	Updated  time.Time `json:"updated"`
+}
+
+// State returns a copy of the device and the current values of its features.
+func (d *Device) State() DeviceState {
+	d.RLock()
+	defer d.RUnlock()
+	s := DeviceState{
+		Topic:        d.Topic,
+		Name:         d.Name,
+		Manufacturer: d.Manufacturer,
+		Model:        d.Model,
+		SerialNumber: d.SerialNumber,
+		Type:         d.Type,
+		Reachable:    d.Reachable,
+		LastSeen:     d.LastSeen,
+		Features:     map[string]FeatureState{},
+	}
+	d.forEachFeature(func(svc *Service, name string, ft *Feature) {
+		fs := FeatureState{
+			Name:     name,
+			GetTopic: ft.GetTopic,
+			SetTopic: ft.SetTopic,
+			ReadOnly: ft.ReadOnly,
+			Updated:  ft.updated,
+		}
+		if svc != nil {
+			fs.Service = svc.ID
+		}
+		if ft.value != nil {
+			v := string(ft.value)
+			fs.Value = &v
+		}
+		s.Features[FeatureKey(svc, name)] = fs
+	})
+	return s
+}
+
+// Snapshot returns the state of every device known to the manager, sorted
+// by topic.
+func (m *Manager) Snapshot() []DeviceState {
+	m.RLock()
+	defer m.RUnlock()
+	states := make([]DeviceState, 0, len(m.devices))
+	for _, d := range m.devices {
+		states = append(states, d.State())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Topic < states[j].Topic
+	})
+	return states
+}
@@ -0,0 +1,77 @@
+package device
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Store persists the devices known to a Manager so that they are available
+// immediately after a restart, before the devices have announced again.
+type Store interface {
+	Load() ([]*Record, error)
+	Save([]*Record) error
+}
+
+// Record is the persisted state of a single device.
+type Record struct {
+	Topic     string          `json:"topic"`
+	Meta      json.RawMessage `json:"meta"`
+	Reachable bool            `json:"reachable"`
+	LastSeen  time.Time       `json:"lastSeen"`
+	// Payloads holds the last payload received on every GetTopic of the
+	// device, keyed by topic
+	Payloads map[string]*Payload `json:"payloads,omitempty"`
+}
+
+// Payload is a message received on one of a device's topics.
+type Payload struct {
+	Data     []byte    `json:"data"`
+	Received time.Time `json:"received"`
+}
+
+// FileStore is a Store that keeps all records in a single JSON file.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a FileStore writing to the file at path. The file
+// is created on the first save.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load returns the records in the file, or none if it doesn't exist yet.
+func (s *FileStore) Load() ([]*Record, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	if err = json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Save replaces the contents of the file with records. It writes to a
+// temporary file first so that a crash can't leave a truncated file behind.
+func (s *FileStore) Save(records []*Record) error {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
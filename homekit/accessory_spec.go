@@ -0,0 +1,165 @@
+package homekit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hemtjanst/hemtjanst/device"
+)
+
+// accessorySpec records the parts of a device's metadata an accessory was
+// built from. It is a copy, so that when a device is announced again it can
+// be compared to what is currently exposed over HomeKit.
+type accessorySpec struct {
+	info     string
+	snapshot string
+	services map[string]serviceSpec
+	features map[string]featureSpec
+}
+
+type serviceSpec struct {
+	Type       string
+	Primary    bool
+	Hidden     bool
+	Linked     string
+	LabelIndex int
+}
+
+type featureSpec struct {
+	Min            int
+	Max            int
+	Step           int
+	BoolStyle      string
+	Transform      string
+	Encoding       string
+	ReadOnly       bool
+	WriteOnly      bool
+	Hidden         bool
+	Notify         bool
+	Characteristic string
+}
+
+// accessoryDiff lists what changed between two accessorySpecs. Features are
+// identified by their device.FeatureKey.
+type accessoryDiff struct {
+	// Identity is whether the key the IDs are stored under changed
+	Identity bool
+	Info     bool
+	Services bool
+	Added    []string
+	Removed  []string
+	Changed  []string
+}
+
+func newAccessorySpec(d *device.Device) accessorySpec {
+	d.RLock()
+	spec := accessorySpec{
+		info:     strings.Join([]string{d.Name, d.Manufacturer, d.Model, d.SerialNumber}, "\x00"),
+		services: map[string]serviceSpec{"": {Type: strings.ToLower(d.Type)}},
+		features: map[string]featureSpec{},
+	}
+	if d.Snapshot != nil {
+		snapshot, _ := json.Marshal(d.Snapshot)
+		spec.snapshot = string(snapshot)
+	}
+	for _, s := range d.Services {
+		spec.services[s.ID] = serviceSpec{
+			Type:       strings.ToLower(s.Type),
+			Primary:    s.Primary,
+			Hidden:     s.Hidden,
+			Linked:     strings.Join(s.Linked, ","),
+			LabelIndex: s.LabelIndex,
+		}
+	}
+	d.RUnlock()
+
+	d.ForEachFeature(func(svc *device.Service, name string, ft *device.Feature) {
+		var transform, custom []byte
+		if ft.Transform != nil {
+			transform, _ = json.Marshal(ft.Transform)
+		}
+		if ft.Characteristic != nil {
+			custom, _ = json.Marshal(ft.Characteristic)
+		}
+		spec.features[device.FeatureKey(svc, name)] = featureSpec{
+			Min:            ft.Min,
+			Max:            ft.Max,
+			Step:           ft.Step,
+			BoolStyle:      ft.BoolStyle,
+			Transform:      string(transform),
+			Encoding:       ft.Encoding,
+			ReadOnly:       ft.ReadOnly,
+			WriteOnly:      ft.WriteOnly,
+			Hidden:         ft.Hidden,
+			Notify:         ft.Notifies(),
+			Characteristic: string(custom),
+		}
+	})
+	return spec
+}
+
+// diff returns the changes needed to go from s to other.
+func (s accessorySpec) diff(other accessorySpec) accessoryDiff {
+	d := accessoryDiff{
+		Info: s.info != other.info,
+	}
+
+	if len(s.services) != len(other.services) || s.snapshot != other.snapshot {
+		d.Services = true
+	}
+	for id, svc := range s.services {
+		if o, ok := other.services[id]; !ok || o != svc {
+			d.Services = true
+		}
+	}
+
+	for key, ft := range s.features {
+		o, ok := other.features[key]
+		if !ok {
+			d.Removed = append(d.Removed, key)
+		} else if o != ft {
+			d.Changed = append(d.Changed, key)
+		}
+	}
+	for key := range other.features {
+		if _, ok := s.features[key]; !ok {
+			d.Added = append(d.Added, key)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+	return d
+}
+
+func (d accessoryDiff) empty() bool {
+	return !d.Identity && !d.Info && !d.Services && len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d accessoryDiff) String() string {
+	var parts []string
+	if d.Identity {
+		parts = append(parts, "identity changed")
+	}
+	if d.Info {
+		parts = append(parts, "info changed")
+	}
+	if d.Services {
+		parts = append(parts, "services changed")
+	}
+	if len(d.Added) > 0 {
+		parts = append(parts, fmt.Sprintf("added %s", strings.Join(d.Added, ", ")))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, fmt.Sprintf("removed %s", strings.Join(d.Removed, ", ")))
+	}
+	if len(d.Changed) > 0 {
+		parts = append(parts, fmt.Sprintf("changed %s", strings.Join(d.Changed, ", ")))
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
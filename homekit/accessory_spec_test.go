@@ -0,0 +1,62 @@
+package homekit
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hemtjanst/hemtjanst/device"
+	"github.com/hemtjanst/hemtjanst/messaging"
+)
+
+func newTestDevice(t *testing.T, meta string) *device.Device {
+	d := device.NewDevice("light/test", &messaging.TestingMessenger{})
+	if err := d.UnmarshalJSON([]byte(meta)); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestAccessorySpecDiff(t *testing.T) {
+	old := newAccessorySpec(newTestDevice(t, `{
+		"name": "light",
+		"type": "lightbulb",
+		"feature": {"on": {}, "brightness": {"max": 100}, "hue": {}}
+	}`))
+
+	same := newAccessorySpec(newTestDevice(t, `{
+		"name": "light",
+		"type": "lightbulb",
+		"feature": {"on": {}, "brightness": {"max": 100}, "hue": {}}
+	}`))
+	if d := old.diff(same); !d.empty() {
+		t.Error("Expected no changes, got ", d)
+	}
+
+	changed := newAccessorySpec(newTestDevice(t, `{
+		"name": "light",
+		"type": "lightbulb",
+		"feature": {"on": {}, "brightness": {"max": 255}, "saturation": {}}
+	}`))
+	d := old.diff(changed)
+	if d.Info || d.Services {
+		t.Error("Expected only feature changes, got ", d)
+	}
+	if !reflect.DeepEqual(d.Added, []string{"saturation"}) {
+		t.Error("Expected saturation to be added, got ", d.Added)
+	}
+	if !reflect.DeepEqual(d.Removed, []string{"hue"}) {
+		t.Error("Expected hue to be removed, got ", d.Removed)
+	}
+	if !reflect.DeepEqual(d.Changed, []string{"brightness"}) {
+		t.Error("Expected brightness to be changed, got ", d.Changed)
+	}
+
+	retyped := newAccessorySpec(newTestDevice(t, `{
+		"name": "light",
+		"type": "switch",
+		"feature": {"on": {}, "brightness": {"max": 100}, "hue": {}}
+	}`))
+	if d := old.diff(retyped); !d.Services {
+		t.Error("Expected a service change, got ", d)
+	}
+}
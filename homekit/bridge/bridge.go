@@ -2,6 +2,8 @@ package bridge
 
 import (
 	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
 	"github.com/hemtjanst/hemtjanst/homekit/util"
 )
 
@@ -12,11 +14,27 @@ type Bridge interface {
 	ReplaceAccessory(old, new *accessory.Accessory)
 	Start()
 	Stop()
+
+	// SetupURI returns the X-HM:// URI encoded in the setup QR code
+	SetupURI() (string, error)
+	// Pairings returns the controllers paired with the bridge
+	Pairings() ([]Pairing, error)
+	// RemovePairing removes the pairing with a controller
+	RemovePairing(id string) error
+	// ResetPairings removes all pairings, making the bridge discoverable
+	// again. Accessory IDs are kept.
+	ResetPairings() error
+	// IDs returns the map of IDs of the accessories on the bridge
+	IDs() *IDMap
+	// HandleSnapshots makes fn answer HomeKit's requests for camera
+	// snapshots of the accessories on the bridge
+	HandleSnapshots(fn SnapshotFunc)
 }
 
 type bridge struct {
 	*accessory.Accessory
 	transport *ipTransport
+	ids       *IDMap
 }
 
 // NewBridge creates a new bridge
@@ -27,6 +45,7 @@ func NewBridge(config Config, info accessory.Info) (_ Bridge, err error) {
 	if err != nil {
 		return
 	}
+	acc.ids = NewIDMap(acc.transport.storage)
 
 	return acc, nil
 }
@@ -37,7 +56,9 @@ func (b *bridge) AddAccessory(a *accessory.Accessory) {
 
 	if b.transport != nil {
 		id := a.ID
+		restore := preserveIDs(a)
 		b.transport.addAccessory(a)
+		restore()
 		if id > 0 {
 			a.ID = id
 		}
@@ -64,13 +85,70 @@ func (b *bridge) ReplaceAccessory(old, new *accessory.Accessory) {
 	if new.ID > 0 {
 		id = new.ID
 	}
+	// The container never forgets the ID of a removed accessory, so add
+	// the new one without an ID and restore it afterwards
+	new.ID = 0
+	restore := preserveIDs(new)
 	b.transport.addAccessory(new)
+	restore()
 	if id > 0 {
 		new.ID = id
 	}
 	b.transport.updateConfig()
 }
 
+// preserveIDs remembers the service and characteristic IDs of the accessory.
+// The container renumbers them when an accessory is added, calling the
+// returned function puts back all IDs that were set beforehand.
+func preserveIDs(a *accessory.Accessory) func() {
+	svcIDs := map[*service.Service]uint64{}
+	chIDs := map[*characteristic.Characteristic]uint64{}
+	for _, s := range a.GetServices() {
+		svcIDs[s] = s.ID
+		for _, c := range s.GetCharacteristics() {
+			chIDs[c] = c.ID
+		}
+	}
+	return func() {
+		for s, id := range svcIDs {
+			if id > 0 {
+				s.ID = id
+			}
+		}
+		for c, id := range chIDs {
+			if id > 0 {
+				c.ID = id
+			}
+		}
+	}
+}
+
+func (b *bridge) SetupURI() (string, error) {
+	return b.transport.XHMURI()
+}
+
+func (b *bridge) Pairings() ([]Pairing, error) {
+	return b.transport.pairings()
+}
+
+func (b *bridge) RemovePairing(id string) error {
+	return b.transport.removePairing(id)
+}
+
+func (b *bridge) ResetPairings() error {
+	return b.transport.resetPairings()
+}
+
+func (b *bridge) IDs() *IDMap {
+	return b.ids
+}
+
+func (b *bridge) HandleSnapshots(fn SnapshotFunc) {
+	b.transport.mutex.Lock()
+	defer b.transport.mutex.Unlock()
+	b.transport.CameraSnapshotReq = fn
+}
+
 func (b *bridge) Start() {
 	b.transport.Start()
 }
@@ -59,6 +59,20 @@ func defaultConfig(name string) *Config {
 	}
 }
 
+// checkSetupId returns an error unless id consists of 4 digits or uppercase
+// letters, which is what fits in the setup URI.
+func checkSetupId(id string) error {
+	if len(id) != 4 {
+		return fmt.Errorf("invalid setup id %q: must be 4 characters", id)
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9') && !(r >= 'A' && r <= 'Z') {
+			return fmt.Errorf("invalid setup id %q: must only contain 0-9 and A-Z", id)
+		}
+	}
+	return nil
+}
+
 // txtRecords returns the config formatted as mDNS txt records
 func (cfg Config) txtRecords() map[string]string {
 	return map[string]string{
@@ -110,7 +124,7 @@ func (cfg *Config) save(storage util.Storage) {
 	storage.Set("configHash", []byte(cfg.configHash))
 }
 
-// merge updates the StoragePath, Pin, Port and IP fields of the receiver from other.
+// merge updates the StoragePath, Pin, SetupId, Port and IP fields of the receiver from other.
 func (cfg *Config) merge(other Config) {
 	if dir := other.StoragePath; len(dir) > 0 {
 		cfg.StoragePath = dir
@@ -120,6 +134,10 @@ func (cfg *Config) merge(other Config) {
 		cfg.Pin = pin
 	}
 
+	if id := other.SetupId; len(id) > 0 {
+		cfg.SetupId = id
+	}
+
 	if port := other.Port; len(port) > 0 {
 		cfg.Port = ":" + port
 	}
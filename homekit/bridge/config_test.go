@@ -0,0 +1,31 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/util"
+)
+
+func TestXHMURI(t *testing.T) {
+	// The payload is the pin with the IP flag and bridge category in base36,
+	// as computed by HAP-NodeJS for the same pin and setup ID
+	for _, tt := range []struct {
+		pin, setupID, exp string
+	}{
+		{"00102003", "HOME", "X-HM://0023GZQSZHOME"},
+		{"03145154", "1QJ8", "X-HM://0023ISYWY1QJ8"},
+	} {
+		cfg := defaultConfig("test")
+		cfg.Pin = tt.pin
+		cfg.SetupId = tt.setupID
+		cfg.categoryId = uint8(accessory.TypeBridge)
+		got, err := cfg.XHMURI(util.SetupFlagIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.exp {
+			t.Errorf("Expected %s for pin %s, got %s", tt.exp, tt.pin, got)
+		}
+	}
+}
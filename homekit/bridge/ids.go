@@ -0,0 +1,134 @@
+package bridge
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/brutella/hc/log"
+	"github.com/brutella/hc/util"
+)
+
+// idsKey is the storage key for the ID map.
+const idsKey = "ids"
+
+// IDMap hands out the IDs HomeKit knows accessories, services and
+// characteristics by, and remembers them in the bridge's storage so they
+// stay the same across restarts.
+//
+// Accessories are identified by a key, usually their topic. Services and
+// characteristics are identified by an instance key that's unique within
+// their accessory. Every ID is allocated as the preferred ID asked for,
+// unless another key already has it.
+type IDMap struct {
+	storage util.Storage
+	mutex   sync.Mutex
+	ids     map[string]*accessoryIDs
+}
+
+type accessoryIDs struct {
+	ID        uint64            `json:"id"`
+	Instances map[string]uint64 `json:"instances"`
+}
+
+// NewIDMap returns the ID map stored in storage. If storage is nil the IDs
+// are only kept in memory.
+func NewIDMap(storage util.Storage) *IDMap {
+	m := &IDMap{storage: storage, ids: map[string]*accessoryIDs{}}
+	if storage == nil {
+		return m
+	}
+	if b, err := storage.Get(idsKey); err == nil {
+		if err := json.Unmarshal(b, &m.ids); err != nil {
+			log.Info.Println("Could not read accessory IDs, allocating new ones:", err)
+			m.ids = map[string]*accessoryIDs{}
+		}
+	}
+	return m
+}
+
+func (m *IDMap) save() {
+	if m.storage == nil {
+		return
+	}
+	b, err := json.Marshal(m.ids)
+	if err == nil {
+		err = store(m.storage, idsKey, b)
+	}
+	if err != nil {
+		log.Info.Println("Could not save accessory IDs:", err)
+	}
+}
+
+// Accessory returns the ID of the accessory with the given key. An
+// accessory that's new to the map takes over the IDs of the first of the
+// previous keys that's known, which allows a device to move to another key
+// while keeping its identity.
+func (m *IDMap) Accessory(key string, preferred uint64, previous ...string) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if a, ok := m.ids[key]; ok {
+		return a.ID
+	}
+	for _, p := range previous {
+		if a, ok := m.ids[p]; ok && p != "" && p != key {
+			log.Info.Printf("Moving accessory IDs from %s to %s", p, key)
+			delete(m.ids, p)
+			m.ids[key] = a
+			m.save()
+			return a.ID
+		}
+	}
+
+	used := map[uint64]bool{}
+	for _, a := range m.ids {
+		used[a.ID] = true
+	}
+	// 1 is the bridge itself
+	id := preferred
+	if id <= 1 {
+		id = 2
+	}
+	for used[id] {
+		id++
+	}
+	if id != preferred {
+		log.Info.Printf("Accessory ID %d of %s is taken, using %d", preferred, key, id)
+	}
+	m.ids[key] = &accessoryIDs{ID: id, Instances: map[string]uint64{}}
+	m.save()
+	return id
+}
+
+// Instance returns the ID of the service or characteristic with the given
+// instance key on the accessory with the given key. The accessory must have
+// been allocated an ID with Accessory first.
+func (m *IDMap) Instance(key, instance string, preferred uint64) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	a, ok := m.ids[key]
+	if !ok {
+		a = &accessoryIDs{Instances: map[string]uint64{}}
+		m.ids[key] = a
+	}
+	if id, ok := a.Instances[instance]; ok {
+		return id
+	}
+
+	used := map[uint64]bool{}
+	for _, id := range a.Instances {
+		used[id] = true
+	}
+	id := preferred
+	if id == 0 {
+		id = 1
+	}
+	for used[id] {
+		id++
+	}
+	if id != preferred && preferred != 0 {
+		log.Info.Printf("Instance ID %d of %s on %s is taken, using %d", preferred, instance, key, id)
+	}
+	a.Instances[instance] = id
+	m.save()
+	return id
+}
@@ -0,0 +1,49 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/brutella/hc/util"
+)
+
+func TestIDMap(t *testing.T) {
+	storage, err := util.NewTempFileStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewIDMap(storage)
+
+	if id := m.Accessory("light/a", 5); id != 5 {
+		t.Errorf("Expected preferred ID 5, got %d", id)
+	}
+	if id := m.Accessory("light/b", 5); id != 6 {
+		t.Errorf("Expected colliding ID to become 6, got %d", id)
+	}
+	if id := m.Accessory("light/c", 1); id != 2 {
+		t.Errorf("Expected ID of the bridge to be skipped, got %d", id)
+	}
+	if id := m.Instance("light/a", "service/1", 10); id != 10 {
+		t.Errorf("Expected preferred instance ID 10, got %d", id)
+	}
+	if id := m.Instance("light/a", "service/2", 10); id != 11 {
+		t.Errorf("Expected second service of the same type to get 11, got %d", id)
+	}
+	if id := m.Instance("light/b", "service/2", 10); id != 10 {
+		t.Errorf("Expected instance IDs to be per accessory, got %d", id)
+	}
+
+	// IDs survive a restart and move along with a device
+	m = NewIDMap(storage)
+	if id := m.Accessory("light/b", 7); id != 6 {
+		t.Errorf("Expected stored ID 6, got %d", id)
+	}
+	if id := m.Accessory("lamp/a", 9, "light/a"); id != 5 {
+		t.Errorf("Expected ID 5 to move to the new key, got %d", id)
+	}
+	if id := m.Instance("lamp/a", "service/2", 3); id != 11 {
+		t.Errorf("Expected instance IDs to move to the new key, got %d", id)
+	}
+	if id := m.Accessory("light/a", 5); id != 7 {
+		t.Errorf("Expected the old key to get a new ID, got %d", id)
+	}
+}
@@ -3,7 +3,6 @@ package bridge
 import (
 	"bytes"
 	"context"
-	"image"
 	"io/ioutil"
 	"net"
 	"sync"
@@ -15,7 +14,6 @@ import (
 	"github.com/brutella/hc/db"
 	"github.com/brutella/hc/event"
 	"github.com/brutella/hc/hap"
-	"github.com/brutella/hc/hap/endpoint"
 	"github.com/brutella/hc/hap/http"
 	"github.com/brutella/hc/log"
 	"github.com/brutella/hc/util"
@@ -23,7 +21,8 @@ import (
 )
 
 type ipTransport struct {
-	CameraSnapshotReq func(width, height uint) (*image.Image, error)
+	// CameraSnapshotReq returns the snapshots requested from /resource
+	CameraSnapshotReq SnapshotFunc
 
 	config  *Config
 	context hap.Context
@@ -31,7 +30,7 @@ type ipTransport struct {
 	mutex   *sync.Mutex
 
 	storage  util.Storage
-	database db.Database
+	database *pairingDatabase
 
 	device    hap.SecuredDevice
 	container *accessory.Container
@@ -73,20 +72,22 @@ func NewIPTransport(config Config, a *accessory.Accessory, as ...*accessory.Acce
 
 	cfg := defaultConfig(name)
 	cfg.merge(config)
+	if err := checkSetupId(cfg.SetupId); err != nil {
+		return nil, err
+	}
 
 	storage, err := util.NewFileStorage(cfg.StoragePath)
 	if err != nil {
 		return nil, err
 	}
 
-	database := db.NewDatabaseWithStorage(storage)
-
 	hap_pin, err := NewPin(cfg.Pin)
 	if err != nil {
 		return nil, err
 	}
 
 	cfg.load(storage)
+	database := newPairingDatabase(db.NewDatabaseWithStorage(storage), storage, cfg.id)
 
 	device, err := hap.NewSecuredDevice(cfg.id, hap_pin, database)
 	if err != nil {
@@ -151,9 +152,8 @@ func (t *ipTransport) Start() {
 	s := http.NewServer(config)
 	t.server = s
 
-	if t.CameraSnapshotReq != nil {
-		t.server.Mux.Handle("/resource", endpoint.NewResource(t.context, t.CameraSnapshotReq))
-	}
+	t.server.Mux.Handle("/resource", &resource{transport: t})
+	t.server.Mux = t.database.recordPermissions(t.server.Mux)
 
 	// Publish server port which might be different then `t.config.Port`
 	t.config.servePort = int(to.Int64(s.Port()))
@@ -223,6 +223,33 @@ func (t *ipTransport) isPaired() bool {
 	return false
 }
 
+func (t *ipTransport) pairings() ([]Pairing, error) {
+	return t.database.Pairings()
+}
+
+func (t *ipTransport) removePairing(id string) error {
+	if err := t.database.Remove(id); err != nil {
+		return err
+	}
+	log.Info.Printf("Removed pairing with %s", id)
+	t.updateMDNSReachability()
+	return nil
+}
+
+// resetPairings removes all pairings and closes the connections of the
+// controllers, the bridge becomes discoverable again.
+func (t *ipTransport) resetPairings() error {
+	if err := t.database.Reset(); err != nil {
+		return err
+	}
+	log.Info.Println("Removed all pairings")
+	for _, conn := range t.context.ActiveConnections() {
+		conn.Close()
+	}
+	t.updateMDNSReachability()
+	return nil
+}
+
 func (t *ipTransport) updateMDNSReachability() {
 	t.config.discoverable = t.isPaired() == false
 	if t.handle != nil {
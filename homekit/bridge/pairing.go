@@ -0,0 +1,219 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/hap/pair"
+	"github.com/brutella/hc/log"
+	"github.com/brutella/hc/util"
+)
+
+// Pairing is a controller, like an iOS device, paired with the bridge.
+//
+// hc doesn't keep the permissions of controllers, so they're recorded from
+// the requests that pair them: the controller the bridge is set up with is
+// an admin, the ones added to the home later on get the permissions the
+// admin adding them asked for. Admin and Paired are only known for
+// controllers paired since hemtjanst started recording them, Admin is nil
+// otherwise.
+type Pairing struct {
+	ID     string    `json:"id"`
+	Admin  *bool     `json:"admin,omitempty"`
+	Paired time.Time `json:"paired"`
+}
+
+// pairingsKey is the storage key for the details about pairings.
+const pairingsKey = "pairings"
+
+// pairingAdmin is the permission of admin controllers in /pairings
+// requests.
+const pairingAdmin = 0x01
+
+// pairingDatabase wraps the database hc stores the keys of controllers in,
+// to record when they were paired and whether they're admins.
+type pairingDatabase struct {
+	db.Database
+	storage util.Storage
+	// id is the name of the bridge's own entity
+	id string
+	// adding holds the permissions of the controllers being added through
+	// /pairings, by their name
+	adding map[string]bool
+	mutex  sync.Mutex
+}
+
+func newPairingDatabase(database db.Database, storage util.Storage, id string) *pairingDatabase {
+	return &pairingDatabase{Database: database, storage: storage, id: id, adding: map[string]bool{}}
+}
+
+func (d *pairingDatabase) details() map[string]Pairing {
+	details := map[string]Pairing{}
+	if b, err := d.storage.Get(pairingsKey); err == nil {
+		if err := json.Unmarshal(b, &details); err != nil {
+			log.Info.Println("Could not read pairing details:", err)
+		}
+	}
+	return details
+}
+
+func (d *pairingDatabase) saveDetails(details map[string]Pairing) error {
+	b, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	return store(d.storage, pairingsKey, b)
+}
+
+// store sets key to value in storage. hc's file storage doesn't truncate
+// the file it writes to, so the key is deleted first to not leave the end
+// of a longer value behind.
+func store(storage util.Storage, key string, value []byte) error {
+	storage.Delete(key)
+	return storage.Set(key, value)
+}
+
+// SaveEntity saves the entity, recording when a controller was paired and
+// whether it's an admin. Controllers not being added through /pairings went
+// through pair setup, which makes them admins.
+func (d *pairingDatabase) SaveEntity(e db.Entity) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if e.Name == d.id {
+		return d.Database.SaveEntity(e)
+	}
+
+	admin, ok := d.adding[e.Name]
+	if !ok {
+		admin = true
+	}
+	details := d.details()
+	p, ok := details[e.Name]
+	if !ok {
+		p = Pairing{ID: e.Name, Paired: time.Now()}
+	}
+	// Adding a controller that's already paired changes its permissions
+	p.Admin = &admin
+	details[e.Name] = p
+	if err := d.saveDetails(details); err != nil {
+		log.Info.Println("Could not save pairing details:", err)
+	}
+	return d.Database.SaveEntity(e)
+}
+
+// recordPermissions returns a handler for the HAP server that passes every
+// request on to mux, after noting the permissions of the controllers added
+// through /pairings for SaveEntity.
+func (d *pairingDatabase) recordPermissions(mux http.Handler) *http.ServeMux {
+	handler := http.NewServeMux()
+	handler.Handle("/", mux)
+	handler.HandleFunc("/pairings", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		in, err := util.NewTLV8ContainerFromReader(bytes.NewReader(body))
+		if err != nil || pair.PairMethodType(in.GetByte(pair.TagPairingMethod)) != pair.PairingMethodAdd {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		name := in.GetString(pair.TagUsername)
+		d.mutex.Lock()
+		d.adding[name] = in.GetByte(pair.TagPermission) == pairingAdmin
+		d.mutex.Unlock()
+		mux.ServeHTTP(w, r)
+		d.mutex.Lock()
+		delete(d.adding, name)
+		d.mutex.Unlock()
+	})
+	return handler
+}
+
+func (d *pairingDatabase) DeleteEntity(e db.Entity) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.delete(e)
+}
+
+func (d *pairingDatabase) delete(e db.Entity) {
+	d.Database.DeleteEntity(e)
+	if e.Name == d.id {
+		return
+	}
+	details := d.details()
+	if _, ok := details[e.Name]; ok {
+		delete(details, e.Name)
+		if err := d.saveDetails(details); err != nil {
+			log.Info.Println("Could not save pairing details:", err)
+		}
+	}
+}
+
+// Pairings returns the paired controllers, which are all entities except
+// for the bridge itself.
+func (d *pairingDatabase) Pairings() ([]Pairing, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.list()
+}
+
+func (d *pairingDatabase) list() ([]Pairing, error) {
+	es, err := d.Database.Entities()
+	if err != nil {
+		return nil, err
+	}
+	details := d.details()
+	ps := []Pairing{}
+	for _, e := range es {
+		if e.Name == d.id {
+			continue
+		}
+		p, ok := details[e.Name]
+		if !ok {
+			p = Pairing{ID: e.Name}
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// Remove removes the pairing with the controller with the given id.
+func (d *pairingDatabase) Remove(id string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if id == d.id {
+		return fmt.Errorf("unknown pairing %s", id)
+	}
+	e, err := d.Database.EntityWithName(id)
+	if err != nil {
+		return fmt.Errorf("unknown pairing %s", id)
+	}
+	d.delete(e)
+	return nil
+}
+
+// Reset removes the pairings with all controllers. The keys of the bridge
+// itself are kept.
+func (d *pairingDatabase) Reset() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	es, err := d.Database.Entities()
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		if e.Name != d.id {
+			d.Database.DeleteEntity(e)
+		}
+	}
+	return d.saveDetails(map[string]Pairing{})
+}
@@ -0,0 +1,92 @@
+package bridge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/event"
+	"github.com/brutella/hc/hap/endpoint"
+	"github.com/brutella/hc/hap/pair"
+	"github.com/brutella/hc/util"
+)
+
+func TestPairingDatabase(t *testing.T) {
+	storage, err := util.NewTempFileStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newPairingDatabase(db.NewDatabaseWithStorage(storage), storage, "bridge")
+	d.SaveEntity(db.NewEntity("bridge", []byte{1}, []byte{2}))
+
+	ps, _ := d.Pairings()
+	if len(ps) != 0 {
+		t.Fatalf("Expected no pairings, got %+v", ps)
+	}
+
+	// The first controller goes through pair setup, which saves it directly,
+	// and adds the next one through /pairings
+	d.SaveEntity(db.NewEntity("setup", []byte{3}, nil))
+	mux := http.NewServeMux()
+	mux.Handle("/pairings", endpoint.NewPairing(pair.NewPairingController(d), event.NewEmitter()))
+	handler := d.recordPermissions(mux)
+	addPairing := func(name string, permission byte) {
+		in := util.NewTLV8Container()
+		in.SetByte(pair.TagPairingMethod, byte(pair.PairingMethodAdd))
+		in.SetString(pair.TagUsername, name)
+		in.SetBytes(pair.TagPublicKey, []byte{4})
+		in.SetByte(pair.TagPermission, permission)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/pairings", in.BytesBuffer()))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Could not add pairing %s: %d", name, rec.Code)
+		}
+	}
+	addPairing("added", 0)
+
+	admins := func() map[string]bool {
+		ps, _ := d.Pairings()
+		admins := map[string]bool{}
+		for _, p := range ps {
+			if p.Paired.IsZero() || p.Admin == nil {
+				t.Errorf("Expected pairing time and permissions for %s", p.ID)
+				continue
+			}
+			admins[p.ID] = *p.Admin
+		}
+		return admins
+	}
+	if a := admins(); len(a) != 2 || !a["setup"] || a["added"] {
+		t.Errorf("Expected setup to be admin and added not, got %v", a)
+	}
+	addPairing("added", pairingAdmin)
+	if a := admins(); len(a) != 2 || !a["added"] {
+		t.Errorf("Expected added to be made admin, got %v", a)
+	}
+
+	if err := d.Remove("added"); err != nil {
+		t.Error(err)
+	}
+	if err := d.Remove("bridge"); err == nil {
+		t.Error("Expected an error when removing the bridge itself")
+	}
+	if err := d.Remove("unknown"); err == nil {
+		t.Error("Expected an error when removing an unknown pairing")
+	}
+	ps, _ = d.Pairings()
+	if len(ps) != 1 || ps[0].ID != "setup" {
+		t.Errorf("Expected only setup to be left, got %+v", ps)
+	}
+
+	if err := d.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	ps, _ = d.Pairings()
+	if len(ps) != 0 {
+		t.Errorf("Expected no pairings after reset, got %+v", ps)
+	}
+	if _, err := d.EntityWithName("bridge"); err != nil {
+		t.Error("Expected the bridge's own keys to be kept: ", err)
+	}
+}
@@ -0,0 +1,81 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/brutella/hc/hap"
+	"github.com/brutella/hc/log"
+)
+
+// ErrNoSnapshot is returned by a SnapshotFunc for accessories that aren't
+// cameras.
+var ErrNoSnapshot = errors.New("accessory has no snapshots")
+
+// SnapshotFunc returns a JPEG image of about width by height pixels taken by
+// the camera with accessory ID aid.
+type SnapshotFunc func(aid uint64, width, height uint) ([]byte, error)
+
+// resourceRequest is the body of a request for a resource. Unlike the one
+// hc handles it includes the accessory ID, so a bridge can have several
+// cameras.
+type resourceRequest struct {
+	Type   string `json:"resource-type"`
+	AID    uint64 `json:"aid"`
+	Width  uint   `json:"image-width"`
+	Height uint   `json:"image-height"`
+}
+
+// resource handles the /resource endpoint, which HomeKit requests camera
+// snapshots from.
+type resource struct {
+	transport *ipTransport
+}
+
+func (r *resource) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != hap.MethodPOST {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var rr resourceRequest
+	if err := json.Unmarshal(body, &rr); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if rr.Type != "image" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	r.transport.mutex.Lock()
+	snapshot := r.transport.CameraSnapshotReq
+	r.transport.mutex.Unlock()
+	if snapshot == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if rr.AID == 0 {
+		// Requests without an accessory ID are for the bridge itself,
+		// which isn't a camera
+		rr.AID = 1
+	}
+	b, err := snapshot(rr.AID, rr.Width, rr.Height)
+	if err == ErrNoSnapshot {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Info.Printf("Could not get a snapshot of accessory %d: %s", rr.AID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	hap.NewChunkedWriter(w, 2048).Write(b)
+}
@@ -0,0 +1,41 @@
+package bridge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestResource(t *testing.T) {
+	var aid uint64
+	r := &resource{transport: &ipTransport{mutex: &sync.Mutex{}}}
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("POST", "/resource", strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := post(`{"resource-type": "image", "aid": 3}`); rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 without snapshots, got ", rec.Code)
+	}
+
+	r.transport.CameraSnapshotReq = func(id uint64, width, height uint) ([]byte, error) {
+		aid = id
+		if id != 3 {
+			return nil, ErrNoSnapshot
+		}
+		return []byte("jpeg"), nil
+	}
+	rec := post(`{"resource-type": "image", "aid": 3, "image-width": 640, "image-height": 360}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" || aid != 3 {
+		t.Errorf("Expected a JPEG of accessory 3, got %d for %d", rec.Code, aid)
+	}
+	if rec := post(`{"resource-type": "image", "aid": 4}`); rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 for an accessory that isn't a camera, got ", rec.Code)
+	}
+	if rec := post(`{`); rec.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for an invalid request, got ", rec.Code)
+	}
+}
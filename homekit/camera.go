@@ -0,0 +1,216 @@
+package homekit
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/rtp"
+	"github.com/brutella/hc/service"
+	"github.com/brutella/hc/tlv8"
+	"github.com/hemtjanst/hemtjanst/device"
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+)
+
+// defaultSnapshotTimeout is how long to wait for a requested image when the
+// device doesn't set a timeout.
+const defaultSnapshotTimeout = 5 * time.Second
+
+// camera keeps the images a device publishes and hands them out as
+// snapshots.
+type camera struct {
+	mutex   sync.Mutex
+	device  *device.Device
+	latest  []byte
+	waiting []chan []byte
+}
+
+func newCamera(d *device.Device) *camera {
+	c := &camera{device: d}
+	c.subscribe()
+	return c
+}
+
+// update switches the camera over to a new instance of its device.
+func (c *camera) update(d *device.Device) {
+	c.mutex.Lock()
+	c.device = d
+	c.mutex.Unlock()
+	c.subscribe()
+}
+
+func (c *camera) subscribe() {
+	c.mutex.Lock()
+	d := c.device
+	c.mutex.Unlock()
+	if err := d.OnSnapshot(c.received); err != nil {
+		log.Printf("Could not subscribe to snapshots of %s: %s", d.Topic, err)
+	}
+}
+
+func (c *camera) received(image []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.latest = image
+	for _, ch := range c.waiting {
+		ch <- image
+	}
+	c.waiting = nil
+}
+
+// snapshot returns an image of at most width by height pixels. If the
+// device takes images on request it's asked for a new one, otherwise, or
+// when it doesn't respond in time, the latest image is used.
+func (c *camera) snapshot(width, height uint) ([]byte, error) {
+	c.mutex.Lock()
+	d := c.device
+	img := c.latest
+	var wait chan []byte
+	if d.Snapshot.RequestTopic != "" {
+		wait = make(chan []byte, 1)
+		c.waiting = append(c.waiting, wait)
+	}
+	c.mutex.Unlock()
+
+	if wait != nil {
+		timeout := defaultSnapshotTimeout
+		if d.Snapshot.Timeout > 0 {
+			timeout = time.Duration(d.Snapshot.Timeout) * time.Second
+		}
+		if err := d.RequestSnapshot(width, height); err != nil {
+			return nil, err
+		}
+		select {
+		case img = <-wait:
+		case <-time.After(timeout):
+			log.Printf("No snapshot from %s within %s, using the latest one", d.Topic, timeout)
+			c.forget(wait)
+		}
+	}
+	if img == nil {
+		return nil, errors.New("no image received yet")
+	}
+	return scaleJPEG(img, width, height)
+}
+
+// forget stops waiting on wait for a new image.
+func (c *camera) forget(wait chan []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, ch := range c.waiting {
+		if ch == wait {
+			c.waiting = append(c.waiting[:i], c.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// newStreamManagement returns the service that makes HomeKit treat an
+// accessory as a camera. Only snapshots are supported, so it's never
+// available for streaming.
+func newStreamManagement() *service.Service {
+	svc := service.NewCameraRTPStreamManagement()
+	if b, err := tlv8.Marshal(rtp.DefaultVideoStreamConfiguration()); err == nil {
+		svc.SupportedVideoStreamConfiguration.SetValue(b)
+	}
+	if b, err := tlv8.Marshal(rtp.DefaultAudioStreamConfiguration()); err == nil {
+		svc.SupportedAudioStreamConfiguration.SetValue(b)
+	}
+	if b, err := tlv8.Marshal(rtp.NewConfiguration(rtp.CryptoSuite_AES_CM_128_HMAC_SHA1_80)); err == nil {
+		svc.SupportedRTPConfiguration.SetValue(b)
+	}
+	if b, err := tlv8.Marshal(rtp.StreamingStatus{Status: rtp.StreamingStatusUnavailable}); err == nil {
+		svc.StreamingStatus.SetValue(b)
+	}
+	return svc.Service
+}
+
+// snapshots returns the SnapshotFunc for the bridge with index i.
+func (h *Homekit) snapshots(i int) bridge.SnapshotFunc {
+	return func(aid uint64, width, height uint) ([]byte, error) {
+		h.lock.RLock()
+		var cam *camera
+		for topic, holder := range h.devices {
+			if h.assigned[topic] == i && holder.accessory != nil && holder.accessory.ID == aid {
+				cam = holder.camera
+				break
+			}
+		}
+		h.lock.RUnlock()
+		if cam == nil {
+			return nil, bridge.ErrNoSnapshot
+		}
+		return cam.snapshot(width, height)
+	}
+}
+
+// scaleJPEG scales the JPEG image b down to fit within width by height
+// pixels, keeping its aspect ratio. Images that already fit are returned as
+// they are.
+func scaleJPEG(b []byte, width, height uint) ([]byte, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 || height == 0 || (uint(cfg.Width) <= width && uint(cfg.Height) <= height) {
+		return b, nil
+	}
+	src, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	w, h := int(width), cfg.Height*int(width)/cfg.Width
+	if h > int(height) {
+		w, h = cfg.Width*int(height)/cfg.Height, int(height)
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, scale(src, w, h), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// scale shrinks src to w by h pixels, averaging the pixels that end up in
+// the same one.
+func scale(src image.Image, w, h int) image.Image {
+	sb := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := sb.Min.Y + y*sb.Dy()/h
+		y1 := sb.Min.Y + (y+1)*sb.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := sb.Min.X + x*sb.Dx()/w
+			x1 := sb.Min.X + (x+1)*sb.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, _ := src.At(sx, sy).RGBA()
+					r, g, b, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
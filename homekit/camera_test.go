@@ -0,0 +1,95 @@
+package homekit
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/hemtjanst/hemtjanst/device"
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+	"github.com/hemtjanst/hemtjanst/messaging"
+)
+
+func testJPEG(t *testing.T, w, h int) []byte {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func jpegSize(t *testing.T, b []byte) (int, int) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Width, cfg.Height
+}
+
+func TestScaleJPEG(t *testing.T) {
+	img := testJPEG(t, 400, 300)
+	out, err := scaleJPEG(img, 200, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := jpegSize(t, out); w != 200 || h != 150 {
+		t.Errorf("Expected 200x150, got %dx%d", w, h)
+	}
+	out, _ = scaleJPEG(img, 640, 480)
+	if !bytes.Equal(out, img) {
+		t.Error("Expected an image that fits to be returned as is")
+	}
+	if _, err := scaleJPEG([]byte("not an image"), 10, 10); err == nil {
+		t.Error("Expected error for an invalid image")
+	}
+}
+
+func TestCameraSnapshot(t *testing.T) {
+	m := &messaging.TestingMessenger{}
+	d := device.NewDevice("camera/door", m)
+	if err := d.UnmarshalJSON([]byte(`{"type": "doorbell", "snapshot": {"requestTopic": "camera/door/take"}, "feature": {"programmableSwitchEvent": {}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBridge()
+	h := NewHomekit(b, nil)
+	h.Updated(d)
+
+	dh := h.devices["camera/door"]
+	if dh.camera == nil || dh.accessory.Type != accessory.TypeVideoDoorbell {
+		t.Fatal("Expected a video doorbell with a camera")
+	}
+	if _, err := b.snapshots(12345, 100, 100); err != bridge.ErrNoSnapshot {
+		t.Error("Expected ErrNoSnapshot for another accessory, got ", err)
+	}
+
+	type result struct {
+		img []byte
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		img, err := b.snapshots(dh.accessory.ID, 320, 240)
+		done <- result{img, err}
+	}()
+	for waiting := 0; waiting == 0; {
+		time.Sleep(time.Millisecond)
+		dh.camera.mutex.Lock()
+		waiting = len(dh.camera.waiting)
+		dh.camera.mutex.Unlock()
+	}
+	dh.camera.received(testJPEG(t, 640, 480))
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if m.Topic[0] != "camera/door/take" || string(m.Message) != `{"height":240,"width":320}` {
+		t.Errorf("Expected a request for a snapshot, got %s on %v", m.Message, m.Topic)
+	}
+	if w, h := jpegSize(t, res.img); w != 320 || h != 240 {
+		t.Errorf("Expected 320x240, got %dx%d", w, h)
+	}
+}
@@ -0,0 +1,332 @@
+// Package codec converts between MQTT payloads and the values of HomeKit
+// characteristics, based on the characteristic's format.
+package codec
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/hemtjanst/hemtjanst/device"
+)
+
+var numberPrefix = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?`)
+
+// BoolStyle is how booleans are rendered in outgoing payloads.
+type BoolStyle struct {
+	True  string
+	False string
+}
+
+var (
+	// BoolNumeric renders booleans as 1 and 0. This is the default.
+	BoolNumeric = BoolStyle{True: "1", False: "0"}
+	// BoolText renders booleans as true and false.
+	BoolText = BoolStyle{True: "true", False: "false"}
+	// BoolOnOff renders booleans as ON and OFF.
+	BoolOnOff = BoolStyle{True: "ON", False: "OFF"}
+)
+
+// ParseBoolStyle parses a style written as "<true>/<false>", for example
+// "ON/OFF". An empty string returns BoolNumeric.
+func ParseBoolStyle(s string) (BoolStyle, error) {
+	if s == "" {
+		return BoolNumeric, nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || parts[0] == parts[1] {
+		return BoolStyle{}, fmt.Errorf("invalid bool style %q, expected <true>/<false>", s)
+	}
+	return BoolStyle{True: parts[0], False: parts[1]}, nil
+}
+
+// Codec decodes payloads into characteristic values and encodes
+// characteristic values into payloads.
+type Codec struct {
+	BoolStyle BoolStyle
+	Transform *device.Transform
+	// ValidValues, when not empty, are the only values an integer
+	// characteristic accepts
+	ValidValues []int
+	// Base64 is set when the payloads of data and TLV8 characteristics are
+	// base64 encoded, otherwise they're the raw bytes
+	Base64 bool
+}
+
+// New returns a Codec using the bool style described by style, see
+// ParseBoolStyle, and the optional transform t.
+func New(style string, t *device.Transform) (*Codec, error) {
+	bs, err := ParseBoolStyle(style)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateTransform(t); err != nil {
+		return nil, err
+	}
+	return &Codec{BoolStyle: bs, Transform: t}, nil
+}
+
+// ParseEncoding parses the encoding of the payloads of a data or TLV8
+// feature, either raw or base64, and returns whether it's base64. An empty
+// string is raw.
+func ParseEncoding(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "", "raw":
+		return false, nil
+	case "base64":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid encoding %q, expected raw or base64", s)
+}
+
+// Decode parses payload into a value matching the format of ch. Numeric
+// values are clamped to the characteristic's min and max and rounded to its
+// step. Trailing units, as in 23.5°C, are ignored.
+func (c *Codec) Decode(ch *characteristic.Characteristic, payload []byte) (interface{}, error) {
+	str := strings.TrimSpace(string(payload))
+
+	mapped, isMapped := c.lookup(str)
+	if isMapped {
+		str = mapped
+	}
+
+	switch ch.Format {
+	case characteristic.FormatBool:
+		return c.parseBool(str)
+	case characteristic.FormatFloat:
+		f, err := parseNumber(str)
+		if err != nil {
+			return nil, err
+		}
+		if !isMapped {
+			f = c.toCharacteristic(f)
+		}
+		return constrain(ch, f), nil
+	case characteristic.FormatUInt8, characteristic.FormatUInt16, characteristic.FormatUInt32,
+		characteristic.FormatUInt64, characteristic.FormatInt32:
+		f, err := parseNumber(str)
+		if err != nil {
+			if b, bErr := c.parseBool(str); bErr == nil {
+				return boolToInt(b), nil
+			}
+			return nil, err
+		}
+		if !isMapped {
+			f = c.toCharacteristic(f)
+		}
+		f = math.Round(constrain(ch, f))
+		lo, hi := formatRange(ch.Format)
+		f = math.Max(lo, math.Min(hi, f))
+		if err := c.validate(int(f)); err != nil {
+			return nil, err
+		}
+		return int(f), nil
+	case characteristic.FormatData, characteristic.FormatTLV8:
+		if !c.Base64 {
+			return base64.StdEncoding.EncodeToString(payload), nil
+		}
+		if _, err := base64.StdEncoding.DecodeString(str); err != nil {
+			return nil, fmt.Errorf("invalid base64 payload: %s", err)
+		}
+		return str, nil
+	default:
+		if isMapped {
+			return str, nil
+		}
+		return string(payload), nil
+	}
+}
+
+// Encode renders value, as received from HomeKit for ch, as a payload.
+func (c *Codec) Encode(ch *characteristic.Characteristic, value interface{}) (string, error) {
+	if f, ok := toFloat(value); ok && len(c.ValidValues) > 0 {
+		if err := c.validate(int(math.Round(f))); err != nil {
+			return "", err
+		}
+	}
+	if key, ok := c.reverseLookup(ch, value); ok {
+		return key, nil
+	}
+	if f, ok := toFloat(value); ok && c.scales() {
+		f = c.toPayload(f)
+		if ch.Format != characteristic.FormatFloat {
+			return strconv.FormatInt(int64(math.Round(f)), 10), nil
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	}
+	return c.encode(ch, value)
+}
+
+func (c *Codec) encode(ch *characteristic.Characteristic, value interface{}) (string, error) {
+	if value != nil && (ch.Format == characteristic.FormatData || ch.Format == characteristic.FormatTLV8) {
+		return c.encodeData(value)
+	}
+	switch v := value.(type) {
+	case nil:
+		return "", fmt.Errorf("no value for characteristic %s", ch.Type)
+	case bool:
+		if ch.Format != characteristic.FormatBool && ch.Format != "" {
+			return strconv.Itoa(boolToInt(v)), nil
+		}
+		if v {
+			return c.BoolStyle.True, nil
+		}
+		return c.BoolStyle.False, nil
+	case int:
+		if ch.Format == characteristic.FormatBool {
+			return c.encode(ch, v != 0)
+		}
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return c.encode(ch, float64(v))
+	case float64:
+		switch ch.Format {
+		case characteristic.FormatFloat, "":
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case characteristic.FormatBool:
+			return c.encode(ch, v != 0)
+		default:
+			return strconv.FormatInt(int64(math.Round(v)), 10), nil
+		}
+	case string:
+		return v, nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v), nil
+	default:
+		return fmt.Sprintf("%v", v), nil
+	}
+}
+
+// encodeData renders the value of a data or TLV8 characteristic, which
+// HomeKit sends base64 encoded, in the encoding of the payloads.
+func (c *Codec) encodeData(value interface{}) (string, error) {
+	var raw []byte
+	switch v := value.(type) {
+	case []byte:
+		raw = v
+	case string:
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 value: %s", err)
+		}
+		raw = b
+	default:
+		return "", fmt.Errorf("invalid data value %v", value)
+	}
+	if c.Base64 {
+		return base64.StdEncoding.EncodeToString(raw), nil
+	}
+	return string(raw), nil
+}
+
+// validate returns an error if v isn't one of the ValidValues.
+func (c *Codec) validate(v int) error {
+	if len(c.ValidValues) == 0 {
+		return nil
+	}
+	for _, valid := range c.ValidValues {
+		if v == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("%d is not one of the valid values %v", v, c.ValidValues)
+}
+
+func (c *Codec) parseBool(str string) (bool, error) {
+	switch {
+	case strings.EqualFold(str, c.BoolStyle.True):
+		return true, nil
+	case strings.EqualFold(str, c.BoolStyle.False):
+		return false, nil
+	}
+	switch strings.ToLower(str) {
+	case "1", "true", "on", "yes":
+		return true, nil
+	case "0", "false", "off", "no":
+		return false, nil
+	}
+	if f, err := parseNumber(str); err == nil {
+		return f != 0, nil
+	}
+	return false, fmt.Errorf("invalid bool %q", str)
+}
+
+// parseNumber parses the number str starts with, ignoring anything after it.
+func parseNumber(str string) (float64, error) {
+	m := numberPrefix.FindString(str)
+	if m == "" {
+		return 0, fmt.Errorf("invalid number %q", str)
+	}
+	return strconv.ParseFloat(m, 64)
+}
+
+// constrain clamps f to the min and max of ch and rounds it to the nearest
+// step, counted from min.
+func constrain(ch *characteristic.Characteristic, f float64) float64 {
+	min, hasMin := toFloat(ch.MinValue)
+	max, hasMax := toFloat(ch.MaxValue)
+	step, hasStep := toFloat(ch.StepValue)
+
+	if hasStep && step > 0 {
+		base := 0.0
+		if hasMin {
+			base = min
+		}
+		f = base + math.Round((f-base)/step)*step
+		// Get rid of floating point noise introduced by the step
+		f, _ = strconv.ParseFloat(strconv.FormatFloat(f, 'f', 10, 64), 64)
+	}
+	if hasMax && f > max {
+		f = max
+	}
+	if hasMin && f < min {
+		f = min
+	}
+	return f
+}
+
+func formatRange(format string) (float64, float64) {
+	switch format {
+	case characteristic.FormatUInt8:
+		return 0, math.MaxUint8
+	case characteristic.FormatUInt16:
+		return 0, math.MaxUint16
+	case characteristic.FormatUInt32:
+		return 0, math.MaxUint32
+	case characteristic.FormatInt32:
+		return math.MinInt32, math.MaxInt32
+	default:
+		return 0, math.MaxInt64
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
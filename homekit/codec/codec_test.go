@@ -0,0 +1,220 @@
+package codec
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/hemtjanst/hemtjanst/device"
+)
+
+func TestDecode(t *testing.T) {
+	c := &Codec{BoolStyle: BoolOnOff}
+	brightness := characteristic.NewBrightness().Characteristic
+	brightness.MaxValue = 100
+	temp := characteristic.NewCurrentTemperature().Characteristic
+
+	var tests = []struct {
+		ch      *characteristic.Characteristic
+		payload string
+		exp     interface{}
+	}{
+		{characteristic.NewOn().Characteristic, "1", true},
+		{characteristic.NewOn().Characteristic, "true", true},
+		{characteristic.NewOn().Characteristic, "OFF", false},
+		{characteristic.NewOn().Characteristic, " on ", true},
+		{brightness, "42", 42},
+		{brightness, "42.6", 43},
+		{brightness, "250", 100},
+		{brightness, "-5", 0},
+		{brightness, "true", 1},
+		{temp, "23.5°C", 23.5},
+		{temp, "23.54", 23.5},
+		{temp, "-300", 0.0},
+		{temp, "300", 100.0},
+		{characteristic.NewName().Characteristic, "kitchen", "kitchen"},
+		// Data payloads are raw bytes unless the codec says otherwise, also
+		// when they happen to be valid base64
+		{characteristic.NewSetupEndpoints().Characteristic, "abcd", base64.StdEncoding.EncodeToString([]byte("abcd"))},
+	}
+	for _, tt := range tests {
+		got, err := c.Decode(tt.ch, []byte(tt.payload))
+		if err != nil {
+			t.Errorf("Decode(%s, %q) returned error: %s", tt.ch.Format, tt.payload, err)
+			continue
+		}
+		if got != tt.exp {
+			t.Errorf("Decode(%s, %q): expected %v (%T), got %v (%T)", tt.ch.Format, tt.payload, tt.exp, tt.exp, got, got)
+		}
+	}
+
+	for _, payload := range []string{"", "maybe", "°C"} {
+		if _, err := c.Decode(brightness, []byte(payload)); err == nil {
+			t.Errorf("Expected error decoding %q", payload)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	on := characteristic.NewOn().Characteristic
+	temp := characteristic.NewTargetTemperature().Characteristic
+	brightness := characteristic.NewBrightness().Characteristic
+
+	var tests = []struct {
+		style string
+		ch    *characteristic.Characteristic
+		value interface{}
+		exp   string
+	}{
+		{"", on, true, "1"},
+		{"", on, false, "0"},
+		{"true/false", on, true, "true"},
+		{"ON/OFF", on, false, "OFF"},
+		{"", brightness, 55, "55"},
+		{"", temp, 21.5, "21.5"},
+		{"", temp, 21.0, "21"},
+	}
+	for _, tt := range tests {
+		c, err := New(tt.style, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Encode(tt.ch, tt.value)
+		if err != nil {
+			t.Errorf("Encode(%v) returned error: %s", tt.value, err)
+		}
+		if got != tt.exp {
+			t.Errorf("Encode(%v) with style %q: expected %s, got %s", tt.value, tt.style, tt.exp, got)
+		}
+	}
+}
+
+func TestParseBoolStyle(t *testing.T) {
+	for _, s := range []string{"ON", "a/a", "/off", "a/b/c"} {
+		if _, err := ParseBoolStyle(s); err == nil {
+			t.Errorf("Expected error for style %q", s)
+		}
+	}
+	bs, err := ParseBoolStyle("open/closed")
+	if err != nil || bs.True != "open" || bs.False != "closed" {
+		t.Errorf("Expected open/closed, got %v (%v)", bs, err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	brightness := characteristic.NewBrightness().Characteristic
+	colorTemp := characteristic.NewColorTemperature().Characteristic
+	targetTemp := characteristic.NewTargetTemperature().Characteristic
+	doorState := characteristic.NewCurrentDoorState().Characteristic
+
+	var tests = []struct {
+		ch      *characteristic.Characteristic
+		t       *device.Transform
+		payload string
+		value   interface{}
+	}{
+		{brightness, &device.Transform{Scale: 100.0 / 255}, "255", 100},
+		{brightness, &device.Transform{Scale: 100.0 / 255}, "0", 0},
+		{colorTemp, &device.Transform{Unit: "kelvin"}, "4000", 250},
+		{targetTemp, &device.Transform{Unit: "fahrenheit"}, "68", 20.0},
+		{targetTemp, &device.Transform{Offset: -1}, "21", 20.0},
+		{doorState, &device.Transform{Map: map[string]interface{}{"open": 0.0, "closed": 1.0}}, "closed", 1},
+		{doorState, &device.Transform{Map: map[string]interface{}{"open": 0.0, "closed": 1.0}}, "open", 0},
+	}
+	for _, tt := range tests {
+		c, err := New("", tt.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Decode(tt.ch, []byte(tt.payload))
+		if err != nil {
+			t.Errorf("Decode(%q) returned error: %s", tt.payload, err)
+		} else if got != tt.value {
+			t.Errorf("Decode(%q): expected %v, got %v", tt.payload, tt.value, got)
+		}
+		out, err := c.Encode(tt.ch, tt.value)
+		if err != nil {
+			t.Errorf("Encode(%v) returned error: %s", tt.value, err)
+		} else if out != tt.payload {
+			t.Errorf("Encode(%v): expected %s, got %s", tt.value, tt.payload, out)
+		}
+	}
+
+	if _, err := New("", &device.Transform{Unit: "furlong"}); err == nil {
+		t.Error("Expected error for unknown unit")
+	}
+}
+
+func TestValidValues(t *testing.T) {
+	c := &Codec{BoolStyle: BoolNumeric, ValidValues: []int{0, 2}}
+	ch := characteristic.NewCharacteristic("E863F10A-079E-48FF-8F27-9C2605A29F52")
+	ch.Format = characteristic.FormatUInt8
+
+	if v, err := c.Decode(ch, []byte("2")); err != nil || v != 2 {
+		t.Errorf("Expected 2, got %v (%v)", v, err)
+	}
+	if _, err := c.Decode(ch, []byte("1")); err == nil {
+		t.Error("Expected error decoding a value that isn't valid")
+	}
+	if _, err := c.Encode(ch, 1); err == nil {
+		t.Error("Expected error encoding a value that isn't valid")
+	}
+	if out, err := c.Encode(ch, 0); err != nil || out != "0" {
+		t.Errorf("Expected 0, got %q (%v)", out, err)
+	}
+}
+
+func TestDataEncoding(t *testing.T) {
+	ch := characteristic.NewSetupEndpoints().Characteristic
+	raw := []byte{0x01, 0x02, 0xff}
+	encoded := base64.StdEncoding.EncodeToString(raw)
+
+	var tests = []struct {
+		encoding string
+		payload  string
+	}{
+		{"", string(raw)},
+		{"raw", string(raw)},
+		{"base64", encoded},
+	}
+	for _, tt := range tests {
+		c := &Codec{BoolStyle: BoolNumeric}
+		var err error
+		if c.Base64, err = ParseEncoding(tt.encoding); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Decode(ch, []byte(tt.payload))
+		if err != nil || got != encoded {
+			t.Errorf("Decode with encoding %q: expected %s, got %v (%v)", tt.encoding, encoded, got, err)
+		}
+		out, err := c.Encode(ch, encoded)
+		if err != nil || out != tt.payload {
+			t.Errorf("Encode with encoding %q: expected %q, got %q (%v)", tt.encoding, tt.payload, out, err)
+		}
+	}
+
+	c := &Codec{BoolStyle: BoolNumeric, Base64: true}
+	if _, err := c.Decode(ch, raw); err == nil {
+		t.Error("Expected error decoding a payload that isn't base64")
+	}
+	if _, err := ParseEncoding("hex"); err == nil {
+		t.Error("Expected error for unknown encoding")
+	}
+}
+
+func TestMappedString(t *testing.T) {
+	c, err := New("", &device.Transform{Map: map[string]interface{}{"lr": "Living room"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := characteristic.NewName().Characteristic
+	if got, err := c.Decode(name, []byte("lr")); err != nil || got != "Living room" {
+		t.Errorf("Expected the mapped name, got %v (%v)", got, err)
+	}
+	if got, err := c.Decode(name, []byte("Kitchen")); err != nil || got != "Kitchen" {
+		t.Errorf("Expected an unmapped name as is, got %v (%v)", got, err)
+	}
+	if out, err := c.Encode(name, "Living room"); err != nil || out != "lr" {
+		t.Errorf("Expected the mapped name to be encoded as lr, got %q (%v)", out, err)
+	}
+}
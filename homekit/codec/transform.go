@@ -0,0 +1,136 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/hemtjanst/hemtjanst/device"
+)
+
+const (
+	unitKelvin     = "kelvin"
+	unitFahrenheit = "fahrenheit"
+)
+
+func validateTransform(t *device.Transform) error {
+	if t == nil {
+		return nil
+	}
+	switch normalizeUnit(t.Unit) {
+	case "", unitKelvin, unitFahrenheit:
+	default:
+		return fmt.Errorf("unknown unit %q", t.Unit)
+	}
+	for k, v := range t.Map {
+		switch v.(type) {
+		case bool, float64, string:
+		default:
+			return fmt.Errorf("invalid value %v for %q in map", v, k)
+		}
+	}
+	return nil
+}
+
+func normalizeUnit(unit string) string {
+	switch strings.ToLower(unit) {
+	case "k", "kelvin":
+		return unitKelvin
+	case "f", "°f", "fahrenheit":
+		return unitFahrenheit
+	}
+	return strings.ToLower(unit)
+}
+
+// scales returns true if the transform converts numeric values.
+func (c *Codec) scales() bool {
+	t := c.Transform
+	return t != nil && (t.Scale != 0 || t.Offset != 0 || t.Unit != "")
+}
+
+// lookup returns the characteristic value, as a string, that str maps to.
+func (c *Codec) lookup(str string) (string, bool) {
+	if c.Transform == nil {
+		return "", false
+	}
+	for k, v := range c.Transform.Map {
+		if strings.EqualFold(k, str) {
+			return fmt.Sprint(v), true
+		}
+	}
+	return "", false
+}
+
+// reverseLookup returns the payload that maps to value, if any.
+func (c *Codec) reverseLookup(ch *characteristic.Characteristic, value interface{}) (string, bool) {
+	if c.Transform == nil || len(c.Transform.Map) == 0 {
+		return "", false
+	}
+	plain := &Codec{BoolStyle: c.BoolStyle}
+	for k, v := range c.Transform.Map {
+		mv, err := plain.Decode(ch, []byte(fmt.Sprint(v)))
+		if err != nil {
+			continue
+		}
+		if fmt.Sprint(mv) == fmt.Sprint(value) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// toCharacteristic converts a numeric payload to a characteristic value.
+func (c *Codec) toCharacteristic(f float64) float64 {
+	t := c.Transform
+	if t == nil {
+		return f
+	}
+	switch normalizeUnit(t.Unit) {
+	case unitKelvin:
+		f = kelvinToMired(f)
+	case unitFahrenheit:
+		f = (f - 32) * 5 / 9
+	}
+	if t.Scale != 0 {
+		f = f * t.Scale
+	}
+	return round(f + t.Offset)
+}
+
+// toPayload converts a characteristic value to a numeric payload.
+func (c *Codec) toPayload(f float64) float64 {
+	t := c.Transform
+	if t == nil {
+		return f
+	}
+	f -= t.Offset
+	if t.Scale != 0 {
+		f = f / t.Scale
+	}
+	switch normalizeUnit(t.Unit) {
+	case unitKelvin:
+		f = kelvinToMired(f)
+	case unitFahrenheit:
+		f = f*9/5 + 32
+	}
+	return round(f)
+}
+
+// kelvinToMired converts between kelvin and mireds, it works both ways.
+func kelvinToMired(f float64) float64 {
+	if f == 0 {
+		return 0
+	}
+	return 1000000 / f
+}
+
+// round gets rid of floating point noise.
+func round(f float64) float64 {
+	r, err := strconv.ParseFloat(strconv.FormatFloat(f, 'f', 6, 64), 64)
+	if err != nil || math.IsInf(r, 0) {
+		return f
+	}
+	return r
+}
@@ -0,0 +1,97 @@
+package homekit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/hemtjanst/hemtjanst/device"
+	"github.com/hemtjanst/hemtjanst/homekit/util"
+)
+
+// customFormats maps the formats of the HomeKit Accessory Protocol to the
+// ones hc uses.
+var customFormats = map[string]string{
+	"bool":   characteristic.FormatBool,
+	"uint8":  characteristic.FormatUInt8,
+	"uint16": characteristic.FormatUInt16,
+	"uint32": characteristic.FormatUInt32,
+	"uint64": characteristic.FormatUInt64,
+	"int":    characteristic.FormatInt32,
+	"int32":  characteristic.FormatInt32,
+	"float":  characteristic.FormatFloat,
+	"string": characteristic.FormatString,
+	"tlv8":   characteristic.FormatTLV8,
+	"data":   characteristic.FormatData,
+}
+
+// customPerms are the permissions a characteristic can have: paired read,
+// paired write, events, additional authorization, timed write, hidden and
+// write response.
+var customPerms = map[string]bool{
+	"pr": true, "pw": true, "ev": true, "aa": true, "tw": true, "hd": true, "wr": true,
+}
+
+// newCustomCharacteristic creates the characteristic described by c.
+func newCustomCharacteristic(c *device.Characteristic) (*characteristic.Characteristic, error) {
+	t, ok := util.UUID(c.Type)
+	if !ok {
+		return nil, fmt.Errorf("type %q is not a UUID", c.Type)
+	}
+	format, ok := customFormats[strings.ToLower(c.Format)]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q", c.Format)
+	}
+
+	ch := characteristic.NewCharacteristic(t)
+	ch.Format = format
+	ch.Unit = c.Unit
+	ch.Description = c.Description
+	ch.Perms = characteristic.PermsRead()
+	if len(c.Perms) > 0 {
+		ch.Perms = nil
+		for _, p := range c.Perms {
+			p = strings.ToLower(p)
+			if !customPerms[p] {
+				return nil, fmt.Errorf("unknown permission %q", p)
+			}
+			ch.Perms = append(ch.Perms, p)
+		}
+	}
+
+	switch format {
+	case characteristic.FormatBool:
+		ch.Value = false
+	case characteristic.FormatFloat:
+		setRange(ch, c, func(f float64) interface{} { return f })
+		ch.Value = 0.0
+		if c.MinValue != nil {
+			ch.Value = *c.MinValue
+		}
+	case characteristic.FormatString, characteristic.FormatTLV8, characteristic.FormatData:
+		ch.Value = ""
+	default:
+		setRange(ch, c, func(f float64) interface{} { return int(f) })
+		ch.Value = 0
+		if len(c.ValidValues) > 0 {
+			ch.Value = c.ValidValues[0]
+		} else if c.MinValue != nil {
+			ch.Value = int(*c.MinValue)
+		}
+	}
+	return ch, nil
+}
+
+// setRange copies the min, max and step of c to ch, converted by conv to
+// the type matching the characteristic's format.
+func setRange(ch *characteristic.Characteristic, c *device.Characteristic, conv func(float64) interface{}) {
+	if c.MinValue != nil {
+		ch.MinValue = conv(*c.MinValue)
+	}
+	if c.MaxValue != nil {
+		ch.MaxValue = conv(*c.MaxValue)
+	}
+	if c.MinStep != nil {
+		ch.StepValue = conv(*c.MinStep)
+	}
+}
@@ -1,33 +1,63 @@
 package homekit
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
-	"reflect"
+	"time"
 
 	"github.com/brutella/hc/accessory"
 	"github.com/brutella/hc/characteristic"
 	"github.com/brutella/hc/service"
-	"github.com/gosexy/to"
 	"github.com/hemtjanst/hemtjanst/device"
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+	"github.com/hemtjanst/hemtjanst/homekit/codec"
 	"github.com/hemtjanst/hemtjanst/homekit/util"
 	"github.com/hemtjanst/hemtjanst/messaging"
 )
 
+// setTimeout is how long a change made in HomeKit may take to reach the
+// broker before it's given up on.
+const setTimeout = 5 * time.Second
+
 type deviceHolder struct {
 	device          *device.Device
 	accessory       *accessory.Accessory
 	mainService     *service.Service
+	labelService    *service.Service
+	streamService   *service.Service
+	camera          *camera
+	services        map[string]*service.Service
+	features        map[string]*device.Feature
+	codecs          map[string]*codec.Codec
 	characteristics map[string]*characteristic.Characteristic
+	spec            accessorySpec
+	// subscribed has the feature the holder got the updates of each topic
+	// through
+	subscribed map[string]*device.Feature
+	// ids and key are where the holder's accessory gets its IDs from,
+	// previous are keys it had before
+	ids      *bridge.IDMap
+	key      string
+	previous []string
 }
 
-func newDeviceHolder(d *device.Device) (*deviceHolder, error) {
+// newDeviceHolder builds the accessory of d, with IDs from ids under key.
+// The IDs of the first of the previous keys ids knows are taken over.
+func newDeviceHolder(d *device.Device, ids *bridge.IDMap, key string, previous ...string) (*deviceHolder, error) {
 	newDev := &deviceHolder{
 		device:          d,
+		ids:             ids,
+		key:             key,
+		previous:        previous,
 		accessory:       nil,
 		mainService:     nil,
+		services:        map[string]*service.Service{},
+		features:        map[string]*device.Feature{},
+		codecs:          map[string]*codec.Codec{},
 		characteristics: map[string]*characteristic.Characteristic{},
+		spec:            newAccessorySpec(d),
 	}
 	err := newDev.createAccessory()
 	if err != nil {
@@ -36,51 +66,157 @@ func newDeviceHolder(d *device.Device) (*deviceHolder, error) {
 	return newDev, nil
 }
 
-func (h *deviceHolder) onHomekitUpdate(c string, value interface{}) {
+// onHomekitUpdate sets the feature of characteristic c to value. If that
+// fails the characteristic goes back to old, so HomeKit doesn't show a
+// state the device never got told about.
+func (h *deviceHolder) onHomekitUpdate(c string, value, old interface{}) {
 	log.Printf("onHomeKitUpdate(%s, %v) on device %s\n", c, value, h.device.Topic)
-	log.Print(h.device)
-	if feature, ok := h.device.Features[c]; ok {
-		log.Print(feature)
-		var out string
-
-		if converted, err := to.Convert(value, reflect.TypeOf(out).Kind()); err == nil {
-			out = converted.(string)
-		}
-		if b, ok := value.(bool); ok {
-			if b {
-				out = "1"
-			} else {
-				out = "0"
-			}
-		}
-
-		if out != "" {
-			feature.Set(out)
-		}
+	feature, ok := h.features[c]
+	if !ok {
+		return
+	}
+	out, err := h.codecs[c].Encode(h.characteristics[c], value)
+	if err != nil {
+		log.Printf("Could not encode value for %s on %s: %s", c, h.device.Topic, err)
 		return
 	}
+	if out == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), setTimeout)
+	defer cancel()
+	if err := feature.SetFromContext(ctx, "homekit", out); err != nil {
+		log.Printf("Could not set %s on %s: %s", c, h.device.Topic, err)
+		if ch := h.characteristics[c]; old != nil && !isEvent(ch) {
+			ch.UpdateValue(old)
+		}
+	}
 }
 
-func (h *deviceHolder) onUpdate(c, value string) {
-	log.Printf("onUpdate(%s, %s) on device %s\n", c, value, h.device.Topic)
+func (h *deviceHolder) onUpdate(c string, payload []byte) {
+	log.Printf("onUpdate(%s, %s) on device %s\n", c, payload, h.device.Topic)
 	if ch, ok := h.characteristics[c]; ok {
 		log.Print("Found characteristic: ", c)
+		payload, ok, err := h.features[c].Extract(payload)
+		if err != nil {
+			log.Printf("Ignoring update for %s on %s: %s", c, h.device.Topic, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		value, err := h.codecs[c].Decode(ch, payload)
+		if err != nil {
+			log.Printf("Ignoring update for %s on %s: %s", c, h.device.Topic, err)
+			return
+		}
 		ch.UpdateValue(value)
+		if isEvent(ch) {
+			// The event has been sent, reading it returns null
+			ch.Value = nil
+		}
+	}
+}
+
+// changes compares the metadata of d with what the accessory was built from,
+// and key with the key its IDs are stored under.
+func (h *deviceHolder) changes(d *device.Device, key string) accessoryDiff {
+	diff := h.spec.diff(newAccessorySpec(d))
+	diff.Identity = h.key != key
+	return diff
+}
+
+// copyValues carries over the current value of every characteristic that
+// also exists on old, so that a rebuilt accessory doesn't fall back to the
+// defaults until the device publishes again.
+func (h *deviceHolder) copyValues(old *deviceHolder) {
+	for name, ch := range h.characteristics {
+		if oldCh, ok := old.characteristics[name]; ok && oldCh.Format == ch.Format && oldCh.Value != nil {
+			ch.UpdateValue(oldCh.Value)
+		}
+	}
+	if h.camera != nil && old.camera != nil {
+		old.camera.mutex.Lock()
+		h.camera.latest = old.camera.latest
+		old.camera.mutex.Unlock()
 	}
 }
 
 func (h *deviceHolder) deviceUpdate(d *device.Device) {
 	h.device = d
-	util.SetReachability(h.accessory, d.Reachable)
+	util.SetReachability(h.accessory, reachable(d))
 
-	for name, feature := range h.device.Features {
-		chName := name
-		feature.OnUpdate(func(msg messaging.Message) {
-			h.onUpdate(chName, string(msg.Payload()))
+	h.device.ForEachFeature(func(svc *device.Service, name string, feature *device.Feature) {
+		chName := device.FeatureKey(svc, name)
+		if _, ok := h.characteristics[chName]; ok {
+			h.features[chName] = feature
+		}
+	})
+	h.subscribe()
+	if h.camera != nil {
+		h.camera.update(d)
+	}
+}
+
+// subscribe subscribes to the GetTopic of every feature that has a
+// characteristic and isn't write-only. Features sharing a topic, like a
+// JSON state topic, are subscribed to once and all get every message on
+// it. Topics it subscribed to before that no feature uses anymore are
+// unsubscribed from.
+func (h *deviceHolder) subscribe() {
+	topics := map[string][]string{}
+	for name, feature := range h.features {
+		if feature.WriteOnly {
+			// HomeKit never reads these, so there's no state to keep
+			continue
+		}
+		topics[feature.GetTopic] = append(topics[feature.GetTopic], name)
+	}
+	old := h.subscribed
+	h.subscribed = map[string]*device.Feature{}
+	for topic, names := range topics {
+		h.subscribed[topic] = h.features[names[0]]
+	}
+	h.stopUpdates(old, h.subscribed)
+	for _, names := range topics {
+		chNames := names
+		h.features[chNames[0]].OnUpdate(func(msg messaging.Message) {
+			retained := messaging.Retained(msg)
+			for _, chName := range chNames {
+				if retained && isEvent(h.characteristics[chName]) {
+					// A button press that's replayed didn't just happen
+					continue
+				}
+				h.onUpdate(chName, msg.Payload())
+			}
 		})
 	}
 }
 
+// unsubscribe stops the updates of the topics the holder subscribed to that
+// next, the holder replacing it, doesn't use. next is nil when the device is
+// gone.
+func (h *deviceHolder) unsubscribe(next *deviceHolder) {
+	var keep map[string]*device.Feature
+	if next != nil {
+		keep = next.subscribed
+	}
+	h.stopUpdates(h.subscribed, keep)
+}
+
+// stopUpdates stops the updates of the topics in subscribed that aren't in
+// keep.
+func (h *deviceHolder) stopUpdates(subscribed, keep map[string]*device.Feature) {
+	for topic, feature := range subscribed {
+		if _, ok := keep[topic]; ok {
+			continue
+		}
+		if err := feature.StopUpdates(); err != nil {
+			log.Printf("Could not unsubscribe from %s of %s: %s", topic, h.device.Topic, err)
+		}
+	}
+}
+
 func (h *deviceHolder) createAccessory() (err error) {
 	if h.accessory != nil {
 		return fmt.Errorf("accessory already created for device %s", h.device.Topic)
@@ -94,31 +230,163 @@ func (h *deviceHolder) createAccessory() (err error) {
 	}
 
 	dType := util.AccessoryType(h.device.Type)
+	if h.device.Type == "" && len(h.device.Services) > 0 {
+		dType = util.AccessoryType(h.device.Services[0].Type)
+	}
+	if h.device.Snapshot != nil {
+		if util.ServiceType(h.device.Type) == service.TypeDoorbell {
+			dType = accessory.TypeVideoDoorbell
+		} else {
+			dType = accessory.TypeIPCamera
+		}
+	}
 	a := accessory.New(info, dType)
 	h.accessory = a
-	a.ID = util.TopicToUint64(h.device.Topic)
+	previous := append([]string{h.device.PreviousTopic, h.device.Topic}, h.previous...)
+	a.ID = h.ids.Accessory(h.key, util.TopicToUint64(h.device.Topic), previous...)
 
 	return h.updateAccessory()
 }
+
 func (h *deviceHolder) updateAccessory() (err error) {
-	sType := util.ServiceType(h.device.Type)
+	var svcs []*service.Service
+
+	// The type and features of the device itself make up the main service,
+	// it can only be left out when additional services are declared or the
+	// device is a camera.
+	if h.device.Type != "" || (len(h.device.Services) == 0 && h.device.Snapshot == nil) {
+		svc, err := h.createService(nil, h.device.Type, h.device.Features)
+		if err != nil {
+			return err
+		}
+		h.mainService = svc
+		if svc != nil {
+			svcs = append(svcs, svc)
+		}
+	}
+
+	hasPrimary := false
+	for _, ds := range h.device.Services {
+		svc, err := h.createService(ds, ds.Type, ds.Features)
+		if err != nil {
+			return err
+		}
+		if svc == nil {
+			continue
+		}
+		svc.Primary = ds.Primary
+		svc.Hidden = ds.Hidden
+		hasPrimary = hasPrimary || ds.Primary
+		h.services[ds.ID] = svc
+		svcs = append(svcs, svc)
+	}
+
+	if h.mainService != nil && len(h.device.Services) > 0 && !hasPrimary {
+		h.mainService.Primary = true
+	}
+
+	for _, ds := range h.device.Services {
+		svc, ok := h.services[ds.ID]
+		if !ok {
+			continue
+		}
+		for _, id := range ds.Linked {
+			if linked, ok := h.services[id]; ok {
+				svc.AddLinkedService(linked)
+			} else {
+				log.Printf("Ignoring unknown linked service '%s' on '%s' (from %s)", id, ds.ID, h.device.Topic)
+			}
+		}
+	}
+
+	indexes := map[*service.Service]int{}
+	for _, ds := range h.device.Services {
+		if svc, ok := h.services[ds.ID]; ok {
+			indexes[svc] = ds.LabelIndex
+		}
+	}
+	if label := labelServices(svcs, indexes); label != nil {
+		h.labelService = label
+		svcs = append(svcs, label)
+	}
+	if h.device.Snapshot != nil {
+		h.streamService = newStreamManagement()
+		h.camera = newCamera(h.device)
+		svcs = append(svcs, h.streamService)
+	}
+
+	if len(svcs) > 0 {
+		for _, svc := range svcs {
+			h.accessory.AddService(svc)
+		}
+		h.assignIDs()
+	}
+	h.subscribe()
+
+	return
+}
+
+// assignIDs gives every service and characteristic the ID it has in the ID
+// map. Services are identified by their ID in the metadata, so that several
+// services of the same type keep their IDs when they're reordered. New
+// services and characteristics get an ID based on their type if it's free.
+func (h *deviceHolder) assignIDs() {
+	keys := map[*service.Service]string{h.accessory.Info.Service: "info"}
+	if h.mainService != nil {
+		keys[h.mainService] = "main"
+	}
+	if h.labelService != nil {
+		keys[h.labelService] = "label"
+	}
+	if h.streamService != nil {
+		keys[h.streamService] = "camera"
+	}
+	for id, svc := range h.services {
+		keys[svc] = "service/" + id
+	}
+
+	util.AssignIDs(h.accessory)
+	for _, s := range h.accessory.GetServices() {
+		key := keys[s]
+		s.ID = h.ids.Instance(h.key, key, s.ID)
+		for _, c := range s.GetCharacteristics() {
+			c.ID = h.ids.Instance(h.key, key+"/"+c.Type, c.ID)
+		}
+	}
+}
+
+// createService creates a service of type t with a characteristic for each
+// of the features. ds is nil when creating the device's main service. It
+// returns nil if none of the features could be mapped to a characteristic.
+func (h *deviceHolder) createService(ds *device.Service, t string, features map[string]*device.Feature) (*service.Service, error) {
+	sType := util.ServiceType(t)
 
 	if sType == "" {
-		return fmt.Errorf("unknown type %s", h.device.Type)
+		return nil, fmt.Errorf("unknown type %s", t)
 	}
 
-	// TODO: Compare with current service/characteristics if any are set
-	//       instead of creating new ones.
 	svc := service.New(sType)
-	h.mainService = svc
 	chCount := 0
 
-	for name, feature := range h.device.Features {
-		chName := name
-		ch := util.CharacteristicType(name)
+	for name, feature := range features {
+		chName := device.FeatureKey(ds, name)
+		var ch *characteristic.Characteristic
+		if feature.Characteristic != nil {
+			var err error
+			if ch, err = newCustomCharacteristic(feature.Characteristic); err != nil {
+				log.Printf("Ignoring invalid characteristic '%s' (from %s): %s", chName, h.device.Topic, err)
+				continue
+			}
+		} else if ch = util.CharacteristicType(name); ch == nil {
+			log.Printf("Ignoring unknown characteristic '%s' (from %s)", chName, h.device.Topic)
+			continue
+		}
 
-		if ch == nil {
-			log.Printf("Ignoring unknown characteristic '%s' (from %s)", name, h.device.Topic)
+		if isEvent(ch) && !feature.Notifies() {
+			log.Printf("Ignoring notify false on '%s' (from %s), it only reports through events", chName, h.device.Topic)
+		}
+		if err := setPerms(ch, feature); err != nil {
+			log.Printf("Ignoring characteristic '%s' (from %s): %s", chName, h.device.Topic, err)
 			continue
 		}
 
@@ -155,30 +423,77 @@ func (h *deviceHolder) updateAccessory() (err error) {
 		case characteristic.FormatTLV8:
 			break
 		}
+		cd, err := codec.New(feature.BoolStyle, feature.Transform)
+		if err != nil {
+			log.Printf("Ignoring invalid bool style or transform of '%s' (from %s): %s", chName, h.device.Topic, err)
+			cd = &codec.Codec{BoolStyle: codec.BoolNumeric}
+		}
+		if cd.Base64, err = codec.ParseEncoding(feature.Encoding); err != nil {
+			log.Printf("Ignoring invalid encoding of '%s' (from %s): %s", chName, h.device.Topic, err)
+		}
+		if feature.Characteristic != nil {
+			cd.ValidValues = feature.Characteristic.ValidValues
+		}
+		if isEvent(ch) {
+			cd.Transform = eventTransform(cd.Transform)
+			ch.Value = nil
+		}
+
 		h.characteristics[chName] = ch
+		h.features[chName] = feature
+		h.codecs[chName] = cd
 		svc.AddCharacteristic(ch)
 		chCount++
 
-		ch.OnValueUpdateFromConn(func(conn net.Conn, c *characteristic.Characteristic, newValue, oldValue interface{}) {
-			h.onHomekitUpdate(chName, newValue)
-		})
-		feature.OnUpdate(func(msg messaging.Message) {
-			h.onUpdate(chName, string(msg.Payload()))
-		})
+		if !feature.ReadOnly {
+			ch.OnValueUpdateFromConn(func(conn net.Conn, c *characteristic.Characteristic, newValue, oldValue interface{}) {
+				h.onHomekitUpdate(chName, newValue, oldValue)
+			})
+		}
+	}
 
+	if chCount == 0 {
+		return nil, nil
 	}
+	return svc, nil
+}
 
-	if chCount > 0 {
-		h.accessory.AddService(svc)
-		for _, s := range h.accessory.GetServices() {
-			// There should never be multiple instances with the same type added to a device
-			// so it should be safe to set ID of service/characteristics to its type
-			s.ID = util.HexToUint64(s.Type, s.ID)
-			for _, c := range s.GetCharacteristics() {
-				c.ID = util.HexToUint64(c.Type, c.ID)
-			}
+// setPerms adjusts the permissions of ch to what feature allows. A read-only
+// feature loses the permissions to write, a write-only feature those to
+// read and send events. Features that don't notify lose the permission to
+// send events, unless that's the only way ch reports, like a button press.
+func setPerms(ch *characteristic.Characteristic, feature *device.Feature) error {
+	if feature.ReadOnly && feature.WriteOnly {
+		return fmt.Errorf("feature can't be both read-only and write-only")
+	}
+	var perms []string
+	for _, p := range ch.Perms {
+		switch {
+		case feature.ReadOnly && (p == characteristic.PermWrite || p == "tw" || p == "wr"):
+		case feature.WriteOnly && (p == characteristic.PermRead || p == characteristic.PermEvents):
+		case !feature.Notifies() && p == characteristic.PermEvents && !isEvent(ch):
+		default:
+			perms = append(perms, p)
 		}
 	}
+	if feature.WriteOnly && !hasPerm(perms, characteristic.PermWrite) {
+		perms = append(perms, characteristic.PermWrite)
+	}
+	if len(perms) == 0 {
+		return fmt.Errorf("no permissions left")
+	}
+	if feature.Hidden && !hasPerm(perms, characteristic.PermHidden) {
+		perms = append(perms, characteristic.PermHidden)
+	}
+	ch.Perms = perms
+	return nil
+}
 
-	return
+func hasPerm(perms []string, perm string) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,102 @@
+package homekit
+
+import (
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/hemtjanst/hemtjanst/device"
+)
+
+// pressPayloads are the payloads understood as presses of a button, on top
+// of 0, 1 and 2, unless a feature maps them itself. Anything else, like the
+// release of a button, is ignored.
+var pressPayloads = map[string]interface{}{
+	"single":       float64(characteristic.ProgrammableSwitchEventSinglePress),
+	"single_press": float64(characteristic.ProgrammableSwitchEventSinglePress),
+	"press":        float64(characteristic.ProgrammableSwitchEventSinglePress),
+	"click":        float64(characteristic.ProgrammableSwitchEventSinglePress),
+	"double":       float64(characteristic.ProgrammableSwitchEventDoublePress),
+	"double_press": float64(characteristic.ProgrammableSwitchEventDoublePress),
+	"double_click": float64(characteristic.ProgrammableSwitchEventDoublePress),
+	"long":         float64(characteristic.ProgrammableSwitchEventLongPress),
+	"long_press":   float64(characteristic.ProgrammableSwitchEventLongPress),
+	"hold":         float64(characteristic.ProgrammableSwitchEventLongPress),
+}
+
+// isEvent returns whether ch is stateless. Every payload received for it is
+// an event, even if it's the same as the one before, and there's no value
+// to be read.
+func isEvent(ch *characteristic.Characteristic) bool {
+	return ch.Type == characteristic.TypeProgrammableSwitchEvent
+}
+
+// eventTransform returns t with pressPayloads as its map if it has none.
+func eventTransform(t *device.Transform) *device.Transform {
+	if t != nil && len(t.Map) > 0 {
+		return t
+	}
+	res := &device.Transform{Map: pressPayloads}
+	if t != nil {
+		*res = *t
+		res.Map = pressPayloads
+	}
+	return res
+}
+
+// labelServices numbers the stateless programmable switches among svcs,
+// like the buttons of a remote, when there's more than one of them. Their
+// indexes default to their order, skipping the ones set explicitly. It
+// returns the service labelling them that has to be added to the accessory,
+// or nil if there's no need for one or it's already there.
+func labelServices(svcs []*service.Service, indexes map[*service.Service]int) *service.Service {
+	var buttons []*service.Service
+	labelled := false
+	for _, svc := range svcs {
+		switch svc.Type {
+		case service.TypeStatelessProgrammableSwitch:
+			buttons = append(buttons, svc)
+		case service.TypeServiceLabel:
+			labelled = true
+		}
+	}
+	if len(buttons) < 2 {
+		return nil
+	}
+
+	used := map[int]bool{}
+	for _, svc := range buttons {
+		used[indexes[svc]] = true
+	}
+	next := 1
+	for _, svc := range buttons {
+		index := indexes[svc]
+		if index <= 0 {
+			for used[next] {
+				next++
+			}
+			index = next
+			used[index] = true
+		}
+		if hasCharacteristic(svc, characteristic.TypeServiceLabelIndex) {
+			continue
+		}
+		ch := characteristic.NewServiceLabelIndex()
+		ch.SetValue(index)
+		svc.AddCharacteristic(ch.Characteristic)
+	}
+	if labelled {
+		return nil
+	}
+
+	label := service.NewServiceLabel()
+	label.ServiceLabelNamespace.SetValue(characteristic.ServiceLabelNamespaceArabicNumerals)
+	return label.Service
+}
+
+func hasCharacteristic(svc *service.Service, t string) bool {
+	for _, c := range svc.Characteristics {
+		if c.Type == t {
+			return true
+		}
+	}
+	return false
+}
@@ -4,49 +4,147 @@ import (
 	"github.com/hemtjanst/hemtjanst/device"
 	"github.com/hemtjanst/hemtjanst/homekit/bridge"
 	"github.com/hemtjanst/hemtjanst/homekit/util"
+	"log"
 	"sync"
 )
 
 type Homekit struct {
 	lock    sync.RWMutex
-	bridge  bridge.Bridge
+	bridges []bridge.Bridge
 	manager *device.Manager
 	devices map[string]*deviceHolder
+	// assigned holds the index of the bridge each device is on
+	assigned        map[string]int
+	assignmentsPath string
 }
 
-func NewHomekit(bridge bridge.Bridge, manager *device.Manager) *Homekit {
-	return &Homekit{
-		bridge:  bridge,
-		manager: manager,
-		devices: map[string]*deviceHolder{},
+func NewHomekit(b bridge.Bridge, manager *device.Manager) *Homekit {
+	return NewShardedHomekit([]bridge.Bridge{b}, manager)
+}
+
+// NewShardedHomekit returns a Homekit that spreads the devices over several
+// bridges, to get around the limit on the number of accessories on a bridge.
+func NewShardedHomekit(bridges []bridge.Bridge, manager *device.Manager) *Homekit {
+	h := &Homekit{
+		bridges:  bridges,
+		manager:  manager,
+		devices:  map[string]*deviceHolder{},
+		assigned: map[string]int{},
 	}
+	for i, b := range bridges {
+		b.HandleSnapshots(h.snapshots(i))
+	}
+	return h
 }
 
 func (h *Homekit) Updated(d *device.Device) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
+	if _, ok := h.devices[d.Topic]; !ok && d.PreviousTopic != "" && d.PreviousTopic != d.Topic {
+		h.takeOver(d)
+	}
+	prev := h.assigned[d.Topic]
+	i := h.assign(d)
+	key := h.identity(d)
 	if val, ok := h.devices[d.Topic]; ok {
-		val.deviceUpdate(d)
+		diff := val.changes(d, key)
+		if diff.empty() && i == prev {
+			val.deviceUpdate(d)
+			return
+		}
+
+		newDev, err := newDeviceHolder(d, h.bridges[i].IDs(), key, val.key)
+		if err != nil {
+			log.Printf("Could not update accessory for %s: %s", d.Topic, err)
+			return
+		}
+		newDev.copyValues(val)
+		util.SetReachability(newDev.accessory, reachable(d))
+		if i != prev {
+			log.Printf("Moving device %s from bridge %d to %d", d.Topic, prev+1, i+1)
+			if val.accessory != nil {
+				h.bridges[prev].RemoveAccessory(val.accessory)
+			}
+			h.bridges[i].AddAccessory(newDev.accessory)
+		} else {
+			// Rebuild the accessory from the new metadata. Since IDs are
+			// derived from the topic and types, unchanged services and
+			// characteristics keep the IDs HomeKit already knows them by.
+			log.Printf("Device %s changed (%s), replacing accessory", d.Topic, diff)
+			h.bridges[i].ReplaceAccessory(val.accessory, newDev.accessory)
+		}
+		val.unsubscribe(newDev)
+		h.devices[d.Topic] = newDev
+		h.keep(d.Topic, i)
 	} else {
-		newDev, err := newDeviceHolder(d)
+		newDev, err := newDeviceHolder(d, h.bridges[i].IDs(), key)
 		if err != nil {
 			return
 		}
+		h.keep(d.Topic, i)
 		if newDev.accessory != nil {
-			util.SetReachability(newDev.accessory, d.Reachable)
-			h.bridge.AddAccessory(newDev.accessory)
+			util.SetReachability(newDev.accessory, reachable(d))
+			h.bridges[i].AddAccessory(newDev.accessory)
 		}
 		h.devices[d.Topic] = newDev
 	}
 }
 
 func (h *Homekit) Removed(d *device.Device) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
 	if val, ok := h.devices[d.Topic]; ok {
-		h.lock.Lock()
-		defer h.lock.Unlock()
 		if val.accessory != nil {
-			h.bridge.RemoveAccessory(val.accessory)
+			h.bridges[h.assigned[d.Topic]].RemoveAccessory(val.accessory)
 		}
+		val.unsubscribe(nil)
 		delete(h.devices, d.Topic)
+		delete(h.assigned, d.Topic)
+		h.saveAssignments()
 	}
 }
+
+// identity returns the key the IDs of the accessory of d are stored under.
+// That's its id if it has one that isn't used by another device, or else
+// its topic. The Homekit must be locked.
+func (h *Homekit) identity(d *device.Device) string {
+	if d.ID == "" {
+		return d.Topic
+	}
+	key := "id:" + d.ID
+	for topic, other := range h.devices {
+		if topic != d.Topic && other.key == key {
+			log.Printf("Device %s has the same id as %s, identifying it by its topic instead", d.Topic, topic)
+			return d.Topic
+		}
+	}
+	return key
+}
+
+// takeOver makes d, which moved from its previous topic, replace the device
+// that's still known by that topic. The Homekit must be locked.
+func (h *Homekit) takeOver(d *device.Device) {
+	if old, ok := h.devices[d.PreviousTopic]; ok {
+		log.Printf("Device %s replaces %s", d.Topic, d.PreviousTopic)
+		if old.accessory != nil {
+			h.bridges[h.assigned[d.PreviousTopic]].RemoveAccessory(old.accessory)
+		}
+		old.unsubscribe(nil)
+		delete(h.devices, d.PreviousTopic)
+	}
+	if i, ok := h.assigned[d.PreviousTopic]; ok {
+		if _, assigned := h.assigned[d.Topic]; !assigned {
+			h.assigned[d.Topic] = i
+		}
+		delete(h.assigned, d.PreviousTopic)
+		h.saveAssignments()
+	}
+}
+
+// reachable returns whether d is reachable, which the manager can change
+// at any time.
+func reachable(d *device.Device) bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.Reachable
+}
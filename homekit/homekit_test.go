@@ -0,0 +1,378 @@
+package homekit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/hemtjanst/hemtjanst/device"
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+	"github.com/hemtjanst/hemtjanst/messaging"
+)
+
+func TestPreviousTopic(t *testing.T) {
+	b := newTestBridge()
+	h := NewHomekit(b, nil)
+
+	h.Updated(newShardTestDevice(t, "light/old", `{"type": "lightbulb", "feature": {"on": {}}}`))
+	old := h.devices["light/old"].accessory
+	h.Updated(newShardTestDevice(t, "light/new", `{"type": "lightbulb", "previousTopic": "light/old", "feature": {"on": {}}}`))
+	acc := h.devices["light/new"].accessory
+
+	if _, ok := h.devices["light/old"]; ok || len(b.accessories) != 1 {
+		t.Fatalf("Expected light/new to replace light/old, got %d accessories", len(b.accessories))
+	}
+	if acc.ID != old.ID {
+		t.Errorf("Expected accessory ID %d to be kept, got %d", old.ID, acc.ID)
+	}
+	if acc.Services[1].ID != old.Services[1].ID {
+		t.Errorf("Expected service ID %d to be kept, got %d", old.Services[1].ID, acc.Services[1].ID)
+	}
+}
+
+func TestDeviceID(t *testing.T) {
+	b := newTestBridge()
+	h := NewShardedHomekit([]bridge.Bridge{b}, nil)
+
+	h.Updated(newShardTestDevice(t, "light/a", `{"type": "lightbulb", "id": "lamp", "feature": {"on": {}}}`))
+	h.Updated(newShardTestDevice(t, "light/b", `{"type": "lightbulb", "id": "lamp", "feature": {"on": {}}}`))
+	if h.devices["light/a"].key != "id:lamp" || h.devices["light/b"].key != "light/b" {
+		t.Errorf("Expected duplicate id to fall back to the topic, got %s and %s", h.devices["light/a"].key, h.devices["light/b"].key)
+	}
+	if h.devices["light/a"].accessory.ID == h.devices["light/b"].accessory.ID {
+		t.Error("Expected accessories to get different IDs")
+	}
+
+	// A device with an id keeps its accessory ID when it changes topic
+	id := h.devices["light/a"].accessory.ID
+	h.Removed(h.devices["light/a"].device)
+	h.Updated(newShardTestDevice(t, "light/c", `{"type": "lightbulb", "id": "lamp", "feature": {"on": {}}}`))
+	if got := h.devices["light/c"].accessory.ID; got != id {
+		t.Errorf("Expected accessory ID %d, got %d", id, got)
+	}
+
+	// A device that gets an id is identified by it from then on
+	id = h.devices["light/b"].accessory.ID
+	h.Updated(newShardTestDevice(t, "light/b", `{"type": "lightbulb", "id": "desk", "feature": {"on": {}}}`))
+	if key := h.devices["light/b"].key; key != "id:desk" {
+		t.Errorf("Expected light/b to be identified by its id, got %s", key)
+	}
+	if got := h.devices["light/b"].accessory.ID; got != id {
+		t.Errorf("Expected accessory ID %d, got %d", id, got)
+	}
+}
+
+func TestRebuildUnsubscribes(t *testing.T) {
+	b := messaging.NewMemoryBroker()
+	client := b.NewClient()
+	h := NewHomekit(newTestBridge(), nil)
+
+	d := device.NewDevice("light/a", client)
+	if err := d.UnmarshalJSON([]byte(`{"type": "lightbulb", "feature": {"on": {}, "brightness": {}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	h.Updated(d)
+	brightness := h.devices["light/a"].characteristics["brightness"]
+
+	d = device.NewDevice("light/a", client)
+	if err := d.UnmarshalJSON([]byte(`{"type": "lightbulb", "feature": {"on": {}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	h.Updated(d)
+	client.Publish("light/a/brightness/get", []byte("50"), 1, false)
+	b.Wait()
+	if brightness.Value == 50 {
+		t.Error("Expected the replaced accessory to be unsubscribed from brightness")
+	}
+}
+
+func TestCustomCharacteristic(t *testing.T) {
+	b := newTestBridge()
+	h := NewHomekit(b, nil)
+	h.Updated(newShardTestDevice(t, "power/meter", `{
+		"type": "E863F007-079E-48FF-8F27-9C2605A29F52",
+		"feature": {
+			"power": {"characteristic": {"type": "e863f10d-079e-48ff-8f27-9c2605a29f52", "format": "float", "unit": "W", "minValue": 0, "maxValue": 3680}},
+			"mode": {"characteristic": {"type": "0000000D-0000-1000-8000-0026BB765291", "format": "uint8", "perms": ["pr", "pw", "ev"], "validValues": [1, 3]}},
+			"bogus": {"characteristic": {"type": "power", "format": "float"}}
+		}
+	}`))
+
+	dh := h.devices["power/meter"]
+	if dh == nil || dh.mainService == nil || dh.mainService.Type != "E863F007-079E-48FF-8F27-9C2605A29F52" {
+		t.Fatal("Expected a service with the custom type")
+	}
+	if _, ok := dh.characteristics["bogus"]; ok {
+		t.Error("Expected characteristic without a UUID to be ignored")
+	}
+	power := dh.characteristics["power"]
+	if power.Type != "E863F10D-079E-48FF-8F27-9C2605A29F52" || power.Unit != "W" || power.MaxValue != 3680.0 || len(power.Perms) != 2 {
+		t.Errorf("Unexpected power characteristic %+v", power)
+	}
+	mode := dh.characteristics["mode"]
+	if mode.Type != "D" || mode.Value != 1 || len(mode.Perms) != 3 {
+		t.Errorf("Unexpected mode characteristic %+v", mode)
+	}
+	// IDs of full UUIDs are hashed instead of overflowing
+	if power.ID < 1<<39 || power.ID >= 1<<40 || power.ID == dh.mainService.ID {
+		t.Errorf("Expected a hashed ID for the power characteristic, got %#x (service %#x)", power.ID, dh.mainService.ID)
+	}
+
+	dh.onUpdate("power", []byte("1200.5"))
+	if power.Value != 1200.5 {
+		t.Errorf("Expected power to be updated, got %v", power.Value)
+	}
+	dh.onUpdate("mode", []byte("2"))
+	if mode.Value != 1 {
+		t.Errorf("Expected invalid mode to be ignored, got %v", mode.Value)
+	}
+}
+
+func TestFeaturePermissions(t *testing.T) {
+	b := newTestBridge()
+	h := NewHomekit(b, nil)
+	h.Updated(newShardTestDevice(t, "lock/door", `{
+		"type": "lockMechanism",
+		"feature": {
+			"lockCurrentState": {"hidden": true, "notify": false},
+			"lockTargetState": {"readOnly": true}
+		},
+		"services": [{"type": "switch", "feature": {"on": {"writeOnly": true, "readOnly": true}}}]
+	}`))
+
+	dh := h.devices["lock/door"]
+	var tests = []struct {
+		key   string
+		perms []string
+	}{
+		{"lockCurrentState", []string{"pr", "hd"}},
+		{"lockTargetState", []string{"pr", "ev"}},
+	}
+	for _, tt := range tests {
+		ch, ok := dh.characteristics[tt.key]
+		if !ok {
+			t.Errorf("Expected characteristic %s", tt.key)
+			continue
+		}
+		if strings.Join(ch.Perms, ",") != strings.Join(tt.perms, ",") {
+			t.Errorf("Expected %s to have permissions %v, got %v", tt.key, tt.perms, ch.Perms)
+		}
+	}
+	if _, ok := dh.characteristics["switch/on"]; ok {
+		t.Error("Expected feature that's both read-only and write-only to be ignored")
+	}
+
+	h.Updated(newShardTestDevice(t, "switch/bell", `{"type": "switch", "feature": {"on": {"writeOnly": true}}}`))
+	if perms := h.devices["switch/bell"].characteristics["on"].Perms; strings.Join(perms, ",") != "pw" {
+		t.Errorf("Expected write-only permissions, got %v", perms)
+	}
+	h.Updated(newShardTestDevice(t, "button/hall", `{"type": "statelessProgrammableSwitch", "feature": {"programmableSwitchEvent": {"notify": false}}}`))
+	if perms := h.devices["button/hall"].characteristics["programmableSwitchEvent"].Perms; !hasPerm(perms, "ev") {
+		t.Errorf("Expected presses to keep sending events, got %v", perms)
+	}
+}
+
+type testMessage struct {
+	payload  string
+	retained bool
+}
+
+func (m testMessage) Topic() string   { return "" }
+func (m testMessage) Payload() []byte { return []byte(m.payload) }
+func (m testMessage) Retained() bool  { return m.retained }
+
+func TestProgrammableSwitchEvent(t *testing.T) {
+	m := &messaging.TestingMessenger{}
+	d := device.NewDevice("button/hall", m)
+	if err := d.UnmarshalJSON([]byte(`{"type": "statelessProgrammableSwitch", "feature": {"programmableSwitchEvent": {}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHomekit(newTestBridge(), nil)
+	h.Updated(d)
+
+	ch := h.devices["button/hall"].characteristics["programmableSwitchEvent"]
+	if ch.Value != nil {
+		t.Errorf("Expected no value before the first press, got %v", ch.Value)
+	}
+	var events []interface{}
+	ch.OnValueUpdate(func(c *characteristic.Characteristic, new, old interface{}) {
+		events = append(events, new)
+	})
+
+	for _, msg := range []testMessage{{"single", false}, {"single", false}, {"release", false}, {"hold", false}, {"double", true}, {"1", false}} {
+		m.Callback(msg)
+	}
+	if fmt.Sprint(events) != "[0 0 2 1]" {
+		t.Errorf("Expected events [0 0 2 1], got %v", events)
+	}
+	if ch.Value != nil {
+		t.Errorf("Expected no value after an event, got %v", ch.Value)
+	}
+}
+
+func TestServiceLabels(t *testing.T) {
+	h := NewHomekit(newTestBridge(), nil)
+	h.Updated(newShardTestDevice(t, "remote/living", `{
+		"services": [
+			{"id": "up", "type": "statelessProgrammableSwitch", "feature": {"programmableSwitchEvent": {}}},
+			{"id": "down", "type": "statelessProgrammableSwitch", "labelIndex": 1, "feature": {"programmableSwitchEvent": {}}},
+			{"id": "off", "type": "statelessProgrammableSwitch", "feature": {"programmableSwitchEvent": {}}}
+		]
+	}`))
+
+	dh := h.devices["remote/living"]
+	if dh.labelService == nil {
+		t.Fatal("Expected a service label service")
+	}
+	for id, exp := range map[string]int{"up": 2, "down": 1, "off": 3} {
+		svc := dh.services[id]
+		index := -1
+		for _, c := range svc.Characteristics {
+			if c.Type == characteristic.TypeServiceLabelIndex {
+				index = c.Value.(int)
+			}
+		}
+		if index != exp {
+			t.Errorf("Expected %s to have label index %d, got %d", id, exp, index)
+		}
+	}
+}
+
+func TestFailedSetReverts(t *testing.T) {
+	m := &messaging.TestingMessenger{}
+	d := device.NewDevice("light/hall", m)
+	if err := d.UnmarshalJSON([]byte(`{"type": "lightbulb", "feature": {"on": {}, "brightness": {}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHomekit(newTestBridge(), nil)
+	h.Updated(d)
+	on := h.devices["light/hall"].characteristics["on"]
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	on.UpdateValueFromConnection(true, conn)
+	if m.Action != "publish" || on.Value != true {
+		t.Fatalf("Expected set to be published and kept, got %s and %v", m.Action, on.Value)
+	}
+
+	m.Err = errors.New("not connected")
+	on.UpdateValueFromConnection(false, conn)
+	if on.Value != true {
+		t.Errorf("Expected failed set to revert to true, got %v", on.Value)
+	}
+}
+
+func TestMemoryBrokerFlow(t *testing.T) {
+	b := messaging.NewMemoryBroker()
+	m := device.NewManager(b.NewClient(), nil)
+	h := NewHomekit(newTestBridge(), m)
+	m.AddHandler(h)
+	b.NewClient().Subscribe("announce/#", 1, func(msg messaging.Message) {
+		m.Add(strings.TrimPrefix(msg.Topic(), "announce/"), msg.Payload())
+	})
+
+	lamp := b.NewClient()
+	lamp.Publish("lightbulb/hall/on/get", []byte("1"), 1, true)
+	sets := make(chan string, 1)
+	lamp.Subscribe("lightbulb/hall/on/set", 1, func(msg messaging.Message) {
+		sets <- string(msg.Payload())
+	})
+	lamp.Publish("announce/lightbulb/hall", []byte(`{"type": "lightbulb", "feature": {"on": {}}}`), 1, true)
+
+	var holder *deviceHolder
+	for deadline := time.Now().Add(time.Second); holder == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected an accessory for the announced device")
+		}
+		time.Sleep(time.Millisecond)
+		h.lock.RLock()
+		holder = h.devices["lightbulb/hall"]
+		h.lock.RUnlock()
+	}
+	b.Wait()
+	on := holder.characteristics["on"]
+	if on.Value != true {
+		t.Errorf("Expected the retained value to turn the light on, got %v", on.Value)
+	}
+
+	lamp.Publish("lightbulb/hall/on/get", []byte("0"), 1, true)
+	b.Wait()
+	if on.Value != false {
+		t.Errorf("Expected the light to be turned off, got %v", on.Value)
+	}
+
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	on.UpdateValueFromConnection(true, conn)
+	select {
+	case set := <-sets:
+		if set != "1" {
+			t.Errorf("Expected HomeKit to set the light to 1, got %s", set)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected HomeKit to set the light")
+	}
+}
+
+func TestStaleWithoutCharacteristics(t *testing.T) {
+	b := messaging.NewMemoryBroker()
+	m := device.NewManager(b.NewClient(), nil)
+	h := NewHomekit(newTestBridge(), m)
+	m.AddHandler(h)
+	b.NewClient().Subscribe("announce/#", 1, func(msg messaging.Message) {
+		m.Add(strings.TrimPrefix(msg.Topic(), "announce/"), msg.Payload())
+	})
+	reachable := func() bool {
+		for _, s := range m.Snapshot() {
+			return s.Reachable
+		}
+		return false
+	}
+
+	// HomeKit has no characteristic for the feature, so it doesn't
+	// subscribe to it, but the device is still seen publishing
+	meter := b.NewClient()
+	meter.Publish("announce/power/meter", []byte(`{"type": "outlet", "staleAfter": 1, "feature": {"wattage": {}}}`), 1, true)
+	for i := 0; i < 5; i++ {
+		meter.Publish("power/meter/wattage/get", []byte(fmt.Sprint(100+i)), 1, false)
+		b.Wait()
+		time.Sleep(400 * time.Millisecond)
+	}
+	if !reachable() {
+		t.Error("Expected the device to be reachable while it publishes")
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if reachable() {
+		t.Error("Expected the device to be unreachable once it stopped publishing")
+	}
+}
+
+func TestReannounceRemovesServicesAndSnapshot(t *testing.T) {
+	b := newTestBridge()
+	h := NewHomekit(b, nil)
+	d := newShardTestDevice(t, "doorbell/front", `{"type": "doorbell", "snapshot": {}, "feature": {"programmableSwitchEvent": {}}, "services": [{"type": "lightbulb", "feature": {"on": {}}}]}`)
+	h.Updated(d)
+	old := h.devices["doorbell/front"].accessory
+	if _, err := b.snapshots(old.ID, 100, 100); err == bridge.ErrNoSnapshot {
+		t.Fatal("Expected the doorbell to be a camera")
+	}
+
+	h.Updated(newShardTestDevice(t, "doorbell/front", `{"type": "doorbell", "feature": {"programmableSwitchEvent": {}}}`))
+	acc := h.devices["doorbell/front"].accessory
+	if acc == old || !b.accessories[acc] || b.accessories[old] {
+		t.Fatal("Expected the accessory to be replaced")
+	}
+	if len(acc.Services) >= len(old.Services) {
+		t.Errorf("Expected the accessory to lose services, had %d and has %d", len(old.Services), len(acc.Services))
+	}
+	if _, err := b.snapshots(acc.ID, 100, 100); err != bridge.ErrNoSnapshot {
+		t.Errorf("Expected the doorbell to no longer be a camera, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package qrcode
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// Terminal renders the code with ANSI colors and half blocks, so that two
+// rows of modules fit on a line.
+func (c *Code) Terminal() string {
+	var b strings.Builder
+	for y := -quietZone; y < c.Size+quietZone; y += 2 {
+		b.WriteString("\x1b[30;107m")
+		for x := -quietZone; x < c.Size+quietZone; x++ {
+			top, bottom := c.Dark(x, y), c.Dark(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	return b.String()
+}
+
+// Image returns the code as a grayscale image, with each module scale
+// pixels wide.
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	size := (c.Size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			v := color.Gray{Y: 0xFF}
+			if c.Dark(px/scale-quietZone, py/scale-quietZone) {
+				v = color.Gray{Y: 0}
+			}
+			img.SetGray(px, py, v)
+		}
+	}
+	return img
+}
+
+// PNG renders the code as a PNG image, with each module scale pixels wide.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, c.Image(scale)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
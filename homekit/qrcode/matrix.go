@@ -0,0 +1,271 @@
+package qrcode
+
+// matrix is a QR code under construction. Function modules, like the
+// finder patterns, are marked reserved so data isn't drawn over them.
+type matrix struct {
+	size     int
+	modules  []bool
+	reserved []bool
+}
+
+func newMatrix(ver int) *matrix {
+	size := 17 + 4*ver
+	return &matrix{
+		size:     size,
+		modules:  make([]bool, size*size),
+		reserved: make([]bool, size*size),
+	}
+}
+
+// Code returns the finished code.
+func (m *matrix) Code() *Code {
+	return &Code{Size: m.size, modules: m.modules}
+}
+
+func (m *matrix) get(x, y int) bool {
+	return m.modules[y*m.size+x]
+}
+
+// set sets a function module.
+func (m *matrix) set(x, y int, dark bool) {
+	m.modules[y*m.size+x] = dark
+	m.reserved[y*m.size+x] = true
+}
+
+func (m *matrix) drawFunctionPatterns(ver int) {
+	for i := 0; i < m.size; i++ {
+		m.set(6, i, i%2 == 0)
+		m.set(i, 6, i%2 == 0)
+	}
+
+	m.drawFinder(3, 3)
+	m.drawFinder(m.size-4, 3)
+	m.drawFinder(3, m.size-4)
+
+	align := versions[ver].alignment
+	last := len(align) - 1
+	for i, x := range align {
+		for j, y := range align {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				// Overlaps a finder pattern
+				continue
+			}
+			m.drawAlignment(x, y)
+		}
+	}
+
+	// Reserve the format areas, they're drawn once the mask is known
+	m.drawFormat(0)
+	m.drawVersion(ver)
+}
+
+// drawFinder draws a finder pattern and its separator around x, y.
+func (m *matrix) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= m.size || yy >= m.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			m.set(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern around x, y.
+func (m *matrix) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			m.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormat draws the error correction level and mask, twice.
+func (m *matrix) drawFormat(mask int) {
+	// Error correction level M is 00
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool {
+		return bits>>uint(i)&1 == 1
+	}
+
+	for i := 0; i <= 5; i++ {
+		m.set(8, i, bit(i))
+	}
+	m.set(8, 7, bit(6))
+	m.set(8, 8, bit(7))
+	m.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		m.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		m.set(m.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		m.set(8, m.size-15+i, bit(i))
+	}
+	m.set(8, m.size-8, true)
+}
+
+// drawVersion draws the version information of versions 7 and up.
+func (m *matrix) drawVersion(ver int) {
+	if ver < 7 {
+		return
+	}
+	rem := ver
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := ver<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>uint(i)&1 == 1
+		a, b := m.size-11+i%3, i/3
+		m.set(a, b, dark)
+		m.set(b, a, dark)
+	}
+}
+
+// drawCodewords draws the data in the zig-zag pattern of two columns wide,
+// starting at the bottom right and skipping the vertical timing pattern.
+func (m *matrix) drawCodewords(data []byte) {
+	i := 0
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < m.size; vert++ {
+			y := vert
+			if upward {
+				y = m.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if m.reserved[y*m.size+x] || i >= len(data)*8 {
+					continue
+				}
+				m.modules[y*m.size+x] = data[i/8]>>uint(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func (m *matrix) applyMask(mask int) {
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			if m.reserved[y*m.size+x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				m.modules[y*m.size+x] = !m.modules[y*m.size+x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to scan, lower is better.
+func (m *matrix) penalty() int {
+	p := 0
+	for i := 0; i < m.size; i++ {
+		p += m.linePenalty(func(j int) bool { return m.get(j, i) })
+		p += m.linePenalty(func(j int) bool { return m.get(i, j) })
+	}
+
+	dark := 0
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			c := m.get(x, y)
+			if c {
+				dark++
+			}
+			if x < m.size-1 && y < m.size-1 && c == m.get(x+1, y) && c == m.get(x, y+1) && c == m.get(x+1, y+1) {
+				p += 3
+			}
+		}
+	}
+
+	total := m.size * m.size
+	p += abs(dark*20-total*10) / total * 10
+	return p
+}
+
+// finderLike is the pattern of a finder pattern with light modules on one
+// side, which scanners could mistake for a real one.
+var finderLike = []bool{true, false, true, true, true, false, true, false, false, false, false}
+
+// linePenalty scores runs of modules of the same color and patterns that
+// look like finder patterns in a row or column.
+func (m *matrix) linePenalty(at func(int) bool) int {
+	p := 0
+	run := 1
+	for j := 1; j <= m.size; j++ {
+		if j < m.size && at(j) == at(j-1) {
+			run++
+			continue
+		}
+		if run >= 5 {
+			p += run - 2
+		}
+		run = 1
+	}
+
+	for j := 0; j+len(finderLike) <= m.size; j++ {
+		forward, backward := true, true
+		for k, dark := range finderLike {
+			if at(j+k) != dark {
+				forward = false
+			}
+			if at(j+len(finderLike)-1-k) != dark {
+				backward = false
+			}
+		}
+		if forward {
+			p += 40
+		}
+		if backward {
+			p += 40
+		}
+	}
+	return p
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,207 @@
+// Package qrcode encodes short texts, like the HomeKit setup URI, as QR
+// codes. It only supports byte mode with error correction level M and
+// versions up to 10, which is plenty for a setup URI.
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// quietZone is the number of light modules around the code.
+const quietZone = 4
+
+// ErrTooLong is returned when the data doesn't fit in the largest supported
+// version.
+var ErrTooLong = errors.New("qrcode: data too long")
+
+// Code is a QR code, a square of Size by Size modules.
+type Code struct {
+	Size    int
+	modules []bool
+}
+
+// Dark returns whether the module at x, y is dark. Modules outside of the
+// code are light.
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y*c.Size+x]
+}
+
+// SVG renders the code as an SVG image, with each module scale pixels wide.
+func (c *Code) SVG(scale int) []byte {
+	if scale < 1 {
+		scale = 1
+	}
+	size := (c.Size + 2*quietZone) * scale
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, c.Size+2*quietZone, c.Size+2*quietZone)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="`)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Dark(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+// block describes the error correction blocks of a version: count blocks
+// of data codewords each.
+type block struct {
+	count, data int
+}
+
+// version describes the layout of a QR code version at error correction
+// level M.
+type version struct {
+	ec        int // error correction codewords per block
+	blocks    []block
+	alignment []int
+}
+
+var versions = []version{
+	1:  {10, []block{{1, 16}}, nil},
+	2:  {16, []block{{1, 28}}, []int{6, 18}},
+	3:  {26, []block{{1, 44}}, []int{6, 22}},
+	4:  {18, []block{{2, 32}}, []int{6, 26}},
+	5:  {24, []block{{2, 43}}, []int{6, 30}},
+	6:  {16, []block{{4, 27}}, []int{6, 34}},
+	7:  {18, []block{{4, 31}}, []int{6, 22, 38}},
+	8:  {22, []block{{2, 38}, {2, 39}}, []int{6, 24, 42}},
+	9:  {22, []block{{3, 36}, {2, 37}}, []int{6, 26, 46}},
+	10: {26, []block{{4, 43}, {1, 44}}, []int{6, 28, 50}},
+}
+
+func (v version) dataCodewords() int {
+	n := 0
+	for _, b := range v.blocks {
+		n += b.count * b.data
+	}
+	return n
+}
+
+// Encode encodes data as a QR code.
+func Encode(data []byte) (*Code, error) {
+	ver := 0
+	for i := 1; i < len(versions); i++ {
+		countBits := 8
+		if i >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*versions[i].dataCodewords() {
+			ver = i
+			break
+		}
+	}
+	if ver == 0 {
+		return nil, ErrTooLong
+	}
+	v := versions[ver]
+
+	codewords := interleave(v, encodeData(ver, data))
+
+	best := (*Code)(nil)
+	bestPenalty := 0
+	for mask := 0; mask < 8; mask++ {
+		c := newMatrix(ver)
+		c.drawFunctionPatterns(ver)
+		c.drawCodewords(codewords)
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); best == nil || p < bestPenalty {
+			best, bestPenalty = c.Code(), p
+		}
+	}
+	return best, nil
+}
+
+// encodeData returns the data codewords for data in byte mode, including
+// the terminator and padding.
+func encodeData(ver int, data []byte) []byte {
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	if ver < 10 {
+		bits.append(len(data), 8)
+	} else {
+		bits.append(len(data), 16)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	capacity := 8 * versions[ver].dataCodewords()
+	for i := 0; i < 4 && bits.len() < capacity; i++ {
+		bits.append(0, 1)
+	}
+	for bits.len()%8 != 0 {
+		bits.append(0, 1)
+	}
+	for pad := 0; bits.len() < capacity; pad++ {
+		if pad%2 == 0 {
+			bits.append(0xEC, 8)
+		} else {
+			bits.append(0x11, 8)
+		}
+	}
+	return bits.bytes()
+}
+
+// interleave splits the data into blocks, adds error correction and
+// interleaves the codewords of the blocks.
+func interleave(v version, data []byte) []byte {
+	var dataBlocks, ecBlocks [][]byte
+	for _, b := range v.blocks {
+		for i := 0; i < b.count; i++ {
+			block := data[:b.data]
+			data = data[b.data:]
+			dataBlocks = append(dataBlocks, block)
+			ecBlocks = append(ecBlocks, reedSolomon(block, v.ec))
+		}
+	}
+
+	var out []byte
+	longest := v.blocks[len(v.blocks)-1].data
+	for i := 0; i < longest; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.ec; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+type bitBuffer struct {
+	bits []bool
+}
+
+func (b *bitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		b.bits = append(b.bits, value>>uint(i)&1 == 1)
+	}
+}
+
+func (b *bitBuffer) len() int {
+	return len(b.bits)
+}
+
+func (b *bitBuffer) bytes() []byte {
+	out := make([]byte, (len(b.bits)+7)/8)
+	for i, bit := range b.bits {
+		if bit {
+			out[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return out
+}
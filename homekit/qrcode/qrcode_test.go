@@ -0,0 +1,201 @@
+package qrcode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// HELLO WORLD at version 1-M
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	exp := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomon(data, 10); !bytes.Equal(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestFormatAndVersion(t *testing.T) {
+	m := newMatrix(7)
+	m.drawFormat(0)
+	bits := 0
+	for i := 0; i <= 5; i++ {
+		if m.get(8, i) {
+			bits |= 1 << uint(i)
+		}
+	}
+	// M with mask 0 is 101010000010010, of which we read the lowest 6 bits
+	if bits != 0x12 {
+		t.Errorf("Expected format bits 0x12, got %#x", bits)
+	}
+
+	m.drawVersion(7)
+	bits = 0
+	for i := 0; i < 18; i++ {
+		if m.get(m.size-11+i%3, i/3) {
+			bits |= 1 << uint(i)
+		}
+	}
+	if bits != 0x07C94 {
+		t.Errorf("Expected version bits 0x07C94, got %#x", bits)
+	}
+}
+
+// readCodewords reads back the codewords of a code by undoing the mask
+// it was drawn with.
+func readCodewords(c *Code, ver, mask int) []byte {
+	ref := newMatrix(ver)
+	ref.drawFunctionPatterns(ver)
+	m := &matrix{size: c.Size, modules: append([]bool{}, c.modules...), reserved: ref.reserved}
+	m.applyMask(mask)
+
+	var bits bitBuffer
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < m.size; vert++ {
+			y := vert
+			if upward {
+				y = m.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				if x := right - j; !m.reserved[y*m.size+x] {
+					b := 0
+					if m.get(x, y) {
+						b = 1
+					}
+					bits.append(b, 1)
+				}
+			}
+		}
+	}
+	return bits.bytes()
+}
+
+func TestEncode(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		ver  int
+	}{
+		{"X-HM://0023ISYWYHOME", 2},
+		{strings.Repeat("a", 100), 6},
+		{strings.Repeat("b", 150), 8},
+	} {
+		c, err := Encode([]byte(tc.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Size != 17+4*tc.ver {
+			t.Errorf("Expected version %d for %d bytes, got size %d", tc.ver, len(tc.data), c.Size)
+			continue
+		}
+		if !c.Dark(0, 0) || c.Dark(7, 7) || !c.Dark(8, c.Size-8) {
+			t.Error("Expected finder patterns and dark module")
+		}
+
+		// Read the mask from the format bits
+		mask := 0
+		for i := 10; i <= 12; i++ {
+			if c.Dark(14-i, 8) {
+				mask |= 1 << uint(i-10)
+			}
+		}
+		mask ^= 0x5412 >> 10 & 7
+
+		exp := interleave(versions[tc.ver], encodeData(tc.ver, []byte(tc.data)))
+		got := readCodewords(c, tc.ver, mask)
+		if !bytes.HasPrefix(got, exp) {
+			t.Errorf("Expected codewords %v, got %v", exp, got)
+		}
+	}
+
+	if _, err := Encode(make([]byte, 300)); err != ErrTooLong {
+		t.Error("Expected ErrTooLong, got ", err)
+	}
+}
+
+// setupCode is the code for X-HM://0023ISYWY1QJ8, the setup URI of a bridge
+// with pin 031-45-154 and setup ID 1QJ8, as drawn by the QR code generator
+// of Kazuhiko Arase. # is a dark module.
+var setupCode = []string{
+	"#######.##.##.###.#######",
+	"#.....#.#.#.#.#.#.#.....#",
+	"#.###.#..#.#.##.#.#.###.#",
+	"#.###.#.##.##.###.#.###.#",
+	"#.###.#....#.###..#.###.#",
+	"#.....#..#..#.....#.....#",
+	"#######.#.#.#.#.#.#######",
+	"........#####.#..........",
+	"#.##.###.#..#..#..#..#.##",
+	"#.#.#.....########...##.#",
+	"#.#..####.##..#.##..#....",
+	"##..##..#..#.#.#..##.###.",
+	".##.#.##...#...##.####.#.",
+	".####...####.##.#.#.#####",
+	".###.##...#.#.#....#.##..",
+	"#.##.#..###.##.#.#...#..#",
+	"..#######.##...##########",
+	"........##..##.##...#..#.",
+	"#######.#..##..##.#.#####",
+	"#.....#.##..#..##...#..#.",
+	"#.###.#..#####..#####..#.",
+	"#.###.#.#.#.###.#####.###",
+	"#.###.#.######...#..####.",
+	"#.....#..##....##.#.#.#..",
+	"#######.#...#.#..########",
+}
+
+func TestEncodeReference(t *testing.T) {
+	c, err := Encode([]byte("X-HM://0023ISYWY1QJ8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size != len(setupCode) {
+		t.Fatalf("Expected size %d, got %d", len(setupCode), c.Size)
+	}
+	for y, row := range setupCode {
+		for x, m := range row {
+			if c.Dark(x, y) != (m == '#') {
+				t.Fatalf("Expected module %d,%d to be dark=%t", x, y, m == '#')
+			}
+		}
+	}
+}
+
+func TestSVG(t *testing.T) {
+	c, _ := Encode([]byte("hemtjanst"))
+	svg := string(c.SVG(4))
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, `width="116"`) {
+		t.Error("Expected a 116 pixel wide SVG, got ", svg)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	c, _ := Encode([]byte("hemtjanst"))
+	lines := strings.Split(strings.TrimSuffix(c.Terminal(), "\n"), "\n")
+	if len(lines) != (c.Size+2*quietZone+1)/2 {
+		t.Errorf("Expected %d lines, got %d", (c.Size+2*quietZone+1)/2, len(lines))
+	}
+	if !strings.Contains(lines[2], "█▀▀▀▀▀█") {
+		t.Error("Expected the top of a finder pattern, got ", lines[2])
+	}
+}
+
+func TestImage(t *testing.T) {
+	c, _ := Encode([]byte("hemtjanst"))
+	img := c.Image(2)
+	if size := img.Bounds().Dx(); size != (c.Size+2*quietZone)*2 {
+		t.Error("Expected image of the code and quiet zone, got width ", size)
+	}
+	if r, _, _, _ := img.At(quietZone*2, quietZone*2).RGBA(); r != 0 {
+		t.Error("Expected dark top left module")
+	}
+	if r, _, _, _ := img.At(0, 0).RGBA(); r == 0 {
+		t.Error("Expected light quiet zone")
+	}
+	if _, err := c.PNG(2); err != nil {
+		t.Error(err)
+	}
+}
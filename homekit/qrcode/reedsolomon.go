@@ -0,0 +1,50 @@
+package qrcode
+
+// exp and log are the exponent and logarithm tables of GF(256) with the
+// polynomial 0x11D used by QR codes.
+var exp, log [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return exp[(int(log[a])+int(log[b]))%255]
+}
+
+// reedSolomon returns the n error correction codewords for data.
+func reedSolomon(data []byte, n int) []byte {
+	// The generator polynomial (x - α^0)(x - α^1)...(x - α^(n-1)), highest
+	// degree first
+	gen := []byte{1}
+	for i := 0; i < n; i++ {
+		next := make([]byte, len(gen)+1)
+		for j, c := range gen {
+			next[j] ^= c
+			next[j+1] ^= mul(c, exp[i])
+		}
+		gen = next
+	}
+
+	rem := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for j := range rem {
+			rem[j] ^= mul(gen[j+1], factor)
+		}
+	}
+	return rem
+}
@@ -0,0 +1,150 @@
+package homekit
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hemtjanst/hemtjanst/device"
+)
+
+// maxAccessories is the number of accessories HomeKit accepts on a single
+// bridge, not counting the bridge itself.
+var maxAccessories = 149
+
+// UseAssignments restores which bridge devices were assigned to from the
+// file at path and keeps it up to date, so devices stay on the same bridge
+// across restarts even if the number of bridges changes. Call it before
+// adding the Homekit as a handler.
+func (h *Homekit) UseAssignments(path string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.assignmentsPath = path
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Bridges are numbered from 1 in the file, like in the metadata
+	assignments := map[string]int{}
+	if err := json.Unmarshal(b, &assignments); err != nil {
+		return err
+	}
+	for topic, n := range assignments {
+		if n > 0 {
+			h.assigned[topic] = n - 1
+		}
+	}
+	return nil
+}
+
+func (h *Homekit) saveAssignments() {
+	if h.assignmentsPath == "" {
+		return
+	}
+	assignments := make(map[string]int, len(h.assigned))
+	for topic, i := range h.assigned {
+		assignments[topic] = i + 1
+	}
+	b, err := json.MarshalIndent(assignments, "", "  ")
+	if err == nil {
+		tmp, err := ioutil.TempFile(filepath.Dir(h.assignmentsPath), ".bridges")
+		if err == nil {
+			_, err = tmp.Write(b)
+			if cerr := tmp.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = os.Rename(tmp.Name(), h.assignmentsPath)
+			}
+			if err != nil {
+				os.Remove(tmp.Name())
+			}
+		}
+	}
+	if err != nil {
+		log.Print("Could not save bridge assignments: ", err)
+	}
+}
+
+// assign returns the index of the bridge d belongs on. That's the bridge
+// set in its metadata, or else the one it was assigned to before. New
+// devices are assigned by a hash of their topic, moving on to the next
+// bridge if that one is full. It doesn't record the assignment, keep does
+// that once the accessory was built. The Homekit must be locked.
+func (h *Homekit) assign(d *device.Device) int {
+	n := len(h.bridges)
+	prev, assigned := h.assigned[d.Topic]
+
+	i := -1
+	switch {
+	case d.Bridge > 0 && d.Bridge <= n:
+		i = d.Bridge - 1
+	case d.Bridge > n:
+		log.Printf("Device %s wants bridge %d but there are only %d, assigning it automatically", d.Topic, d.Bridge, n)
+	}
+	if i < 0 && assigned && prev < n {
+		i = prev
+	}
+	if i < 0 {
+		// Devices that were assigned but haven't been announced yet still
+		// take up their place
+		counts := make([]int, n)
+		for _, j := range h.assigned {
+			if j < n {
+				counts[j]++
+			}
+		}
+		f := fnv.New32a()
+		f.Write([]byte(d.Topic))
+		start := int(f.Sum32() % uint32(n))
+		i = start
+		for j := 0; j < n; j++ {
+			if k := (start + j) % n; counts[k] < maxAccessories {
+				i = k
+				break
+			}
+		}
+		if counts[i] >= maxAccessories {
+			log.Printf("All bridges have %d accessories, HomeKit won't accept %s", maxAccessories, d.Topic)
+		}
+	}
+
+	return i
+}
+
+// keep records that the device at topic is on bridge i. The Homekit must be
+// locked.
+func (h *Homekit) keep(topic string, i int) {
+	if prev, ok := h.assigned[topic]; !ok || prev != i {
+		h.assigned[topic] = i
+		h.saveAssignments()
+	}
+}
+
+// ExpireAssignments forgets the bridges of devices that don't have an
+// accessory, because they weren't announced again since UseAssignments
+// restored their assignment, so they stop taking up a place on it. Call it
+// once devices had the time to answer the discover. It returns the number
+// of assignments it dropped.
+func (h *Homekit) ExpireAssignments() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	n := 0
+	for topic := range h.assigned {
+		if _, ok := h.devices[topic]; !ok {
+			delete(h.assigned, topic)
+			n++
+		}
+	}
+	if n > 0 {
+		h.saveAssignments()
+	}
+	return n
+}
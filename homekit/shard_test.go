@@ -0,0 +1,177 @@
+package homekit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/hemtjanst/hemtjanst/device"
+	"github.com/hemtjanst/hemtjanst/homekit/bridge"
+	"github.com/hemtjanst/hemtjanst/messaging"
+)
+
+type testBridge struct {
+	bridge.Bridge
+	accessories map[*accessory.Accessory]bool
+	ids         *bridge.IDMap
+	snapshots   bridge.SnapshotFunc
+}
+
+func newTestBridge() *testBridge {
+	return &testBridge{accessories: map[*accessory.Accessory]bool{}, ids: bridge.NewIDMap(nil)}
+}
+
+func (b *testBridge) IDs() *bridge.IDMap                     { return b.ids }
+func (b *testBridge) HandleSnapshots(fn bridge.SnapshotFunc) { b.snapshots = fn }
+
+func (b *testBridge) AddAccessory(a *accessory.Accessory)    { b.accessories[a] = true }
+func (b *testBridge) RemoveAccessory(a *accessory.Accessory) { delete(b.accessories, a) }
+func (b *testBridge) ReplaceAccessory(old, new *accessory.Accessory) {
+	delete(b.accessories, old)
+	b.accessories[new] = true
+}
+
+func newShardTestDevice(t *testing.T, topic, meta string) *device.Device {
+	d := device.NewDevice(topic, &messaging.TestingMessenger{})
+	if err := d.UnmarshalJSON([]byte(meta)); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestSharding(t *testing.T) {
+	defer func(max int) { maxAccessories = max }(maxAccessories)
+	maxAccessories = 3
+
+	dir, err := ioutil.TempDir("", "hemtjanst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bridges.json")
+
+	bridges := []*testBridge{newTestBridge(), newTestBridge()}
+	h := NewShardedHomekit([]bridge.Bridge{bridges[0], bridges[1]}, nil)
+	if err := h.UseAssignments(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		h.Updated(newShardTestDevice(t, fmt.Sprintf("light/%d", i), `{"type": "lightbulb", "feature": {"on": {}}}`))
+	}
+	if len(bridges[0].accessories) != 3 || len(bridges[1].accessories) != 3 {
+		t.Fatalf("Expected 3 accessories on each bridge, got %d and %d", len(bridges[0].accessories), len(bridges[1].accessories))
+	}
+	assigned := map[string]int{}
+	for topic, i := range h.assigned {
+		assigned[topic] = i
+	}
+
+	// Assignments survive a restart, even with more bridges
+	bridges = []*testBridge{newTestBridge(), newTestBridge(), newTestBridge()}
+	h = NewShardedHomekit([]bridge.Bridge{bridges[0], bridges[1], bridges[2]}, nil)
+	if err := h.UseAssignments(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		topic := fmt.Sprintf("light/%d", i)
+		h.Updated(newShardTestDevice(t, topic, `{"type": "lightbulb", "feature": {"on": {}}}`))
+		if h.assigned[topic] != assigned[topic] {
+			t.Errorf("Expected %s to stay on bridge %d, got %d", topic, assigned[topic], h.assigned[topic])
+		}
+	}
+
+	// Metadata moves a device to another bridge
+	d := newShardTestDevice(t, "light/0", `{"type": "lightbulb", "bridge": 3, "feature": {"on": {}}}`)
+	h.Updated(d)
+	if h.assigned["light/0"] != 2 || len(bridges[2].accessories) != 1 {
+		t.Errorf("Expected light/0 to move to bridge 3, got %d", h.assigned["light/0"]+1)
+	}
+	if len(bridges[0].accessories)+len(bridges[1].accessories) != 5 {
+		t.Error("Expected light/0 to be removed from its old bridge")
+	}
+
+	h.Removed(d)
+	if len(bridges[2].accessories) != 0 {
+		t.Error("Expected light/0 to be removed")
+	}
+	if _, ok := h.assigned["light/0"]; ok {
+		t.Error("Expected the assignment of light/0 to be forgotten")
+	}
+}
+
+func TestShardingCountsAssignments(t *testing.T) {
+	defer func(max int) { maxAccessories = max }(maxAccessories)
+	maxAccessories = 3
+
+	dir, err := ioutil.TempDir("", "hemtjanst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bridges.json")
+	if err := ioutil.WriteFile(path, []byte(`{"light/0": 1, "light/1": 1, "light/2": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bridges := []*testBridge{newTestBridge(), newTestBridge()}
+	h := NewShardedHomekit([]bridge.Bridge{bridges[0], bridges[1]}, nil)
+	if err := h.UseAssignments(path); err != nil {
+		t.Fatal(err)
+	}
+	// The first bridge is full even though none of its devices are back yet
+	for i := 3; i < 6; i++ {
+		h.Updated(newShardTestDevice(t, fmt.Sprintf("light/%d", i), `{"type": "lightbulb", "feature": {"on": {}}}`))
+	}
+	if len(bridges[0].accessories) != 0 || len(bridges[1].accessories) != 3 {
+		t.Errorf("Expected the new devices on the second bridge, got %d and %d", len(bridges[0].accessories), len(bridges[1].accessories))
+	}
+}
+
+func TestShardingExpiresAssignments(t *testing.T) {
+	defer func(max int) { maxAccessories = max }(maxAccessories)
+	maxAccessories = 3
+
+	dir, err := ioutil.TempDir("", "hemtjanst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bridges.json")
+	if err := ioutil.WriteFile(path, []byte(`{"light/0": 1, "light/1": 1, "light/2": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bridges := []*testBridge{newTestBridge(), newTestBridge()}
+	h := NewShardedHomekit([]bridge.Bridge{bridges[0], bridges[1]}, nil)
+	if err := h.UseAssignments(path); err != nil {
+		t.Fatal(err)
+	}
+	h.Updated(newShardTestDevice(t, "light/0", `{"type": "lightbulb", "feature": {"on": {}}}`))
+	// Devices without an accessory don't get a bridge
+	h.Updated(newShardTestDevice(t, "broken/0", `{"type": "nonsense", "feature": {"on": {}}}`))
+	if _, ok := h.assigned["broken/0"]; ok {
+		t.Error("Expected broken/0 not to be assigned")
+	}
+
+	if n := h.ExpireAssignments(); n != 2 {
+		t.Errorf("Expected 2 assignments to expire, got %d", n)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "{\n  \"light/0\": 1\n}" {
+		t.Errorf("Expected only light/0 to be saved, got %s", b)
+	}
+	// The places of the expired devices are free again
+	for i := 3; i < 5; i++ {
+		h.Updated(newShardTestDevice(t, fmt.Sprintf("light/%d", i), `{"type": "lightbulb", "feature": {"on": {}}}`))
+		h.Updated(newShardTestDevice(t, fmt.Sprintf("light/%d", i+2), `{"type": "lightbulb", "feature": {"on": {}}}`))
+	}
+	if len(bridges[0].accessories) != 3 || len(bridges[1].accessories) != 2 {
+		t.Errorf("Expected 3 and 2 accessories, got %d and %d", len(bridges[0].accessories), len(bridges[1].accessories))
+	}
+}
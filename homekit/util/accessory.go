@@ -4,6 +4,8 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"hash/fnv"
+	"regexp"
 	"strings"
 
 	"github.com/brutella/hc/accessory"
@@ -14,16 +16,68 @@ func TopicToUint64(topic string) uint64 {
 	return binary.BigEndian.Uint64(append([]byte{0x0F}, sum[:7]...))
 }
 
+// HexToUint64 returns an ID for the type hexStr, or def if it isn't hex.
+// Short types, like the ones defined by Apple, are used as the ID. Full
+// UUIDs don't fit and are hashed into the range below 1<<40, above the
+// short types, so further instances can still be offset by multiples of
+// 1<<40.
 func HexToUint64(hexStr string, def uint64) uint64 {
-	if b, err := hex.DecodeString(hexStr); err == nil {
-		var ret uint64 = 0
-		for i := len(b) - 1; i >= 0; i-- {
-			ret = ret<<8 + uint64(b[i])
+	b, err := hex.DecodeString(strings.Replace(hexStr, "-", "", -1))
+	if err != nil {
+		return def
+	}
+	if len(b) > 4 {
+		f := fnv.New64a()
+		f.Write(b)
+		return 1<<39 | f.Sum64()&(1<<39-1)
+	}
+	var ret uint64 = 0
+	for i := len(b) - 1; i >= 0; i-- {
+		ret = ret<<8 + uint64(b[i])
+	}
+	// Static addition to avoid collision with auto-assigned ID:s
+	return ret + 0x100000000
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9A-F]{8}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{12}$`)
+
+// appleUUIDSuffix is what the UUIDs of the types defined by Apple end with.
+// hc refers to them by the part in front of it only.
+const appleUUIDSuffix = "-0000-1000-8000-0026BB765291"
+
+// UUID returns the HomeKit type for the UUID s, and false if s isn't a
+// UUID. Types defined by Apple are shortened to the form hc uses for them,
+// so they match the built-in types.
+func UUID(s string) (string, bool) {
+	s = strings.ToUpper(s)
+	if !uuidPattern.MatchString(s) {
+		return "", false
+	}
+	if strings.HasSuffix(s, appleUUIDSuffix) {
+		short := strings.TrimLeft(strings.TrimSuffix(s, appleUUIDSuffix), "0")
+		if short == "" {
+			short = "0"
+		}
+		return short, true
+	}
+	return s, true
+}
+
+// AssignIDs sets the ID of every service and characteristic on the
+// accessory based on its type, so that they stay the same across restarts.
+// When a type occurs more than once on the accessory every further
+// instance is offset to keep the IDs unique.
+func AssignIDs(a *accessory.Accessory) {
+	svcSeen := map[string]uint64{}
+	chSeen := map[string]uint64{}
+	for _, s := range a.GetServices() {
+		s.ID = HexToUint64(s.Type, s.ID) + svcSeen[s.Type]<<40
+		svcSeen[s.Type]++
+		for _, c := range s.GetCharacteristics() {
+			c.ID = HexToUint64(c.Type, c.ID) + chSeen[c.Type]<<40
+			chSeen[c.Type]++
 		}
-		// Static addition to avoid collision with auto-assigned ID:s
-		return ret + 0x100000000
 	}
-	return def
 }
 
 func AccessoryType(t string) accessory.AccessoryType {
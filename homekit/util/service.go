@@ -6,6 +6,8 @@ import (
 	"github.com/brutella/hc/service"
 )
 
+// ServiceType returns the HomeKit type of the service named t. t can also
+// be the UUID of a service that isn't built in.
 func ServiceType(t string) string {
 	switch strings.ToLower(t) {
 	case "accessoryinformation":
@@ -107,6 +109,7 @@ func ServiceType(t string) string {
 	case "windowcovering":
 		return service.TypeWindowCovering
 	default:
-		return ""
+		uuid, _ := UUID(t)
+		return uuid
 	}
 }
@@ -0,0 +1,239 @@
+// Package broker is an MQTT broker that runs inside the process using it.
+// It accepts MQTT 3.1.1 and MQTT 5 clients over the network, and clients in
+// the same process through NewClient, which don't go through the network
+// at all. ListenAndServeTLS serves clients over TLS.
+//
+// It's meant for small installations: sessions don't outlive their
+// connection, messages are kept in memory and shared subscriptions aren't
+// supported. Retained messages, wildcards and last wills work as usual.
+package broker
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+	"github.com/hemtjanst/hemtjanst/messaging/packet"
+)
+
+// DefaultMaxPacketSize is the largest packet clients may send when
+// Broker.MaxPacketSize isn't set.
+const DefaultMaxPacketSize = 1 << 20
+
+// ErrClosed is returned by Serve once the broker is closed.
+var ErrClosed = errors.New("broker closed")
+
+// message is a message routed through the broker.
+type message struct {
+	topic      string
+	payload    []byte
+	qos        byte
+	retain     bool
+	properties packet.Properties
+	// expires is when a retained message with a message expiry is
+	// dropped
+	expires time.Time
+}
+
+// session is a client of the broker.
+type session interface {
+	clientID() string
+	// deliver hands m to the session if it's subscribed to its topic.
+	// from is the session that published it.
+	deliver(from session, m *message)
+	// close ends the session because another one took over its client
+	// ID or the broker is closing.
+	close(reason packet.ReasonCode)
+}
+
+// Broker routes messages between its clients.
+type Broker struct {
+	// Authenticate checks the user name and password of clients
+	// connecting over the network. Every client is let in when it's nil.
+	Authenticate func(username, password string) bool
+	// MaxPacketSize is the largest packet in bytes that clients connected
+	// over the network may send, DefaultMaxPacketSize when it's 0.
+	// Clients sending larger packets are disconnected.
+	MaxPacketSize int
+
+	mutex     sync.Mutex
+	sessions  map[string]session
+	retained  map[string]*message
+	listeners map[net.Listener]bool
+	closed    bool
+	nextID    int
+}
+
+// New returns a broker without any listeners.
+func New() *Broker {
+	return &Broker{
+		sessions:  map[string]session{},
+		retained:  map[string]*message{},
+		listeners: map[net.Listener]bool{},
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves MQTT clients
+// connecting to it.
+func (b *Broker) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(l)
+}
+
+// ListenAndServeTLS listens on the TCP address addr and serves MQTT clients
+// connecting to it over TLS, with the certificate and key in certFile and
+// keyFile.
+func (b *Broker) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	l, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return err
+	}
+	return b.Serve(l)
+}
+
+// Serve serves MQTT clients connecting to l until the broker is closed.
+func (b *Broker) Serve(l net.Listener) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	b.listeners[l] = true
+	b.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			b.mutex.Lock()
+			closed := b.closed
+			delete(b.listeners, l)
+			b.mutex.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			return err
+		}
+		go b.serve(conn)
+	}
+}
+
+// Close stops all listeners and disconnects all clients.
+func (b *Broker) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	listeners := b.listeners
+	b.listeners = map[net.Listener]bool{}
+	sessions := b.sessions
+	b.sessions = map[string]session{}
+	b.mutex.Unlock()
+
+	for l := range listeners {
+		l.Close()
+	}
+	for _, s := range sessions {
+		s.close(packet.ServerShuttingDown)
+	}
+	return nil
+}
+
+// register adds s to the sessions, closing the session that had the same
+// client ID.
+func (b *Broker) register(s session) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrClosed
+	}
+	old := b.sessions[s.clientID()]
+	b.sessions[s.clientID()] = s
+	b.mutex.Unlock()
+	if old != nil {
+		log.Printf("Client %s connected again, closing its previous session", s.clientID())
+		old.close(packet.SessionTakenOver)
+	}
+	return nil
+}
+
+// unregister removes s from the sessions, unless another session took its
+// place.
+func (b *Broker) unregister(s session) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.sessions[s.clientID()] == s {
+		delete(b.sessions, s.clientID())
+	}
+}
+
+// assignID returns a client ID for a client that didn't bring one.
+func (b *Broker) assignID() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.nextID++
+	return fmt.Sprintf("broker-%d-%d", time.Now().Unix(), b.nextID)
+}
+
+// maxPacketSize returns the largest packet clients may send.
+func (b *Broker) maxPacketSize() int {
+	if b.MaxPacketSize > 0 {
+		return b.MaxPacketSize
+	}
+	return DefaultMaxPacketSize
+}
+
+// publish routes m to the subscribed sessions, and keeps it when it's
+// retained.
+func (b *Broker) publish(from session, m *message) {
+	b.mutex.Lock()
+	if m.retain {
+		if len(m.payload) == 0 {
+			delete(b.retained, m.topic)
+		} else {
+			kept := *m
+			if m.properties.MessageExpiry != nil {
+				kept.expires = time.Now().Add(time.Duration(*m.properties.MessageExpiry) * time.Second)
+			}
+			b.retained[m.topic] = &kept
+		}
+	}
+	sessions := make([]session, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mutex.Unlock()
+
+	for _, s := range sessions {
+		s.deliver(from, m)
+	}
+}
+
+// retainedFor returns the retained messages matching filter, dropping the
+// ones that expired.
+func (b *Broker) retainedFor(filter string) []*message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var res []*message
+	now := time.Now()
+	for topic, m := range b.retained {
+		if !m.expires.IsZero() && now.After(m.expires) {
+			delete(b.retained, topic)
+			continue
+		}
+		if messaging.Match(filter, topic) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
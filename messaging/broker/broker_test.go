@@ -0,0 +1,255 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+	"github.com/hemtjanst/hemtjanst/messaging/mqtt5"
+	"github.com/hemtjanst/hemtjanst/messaging/packet"
+)
+
+// testConn is a client connected over the network, driven by the test.
+type testConn struct {
+	t       *testing.T
+	conn    net.Conn
+	r       *bufio.Reader
+	version byte
+}
+
+func dial(t *testing.T, b *Broker, version byte) *testConn {
+	client, server := net.Pipe()
+	go b.serve(server)
+	return &testConn{t: t, conn: client, r: bufio.NewReader(client), version: version}
+}
+
+func (c *testConn) read() packet.Packet {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packet.Read(c.r, c.version, packet.MaxSize)
+	if err != nil {
+		c.t.Fatal("Could not read packet: ", err)
+	}
+	return p
+}
+
+func (c *testConn) write(p packet.Packet) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := packet.Write(c.conn, p, c.version); err != nil {
+		c.t.Fatal("Could not write packet: ", err)
+	}
+}
+
+func (c *testConn) connect(connect *packet.Connect) *packet.Connack {
+	c.t.Helper()
+	connect.Version = c.version
+	c.write(connect)
+	ack, ok := c.read().(*packet.Connack)
+	if !ok {
+		c.t.Fatal("Expected CONNACK")
+	}
+	return ack
+}
+
+// receive returns the next message delivered on msgs.
+func receive(t *testing.T, msgs chan messaging.Message) messaging.Message {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+	}
+	return nil
+}
+
+func TestClient(t *testing.T) {
+	b := New()
+	defer b.Close()
+	pub, err := b.NewClient("pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := b.NewClient("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub.Publish("lamp/1", []byte("on"), 1, true)
+	msgs := make(chan messaging.Message, 10)
+	sub.Subscribe("lamp/+", 1, func(msg messaging.Message) { msgs <- msg })
+
+	msg := receive(t, msgs)
+	if msg.Topic() != "lamp/1" || string(msg.Payload()) != "on" || !messaging.Retained(msg) {
+		t.Errorf("Expected retained lamp/1 on, got %s %q retained %t", msg.Topic(), msg.Payload(), messaging.Retained(msg))
+	}
+
+	pub.Publish("lamp/2", []byte("off"), 0, false)
+	pub.Publish("lamp/2/set", []byte("on"), 0, false)
+	pub.Publish("lamp/3", []byte("on"), 0, false)
+	for _, topic := range []string{"lamp/2", "lamp/3"} {
+		if msg := receive(t, msgs); msg.Topic() != topic || messaging.Retained(msg) {
+			t.Errorf("Expected live message on %s, got %s", topic, msg.Topic())
+		}
+	}
+
+	sub.Unsubscribe("lamp/+")
+	pub.Publish("lamp/1", []byte("off"), 0, false)
+	select {
+	case msg := <-msgs:
+		t.Errorf("Expected no message after unsubscribing, got %s", msg.Topic())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := pub.PublishContext(context.Background(), "lamp/#", nil, 0, false); err == nil {
+		t.Error("Expected publishing to a wildcard to fail")
+	}
+	pub.Close()
+	if err := pub.PublishContext(context.Background(), "lamp/1", nil, 0, false); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestServe311(t *testing.T) {
+	b := New()
+	defer b.Close()
+	local, _ := b.NewClient("local")
+	msgs := make(chan messaging.Message, 10)
+	local.Subscribe("leave", 0, func(msg messaging.Message) { msgs <- msg })
+	local.Publish("lamp/1", []byte("on"), 1, true)
+
+	c := dial(t, b, packet.Version311)
+	ack := c.connect(&packet.Connect{
+		ClientID:   "lamp",
+		CleanStart: true,
+		Will:       &packet.Will{Topic: "leave", Payload: []byte("lamp")},
+	})
+	if ack.ReasonCode != 0 {
+		t.Fatal("Expected to be accepted, got ", ack.ReasonCode)
+	}
+
+	c.write(&packet.Subscribe{PacketID: 1, Subscriptions: []packet.Subscription{
+		{Filter: "lamp/#", QoS: 1},
+		{Filter: "$share/group/lamp", QoS: 0},
+	}})
+	suback, ok := c.read().(*packet.Suback)
+	if !ok || len(suback.ReasonCodes) != 2 || suback.ReasonCodes[0] != packet.GrantedQoS1 || suback.ReasonCodes[1] != packet.UnspecifiedError {
+		t.Fatalf("Expected SUBACK granting QoS 1 and refusing the shared subscription, got %#v", suback)
+	}
+	p, ok := c.read().(*packet.Publish)
+	if !ok || p.Topic != "lamp/1" || !p.Retain || p.QoS != 1 {
+		t.Fatalf("Expected retained lamp/1, got %#v", p)
+	}
+	c.write(&packet.Ack{Kind: packet.PUBACK, PacketID: p.PacketID})
+
+	local.Publish("lamp/1", []byte("off"), 0, false)
+	p, ok = c.read().(*packet.Publish)
+	if !ok || p.Topic != "lamp/1" || string(p.Payload) != "off" || p.QoS != 0 {
+		t.Fatalf("Expected lamp/1 off at QoS 0, got %#v", p)
+	}
+
+	c.write(&packet.Publish{Topic: "lamp/1/set", Payload: []byte("on"), QoS: 2, PacketID: 7})
+	// The message comes back since the client is subscribed to it
+	if p, ok := c.read().(*packet.Publish); !ok || p.Topic != "lamp/1/set" {
+		t.Fatalf("Expected lamp/1/set, got %#v", p)
+	}
+	if ack, ok := c.read().(*packet.Ack); !ok || ack.Kind != packet.PUBREC || ack.PacketID != 7 {
+		t.Fatalf("Expected PUBREC, got %#v", ack)
+	}
+	c.write(&packet.Ack{Kind: packet.PUBREL, PacketID: 7})
+	if ack, ok := c.read().(*packet.Ack); !ok || ack.Kind != packet.PUBCOMP || ack.PacketID != 7 {
+		t.Fatalf("Expected PUBCOMP, got %#v", ack)
+	}
+
+	c.conn.Close()
+	if msg := receive(t, msgs); string(msg.Payload()) != "lamp" {
+		t.Errorf("Expected the will, got %q", msg.Payload())
+	}
+}
+
+func TestServe5(t *testing.T) {
+	b := New()
+	defer b.Close()
+	local, _ := b.NewClient("local")
+	msgs := make(chan messaging.Message, 10)
+	local.Subscribe("lamp/+/set", 1, func(msg messaging.Message) { msgs <- msg })
+
+	connected := make(chan bool, 1)
+	c := mqtt5.NewClient(mqtt5.Config{
+		ClientID: "lamp",
+		Dial: func() (net.Conn, error) {
+			client, server := net.Pipe()
+			go b.serve(server)
+			return client, nil
+		},
+		OnConnect: func(*mqtt5.Client) { connected <- true },
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	<-connected
+
+	err := c.PublishProperties(context.Background(), "lamp/1/set", []byte("on"), 1, false, &messaging.Properties{ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, msgs)
+	if p := messaging.MessageProperties(msg); p == nil || p.ContentType != "text/plain" {
+		t.Errorf("Expected the content type to be passed on, got %+v", p)
+	}
+
+	if err := c.Subscribe("$share/group/lamp", 0, func(messaging.Message) {}); err == nil {
+		t.Error("Expected shared subscriptions to be refused")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	b := New()
+	defer b.Close()
+	b.Authenticate = func(username, password string) bool {
+		return username == "hemtjanst" && password == "secret"
+	}
+
+	username := "hemtjanst"
+	c := dial(t, b, packet.Version311)
+	if ack := c.connect(&packet.Connect{ClientID: "a", CleanStart: true, Username: &username, Password: []byte("wrong")}); ack.ReasonCode != 4 {
+		t.Errorf("Expected return code 4, got %d", ack.ReasonCode)
+	}
+
+	c = dial(t, b, packet.Version5)
+	if ack := c.connect(&packet.Connect{CleanStart: true, Username: &username, Password: []byte("secret")}); ack.ReasonCode != packet.Success || ack.Properties.AssignedClientID == "" {
+		t.Errorf("Expected to be accepted with an assigned client ID, got %#v", ack)
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	b := New()
+	defer b.Close()
+	b.Authenticate = func(username, password string) bool { return false }
+	b.MaxPacketSize = 100
+
+	// A CONNECT claiming the largest remaining length is refused without
+	// waiting for its bytes
+	c := dial(t, b, packet.Version5)
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c.conn.Write([]byte{0x10, 0xff, 0xff, 0xff, 0x7f})
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+
+	b.Authenticate = nil
+	c = dial(t, b, packet.Version5)
+	ack := c.connect(&packet.Connect{ClientID: "a", CleanStart: true})
+	if ack.Properties.MaximumPacketSize == nil || *ack.Properties.MaximumPacketSize != 100 {
+		t.Errorf("Expected a maximum packet size of 100, got %#v", ack.Properties.MaximumPacketSize)
+	}
+	c.write(&packet.Publish{Topic: "sensor/temperature", Payload: make([]byte, 100)})
+	if d, ok := c.read().(*packet.Disconnect); !ok || d.ReasonCode != packet.PacketTooLarge {
+		t.Errorf("Expected to be disconnected for a packet too large, got %#v", d)
+	}
+}
@@ -0,0 +1,240 @@
+package broker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+	"github.com/hemtjanst/hemtjanst/messaging/packet"
+)
+
+// Client is a client of the broker in the same process. It's a
+// messaging.PublishSubscriber, a messaging.ContextPublishSubscriber and a
+// messaging.PropertiesPublisher.
+//
+// Messages are handed to the callbacks one at a time, in the order they
+// were published.
+type Client struct {
+	broker *Broker
+	id     string
+
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	subs   map[string]subscription
+	queue  []delivery
+	closed bool
+}
+
+type subscription struct {
+	qos      byte
+	callback func(messaging.Message)
+}
+
+type delivery struct {
+	msg       *clientMessage
+	callbacks []func(messaging.Message)
+}
+
+// NewClient returns a client with the client ID id, taking over from any
+// client already using it.
+func (b *Broker) NewClient(id string) (*Client, error) {
+	c := &Client{
+		broker: b,
+		id:     id,
+		subs:   map[string]subscription{},
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	if err := b.register(c); err != nil {
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// Publish publishes payload on topic.
+func (c *Client) Publish(topic string, payload []byte, qos int, retain bool) {
+	c.PublishProperties(context.Background(), topic, payload, qos, retain, nil)
+}
+
+// PublishContext publishes payload on topic. It fails when the client is
+// closed or the topic can't be published to.
+func (c *Client) PublishContext(ctx context.Context, topic string, payload []byte, qos int, retain bool) error {
+	return c.PublishProperties(ctx, topic, payload, qos, retain, nil)
+}
+
+// PublishProperties publishes payload on topic with the MQTT 5 properties
+// props.
+func (c *Client) PublishProperties(ctx context.Context, topic string, payload []byte, qos int, retain bool, props *messaging.Properties) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if !messaging.ValidTopic(topic) {
+		return packet.TopicNameInvalid
+	}
+	c.broker.publish(c, &message{
+		topic:      topic,
+		payload:    payload,
+		qos:        clampQoS(qos),
+		retain:     retain,
+		properties: packet.FromMessaging(props),
+	})
+	return nil
+}
+
+// Subscribe calls callback for every message published on a topic matching
+// topic, starting with the retained ones.
+func (c *Client) Subscribe(topic string, qos int, callback func(messaging.Message)) {
+	c.SubscribeContext(context.Background(), topic, qos, callback)
+}
+
+// SubscribeContext is Subscribe, failing when the client is closed or topic
+// isn't a valid filter.
+func (c *Client) SubscribeContext(ctx context.Context, topic string, qos int, callback func(messaging.Message)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !messaging.ValidFilter(topic) {
+		return packet.TopicFilterInvalid
+	}
+	sub := subscription{qos: clampQoS(qos), callback: callback}
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return ErrClosed
+	}
+	c.subs[topic] = sub
+	// Queue the retained messages while holding the lock so they're
+	// delivered before anything published after subscribing.
+	for _, m := range c.broker.retainedFor(topic) {
+		c.enqueue(newClientMessage(m, true), []func(messaging.Message){callback})
+	}
+	c.mutex.Unlock()
+	return nil
+}
+
+// Unsubscribe stops calling the callbacks of topics.
+func (c *Client) Unsubscribe(topics ...string) {
+	c.UnsubscribeContext(context.Background(), topics...)
+}
+
+// UnsubscribeContext is Unsubscribe, failing when the client is closed.
+func (c *Client) UnsubscribeContext(ctx context.Context, topics ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	for _, topic := range topics {
+		delete(c.subs, topic)
+	}
+	return nil
+}
+
+// Close disconnects the client from the broker.
+func (c *Client) Close() {
+	c.close(packet.Success)
+	c.broker.unregister(c)
+}
+
+func (c *Client) clientID() string {
+	return c.id
+}
+
+func (c *Client) deliver(from session, m *message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var callbacks []func(messaging.Message)
+	for filter, sub := range c.subs {
+		if messaging.Match(filter, m.topic) {
+			callbacks = append(callbacks, sub.callback)
+		}
+	}
+	if len(callbacks) > 0 {
+		// Like for network clients without RetainAsPublished, only
+		// messages sent because of subscribing are flagged as retained.
+		c.enqueue(newClientMessage(m, false), callbacks)
+	}
+}
+
+// enqueue adds a delivery to the queue. The mutex must be held.
+func (c *Client) enqueue(msg *clientMessage, callbacks []func(messaging.Message)) {
+	if c.closed {
+		return
+	}
+	c.queue = append(c.queue, delivery{msg: msg, callbacks: callbacks})
+	c.cond.Signal()
+}
+
+func (c *Client) close(reason packet.ReasonCode) {
+	c.mutex.Lock()
+	c.closed = true
+	c.queue = nil
+	c.cond.Signal()
+	c.mutex.Unlock()
+}
+
+func (c *Client) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// run hands queued messages to their callbacks until the client is closed.
+func (c *Client) run() {
+	for {
+		c.mutex.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mutex.Unlock()
+			return
+		}
+		d := c.queue[0]
+		c.queue[0] = delivery{}
+		c.queue = c.queue[1:]
+		c.mutex.Unlock()
+
+		for _, callback := range d.callbacks {
+			callback(d.msg)
+		}
+	}
+}
+
+func clampQoS(qos int) byte {
+	switch {
+	case qos < 0:
+		return 0
+	case qos > 2:
+		return 2
+	}
+	return byte(qos)
+}
+
+// clientMessage is a messaging.Message delivered to a Client.
+type clientMessage struct {
+	topic      string
+	payload    []byte
+	retained   bool
+	properties *messaging.Properties
+}
+
+func newClientMessage(m *message, retained bool) *clientMessage {
+	return &clientMessage{
+		topic:      m.topic,
+		payload:    m.payload,
+		retained:   retained,
+		properties: packet.ToMessaging(m.properties),
+	}
+}
+
+func (m *clientMessage) Topic() string                     { return m.topic }
+func (m *clientMessage) Payload() []byte                   { return m.payload }
+func (m *clientMessage) Retained() bool                    { return m.retained }
+func (m *clientMessage) Properties() *messaging.Properties { return m.properties }
@@ -0,0 +1,412 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+	"github.com/hemtjanst/hemtjanst/messaging/packet"
+)
+
+// connectTimeout is how long a client has to send its CONNECT.
+const connectTimeout = 10 * time.Second
+
+// connectMaxSize is the largest CONNECT a client may send. It's read
+// before the client is authenticated, so it's kept small.
+const connectMaxSize = 8 << 10
+
+// writeTimeout is how long writing a packet to a client may take.
+const writeTimeout = 10 * time.Second
+
+// queueSize is how many packets can wait to be written to a client before
+// it's considered too slow and disconnected.
+const queueSize = 1024
+
+// conn is the session of a client connected over the network.
+type conn struct {
+	broker  *Broker
+	conn    net.Conn
+	version byte
+	id      string
+	will    *packet.Will
+
+	mutex    sync.Mutex
+	subs     map[string]packet.Subscription
+	nextID   uint16
+	qos2     map[uint16]bool
+	graceful bool
+
+	out        chan packet.Packet
+	done       chan struct{}
+	closeOnce  sync.Once
+	writeMutex sync.Mutex
+}
+
+func (b *Broker) serve(nc net.Conn) {
+	c := &conn{
+		broker: b,
+		conn:   nc,
+		subs:   map[string]packet.Subscription{},
+		qos2:   map[uint16]bool{},
+		out:    make(chan packet.Packet, queueSize),
+		done:   make(chan struct{}),
+	}
+	r := bufio.NewReader(nc)
+	keepAlive, err := c.connect(r)
+	if err != nil {
+		log.Printf("Refused MQTT client from %s: %s", nc.RemoteAddr(), err)
+		nc.Close()
+		return
+	}
+
+	go c.write()
+	err = c.read(r, keepAlive)
+	c.shutdown()
+	c.broker.unregister(c)
+
+	c.mutex.Lock()
+	graceful := c.graceful
+	c.mutex.Unlock()
+	if !graceful && c.will != nil {
+		log.Printf("Client %s went away (%s), publishing its will", c.id, err)
+		c.broker.publish(c, &message{
+			topic:      c.will.Topic,
+			payload:    c.will.Payload,
+			qos:        c.will.QoS,
+			retain:     c.will.Retain,
+			properties: c.will.Properties,
+		})
+	}
+}
+
+// connect handles the CONNECT of the client and returns the keep alive it
+// asked for.
+func (c *conn) connect(r *bufio.Reader) (time.Duration, error) {
+	c.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := packet.Read(r, 0, connectMaxSize)
+	if err != nil {
+		return 0, err
+	}
+	connect, ok := p.(*packet.Connect)
+	if !ok {
+		return 0, errors.New("expected CONNECT")
+	}
+	c.version = connect.Version
+	if c.version != packet.Version311 && c.version != packet.Version5 {
+		c.version = packet.Version311
+		c.refuse(packet.UnsupportedProtocolVersion)
+		return 0, packet.UnsupportedProtocolVersion
+	}
+
+	if auth := c.broker.Authenticate; auth != nil {
+		username := ""
+		if connect.Username != nil {
+			username = *connect.Username
+		}
+		if !auth(username, string(connect.Password)) {
+			c.refuse(packet.BadUsernameOrPassword)
+			return 0, packet.BadUsernameOrPassword
+		}
+	}
+
+	ack := &packet.Connack{}
+	c.id = connect.ClientID
+	if c.id == "" {
+		if c.version == packet.Version311 && !connect.CleanStart {
+			c.refuse(packet.ClientIDNotValid)
+			return 0, packet.ClientIDNotValid
+		}
+		c.id = c.broker.assignID()
+		ack.Properties.AssignedClientID = c.id
+	}
+	c.will = connect.Will
+	if c.will != nil && !messaging.ValidTopic(c.will.Topic) {
+		c.refuse(packet.TopicNameInvalid)
+		return 0, packet.TopicNameInvalid
+	}
+	ack.Properties.MaximumPacketSize = packet.Uint32(uint32(c.broker.maxPacketSize()))
+	ack.Properties.SharedSubAvailable = packet.Byte(0)
+	ack.Properties.SubIDAvailable = packet.Byte(0)
+
+	if err := c.broker.register(c); err != nil {
+		c.refuse(packet.ServerUnavailable)
+		return 0, err
+	}
+	if err := c.writePacket(ack); err != nil {
+		return 0, err
+	}
+	return time.Duration(connect.KeepAlive) * time.Second, nil
+}
+
+// refuse answers a CONNECT with rc.
+func (c *conn) refuse(rc packet.ReasonCode) {
+	if c.version == packet.Version311 {
+		rc = connectReturnCode(rc)
+	}
+	c.writePacket(&packet.Connack{ReasonCode: rc})
+}
+
+// connectReturnCode converts a reason code to the return code MQTT 3.1.1
+// has for it.
+func connectReturnCode(rc packet.ReasonCode) packet.ReasonCode {
+	for code := byte(1); code <= 5; code++ {
+		if packet.ConnectReturnCode(code) == rc {
+			return packet.ReasonCode(code)
+		}
+	}
+	return packet.ReasonCode(3)
+}
+
+func (c *conn) read(r *bufio.Reader, keepAlive time.Duration) error {
+	for {
+		if keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		p, err := packet.Read(r, c.version, c.broker.maxPacketSize())
+		if err == packet.PacketTooLarge {
+			c.disconnect(packet.PacketTooLarge)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch p := p.(type) {
+		case *packet.Publish:
+			if err := c.handlePublish(p); err != nil {
+				c.disconnect(packet.ProtocolError)
+				return err
+			}
+		case *packet.Ack:
+			switch p.Kind {
+			case packet.PUBREL:
+				c.mutex.Lock()
+				delete(c.qos2, p.PacketID)
+				c.mutex.Unlock()
+				c.send(&packet.Ack{Kind: packet.PUBCOMP, PacketID: p.PacketID})
+			case packet.PUBREC:
+				c.send(&packet.Ack{Kind: packet.PUBREL, PacketID: p.PacketID})
+			}
+		case *packet.Subscribe:
+			c.handleSubscribe(p)
+		case *packet.Unsubscribe:
+			c.handleUnsubscribe(p)
+		case *packet.Pingreq:
+			c.send(&packet.Pingresp{})
+		case *packet.Disconnect:
+			c.mutex.Lock()
+			c.graceful = p.ReasonCode != packet.DisconnectWithWill
+			c.mutex.Unlock()
+			return nil
+		default:
+			c.disconnect(packet.ProtocolError)
+			return errors.New("unexpected packet")
+		}
+	}
+}
+
+func (c *conn) handlePublish(p *packet.Publish) error {
+	if !messaging.ValidTopic(p.Topic) {
+		return packet.TopicNameInvalid
+	}
+	if p.Properties.TopicAlias != nil {
+		return errors.New("topic aliases aren't supported")
+	}
+	m := &message{
+		topic:      p.Topic,
+		payload:    p.Payload,
+		qos:        p.QoS,
+		retain:     p.Retain,
+		properties: p.Properties,
+	}
+	switch p.QoS {
+	case 0:
+		c.broker.publish(c, m)
+	case 1:
+		c.broker.publish(c, m)
+		c.send(&packet.Ack{Kind: packet.PUBACK, PacketID: p.PacketID})
+	case 2:
+		c.mutex.Lock()
+		seen := c.qos2[p.PacketID]
+		c.qos2[p.PacketID] = true
+		c.mutex.Unlock()
+		if !seen {
+			c.broker.publish(c, m)
+		}
+		c.send(&packet.Ack{Kind: packet.PUBREC, PacketID: p.PacketID})
+	}
+	return nil
+}
+
+func (c *conn) handleSubscribe(p *packet.Subscribe) {
+	ack := &packet.Suback{PacketID: p.PacketID}
+	var retained []packet.Subscription
+	for _, sub := range p.Subscriptions {
+		rc := packet.ReasonCode(sub.QoS)
+		switch {
+		case strings.HasPrefix(sub.Filter, "$share/"):
+			rc = packet.SharedSubNotSupported
+		case !messaging.ValidFilter(sub.Filter) || sub.QoS > 2:
+			rc = packet.TopicFilterInvalid
+		}
+		if rc.Failed() {
+			if c.version == packet.Version311 {
+				rc = packet.UnspecifiedError
+			}
+			ack.ReasonCodes = append(ack.ReasonCodes, rc)
+			continue
+		}
+		ack.ReasonCodes = append(ack.ReasonCodes, rc)
+
+		c.mutex.Lock()
+		_, existed := c.subs[sub.Filter]
+		c.subs[sub.Filter] = sub
+		c.mutex.Unlock()
+		if sub.RetainHandling == 0 || (sub.RetainHandling == 1 && !existed) {
+			retained = append(retained, sub)
+		}
+	}
+	c.send(ack)
+
+	for _, sub := range retained {
+		for _, m := range c.broker.retainedFor(sub.Filter) {
+			c.publish(m, min(m.qos, sub.QoS), true)
+		}
+	}
+}
+
+func (c *conn) handleUnsubscribe(p *packet.Unsubscribe) {
+	ack := &packet.Unsuback{PacketID: p.PacketID}
+	c.mutex.Lock()
+	for _, filter := range p.Filters {
+		if _, ok := c.subs[filter]; ok {
+			delete(c.subs, filter)
+			ack.ReasonCodes = append(ack.ReasonCodes, packet.Success)
+		} else {
+			ack.ReasonCodes = append(ack.ReasonCodes, packet.NoSubscriptionExisted)
+		}
+	}
+	c.mutex.Unlock()
+	c.send(ack)
+}
+
+func (c *conn) clientID() string {
+	return c.id
+}
+
+func (c *conn) deliver(from session, m *message) {
+	c.mutex.Lock()
+	matched := false
+	var qos byte
+	retain := false
+	for filter, sub := range c.subs {
+		if !messaging.Match(filter, m.topic) || (sub.NoLocal && from == session(c)) {
+			continue
+		}
+		matched = true
+		if sub.QoS > qos {
+			qos = sub.QoS
+		}
+		retain = retain || sub.RetainAsPublished
+	}
+	c.mutex.Unlock()
+	if matched {
+		c.publish(m, min(m.qos, qos), m.retain && retain)
+	}
+}
+
+// publish sends m to the client.
+func (c *conn) publish(m *message, qos byte, retain bool) {
+	p := &packet.Publish{
+		Topic:      m.topic,
+		Payload:    m.payload,
+		QoS:        qos,
+		Retain:     retain,
+		Properties: m.properties,
+	}
+	if qos > 0 {
+		c.mutex.Lock()
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID++
+		}
+		p.PacketID = c.nextID
+		c.mutex.Unlock()
+	}
+	c.send(p)
+}
+
+// send queues p to be written to the client. A client that doesn't keep
+// up is disconnected.
+func (c *conn) send(p packet.Packet) {
+	select {
+	case c.out <- p:
+	case <-c.done:
+	default:
+		log.Printf("Client %s doesn't keep up, disconnecting it", c.id)
+		c.shutdown()
+	}
+}
+
+func (c *conn) write() {
+	for {
+		select {
+		case p := <-c.out:
+			if err := c.writePacket(p); err != nil {
+				c.shutdown()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) writePacket(p packet.Packet) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return packet.Write(c.conn, p, c.version)
+}
+
+// disconnect tells an MQTT 5 client why it's disconnected. MQTT 3.1.1 has
+// no way to do so.
+func (c *conn) disconnect(reason packet.ReasonCode) {
+	if c.version == packet.Version5 {
+		c.writePacket(&packet.Disconnect{ReasonCode: reason})
+	}
+}
+
+func (c *conn) close(reason packet.ReasonCode) {
+	if reason == packet.ServerShuttingDown {
+		c.mutex.Lock()
+		c.graceful = true
+		c.mutex.Unlock()
+	}
+	// Don't hold up the broker on a client that isn't reading
+	go func() {
+		c.disconnect(reason)
+		c.shutdown()
+	}()
+}
+
+// shutdown closes the connection, which ends reading from it.
+func (c *conn) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func min(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	mq "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The tests in this file check the broker against the Paho MQTT 3.1.1
+// client, over TCP like devices connect to it.
+
+// listen serves b on a random port of localhost, with TLS when cfg is set,
+// and returns the URL to connect to.
+func listen(t *testing.T, b *Broker, cfg *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme := "tcp://"
+	if cfg != nil {
+		l = tls.NewListener(l, cfg)
+		scheme = "ssl://"
+	}
+	go b.Serve(l)
+	return scheme + l.Addr().String()
+}
+
+func pahoClient(t *testing.T, url string, opts *mq.ClientOptions) mq.Client {
+	t.Helper()
+	c := mq.NewClient(opts.AddBroker(url).SetConnectTimeout(5 * time.Second).SetAutoReconnect(false))
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("%s could not connect: %v", opts.ClientID, token.Error())
+	}
+	return c
+}
+
+func wait(t *testing.T, token mq.Token) {
+	t.Helper()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatal("Timed out waiting for the broker")
+	}
+	if err := token.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receivePaho(t *testing.T, msgs chan mq.Message) mq.Message {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+		return nil
+	}
+}
+
+func TestPaho(t *testing.T) {
+	b := New()
+	b.Authenticate = func(username, password string) bool {
+		return username == "hemtjanst" && password == "secret"
+	}
+	defer b.Close()
+	url := listen(t, b, nil)
+
+	opts := mq.NewClientOptions().SetClientID("refused").SetUsername("hemtjanst").SetPassword("wrong").
+		AddBroker(url).SetConnectTimeout(5 * time.Second).SetAutoReconnect(false)
+	// This Paho retries with MQTT 3.1 when refused, and setting the error
+	// of a token waits for WaitTimeout to give up, so poll for it
+	refused := mq.NewClient(opts).Connect()
+	for i := 0; i < 50 && refused.Error() == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if refused.Error() == nil {
+		t.Error("Expected a wrong password to be refused")
+	}
+
+	login := func(id string) *mq.ClientOptions {
+		return mq.NewClientOptions().SetClientID(id).SetUsername("hemtjanst").SetPassword("secret")
+	}
+	device := pahoClient(t, url, login("device"))
+	defer device.Disconnect(0)
+	hemtjanst := pahoClient(t, url, login("hemtjanst"))
+	defer hemtjanst.Disconnect(0)
+
+	msgs := make(chan mq.Message, 10)
+	wait(t, hemtjanst.Subscribe("sensor/#", 2, func(_ mq.Client, msg mq.Message) { msgs <- msg }))
+
+	wait(t, device.Publish("sensor/temperature", 1, true, "21.5"))
+	msg := receivePaho(t, msgs)
+	if msg.Topic() != "sensor/temperature" || string(msg.Payload()) != "21.5" || msg.Qos() != 1 || msg.Retained() {
+		t.Errorf("Expected 21.5 on sensor/temperature with QoS 1, got %s on %s with QoS %d, retained %t", msg.Payload(), msg.Topic(), msg.Qos(), msg.Retained())
+	}
+
+	wait(t, device.Publish("sensor/humidity", 2, false, "40"))
+	msg = receivePaho(t, msgs)
+	if string(msg.Payload()) != "40" || msg.Qos() != 2 {
+		t.Errorf("Expected 40 with QoS 2, got %s with QoS %d", msg.Payload(), msg.Qos())
+	}
+	select {
+	case msg := <-msgs:
+		t.Error("Expected a message with QoS 2 once, got it again: ", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	late := pahoClient(t, url, login("late"))
+	defer late.Disconnect(0)
+	retained := make(chan mq.Message, 10)
+	wait(t, late.Subscribe("sensor/+", 0, func(_ mq.Client, msg mq.Message) { retained <- msg }))
+	msg = receivePaho(t, retained)
+	if msg.Topic() != "sensor/temperature" || !msg.Retained() || msg.Qos() != 0 {
+		t.Errorf("Expected the retained message with QoS 0, got %s retained %t with QoS %d", msg.Topic(), msg.Retained(), msg.Qos())
+	}
+
+	wait(t, hemtjanst.Unsubscribe("sensor/#"))
+	wait(t, device.Publish("sensor/temperature", 1, false, "22"))
+	receivePaho(t, retained)
+	select {
+	case msg := <-msgs:
+		t.Error("Expected no messages after unsubscribing, got ", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPahoTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "broker"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	b := New()
+	defer b.Close()
+	url := listen(t, b, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+
+	c := pahoClient(t, url, mq.NewClientOptions().SetClientID("device").SetTLSConfig(&tls.Config{RootCAs: roots}))
+	defer c.Disconnect(0)
+	msgs := make(chan mq.Message, 1)
+	wait(t, c.Subscribe("lightbulb/kitchen/on", 1, func(_ mq.Client, msg mq.Message) { msgs <- msg }))
+	wait(t, c.Publish("lightbulb/kitchen/on", 1, false, "1"))
+	if msg := receivePaho(t, msgs); string(msg.Payload()) != "1" {
+		t.Error("Expected 1 over TLS, got ", string(msg.Payload()))
+	}
+}
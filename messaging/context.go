@@ -0,0 +1,79 @@
+package messaging
+
+import "context"
+
+// ContextPublisher publishes messages on a transport and reports whether
+// that succeeded. The context bounds how long it waits for the transport.
+type ContextPublisher interface {
+	PublishContext(ctx context.Context, destination string, message []byte, qos int, persist bool) error
+}
+
+// ContextSubscriber subscribes to messages on a transport and reports
+// whether that succeeded.
+type ContextSubscriber interface {
+	SubscribeContext(ctx context.Context, source string, qos int, callback func(Message)) error
+	UnsubscribeContext(ctx context.Context, sources ...string) error
+}
+
+// ContextPublishSubscriber is a PublishSubscriber whose operations take a
+// context and return an error.
+type ContextPublishSubscriber interface {
+	ContextPublisher
+	ContextSubscriber
+}
+
+// WithContext returns ps as a ContextPublishSubscriber. A transport that
+// isn't one is wrapped, its operations can only fail when ctx is done
+// before they start.
+func WithContext(ps PublishSubscriber) ContextPublishSubscriber {
+	if c, ok := ps.(ContextPublishSubscriber); ok {
+		return c
+	}
+	return contextAdapter{ps: ps}
+}
+
+type contextAdapter struct {
+	ps PublishSubscriber
+}
+
+func (a contextAdapter) PublishContext(ctx context.Context, destination string, message []byte, qos int, persist bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.ps.Publish(destination, message, qos, persist)
+	return nil
+}
+
+func (a contextAdapter) SubscribeContext(ctx context.Context, source string, qos int, callback func(Message)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.ps.Subscribe(source, qos, callback)
+	return nil
+}
+
+func (a contextAdapter) UnsubscribeContext(ctx context.Context, sources ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.ps.Unsubscribe(sources...)
+	return nil
+}
+
+// AsConnection returns ps as a Connection, for passing to
+// Handler.Connected.
+func AsConnection(ps PublishSubscriber) Connection {
+	return connection{ps: WithContext(ps)}
+}
+
+type connection struct {
+	ps ContextPublishSubscriber
+}
+
+func (c connection) Publish(topic string, payload []byte, qos int, retain bool) error {
+	return c.ps.PublishContext(context.Background(), topic, payload, qos, retain)
+}
+
+func (c connection) Subscribe(topic string, qos int, callback func(Message)) error {
+	return c.ps.SubscribeContext(context.Background(), topic, qos, callback)
+}
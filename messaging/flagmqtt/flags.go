@@ -7,6 +7,7 @@ var (
 	MqttUsernameFlag         = flag.String("mqtt.username", "", "MQTT Username")
 	MqttPasswordFlag         = flag.String("mqtt.password", "", "MQTT Password")
 	MqttTLSFlag              = flag.Bool("mqtt.tls", false, "Enable TLS")
+	MqttCleanSessionFlag     = flag.Bool("mqtt.clean-session", true, "Start a new session when connecting, dropping messages that weren't acknowledged before the connection was lost")
 	MqttCAFlag               = flag.String("mqtt.ca", "", "Path to CA certificate")
 	MqttCertFlag             = flag.String("mqtt.cert", "", "Path to Client certificate")
 	MqttKeyFlag              = flag.String("mqtt.key", "", "Path to Client certificate key")
@@ -14,5 +15,6 @@ var (
 	MqttKeepAlive            = flag.Int("mqtt.keepalive", 5, "Time in seconds between each PING packet")
 	MqttMaxReconnectInterval = flag.Int("mqtt.max-reconnect-interval", 2, "Maximum time in minutes to wait between reconnect attemps")
 	MqttPingTimeout          = flag.Int("mqtt.ping-timeout", 10, "Time in seconds after which a ping times out")
+	MqttProtocolFlag         = flag.Int("mqtt.protocol", 4, "MQTT protocol version, 4 for MQTT 3.1.1 or 5 for MQTT 5")
 	MqttWriteTimeout         = flag.Int("mqtt.write-timeout", 5, "Time in seconds after which a write will time out")
 )
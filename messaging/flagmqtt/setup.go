@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	mq "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hemtjanst/hemtjanst/messaging/mqtt5"
 	"github.com/satori/go.uuid"
 	"io/ioutil"
 	"os"
@@ -21,21 +22,18 @@ type ClientConfig struct {
 	ClientID                string
 	OnConnectHandler        func(mq.Client)
 	OnConnectionLostHandler func(mq.Client, error)
+	// OnConnect5Handler and OnConnectionLost5Handler are used instead
+	// of the handlers above by the client from NewMqtt5
+	OnConnect5Handler        func(*mqtt5.Client)
+	OnConnectionLost5Handler func(*mqtt5.Client, error)
 }
 
 func NewPersistentMqtt(config ClientConfig) (mqttClient mq.Client, err error) {
-	useTls := false
-
-	if val, ok := os.LookupEnv("MQTT_TLS"); ok {
-		useTls = val != "0" && val != "" && strings.ToLower(val) != "false"
-	}
-	if *MqttTLSFlag {
-		useTls = true
+	tlsCfg, err := loadTLS()
+	if err != nil {
+		return nil, err
 	}
 
-	caPath := envOrFlagStr(*MqttCAFlag, "MQTT_CA_PATH", "")
-	certPath := envOrFlagStr(*MqttCertFlag, "MQTT_CERT_PATH", "")
-	keyPath := envOrFlagStr(*MqttKeyFlag, "MQTT_KEY_PATH", "")
 	address := envOrFlagStr(*MqttAddressFlag, "MQTT_ADDRESS", "localhost:1883")
 	username := envOrFlagStr(*MqttUsernameFlag, "MQTT_USERNAME", "")
 	password := envOrFlagStr(*MqttPasswordFlag, "MQTT_PASSWORD", "")
@@ -44,14 +42,7 @@ func NewPersistentMqtt(config ClientConfig) (mqttClient mq.Client, err error) {
 	maxReconnectInterval := envOrFlagInt(*MqttMaxReconnectInterval, "MQTT_MAX_RECONNECT_INTERVAL", 2)
 	pingTimeout := envOrFlagInt(*MqttPingTimeout, "MQTT_PING_TIMEOUT", 10)
 	writeTimeout := envOrFlagInt(*MqttWriteTimeout, "MQTT_WRITE_TIMEOUT", 5)
-
-	var tlsCfg *tls.Config
-	if useTls {
-		tlsCfg, err = setupTLS(caPath, certPath, keyPath)
-		if err != nil {
-			return nil, err
-		}
-	}
+	cleanSession := envOrFlagBool(*MqttCleanSessionFlag, "MQTT_CLEAN_SESSION", true)
 
 	clientId := config.ClientID
 
@@ -61,6 +52,7 @@ func NewPersistentMqtt(config ClientConfig) (mqttClient mq.Client, err error) {
 
 	opts := mq.NewClientOptions().
 		SetClientID(clientId).
+		SetCleanSession(cleanSession).
 		SetConnectTimeout(time.Duration(connectionTimeout) * time.Second).
 		SetKeepAlive(time.Duration(keepAlive) * time.Second).
 		SetMaxReconnectInterval(time.Duration(maxReconnectInterval) * time.Minute).
@@ -93,7 +85,7 @@ func NewPersistentMqtt(config ClientConfig) (mqttClient mq.Client, err error) {
 	if password != "" {
 		opts.SetPassword(password)
 	}
-	if useTls {
+	if tlsCfg != nil {
 		opts.SetTLSConfig(tlsCfg)
 		opts.AddBroker(fmt.Sprintf("ssl://%s", address))
 	} else {
@@ -103,6 +95,51 @@ func NewPersistentMqtt(config ClientConfig) (mqttClient mq.Client, err error) {
 	return mq.NewClient(opts), nil
 }
 
+// NewMqtt5 returns an MQTT 5 client configured like NewPersistentMqtt
+// configures an MQTT 3.1.1 one. It uses the MQTT 5 handlers of config.
+func NewMqtt5(config ClientConfig) (*mqtt5.Client, error) {
+	tlsCfg, err := loadTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	clientId := config.ClientID
+	if clientId == "" {
+		clientId = NewUniqueIdentifier()
+	}
+
+	cfg := mqtt5.Config{
+		Address:              envOrFlagStr(*MqttAddressFlag, "MQTT_ADDRESS", "localhost:1883"),
+		TLS:                  tlsCfg,
+		ClientID:             clientId,
+		Username:             envOrFlagStr(*MqttUsernameFlag, "MQTT_USERNAME", ""),
+		Password:             envOrFlagStr(*MqttPasswordFlag, "MQTT_PASSWORD", ""),
+		KeepAlive:            time.Duration(envOrFlagInt(*MqttKeepAlive, "MQTT_KEEPALIVE", 5)) * time.Second,
+		Timeout:              time.Duration(envOrFlagInt(*MqttConnectionTimeout, "MQTT_CONNECTION_TIMEOUT", 10)) * time.Second,
+		MaxReconnectInterval: time.Duration(envOrFlagInt(*MqttMaxReconnectInterval, "MQTT_MAX_RECONNECT_INTERVAL", 2)) * time.Minute,
+		OnConnect:            config.OnConnect5Handler,
+		OnConnectionLost:     config.OnConnectionLost5Handler,
+	}
+	if !envOrFlagBool(*MqttCleanSessionFlag, "MQTT_CLEAN_SESSION", true) {
+		cfg.SessionExpiry = mqtt5.NoExpiry
+	}
+	if config.WillTopic != "" {
+		cfg.Will = &mqtt5.Will{
+			Topic:   config.WillTopic,
+			Payload: []byte(config.WillPayload),
+			QoS:     config.WillQoS,
+			Retain:  config.WillRetain,
+		}
+	}
+	return mqtt5.NewClient(cfg), nil
+}
+
+// ProtocolVersion returns the MQTT protocol version to use, 4 for MQTT
+// 3.1.1 or 5.
+func ProtocolVersion() int {
+	return envOrFlagInt(*MqttProtocolFlag, "MQTT_PROTOCOL", 4)
+}
+
 // NewUniqueIdentifier returns a unique identifier that the client can use.
 // This identifier is what should be set for the lastWillID for anything
 // that is bridging more than one device
@@ -110,6 +147,27 @@ func NewUniqueIdentifier() string {
 	return uuid.NewV4().String()
 }
 
+// loadTLS returns the TLS configuration from the flags and environment, or
+// nil if TLS isn't enabled.
+func loadTLS() (*tls.Config, error) {
+	useTls := false
+
+	if val, ok := os.LookupEnv("MQTT_TLS"); ok {
+		useTls = val != "0" && val != "" && strings.ToLower(val) != "false"
+	}
+	if *MqttTLSFlag {
+		useTls = true
+	}
+	if !useTls {
+		return nil, nil
+	}
+
+	caPath := envOrFlagStr(*MqttCAFlag, "MQTT_CA_PATH", "")
+	certPath := envOrFlagStr(*MqttCertFlag, "MQTT_CERT_PATH", "")
+	keyPath := envOrFlagStr(*MqttKeyFlag, "MQTT_KEY_PATH", "")
+	return setupTLS(caPath, certPath, keyPath)
+}
+
 func setupTLS(caPath, certPath, keyPath string) (*tls.Config, error) {
 	tlsCfg := &tls.Config{}
 	if caPath != "" {
@@ -3,6 +3,7 @@ package flagmqtt
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 func envOrFlagStr(flagVal, envName, defVal string) (ret string) {
@@ -28,3 +29,15 @@ func envOrFlagInt(flagVal int, envName string, defVal int) (ret int) {
 	}
 	return
 }
+
+func envOrFlagBool(flagVal bool, envName string, defVal bool) (ret bool) {
+	ret = defVal
+
+	if val, ok := os.LookupEnv(envName); ok {
+		ret = val != "0" && val != "" && strings.ToLower(val) != "false"
+	}
+	if flagVal != defVal {
+		ret = flagVal
+	}
+	return
+}
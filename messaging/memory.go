@@ -0,0 +1,372 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ErrDisconnected is returned by a MemoryClient that was disconnected.
+var ErrDisconnected = errors.New("client disconnected")
+
+// MemoryBroker routes messages between MemoryClients without a network, to
+// test code using a PublishSubscriber against something that behaves like
+// an MQTT broker:
+//
+//   - Subscriptions match topics with the + and # wildcards
+//   - Retained messages are kept, delivered on subscribing with Retained
+//     set, and removed by publishing an empty retained message
+//   - Messages are delivered with the lower of the QoS they were published
+//     and subscribed with
+//   - The will of a client is published when it's dropped, but not when it
+//     disconnects
+//
+// Messages are delivered to every client in the order they were published,
+// from a goroutine per client like a network transport would. Wait blocks
+// until they have all been handled.
+type MemoryBroker struct {
+	mutex    sync.Mutex
+	idle     *sync.Cond
+	clients  map[*MemoryClient]bool
+	retained map[string]*memoryMessage
+	pending  int
+}
+
+// NewMemoryBroker returns a broker without any clients or retained
+// messages.
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		clients:  map[*MemoryClient]bool{},
+		retained: map[string]*memoryMessage{},
+	}
+	b.idle = sync.NewCond(&b.mutex)
+	return b
+}
+
+// NewClient returns a client connected to the broker.
+func (b *MemoryBroker) NewClient() *MemoryClient {
+	c := &MemoryClient{
+		broker:    b,
+		subs:      map[string]memorySubscription{},
+		connected: true,
+	}
+	c.ready = sync.NewCond(&c.mutex)
+	b.mutex.Lock()
+	b.clients[c] = true
+	b.mutex.Unlock()
+	go c.run()
+	return c
+}
+
+// Retained returns the retained message on topic, if there is one.
+func (b *MemoryBroker) Retained(topic string) ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	m, ok := b.retained[topic]
+	if !ok {
+		return nil, false
+	}
+	return m.payload, true
+}
+
+// Wait blocks until all messages published so far, and those published
+// while handling them, have been handed to the callbacks of their
+// subscribers. It must not be called from a callback.
+func (b *MemoryBroker) Wait() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.pending > 0 {
+		b.idle.Wait()
+	}
+}
+
+func (b *MemoryBroker) publish(m *memoryMessage) {
+	b.mutex.Lock()
+	if m.retain {
+		if len(m.payload) == 0 {
+			delete(b.retained, m.topic)
+		} else {
+			b.retained[m.topic] = m
+		}
+	}
+	clients := make([]*MemoryClient, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mutex.Unlock()
+
+	for _, c := range clients {
+		c.deliver(m)
+	}
+}
+
+// retainedFor returns the retained messages matching filter.
+func (b *MemoryBroker) retainedFor(filter string) []*memoryMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var res []*memoryMessage
+	for topic, m := range b.retained {
+		if Match(filter, topic) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// done records that n deliveries have been handled, or queued when n is
+// negative.
+func (b *MemoryBroker) done(n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.pending -= n
+	if b.pending == 0 {
+		b.idle.Broadcast()
+	}
+}
+
+// MemoryClient is a client of a MemoryBroker. It's a PublishSubscriber, a
+// ContextPublishSubscriber and a PropertiesPublisher. The methods that
+// can't return errors log them.
+type MemoryClient struct {
+	broker *MemoryBroker
+
+	mutex     sync.Mutex
+	ready     *sync.Cond
+	subs      map[string]memorySubscription
+	queue     []memoryDelivery
+	will      *memoryMessage
+	connected bool
+}
+
+type memorySubscription struct {
+	qos      byte
+	callback func(Message)
+}
+
+type memoryDelivery struct {
+	msg      *memoryMessage
+	callback func(Message)
+}
+
+// SetWill sets the message published for the client when it's dropped.
+func (c *MemoryClient) SetWill(topic string, payload []byte, qos int, retain bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.will = &memoryMessage{topic: topic, payload: payload, qos: byte(qos), retain: retain}
+}
+
+// Disconnect disconnects the client from the broker, without publishing
+// its will.
+func (c *MemoryClient) Disconnect() {
+	c.disconnect()
+}
+
+// Drop disconnects the client as if its connection was lost, publishing
+// its will.
+func (c *MemoryClient) Drop() {
+	if will := c.disconnect(); will != nil {
+		c.broker.publish(will)
+	}
+}
+
+// disconnect disconnects the client and returns its will.
+func (c *MemoryClient) disconnect() *memoryMessage {
+	c.mutex.Lock()
+	if !c.connected {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.connected = false
+	dropped := len(c.queue)
+	c.queue = nil
+	c.ready.Signal()
+	will := c.will
+	c.mutex.Unlock()
+
+	c.broker.mutex.Lock()
+	delete(c.broker.clients, c)
+	c.broker.mutex.Unlock()
+	c.broker.done(dropped)
+	return will
+}
+
+// Publish publishes payload on topic.
+func (c *MemoryClient) Publish(topic string, payload []byte, qos int, retain bool) {
+	if err := c.PublishContext(context.Background(), topic, payload, qos, retain); err != nil {
+		log.Printf("Could not publish to %s: %s", topic, err)
+	}
+}
+
+// PublishContext publishes payload on topic. It fails when the client is
+// disconnected, or topic or qos aren't valid.
+func (c *MemoryClient) PublishContext(ctx context.Context, topic string, payload []byte, qos int, retain bool) error {
+	return c.PublishProperties(ctx, topic, payload, qos, retain, nil)
+}
+
+// PublishProperties publishes payload on topic with the properties p.
+func (c *MemoryClient) PublishProperties(ctx context.Context, topic string, payload []byte, qos int, retain bool, p *Properties) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !c.isConnected() {
+		return ErrDisconnected
+	}
+	if !ValidTopic(topic) {
+		return fmt.Errorf("invalid topic %q", topic)
+	}
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid QoS %d", qos)
+	}
+	c.broker.publish(&memoryMessage{
+		topic:      topic,
+		payload:    payload,
+		qos:        byte(qos),
+		retain:     retain,
+		properties: p,
+	})
+	return nil
+}
+
+// Subscribe calls callback for the retained messages matching topic, and
+// for every message published on it from now on.
+func (c *MemoryClient) Subscribe(topic string, qos int, callback func(Message)) {
+	if err := c.SubscribeContext(context.Background(), topic, qos, callback); err != nil {
+		log.Printf("Could not subscribe to %s: %s", topic, err)
+	}
+}
+
+// SubscribeContext subscribes like Subscribe. It fails when the client is
+// disconnected, or topic or qos aren't valid.
+func (c *MemoryClient) SubscribeContext(ctx context.Context, topic string, qos int, callback func(Message)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !ValidFilter(topic) {
+		return fmt.Errorf("invalid filter %q", topic)
+	}
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid QoS %d", qos)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.connected {
+		return ErrDisconnected
+	}
+	sub := memorySubscription{qos: byte(qos), callback: callback}
+	c.subs[topic] = sub
+	for _, m := range c.broker.retainedFor(topic) {
+		c.enqueue(deliveredTo(m, sub, true), sub)
+	}
+	return nil
+}
+
+// Unsubscribe stops calling the callbacks of topics.
+func (c *MemoryClient) Unsubscribe(topics ...string) {
+	if err := c.UnsubscribeContext(context.Background(), topics...); err != nil {
+		log.Printf("Could not unsubscribe from %v: %s", topics, err)
+	}
+}
+
+// UnsubscribeContext unsubscribes like Unsubscribe. It fails when the
+// client is disconnected.
+func (c *MemoryClient) UnsubscribeContext(ctx context.Context, topics ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.connected {
+		return ErrDisconnected
+	}
+	for _, topic := range topics {
+		delete(c.subs, topic)
+	}
+	return nil
+}
+
+func (c *MemoryClient) isConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
+// deliver queues m for every subscription matching its topic. The
+// subscriptions that get it with the same QoS get the same message.
+func (c *MemoryClient) deliver(m *memoryMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	copies := map[byte]*memoryMessage{}
+	for filter, sub := range c.subs {
+		if Match(filter, m.topic) {
+			msg := copies[sub.qos]
+			if msg == nil {
+				msg = deliveredTo(m, sub, false)
+				copies[sub.qos] = msg
+			}
+			c.enqueue(msg, sub)
+		}
+	}
+}
+
+// deliveredTo returns m as delivered to sub.
+func deliveredTo(m *memoryMessage, sub memorySubscription, retained bool) *memoryMessage {
+	msg := *m
+	msg.retain = retained
+	if sub.qos < msg.qos {
+		msg.qos = sub.qos
+	}
+	return &msg
+}
+
+// enqueue queues msg for sub. The mutex must be held.
+func (c *MemoryClient) enqueue(msg *memoryMessage, sub memorySubscription) {
+	if !c.connected {
+		return
+	}
+	c.broker.done(-1)
+	c.queue = append(c.queue, memoryDelivery{msg: msg, callback: sub.callback})
+	c.ready.Signal()
+}
+
+// run hands queued messages to their callbacks until the client is
+// disconnected.
+func (c *MemoryClient) run() {
+	for {
+		c.mutex.Lock()
+		for len(c.queue) == 0 && c.connected {
+			c.ready.Wait()
+		}
+		if !c.connected {
+			c.mutex.Unlock()
+			return
+		}
+		d := c.queue[0]
+		c.queue[0] = memoryDelivery{}
+		c.queue = c.queue[1:]
+		c.mutex.Unlock()
+
+		d.callback(d.msg)
+		c.broker.done(1)
+	}
+}
+
+// memoryMessage is a message published through a MemoryBroker. When it's
+// delivered, retain tells whether it was sent because of subscribing.
+type memoryMessage struct {
+	topic      string
+	payload    []byte
+	qos        byte
+	retain     bool
+	properties *Properties
+}
+
+func (m *memoryMessage) Topic() string           { return m.topic }
+func (m *memoryMessage) Payload() []byte         { return m.payload }
+func (m *memoryMessage) Retained() bool          { return m.retain }
+func (m *memoryMessage) Properties() *Properties { return m.properties }
+
+// Qos returns the QoS the message was delivered with, like it does for
+// messages of the MQTT 3.1.1 messenger.
+func (m *memoryMessage) Qos() byte { return m.qos }
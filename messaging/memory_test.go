@@ -0,0 +1,166 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// received collects the messages handed to its callback.
+type received struct {
+	sync.Mutex
+	msgs []Message
+}
+
+func (r *received) callback(msg Message) {
+	r.Lock()
+	defer r.Unlock()
+	r.msgs = append(r.msgs, msg)
+}
+
+func (r *received) topics() []string {
+	r.Lock()
+	defer r.Unlock()
+	var res []string
+	for _, msg := range r.msgs {
+		res = append(res, msg.Topic())
+	}
+	return res
+}
+
+func (r *received) last() Message {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.msgs) == 0 {
+		return nil
+	}
+	return r.msgs[len(r.msgs)-1]
+}
+
+func equalTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemoryBrokerWildcards(t *testing.T) {
+	b := NewMemoryBroker()
+	pub, sub := b.NewClient(), b.NewClient()
+	plus, hash := &received{}, &received{}
+	sub.Subscribe("sensor/+/temperature", 0, plus.callback)
+	sub.Subscribe("sensor/#", 0, hash.callback)
+
+	for _, topic := range []string{"sensor/hall/temperature", "sensor/hall/humidity", "sensor", "other/hall/temperature", "sensor/a/b/temperature"} {
+		pub.Publish(topic, []byte("1"), 0, false)
+	}
+	b.Wait()
+
+	if exp := []string{"sensor/hall/temperature"}; !equalTopics(plus.topics(), exp) {
+		t.Errorf("Expected + to match %v, got %v", exp, plus.topics())
+	}
+	if exp := []string{"sensor/hall/temperature", "sensor/hall/humidity", "sensor", "sensor/a/b/temperature"}; !equalTopics(hash.topics(), exp) {
+		t.Errorf("Expected # to match %v, got %v", exp, hash.topics())
+	}
+
+	sub.Unsubscribe("sensor/#")
+	pub.Publish("sensor/hall/temperature", []byte("2"), 0, false)
+	b.Wait()
+	if len(hash.topics()) != 4 || len(plus.topics()) != 2 {
+		t.Errorf("Expected only the remaining subscription to get the message")
+	}
+
+	if err := pub.PublishContext(context.Background(), "sensor/+", nil, 0, false); err == nil {
+		t.Error("Expected publishing to a wildcard to fail")
+	}
+	if err := sub.SubscribeContext(context.Background(), "sensor/#/x", 0, plus.callback); err == nil {
+		t.Error("Expected subscribing to an invalid filter to fail")
+	}
+}
+
+func TestMemoryBrokerRetained(t *testing.T) {
+	b := NewMemoryBroker()
+	pub, sub := b.NewClient(), b.NewClient()
+	pub.Publish("announce/light", []byte("{}"), 1, true)
+	pub.Publish("announce/switch", []byte("{}"), 1, true)
+	pub.Publish("announce/switch", nil, 1, true)
+
+	r := &received{}
+	sub.Subscribe("announce/#", 1, r.callback)
+	b.Wait()
+	if exp := []string{"announce/light"}; !equalTopics(r.topics(), exp) || !Retained(r.last()) {
+		t.Fatalf("Expected retained %v, got %v", exp, r.topics())
+	}
+	if _, ok := b.Retained("announce/switch"); ok {
+		t.Error("Expected an empty retained message to remove the retained one")
+	}
+
+	pub.Publish("announce/light", []byte(`{"name": "Light"}`), 1, true)
+	b.Wait()
+	if Retained(r.last()) {
+		t.Error("Expected a message published while subscribed not to be retained")
+	}
+	if payload, _ := b.Retained("announce/light"); string(payload) != `{"name": "Light"}` {
+		t.Errorf("Expected the retained message to be replaced, got %s", payload)
+	}
+}
+
+func TestMemoryBrokerQoS(t *testing.T) {
+	b := NewMemoryBroker()
+	pub, sub := b.NewClient(), b.NewClient()
+	r := &received{}
+	sub.Subscribe("lamp", 1, r.callback)
+
+	for qos, exp := range []byte{0, 1, 1} {
+		pub.Publish("lamp", []byte("1"), qos, false)
+		b.Wait()
+		if got := r.last().(interface{ Qos() byte }).Qos(); got != exp {
+			t.Errorf("Expected QoS %d published to be delivered at %d, got %d", qos, exp, got)
+		}
+	}
+	if err := pub.PublishContext(context.Background(), "lamp", nil, 3, false); err == nil {
+		t.Error("Expected QoS 3 to be refused")
+	}
+}
+
+func TestMemoryBrokerWill(t *testing.T) {
+	b := NewMemoryBroker()
+	hemtjanst := b.NewClient()
+	r := &received{}
+	hemtjanst.Subscribe("leave", 1, r.callback)
+
+	clean, dropped := b.NewClient(), b.NewClient()
+	clean.SetWill("leave", []byte("clean"), 1, false)
+	dropped.SetWill("leave", []byte("dropped"), 1, false)
+	clean.Disconnect()
+	dropped.Drop()
+	b.Wait()
+
+	if len(r.topics()) != 1 || string(r.last().Payload()) != "dropped" {
+		t.Errorf("Expected only the will of the dropped client, got %d messages", len(r.topics()))
+	}
+	if err := dropped.PublishContext(context.Background(), "leave", nil, 0, false); err != ErrDisconnected {
+		t.Errorf("Expected ErrDisconnected, got %v", err)
+	}
+}
+
+func TestMemoryBrokerWaitCascades(t *testing.T) {
+	b := NewMemoryBroker()
+	device, hemtjanst := b.NewClient(), b.NewClient()
+	device.Subscribe("lamp/on/set", 1, func(msg Message) {
+		device.Publish("lamp/on", msg.Payload(), 1, false)
+	})
+	r := &received{}
+	hemtjanst.Subscribe("lamp/on", 1, r.callback)
+
+	hemtjanst.Publish("lamp/on/set", []byte("1"), 1, false)
+	b.Wait()
+	if r.last() == nil || string(r.last().Payload()) != "1" {
+		t.Error("Expected Wait to wait for the message published in response")
+	}
+}
@@ -21,3 +21,11 @@ type Message interface {
 	Topic() string
 	Payload() []byte
 }
+
+// Retained returns whether msg was retained, or replayed from memory, rather
+// than published just now. Messages from transports that don't support
+// retained messages are never retained.
+func Retained(msg Message) bool {
+	r, ok := msg.(interface{ Retained() bool })
+	return ok && r.Retained()
+}
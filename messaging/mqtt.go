@@ -1,6 +1,7 @@
 package messaging
 
 import (
+	"context"
 	"fmt"
 	mq "github.com/eclipse/paho.mqtt.golang"
 	"log"
@@ -19,6 +20,8 @@ type Handler struct {
 	DiscoverTopic string
 	DiscoverDelay time.Duration
 	DiscoverStart chan bool
+	// Recorder records the announcements, leaves and discovers when set
+	Recorder *Recorder
 }
 
 // RetryWithBackoff will retry the operation for the amount of attempts. The
@@ -44,19 +47,49 @@ func RetryWithBackoff(attempts int, backoff time.Duration, callback func() error
 	return fmt.Errorf("Operation failed after %d attempts, last error: %s", attempts, err)
 }
 
+// Connection is a client connected to a broker, as used by Handler.
+type Connection interface {
+	Publish(topic string, payload []byte, qos int, retain bool) error
+	Subscribe(topic string, qos int, callback func(Message)) error
+}
+
+type pahoConnection struct {
+	client mq.Client
+}
+
+func (c pahoConnection) Publish(topic string, payload []byte, qos int, retain bool) error {
+	token := c.client.Publish(topic, byte(qos), retain, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (c pahoConnection) Subscribe(topic string, qos int, callback func(Message)) error {
+	token := c.client.Subscribe(topic, byte(qos), func(client mq.Client, msg mq.Message) {
+		callback(msg)
+	})
+	token.Wait()
+	return token.Error()
+}
+
 // onConnect gets executed when we've established a connection with the MQTT
 // broker, regardless of if this was our first attempt or after a reconnect.
 func (h *Handler) OnConnect(c mq.Client) {
+	h.Connected(pahoConnection{client: c})
+}
+
+// Connected does what OnConnect does for any kind of connection.
+func (h *Handler) Connected(c Connection) {
 	log.Print("Connected to MQTT broker")
+	if h.Recorder != nil {
+		c = h.Recorder.Connection(c)
+	}
 
 	if h.Ann != nil && h.AnnounceTopic != "" {
 		log.Print("Attempting to subscribe to announce topic")
 		err := RetryWithBackoff(5, 2*time.Second, func() error {
-			token := c.Subscribe(h.AnnounceTopic, 1, func(client mq.Client, msg mq.Message) {
+			return c.Subscribe(h.AnnounceTopic, 1, func(msg Message) {
 				h.Ann <- msg
 			})
-			token.Wait()
-			return token.Error()
 		})
 		if err != nil {
 			log.Fatal("Could not subscribe to announce topic")
@@ -67,11 +100,9 @@ func (h *Handler) OnConnect(c mq.Client) {
 	if h.Leave != nil && h.LeaveTopic != "" {
 		log.Print("Attempting to subscribe to leave topic")
 		err := RetryWithBackoff(5, 2*time.Second, func() error {
-			token := c.Subscribe(h.LeaveTopic, 1, func(client mq.Client, msg mq.Message) {
+			return c.Subscribe(h.LeaveTopic, 1, func(msg Message) {
 				h.Leave <- msg
 			})
-			token.Wait()
-			return token.Error()
 		})
 		if err != nil {
 			log.Fatal("Could not subscribe to leave topic")
@@ -91,9 +122,7 @@ func (h *Handler) OnConnect(c mq.Client) {
 	if h.DiscoverTopic != "" {
 		log.Print("Attempting to publish to discover topic")
 		err := RetryWithBackoff(5, 2*time.Second, func() error {
-			token := c.Publish(h.DiscoverTopic, 1, true, "1")
-			token.Wait()
-			return token.Error()
+			return c.Publish(h.DiscoverTopic, []byte("1"), 1, true)
 		})
 		if err != nil {
 			log.Fatal("Could not publish to discover topic")
@@ -116,30 +145,75 @@ func (h *Handler) OnConnectionLost(c mq.Client, e error) {
 //
 // It allows for publishing messages to a topic on an MQTT broker, to
 // subscribe to messages published to topics and to unsubscribe from topic.
+// It is also a ContextPublishSubscriber, which waits for the broker to
+// acknowledge an operation and returns its error. The methods without a
+// context return right away and log errors.
 func NewMQTTMessenger(client mq.Client) PublishSubscriber {
 	return &mqttMessenger{
 		client: client,
 	}
 }
 
+// waitInterval is how often wait checks whether its context is done.
+const waitInterval = 50 * time.Millisecond
+
+// wait waits for token to complete, or for ctx to be done. It waits in
+// steps of waitInterval so nothing is left waiting for a token that never
+// completes.
+func wait(ctx context.Context, token mq.Token) error {
+	for !token.WaitTimeout(waitInterval) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+	return token.Error()
+}
+
+// logError logs the error of token once it completes.
+func logError(token mq.Token, action string) {
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Could not %s: %s", action, token.Error())
+		}
+	}()
+}
+
 // Publish publishes a msg on the specified topic. qos represents the MQTT QoS
 // level and retain informs the broker that it needs to persist this message so
 // that when a new client subscribes to the topic we published on they will
 // automatically get that message.
 func (m *mqttMessenger) Publish(topic string, msg []byte, qos int, retain bool) {
-	m.client.Publish(topic, byte(qos), retain, msg)
+	logError(m.client.Publish(topic, byte(qos), retain, msg), "publish to "+topic)
 }
 
 // Subscribe subscribes to the specified topic with a certain qos. The topic
 // and message are then passed into this messenger's recv channel and can be
 // read from by any interested consumer.
 func (m *mqttMessenger) Subscribe(topic string, qos int, callback func(Message)) {
-	m.client.Subscribe(topic, byte(qos), func(c mq.Client, msg mq.Message) {
-		callback(msg)
-	})
+	logError(m.subscribe(topic, qos, callback), "subscribe to "+topic)
 }
 
 // Unsubscribe unsubscribes from one or multiple topics.
 func (m *mqttMessenger) Unsubscribe(topics ...string) {
-	m.client.Unsubscribe(topics...)
+	logError(m.client.Unsubscribe(topics...), fmt.Sprintf("unsubscribe from %v", topics))
+}
+
+func (m *mqttMessenger) subscribe(topic string, qos int, callback func(Message)) mq.Token {
+	return m.client.Subscribe(topic, byte(qos), func(c mq.Client, msg mq.Message) {
+		callback(msg)
+	})
+}
+
+func (m *mqttMessenger) PublishContext(ctx context.Context, topic string, msg []byte, qos int, retain bool) error {
+	return wait(ctx, m.client.Publish(topic, byte(qos), retain, msg))
+}
+
+func (m *mqttMessenger) SubscribeContext(ctx context.Context, topic string, qos int, callback func(Message)) error {
+	return wait(ctx, m.subscribe(topic, qos, callback))
+}
+
+func (m *mqttMessenger) UnsubscribeContext(ctx context.Context, topics ...string) error {
+	return wait(ctx, m.client.Unsubscribe(topics...))
 }
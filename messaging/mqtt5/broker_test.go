@@ -0,0 +1,134 @@
+package mqtt5
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+	"github.com/hemtjanst/hemtjanst/messaging/broker"
+)
+
+// The tests in this file run the client against a broker over TCP. That's
+// the embedded broker, unless MQTT_TEST_BROKER is set to the address of
+// another one, like Mosquitto, which also has to keep sessions.
+
+func testBrokerAddress(t *testing.T) (string, bool) {
+	if addr := os.Getenv("MQTT_TEST_BROKER"); addr != "" {
+		return addr, true
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := broker.New()
+	go b.Serve(l)
+	t.Cleanup(func() { b.Close() })
+	return l.Addr().String(), false
+}
+
+func brokerClient(t *testing.T, addr string, cfg Config) *Client {
+	t.Helper()
+	cfg.Address = addr
+	cfg.Timeout = 5 * time.Second
+	c := NewClient(cfg)
+	if err := c.Connect(); err != nil {
+		t.Fatal("Could not connect: ", err)
+	}
+	t.Cleanup(c.Disconnect)
+	return c
+}
+
+func receiveFrom(t *testing.T, msgs chan messaging.Message) messaging.Message {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+		return nil
+	}
+}
+
+func TestBroker(t *testing.T) {
+	addr, _ := testBrokerAddress(t)
+	prefix := "hemtjanst-test/" + time.Now().Format("150405.000") + "/"
+	device := brokerClient(t, addr, Config{ClientID: "hemtjanst-test-device"})
+	hemtjanst := brokerClient(t, addr, Config{ClientID: "hemtjanst-test"})
+	ctx := context.Background()
+
+	msgs := make(chan messaging.Message, 10)
+	if err := hemtjanst.Subscribe(prefix+"sensor/#", 2, func(msg messaging.Message) { msgs <- msg }); err != nil {
+		t.Fatal("Could not subscribe: ", err)
+	}
+	for qos := 0; qos <= 2; qos++ {
+		props := &messaging.Properties{ContentType: "text/plain", UserProperties: map[string]string{"unit": "celsius"}}
+		if err := device.PublishProperties(ctx, prefix+"sensor/temperature", []byte("21.5"), qos, false, props); err != nil {
+			t.Fatalf("Could not publish with QoS %d: %s", qos, err)
+		}
+		msg := receiveFrom(t, msgs)
+		p := messaging.MessageProperties(msg)
+		if string(msg.Payload()) != "21.5" || p == nil || p.ContentType != "text/plain" || p.UserProperties["unit"] != "celsius" {
+			t.Errorf("Expected 21.5 with properties with QoS %d, got %s with %+v", qos, msg.Payload(), p)
+		}
+	}
+
+	if err := device.Publish(prefix+"retained", []byte("1"), 1, true); err != nil {
+		t.Fatal("Could not publish retained message: ", err)
+	}
+	retained := make(chan messaging.Message, 1)
+	if err := hemtjanst.Subscribe(prefix+"retained", 1, func(msg messaging.Message) { retained <- msg }); err != nil {
+		t.Fatal("Could not subscribe: ", err)
+	}
+	if msg := receiveFrom(t, retained); !messaging.Retained(msg) {
+		t.Error("Expected a retained message")
+	}
+	device.Publish(prefix+"retained", nil, 1, true)
+
+	if err := device.Subscribe(prefix+"lock/set", 1, func(msg messaging.Message) {
+		p := messaging.MessageProperties(msg)
+		device.PublishProperties(ctx, p.ResponseTopic, []byte("locked"), 1, false, &messaging.Properties{CorrelationData: p.CorrelationData})
+	}); err != nil {
+		t.Fatal("Could not subscribe: ", err)
+	}
+	responses := make(chan messaging.Message, 1)
+	if err := hemtjanst.Request(ctx, prefix+"lock/set", []byte("1"), 1, nil, func(msg messaging.Message) { responses <- msg }); err != nil {
+		t.Fatal("Could not send request: ", err)
+	}
+	if msg := receiveFrom(t, responses); string(msg.Payload()) != "locked" {
+		t.Error("Expected response to the request, got ", string(msg.Payload()))
+	}
+}
+
+func TestBrokerSession(t *testing.T) {
+	addr, external := testBrokerAddress(t)
+	if !external {
+		t.Skip("The embedded broker doesn't keep sessions, set MQTT_TEST_BROKER")
+	}
+	topic := "hemtjanst-test/" + time.Now().Format("150405.000") + "/session"
+	cfg := Config{Address: addr, ClientID: "hemtjanst-test-session", SessionExpiry: time.Minute}
+
+	c := brokerClient(t, addr, cfg)
+	if err := c.Subscribe(topic, 1, func(messaging.Message) {}); err != nil {
+		t.Fatal("Could not subscribe: ", err)
+	}
+	c.Disconnect()
+
+	device := brokerClient(t, addr, Config{ClientID: "hemtjanst-test-device"})
+	if err := device.Publish(topic, []byte("while away"), 1, false); err != nil {
+		t.Fatal("Could not publish: ", err)
+	}
+
+	msgs := make(chan messaging.Message, 1)
+	c = NewClient(cfg)
+	c.Subscribe(topic, 1, func(msg messaging.Message) { msgs <- msg })
+	if err := c.Connect(); err != nil {
+		t.Fatal("Could not connect again: ", err)
+	}
+	defer c.Disconnect()
+	if msg := receiveFrom(t, msgs); string(msg.Payload()) != "while away" {
+		t.Error("Expected the message published while away, got ", string(msg.Payload()))
+	}
+}
@@ -0,0 +1,754 @@
+// Package mqtt5 is an MQTT 5 client. Unlike MQTT 3.1.1 it carries message
+// properties, which are passed on as messaging.Properties, ties responses
+// to requests through response topics and correlation data, and reports
+// why the broker refused something with a reason code, returned as a
+// packet.ReasonCode error.
+package mqtt5
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+	"github.com/hemtjanst/hemtjanst/messaging/packet"
+)
+
+var (
+	// ErrNotConnected is returned when there's no connection to the
+	// broker.
+	ErrNotConnected = errors.New("not connected to the broker")
+	// ErrTimeout is returned when the broker doesn't acknowledge a
+	// packet in time.
+	ErrTimeout = errors.New("timed out waiting for the broker")
+)
+
+// NoExpiry is the SessionExpiry of a session the broker keeps forever,
+// like a session that isn't clean in MQTT 3.1.1.
+const NoExpiry = math.MaxUint32 * time.Second
+
+// Config configures a Client.
+type Config struct {
+	// Address is the host:port of the broker
+	Address string
+	// TLS is used to connect to the broker when set
+	TLS      *tls.Config
+	ClientID string
+	Username string
+	Password string
+	// KeepAlive is the time between pings, unless the broker asks for
+	// another interval
+	KeepAlive time.Duration
+	// Timeout is how long to wait for connecting to the broker and for
+	// it to acknowledge a packet
+	Timeout time.Duration
+	// MaxReconnectInterval caps the time between attempts to reconnect
+	MaxReconnectInterval time.Duration
+	// SessionExpiry is how long the broker keeps the session after the
+	// connection is lost. When it's 0 every connection starts a new
+	// session. Otherwise messages that weren't acknowledged are sent
+	// again when the broker still has the session after reconnecting.
+	SessionExpiry time.Duration
+	// ResponseTopic is subscribed to for responses to requests. It
+	// defaults to <ClientID>/response.
+	ResponseTopic    string
+	Will             *Will
+	OnConnect        func(*Client)
+	OnConnectionLost func(*Client, error)
+	// Dial opens the connection to the broker, instead of connecting to
+	// Address
+	Dial func() (net.Conn, error)
+}
+
+// Will is published by the broker when the client disconnects without
+// saying so.
+type Will struct {
+	Topic      string
+	Payload    []byte
+	QoS        int
+	Retain     bool
+	Properties *messaging.Properties
+}
+
+type subscription struct {
+	qos      int
+	callback func(messaging.Message)
+}
+
+type delivery struct {
+	msg      *message
+	callback func(messaging.Message)
+}
+
+// outgoing is a PUBLISH, or the PUBREL of one with QoS 2, that the broker
+// hasn't acknowledged yet.
+type outgoing struct {
+	id uint16
+	p  packet.Packet
+}
+
+// Client is a connection to an MQTT 5 broker that reconnects when it's
+// lost, subscribing to everything it was subscribed to again.
+type Client struct {
+	cfg Config
+
+	mutex     sync.Mutex
+	ready     *sync.Cond
+	conn      net.Conn
+	closing   bool
+	nextID    uint16
+	inflight  map[uint16]chan packet.Packet
+	session   []outgoing
+	subs      map[string]subscription
+	qos2      map[uint16]bool
+	requests  map[string]func(messaging.Message)
+	responses bool
+	received  time.Time
+	queue     []delivery
+	running   bool
+
+	writeMutex sync.Mutex
+}
+
+// NewClient returns a client for the broker in cfg. It doesn't connect
+// until Connect is called.
+func NewClient(cfg Config) *Client {
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = 30 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxReconnectInterval <= 0 {
+		cfg.MaxReconnectInterval = 2 * time.Minute
+	}
+	if cfg.ResponseTopic == "" {
+		cfg.ResponseTopic = cfg.ClientID + "/response"
+	}
+	c := &Client{
+		cfg:      cfg,
+		inflight: map[uint16]chan packet.Packet{},
+		subs:     map[string]subscription{},
+		qos2:     map[uint16]bool{},
+		requests: map[string]func(messaging.Message){},
+	}
+	c.ready = sync.NewCond(&c.mutex)
+	return c
+}
+
+// Connect connects to the broker. Once connected the connection is kept up
+// until Disconnect is called.
+func (c *Client) Connect() error {
+	c.mutex.Lock()
+	c.closing = false
+	c.mutex.Unlock()
+	return c.connect()
+}
+
+// Disconnect closes the connection to the broker, which won't publish the
+// will for it.
+func (c *Client) Disconnect() {
+	c.mutex.Lock()
+	c.closing = true
+	c.ready.Signal()
+	conn := c.conn
+	c.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+	c.write(conn, &packet.Disconnect{ReasonCode: packet.Success})
+	conn.Close()
+}
+
+// IsConnected returns whether there's a connection to the broker.
+func (c *Client) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn != nil
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	if c.cfg.Dial != nil {
+		return c.cfg.Dial()
+	}
+	dialer := &net.Dialer{Timeout: c.cfg.Timeout}
+	if c.cfg.TLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", c.cfg.Address, c.cfg.TLS)
+	}
+	return dialer.Dial("tcp", c.cfg.Address)
+}
+
+func (c *Client) connect() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	keepAlive := c.cfg.KeepAlive
+	connect := &packet.Connect{
+		Version:    packet.Version5,
+		ClientID:   c.cfg.ClientID,
+		CleanStart: c.cfg.SessionExpiry <= 0,
+		KeepAlive:  uint16(keepAlive / time.Second),
+	}
+	if expiry := c.cfg.SessionExpiry; expiry > 0 {
+		if expiry > NoExpiry {
+			expiry = NoExpiry
+		}
+		connect.Properties.SessionExpiry = packet.Uint32(uint32(expiry / time.Second))
+	}
+	if c.cfg.Username != "" {
+		connect.Username = &c.cfg.Username
+	}
+	if c.cfg.Password != "" {
+		connect.Password = []byte(c.cfg.Password)
+	}
+	if w := c.cfg.Will; w != nil {
+		connect.Will = &packet.Will{
+			Topic:      w.Topic,
+			Payload:    w.Payload,
+			QoS:        byte(w.QoS),
+			Retain:     w.Retain,
+			Properties: packet.FromMessaging(w.Properties),
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(c.cfg.Timeout))
+	r := bufio.NewReader(conn)
+	if err := packet.Write(conn, connect, packet.Version5); err != nil {
+		conn.Close()
+		return err
+	}
+	p, err := packet.Read(r, packet.Version5, packet.MaxSize)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	ack, ok := p.(*packet.Connack)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("expected CONNACK, got packet type %d", p.Type())
+	}
+	if ack.ReasonCode.Failed() {
+		conn.Close()
+		return ack.ReasonCode
+	}
+	if ack.Properties.ServerKeepAlive != nil {
+		keepAlive = time.Duration(*ack.Properties.ServerKeepAlive) * time.Second
+	}
+	if err := c.resume(conn, ack.SessionPresent); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Subscriptions made from here on are sent by Subscribe itself
+	c.mutex.Lock()
+	c.conn = conn
+	c.received = time.Now()
+	subs := make(map[string]subscription, len(c.subs))
+	for filter, sub := range c.subs {
+		subs[filter] = sub
+	}
+	c.mutex.Unlock()
+
+	go c.read(conn, r)
+	if keepAlive > 0 {
+		go c.ping(conn, keepAlive)
+	}
+	go c.connected(subs)
+	return nil
+}
+
+// resume sends the packets the broker hasn't acknowledged again if it kept
+// the session. Otherwise they're given up on.
+func (c *Client) resume(conn net.Conn, present bool) error {
+	c.mutex.Lock()
+	session := c.session
+	if !present {
+		for _, o := range session {
+			if ch := c.inflight[o.id]; ch != nil {
+				close(ch)
+				delete(c.inflight, o.id)
+			}
+		}
+		c.session = nil
+		c.qos2 = map[uint16]bool{}
+		session = nil
+	}
+	c.mutex.Unlock()
+
+	for _, o := range session {
+		p := o.p
+		if pub, ok := p.(*packet.Publish); ok {
+			dup := *pub
+			dup.Dup = true
+			p = &dup
+		}
+		if err := c.write(conn, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connected restores the subscriptions of the previous connection and
+// calls OnConnect.
+func (c *Client) connected(subs map[string]subscription) {
+	for filter, sub := range subs {
+		if err := c.subscribe(context.Background(), filter, sub); err != nil {
+			log.Printf("Could not subscribe to %s again: %s", filter, err)
+		}
+	}
+	if c.cfg.OnConnect != nil {
+		c.cfg.OnConnect(c)
+	}
+}
+
+// lost cleans up after conn has been closed and reconnects, unless the
+// client is disconnecting.
+func (c *Client) lost(conn net.Conn, err error) {
+	conn.Close()
+	c.mutex.Lock()
+	if c.conn != conn {
+		c.mutex.Unlock()
+		return
+	}
+	c.conn = nil
+	for id, ch := range c.inflight {
+		if c.cfg.SessionExpiry > 0 && c.outgoing(id) >= 0 {
+			// Sent again once reconnected
+			continue
+		}
+		close(ch)
+		delete(c.inflight, id)
+	}
+	if c.cfg.SessionExpiry <= 0 {
+		c.session = nil
+		c.qos2 = map[uint16]bool{}
+	}
+	closing := c.closing
+	c.mutex.Unlock()
+	if closing {
+		return
+	}
+
+	if c.cfg.OnConnectionLost != nil {
+		c.cfg.OnConnectionLost(c, err)
+	}
+	go c.reconnect()
+}
+
+func (c *Client) reconnect() {
+	wait := time.Second
+	for {
+		time.Sleep(wait)
+		c.mutex.Lock()
+		closing := c.closing
+		c.mutex.Unlock()
+		if closing {
+			return
+		}
+		err := c.connect()
+		if err == nil {
+			return
+		}
+		wait *= 2
+		if wait > c.cfg.MaxReconnectInterval {
+			wait = c.cfg.MaxReconnectInterval
+		}
+		log.Printf("Could not reconnect to the MQTT broker, retrying in %s: %s", wait, err)
+	}
+}
+
+func (c *Client) ping(conn net.Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mutex.Lock()
+		current := c.conn == conn
+		silent := time.Since(c.received)
+		c.mutex.Unlock()
+		if !current {
+			return
+		}
+		if silent > interval*3/2 {
+			c.lost(conn, errors.New("keep alive timeout"))
+			return
+		}
+		if err := c.write(conn, &packet.Pingreq{}); err != nil {
+			c.lost(conn, err)
+			return
+		}
+	}
+}
+
+func (c *Client) write(conn net.Conn, p packet.Packet) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(c.cfg.Timeout))
+	return packet.Write(conn, p, packet.Version5)
+}
+
+func (c *Client) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		p, err := packet.Read(r, packet.Version5, packet.MaxSize)
+		if err != nil {
+			c.lost(conn, err)
+			return
+		}
+		c.mutex.Lock()
+		c.received = time.Now()
+		c.mutex.Unlock()
+
+		switch p := p.(type) {
+		case *packet.Publish:
+			err = c.handlePublish(conn, p)
+		case *packet.Ack:
+			if p.Kind == packet.PUBREL {
+				c.mutex.Lock()
+				delete(c.qos2, p.PacketID)
+				c.mutex.Unlock()
+				err = c.write(conn, &packet.Ack{Kind: packet.PUBCOMP, PacketID: p.PacketID})
+			} else {
+				err = c.handleAck(conn, p)
+			}
+		case *packet.Suback:
+			c.acknowledged(p.PacketID, p)
+		case *packet.Unsuback:
+			c.acknowledged(p.PacketID, p)
+		case *packet.Disconnect:
+			err = fmt.Errorf("disconnected by the broker: %w", p.ReasonCode)
+		case *packet.Pingresp:
+		default:
+			err = fmt.Errorf("unexpected packet type %d", p.Type())
+		}
+		if err != nil {
+			c.lost(conn, err)
+			return
+		}
+	}
+}
+
+func (c *Client) handlePublish(conn net.Conn, p *packet.Publish) error {
+	msg := &message{topic: p.Topic, payload: p.Payload, retained: p.Retain, properties: packet.ToMessaging(p.Properties)}
+	switch p.QoS {
+	case 0:
+		c.deliver(msg)
+	case 1:
+		c.deliver(msg)
+		return c.write(conn, &packet.Ack{Kind: packet.PUBACK, PacketID: p.PacketID})
+	case 2:
+		c.mutex.Lock()
+		seen := c.qos2[p.PacketID]
+		c.qos2[p.PacketID] = true
+		c.mutex.Unlock()
+		if !seen {
+			c.deliver(msg)
+		}
+		return c.write(conn, &packet.Ack{Kind: packet.PUBREC, PacketID: p.PacketID})
+	}
+	return nil
+}
+
+// deliver queues msg for all subscriptions matching it. The queue is
+// handed to the callbacks by run, in the order the messages arrived,
+// so they can publish without holding up the connection.
+func (c *Client) deliver(msg *message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for filter, sub := range c.subs {
+		if messaging.Match(filter, msg.topic) {
+			c.queue = append(c.queue, delivery{msg: msg, callback: sub.callback})
+		}
+	}
+	if len(c.queue) == 0 {
+		return
+	}
+	if !c.running {
+		c.running = true
+		go c.run()
+	}
+	c.ready.Signal()
+}
+
+// run hands queued messages to their callbacks until the queue is empty
+// after Disconnect.
+func (c *Client) run() {
+	for {
+		c.mutex.Lock()
+		for len(c.queue) == 0 && !c.closing {
+			c.ready.Wait()
+		}
+		if len(c.queue) == 0 {
+			c.running = false
+			c.mutex.Unlock()
+			return
+		}
+		d := c.queue[0]
+		c.queue[0] = delivery{}
+		c.queue = c.queue[1:]
+		c.mutex.Unlock()
+
+		d.callback(d.msg)
+	}
+}
+
+// handleAck moves a publish with a QoS above 0 along once the broker
+// acknowledged it, releasing it after a PUBREC.
+func (c *Client) handleAck(conn net.Conn, p *packet.Ack) error {
+	c.mutex.Lock()
+	i := c.outgoing(p.PacketID)
+	var rel *packet.Ack
+	if p.Kind == packet.PUBREC && !p.ReasonCode.Failed() {
+		rel = &packet.Ack{Kind: packet.PUBREL, PacketID: p.PacketID}
+		if i >= 0 {
+			c.session[i].p = rel
+		}
+	} else if i >= 0 {
+		c.session = append(c.session[:i], c.session[i+1:]...)
+	}
+	c.mutex.Unlock()
+
+	c.acknowledged(p.PacketID, p)
+	if rel != nil {
+		return c.write(conn, rel)
+	}
+	return nil
+}
+
+// outgoing returns the index of the packet with id in the session, or -1.
+// The mutex must be held.
+func (c *Client) outgoing(id uint16) int {
+	for i, o := range c.session {
+		if o.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// acknowledged hands p to whoever is waiting for the acknowledgement of the
+// packet with that ID.
+func (c *Client) acknowledged(id uint16, p packet.Packet) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if ch := c.inflight[id]; ch != nil {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// send writes p, which is given a new packet ID by setID, and returns a
+// channel receiving the packets acknowledging it. A PUBLISH is kept in the
+// session until the broker acknowledged it, even if nobody waits for it
+// anymore.
+func (c *Client) send(p packet.Packet, setID func(uint16)) (uint16, chan packet.Packet, error) {
+	c.mutex.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mutex.Unlock()
+		return 0, nil, ErrNotConnected
+	}
+	for {
+		c.nextID++
+		if _, used := c.inflight[c.nextID]; c.nextID != 0 && !used && c.outgoing(c.nextID) < 0 {
+			break
+		}
+	}
+	id := c.nextID
+	ch := make(chan packet.Packet, 2)
+	c.inflight[id] = ch
+	setID(id)
+	_, publish := p.(*packet.Publish)
+	if publish {
+		c.session = append(c.session, outgoing{id: id, p: p})
+	}
+	c.mutex.Unlock()
+
+	if err := c.write(conn, p); err != nil {
+		c.lost(conn, err)
+		if publish && c.cfg.SessionExpiry > 0 {
+			// Sent again once reconnected
+			return id, ch, nil
+		}
+		c.done(id)
+		return 0, nil, err
+	}
+	return id, ch, nil
+}
+
+func (c *Client) done(id uint16) {
+	c.mutex.Lock()
+	delete(c.inflight, id)
+	c.mutex.Unlock()
+}
+
+// wait returns the next acknowledgement on ch, giving up when ctx is done
+// or the broker takes longer than the Timeout.
+func (c *Client) wait(ctx context.Context, ch chan packet.Packet) (packet.Packet, error) {
+	timer := time.NewTimer(c.cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case p, ok := <-ch:
+		if !ok {
+			return nil, ErrNotConnected
+		}
+		return p, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+// Publish publishes payload on topic. With a QoS above 0 it waits for the
+// broker to acknowledge it.
+func (c *Client) Publish(topic string, payload []byte, qos int, retain bool) error {
+	return c.PublishProperties(context.Background(), topic, payload, qos, retain, nil)
+}
+
+// PublishContext publishes like Publish, waiting no longer than ctx allows.
+func (c *Client) PublishContext(ctx context.Context, topic string, payload []byte, qos int, retain bool) error {
+	return c.PublishProperties(ctx, topic, payload, qos, retain, nil)
+}
+
+// PublishProperties publishes like PublishContext, with properties.
+func (c *Client) PublishProperties(ctx context.Context, topic string, payload []byte, qos int, retain bool, props *messaging.Properties) error {
+	p := &packet.Publish{
+		Topic:      topic,
+		Payload:    payload,
+		QoS:        byte(qos),
+		Retain:     retain,
+		Properties: packet.FromMessaging(props),
+	}
+	if qos == 0 {
+		c.mutex.Lock()
+		conn := c.conn
+		c.mutex.Unlock()
+		if conn == nil {
+			return ErrNotConnected
+		}
+		return c.write(conn, p)
+	}
+
+	id, ch, err := c.send(p, func(id uint16) { p.PacketID = id })
+	if err != nil {
+		return err
+	}
+	defer c.done(id)
+	for {
+		ack, err := c.wait(ctx, ch)
+		if err != nil {
+			return err
+		}
+		// QoS 2 takes another round trip to release the packet ID,
+		// which handleAck starts
+		if a := ack.(*packet.Ack); a.Kind != packet.PUBREC || a.ReasonCode.Failed() {
+			return failure(a.ReasonCode)
+		}
+	}
+}
+
+// Subscribe subscribes to topic, which can be a filter with wildcards or a
+// shared subscription. callback is called for every message received on
+// it, also after reconnecting. Without a connection the subscription is
+// made once connected.
+func (c *Client) Subscribe(topic string, qos int, callback func(messaging.Message)) error {
+	return c.SubscribeContext(context.Background(), topic, qos, callback)
+}
+
+// SubscribeContext subscribes like Subscribe, waiting no longer than ctx
+// allows.
+func (c *Client) SubscribeContext(ctx context.Context, topic string, qos int, callback func(messaging.Message)) error {
+	sub := subscription{qos: qos, callback: callback}
+	c.mutex.Lock()
+	previous, existed := c.subs[topic]
+	c.subs[topic] = sub
+	c.mutex.Unlock()
+
+	err := c.subscribe(ctx, topic, sub)
+	if err == ErrNotConnected {
+		return nil
+	}
+	if err != nil {
+		c.mutex.Lock()
+		if existed {
+			c.subs[topic] = previous
+		} else {
+			delete(c.subs, topic)
+		}
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+func (c *Client) subscribe(ctx context.Context, topic string, sub subscription) error {
+	p := &packet.Subscribe{Subscriptions: []packet.Subscription{{Filter: topic, QoS: byte(sub.qos)}}}
+	id, ch, err := c.send(p, func(id uint16) { p.PacketID = id })
+	if err != nil {
+		return err
+	}
+	defer c.done(id)
+	ack, err := c.wait(ctx, ch)
+	if err != nil {
+		return err
+	}
+	codes := ack.(*packet.Suback).ReasonCodes
+	if len(codes) != 1 {
+		return packet.ProtocolError
+	}
+	return failure(codes[0])
+}
+
+// Unsubscribe unsubscribes from topics.
+func (c *Client) Unsubscribe(topics ...string) error {
+	return c.UnsubscribeContext(context.Background(), topics...)
+}
+
+// UnsubscribeContext unsubscribes like Unsubscribe, waiting no longer than
+// ctx allows.
+func (c *Client) UnsubscribeContext(ctx context.Context, topics ...string) error {
+	c.mutex.Lock()
+	for _, topic := range topics {
+		delete(c.subs, topic)
+	}
+	c.mutex.Unlock()
+
+	p := &packet.Unsubscribe{Filters: topics}
+	id, ch, err := c.send(p, func(id uint16) { p.PacketID = id })
+	if err == ErrNotConnected {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer c.done(id)
+	ack, err := c.wait(ctx, ch)
+	if err != nil {
+		return err
+	}
+	for _, rc := range ack.(*packet.Unsuback).ReasonCodes {
+		if rc.Failed() {
+			return rc
+		}
+	}
+	return nil
+}
+
+// failure returns rc as an error if it's a failure.
+func failure(rc packet.ReasonCode) error {
+	if rc.Failed() {
+		return rc
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package mqtt5
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+	"github.com/hemtjanst/hemtjanst/messaging/packet"
+)
+
+// testBroker is the broker end of a connection, driven by the test.
+type testBroker struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (b *testBroker) read() packet.Packet {
+	b.t.Helper()
+	b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packet.Read(b.r, packet.Version5, packet.MaxSize)
+	if err != nil {
+		b.t.Fatal("Broker could not read packet: ", err)
+	}
+	return p
+}
+
+func (b *testBroker) write(p packet.Packet) {
+	b.t.Helper()
+	if err := packet.Write(b.conn, p, packet.Version5); err != nil {
+		b.t.Fatal("Broker could not write packet: ", err)
+	}
+}
+
+// newTestClient returns a client whose connections are accepted by
+// brokers sent on the returned channel.
+func newTestClient(t *testing.T, cfg Config) (*Client, chan *testBroker) {
+	brokers := make(chan *testBroker, 2)
+	cfg.Dial = func() (net.Conn, error) {
+		client, server := net.Pipe()
+		brokers <- &testBroker{t: t, conn: server, r: bufio.NewReader(server)}
+		return client, nil
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "test"
+	}
+	return NewClient(cfg), brokers
+}
+
+// connect connects c, with the broker accepting the connection.
+func connect(t *testing.T, c *Client, brokers chan *testBroker) *testBroker {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() { errs <- c.Connect() }()
+	b := <-brokers
+	if _, ok := b.read().(*packet.Connect); !ok {
+		t.Fatal("Expected CONNECT")
+	}
+	b.write(&packet.Connack{})
+	if err := <-errs; err != nil {
+		t.Fatal("Expected to connect, got ", err)
+	}
+	return b
+}
+
+func TestConnect(t *testing.T) {
+	c, brokers := newTestClient(t, Config{
+		ClientID: "hemtjanst-1",
+		Username: "user",
+		Will:     &Will{Topic: "leave", Payload: []byte("hemtjanst-1")},
+	})
+	errs := make(chan error, 1)
+	go func() { errs <- c.Connect() }()
+	b := <-brokers
+	connect, ok := b.read().(*packet.Connect)
+	if !ok {
+		t.Fatal("Expected CONNECT")
+	}
+	if connect.Version != packet.Version5 || connect.ClientID != "hemtjanst-1" {
+		t.Errorf("Expected MQTT 5 connect of hemtjanst-1, got version %d of %s", connect.Version, connect.ClientID)
+	}
+	if connect.Username == nil || *connect.Username != "user" || connect.Password != nil {
+		t.Error("Expected user name without password, got ", connect.Username, connect.Password)
+	}
+	if connect.Will == nil || connect.Will.Topic != "leave" || string(connect.Will.Payload) != "hemtjanst-1" {
+		t.Error("Expected will on leave, got ", connect.Will)
+	}
+
+	b.write(&packet.Connack{ReasonCode: packet.NotAuthorized})
+	if err := <-errs; err != packet.NotAuthorized {
+		t.Error("Expected not authorized, got ", err)
+	}
+	if c.IsConnected() {
+		t.Error("Expected to not be connected")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	c, brokers := newTestClient(t, Config{})
+	b := connect(t, c, brokers)
+
+	errs := make(chan error, 1)
+	props := &messaging.Properties{
+		ContentType:    "application/json",
+		MessageExpiry:  1500 * time.Millisecond,
+		UserProperties: map[string]string{"source": "test"},
+	}
+	go func() {
+		errs <- c.PublishProperties(context.Background(), "lightbulb/on/set", []byte("1"), 1, false, props)
+	}()
+	pub, ok := b.read().(*packet.Publish)
+	if !ok {
+		t.Fatal("Expected PUBLISH")
+	}
+	if pub.Topic != "lightbulb/on/set" || string(pub.Payload) != "1" || pub.QoS != 1 {
+		t.Errorf("Expected 1 on lightbulb/on/set with QoS 1, got %s on %s with QoS %d", pub.Payload, pub.Topic, pub.QoS)
+	}
+	if pub.Properties.MessageExpiry == nil || *pub.Properties.MessageExpiry != 2 {
+		t.Error("Expected message expiry rounded up to 2 seconds, got ", pub.Properties.MessageExpiry)
+	}
+	if pub.Properties.ContentType != "application/json" {
+		t.Error("Expected content type application/json, got ", pub.Properties.ContentType)
+	}
+	if len(pub.Properties.UserProperties) != 1 || pub.Properties.UserProperties[0] != (packet.UserProperty{Key: "source", Value: "test"}) {
+		t.Error("Expected user property source=test, got ", pub.Properties.UserProperties)
+	}
+	b.write(&packet.Ack{Kind: packet.PUBACK, PacketID: pub.PacketID, ReasonCode: packet.NoMatchingSubscribers})
+	if err := <-errs; err != nil {
+		t.Error("Expected no error when nobody is subscribed, got ", err)
+	}
+
+	go func() { errs <- c.Publish("lightbulb/on/set", []byte("0"), 2, false) }()
+	pub = b.read().(*packet.Publish)
+	b.write(&packet.Ack{Kind: packet.PUBREC, PacketID: pub.PacketID})
+	if rel, ok := b.read().(*packet.Ack); !ok || rel.Kind != packet.PUBREL || rel.PacketID != pub.PacketID {
+		t.Fatal("Expected PUBREL, got ", rel)
+	}
+	b.write(&packet.Ack{Kind: packet.PUBCOMP, PacketID: pub.PacketID})
+	if err := <-errs; err != nil {
+		t.Error("Expected QoS 2 publish to complete, got ", err)
+	}
+
+	go func() { errs <- c.Publish("lightbulb/on/set", []byte("1"), 1, false) }()
+	pub = b.read().(*packet.Publish)
+	b.write(&packet.Ack{Kind: packet.PUBACK, PacketID: pub.PacketID, ReasonCode: packet.QuotaExceeded})
+	if err := <-errs; err != packet.QuotaExceeded {
+		t.Error("Expected quota exceeded, got ", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	c, brokers := newTestClient(t, Config{})
+	b := connect(t, c, brokers)
+
+	received := make(chan messaging.Message, 1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Subscribe("$share/hemtjanst/sensor/+/get", 1, func(msg messaging.Message) {
+			received <- msg
+		})
+	}()
+	sub := b.read().(*packet.Subscribe)
+	if len(sub.Subscriptions) != 1 || sub.Subscriptions[0].Filter != "$share/hemtjanst/sensor/+/get" {
+		t.Fatal("Expected subscription to shared filter, got ", sub.Subscriptions)
+	}
+	b.write(&packet.Suback{PacketID: sub.PacketID, ReasonCodes: []packet.ReasonCode{packet.GrantedQoS1}})
+	if err := <-errs; err != nil {
+		t.Fatal("Expected to subscribe, got ", err)
+	}
+
+	go func() { errs <- c.Subscribe("secret/#", 1, func(messaging.Message) {}) }()
+	sub = b.read().(*packet.Subscribe)
+	b.write(&packet.Suback{PacketID: sub.PacketID, ReasonCodes: []packet.ReasonCode{packet.NotAuthorized}})
+	if err := <-errs; err != packet.NotAuthorized {
+		t.Error("Expected not authorized, got ", err)
+	}
+
+	b.write(&packet.Publish{
+		Topic:      "sensor/temperature/get",
+		Payload:    []byte("21.5"),
+		QoS:        1,
+		PacketID:   7,
+		Retain:     true,
+		Properties: packet.Properties{UserProperties: []packet.UserProperty{{Key: "unit", Value: "celsius"}}},
+	})
+	if ack, ok := b.read().(*packet.Ack); !ok || ack.Kind != packet.PUBACK || ack.PacketID != 7 {
+		t.Error("Expected PUBACK of 7, got ", ack)
+	}
+	select {
+	case msg := <-received:
+		if msg.Topic() != "sensor/temperature/get" || string(msg.Payload()) != "21.5" {
+			t.Errorf("Expected 21.5 on sensor/temperature/get, got %s on %s", msg.Payload(), msg.Topic())
+		}
+		if !messaging.Retained(msg) {
+			t.Error("Expected message to be retained")
+		}
+		if p := messaging.MessageProperties(msg); p == nil || p.UserProperties["unit"] != "celsius" {
+			t.Error("Expected user property unit=celsius, got ", p)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected message to be delivered")
+	}
+}
+
+func TestSubscribeOrder(t *testing.T) {
+	c, brokers := newTestClient(t, Config{})
+	b := connect(t, c, brokers)
+
+	received := make(chan string, 100)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Subscribe("sensor/#", 0, func(msg messaging.Message) {
+			if string(msg.Payload()) == "0" {
+				// A slow callback mustn't be overtaken
+				time.Sleep(20 * time.Millisecond)
+			}
+			received <- string(msg.Payload())
+		})
+	}()
+	sub := b.read().(*packet.Subscribe)
+	b.write(&packet.Suback{PacketID: sub.PacketID, ReasonCodes: []packet.ReasonCode{packet.Success}})
+	if err := <-errs; err != nil {
+		t.Fatal("Expected to subscribe, got ", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		b.write(&packet.Publish{Topic: "sensor/temperature/get", Payload: []byte(strconv.Itoa(i))})
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case payload := <-received:
+			if payload != strconv.Itoa(i) {
+				t.Fatalf("Expected message %d, got %s", i, payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message %d to be delivered", i)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	c, brokers := newTestClient(t, Config{ClientID: "hemtjanst-1"})
+	b := connect(t, c, brokers)
+
+	responses := make(chan messaging.Message, 1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Request(context.Background(), "lock/front/set", []byte("1"), 1, &messaging.Properties{MessageExpiry: time.Minute}, func(msg messaging.Message) {
+			responses <- msg
+		})
+	}()
+
+	sub := b.read().(*packet.Subscribe)
+	if sub.Subscriptions[0].Filter != "hemtjanst-1/response" {
+		t.Error("Expected subscription to hemtjanst-1/response, got ", sub.Subscriptions[0].Filter)
+	}
+	b.write(&packet.Suback{PacketID: sub.PacketID, ReasonCodes: []packet.ReasonCode{packet.GrantedQoS1}})
+
+	pub := b.read().(*packet.Publish)
+	if pub.Properties.ResponseTopic != "hemtjanst-1/response" || len(pub.Properties.CorrelationData) == 0 {
+		t.Fatal("Expected response topic and correlation data, got ", pub.Properties)
+	}
+	b.write(&packet.Ack{Kind: packet.PUBACK, PacketID: pub.PacketID})
+	if err := <-errs; err != nil {
+		t.Fatal("Expected request to be published, got ", err)
+	}
+
+	b.write(&packet.Publish{
+		Topic:      "hemtjanst-1/response",
+		Properties: packet.Properties{CorrelationData: []byte("someone else")},
+	})
+	b.write(&packet.Publish{
+		Topic:   "hemtjanst-1/response",
+		Payload: []byte("jammed"),
+		Properties: packet.Properties{
+			CorrelationData: pub.Properties.CorrelationData,
+			UserProperties:  []packet.UserProperty{{Key: "error", Value: "jammed"}},
+		},
+	})
+	select {
+	case msg := <-responses:
+		if string(msg.Payload()) != "jammed" {
+			t.Error("Expected the response to the request, got ", string(msg.Payload()))
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a response")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	connected := make(chan bool, 2)
+	c, brokers := newTestClient(t, Config{OnConnect: func(*Client) { connected <- true }})
+	b := connect(t, c, brokers)
+	<-connected
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Subscribe("announce/#", 1, func(messaging.Message) {}) }()
+	sub := b.read().(*packet.Subscribe)
+	b.write(&packet.Suback{PacketID: sub.PacketID, ReasonCodes: []packet.ReasonCode{packet.GrantedQoS1}})
+	if err := <-errs; err != nil {
+		t.Fatal("Expected to subscribe, got ", err)
+	}
+
+	b.write(&packet.Disconnect{ReasonCode: packet.ServerShuttingDown})
+	b.conn.Close()
+
+	select {
+	case b = <-brokers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected to reconnect")
+	}
+	b.read()
+	b.write(&packet.Connack{})
+	sub = b.read().(*packet.Subscribe)
+	if sub.Subscriptions[0].Filter != "announce/#" {
+		t.Error("Expected to subscribe to announce/# again, got ", sub.Subscriptions[0].Filter)
+	}
+	b.write(&packet.Suback{PacketID: sub.PacketID, ReasonCodes: []packet.ReasonCode{packet.GrantedQoS1}})
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Error("Expected OnConnect to be called after reconnecting")
+	}
+
+	go c.Disconnect()
+	if dis, ok := b.read().(*packet.Disconnect); !ok || dis.ReasonCode != packet.Success {
+		t.Error("Expected a normal DISCONNECT, got ", dis)
+	}
+}
+
+func TestSession(t *testing.T) {
+	c, brokers := newTestClient(t, Config{SessionExpiry: time.Hour})
+	errs := make(chan error, 2)
+	go func() { errs <- c.Connect() }()
+	b := <-brokers
+	connect := b.read().(*packet.Connect)
+	if connect.CleanStart || connect.Properties.SessionExpiry == nil || *connect.Properties.SessionExpiry != 3600 {
+		t.Error("Expected to keep the session for an hour, got ", connect)
+	}
+	b.write(&packet.Connack{})
+	if err := <-errs; err != nil {
+		t.Fatal("Expected to connect, got ", err)
+	}
+
+	go func() { errs <- c.Publish("lightbulb/kitchen/on/set", []byte("1"), 1, false) }()
+	pub := b.read().(*packet.Publish)
+	go func() { errs <- c.Publish("lock/front/set", []byte("1"), 2, false) }()
+	pub2 := b.read().(*packet.Publish)
+	b.write(&packet.Ack{Kind: packet.PUBREC, PacketID: pub2.PacketID})
+	if rel, ok := b.read().(*packet.Ack); !ok || rel.Kind != packet.PUBREL {
+		t.Fatal("Expected PUBREL, got ", rel)
+	}
+	b.conn.Close()
+
+	b = <-brokers
+	b.read()
+	b.write(&packet.Connack{SessionPresent: true})
+	if dup, ok := b.read().(*packet.Publish); !ok || !dup.Dup || dup.PacketID != pub.PacketID || dup.Topic != pub.Topic {
+		t.Error("Expected the publish to be sent again, got ", dup)
+	}
+	if rel, ok := b.read().(*packet.Ack); !ok || rel.Kind != packet.PUBREL || rel.PacketID != pub2.PacketID {
+		t.Error("Expected the PUBREL to be sent again, got ", rel)
+	}
+	b.write(&packet.Ack{Kind: packet.PUBACK, PacketID: pub.PacketID})
+	b.write(&packet.Ack{Kind: packet.PUBCOMP, PacketID: pub2.PacketID})
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error("Expected publish to succeed after reconnecting, got ", err)
+		}
+	}
+
+	go func() { errs <- c.Publish("lightbulb/kitchen/on/set", []byte("0"), 1, false) }()
+	b.read()
+	b.conn.Close()
+	b = <-brokers
+	b.read()
+	b.write(&packet.Connack{})
+	if err := <-errs; err != ErrNotConnected {
+		t.Error("Expected publish to fail when the broker lost the session, got ", err)
+	}
+}
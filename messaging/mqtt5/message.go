@@ -0,0 +1,17 @@
+package mqtt5
+
+import (
+	"github.com/hemtjanst/hemtjanst/messaging"
+)
+
+type message struct {
+	topic      string
+	payload    []byte
+	retained   bool
+	properties *messaging.Properties
+}
+
+func (m *message) Topic() string                     { return m.topic }
+func (m *message) Payload() []byte                   { return m.payload }
+func (m *message) Retained() bool                    { return m.retained }
+func (m *message) Properties() *messaging.Properties { return m.properties }
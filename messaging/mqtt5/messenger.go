@@ -0,0 +1,136 @@
+package mqtt5
+
+import (
+	"context"
+	"crypto/rand"
+	"log"
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+)
+
+// defaultRequestExpiry is how long a response is waited for when the
+// request doesn't expire.
+const defaultRequestExpiry = time.Minute
+
+// Request publishes payload on topic with a response topic and correlation
+// data, and calls response with the first message published back for it
+// before the request expires.
+func (c *Client) Request(ctx context.Context, topic string, payload []byte, qos int, props *messaging.Properties, response func(messaging.Message)) error {
+	if err := c.listen(ctx); err != nil {
+		return err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	p := &messaging.Properties{}
+	if props != nil {
+		*p = *props
+	}
+	p.ResponseTopic = c.cfg.ResponseTopic
+	p.CorrelationData = id
+	expiry := p.MessageExpiry
+	if expiry <= 0 {
+		expiry = defaultRequestExpiry
+	}
+
+	c.mutex.Lock()
+	c.requests[string(id)] = response
+	c.mutex.Unlock()
+	time.AfterFunc(expiry, func() { c.forget(id) })
+
+	err := c.PublishProperties(ctx, topic, payload, qos, false, p)
+	if err != nil {
+		c.forget(id)
+	}
+	return err
+}
+
+// listen subscribes to the response topic, unless that's been done.
+func (c *Client) listen(ctx context.Context) error {
+	c.mutex.Lock()
+	listening := c.responses
+	c.mutex.Unlock()
+	if listening {
+		return nil
+	}
+	if err := c.SubscribeContext(ctx, c.cfg.ResponseTopic, 1, c.respond); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.responses = true
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *Client) respond(msg messaging.Message) {
+	p := messaging.MessageProperties(msg)
+	if p == nil || p.CorrelationData == nil {
+		return
+	}
+	c.mutex.Lock()
+	response := c.requests[string(p.CorrelationData)]
+	delete(c.requests, string(p.CorrelationData))
+	c.mutex.Unlock()
+	if response != nil {
+		response(msg)
+	}
+}
+
+func (c *Client) forget(id []byte) {
+	c.mutex.Lock()
+	delete(c.requests, string(id))
+	c.mutex.Unlock()
+}
+
+type messenger struct {
+	client *Client
+}
+
+// NewMessenger returns a PublishSubscriber for client. Its methods without
+// a context log errors since they can't return them. It also is a
+// messaging.ContextPublishSubscriber, a messaging.PropertiesPublisher and
+// a messaging.Requester.
+func NewMessenger(client *Client) messaging.PublishSubscriber {
+	return &messenger{client: client}
+}
+
+func (m *messenger) Publish(topic string, payload []byte, qos int, retain bool) {
+	if err := m.client.Publish(topic, payload, qos, retain); err != nil {
+		log.Printf("Could not publish to %s: %s", topic, err)
+	}
+}
+
+func (m *messenger) Subscribe(topic string, qos int, callback func(messaging.Message)) {
+	if err := m.client.Subscribe(topic, qos, callback); err != nil {
+		log.Printf("Could not subscribe to %s: %s", topic, err)
+	}
+}
+
+func (m *messenger) Unsubscribe(topics ...string) {
+	if err := m.client.Unsubscribe(topics...); err != nil {
+		log.Printf("Could not unsubscribe from %v: %s", topics, err)
+	}
+}
+
+func (m *messenger) PublishContext(ctx context.Context, topic string, payload []byte, qos int, retain bool) error {
+	return m.client.PublishContext(ctx, topic, payload, qos, retain)
+}
+
+func (m *messenger) SubscribeContext(ctx context.Context, topic string, qos int, callback func(messaging.Message)) error {
+	return m.client.SubscribeContext(ctx, topic, qos, callback)
+}
+
+func (m *messenger) UnsubscribeContext(ctx context.Context, topics ...string) error {
+	return m.client.UnsubscribeContext(ctx, topics...)
+}
+
+func (m *messenger) PublishProperties(ctx context.Context, topic string, payload []byte, qos int, retain bool, p *messaging.Properties) error {
+	return m.client.PublishProperties(ctx, topic, payload, qos, retain, p)
+}
+
+func (m *messenger) Request(ctx context.Context, topic string, payload []byte, qos int, p *messaging.Properties, response func(messaging.Message)) error {
+	return m.client.Request(ctx, topic, payload, qos, p, response)
+}
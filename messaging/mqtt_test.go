@@ -0,0 +1,40 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mq "github.com/eclipse/paho.mqtt.golang"
+)
+
+// pendingToken is a token that never completes.
+type pendingToken struct {
+	mq.Token
+	t *testing.T
+}
+
+func (p *pendingToken) Wait() bool {
+	p.t.Error("Expected not to wait for the token without a timeout")
+	return false
+}
+func (p *pendingToken) WaitTimeout(d time.Duration) bool {
+	time.Sleep(d)
+	return false
+}
+
+func TestWait(t *testing.T) {
+	if err := wait(context.Background(), &TestingMQTTToken{}); err != nil {
+		t.Error("Expected a completed token to succeed, got ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := wait(ctx, &pendingToken{t: t}); err != context.DeadlineExceeded {
+		t.Error("Expected the deadline to be exceeded, got ", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("Expected to stop waiting with the context, took ", d)
+	}
+}
@@ -0,0 +1,138 @@
+package packet
+
+import "encoding/binary"
+
+type encoder struct {
+	buf []byte
+	v5  bool
+}
+
+func (e *encoder) byte(b byte) { e.buf = append(e.buf, b) }
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.byte(1)
+	} else {
+		e.byte(0)
+	}
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) binary(b []byte) {
+	e.uint16(uint16(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.uint16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// properties writes p preceded by its length. Nothing is written for
+// version 4, which has no properties.
+func (e *encoder) properties(p Properties) {
+	if !e.v5 {
+		return
+	}
+	inner := encoder{v5: true}
+	p.encode(&inner)
+	e.buf = appendVarint(e.buf, uint32(len(inner.buf)))
+	e.buf = append(e.buf, inner.buf...)
+}
+
+// decoder reads the fields of a packet. The first error sticks, after which
+// every read returns a zero value.
+type decoder struct {
+	buf []byte
+	v5  bool
+	err error
+}
+
+func (d *decoder) remaining() int { return len(d.buf) }
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || n > len(d.buf) {
+		d.err = ErrMalformed
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) varint() uint32 {
+	var v uint32
+	for i := uint(0); i < 4; i++ {
+		b := d.take(1)
+		if b == nil {
+			return 0
+		}
+		v |= uint32(b[0]&0x7f) << (7 * i)
+		if b[0]&0x80 == 0 {
+			return v
+		}
+	}
+	d.err = ErrMalformed
+	return 0
+}
+
+func (d *decoder) binary() []byte {
+	n := d.uint16()
+	if b := d.take(int(n)); b != nil && n > 0 {
+		return append([]byte(nil), b...)
+	}
+	return nil
+}
+
+func (d *decoder) string() string {
+	return string(d.take(int(d.uint16())))
+}
+
+func (d *decoder) rest() []byte {
+	b := d.buf
+	d.buf = nil
+	return b
+}
+
+// properties reads the properties of a version 5 packet.
+func (d *decoder) properties() Properties {
+	var p Properties
+	if !d.v5 || d.err != nil {
+		return p
+	}
+	n := d.varint()
+	inner := &decoder{buf: d.take(int(n)), v5: true, err: d.err}
+	p.decode(inner)
+	if inner.err != nil {
+		d.err = inner.err
+	}
+	return p
+}
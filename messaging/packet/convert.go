@@ -0,0 +1,51 @@
+package packet
+
+import (
+	"time"
+
+	"github.com/hemtjanst/hemtjanst/messaging"
+)
+
+// FromMessaging converts the properties of a message to the ones of a
+// packet.
+func FromMessaging(p *messaging.Properties) Properties {
+	var res Properties
+	if p == nil {
+		return res
+	}
+	res.ContentType = p.ContentType
+	res.ResponseTopic = p.ResponseTopic
+	res.CorrelationData = p.CorrelationData
+	if p.MessageExpiry > 0 {
+		seconds := (p.MessageExpiry + time.Second - 1) / time.Second
+		res.MessageExpiry = Uint32(uint32(seconds))
+	}
+	for k, v := range p.UserProperties {
+		res.UserProperties = append(res.UserProperties, UserProperty{Key: k, Value: v})
+	}
+	return res
+}
+
+// ToMessaging converts the properties of a packet to the ones of a
+// message, returning nil if there are none.
+func ToMessaging(p Properties) *messaging.Properties {
+	res := &messaging.Properties{
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+	}
+	if p.MessageExpiry != nil {
+		res.MessageExpiry = time.Duration(*p.MessageExpiry) * time.Second
+	}
+	if len(p.UserProperties) > 0 {
+		res.UserProperties = map[string]string{}
+		for _, up := range p.UserProperties {
+			res.UserProperties[up.Key] = up.Value
+		}
+	}
+	if res.ContentType == "" && res.ResponseTopic == "" && res.CorrelationData == nil &&
+		res.MessageExpiry == 0 && res.UserProperties == nil {
+		return nil
+	}
+	return res
+}
@@ -0,0 +1,482 @@
+// Package packet encodes and decodes MQTT control packets, for both MQTT
+// 3.1.1 (protocol version 4) and MQTT 5. Properties and reason codes are
+// only encoded for version 5, version 4 uses the return codes it has
+// instead.
+package packet
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol versions
+const (
+	Version311 byte = 4
+	Version5   byte = 5
+)
+
+// Control packet types
+const (
+	CONNECT     byte = 1
+	CONNACK     byte = 2
+	PUBLISH     byte = 3
+	PUBACK      byte = 4
+	PUBREC      byte = 5
+	PUBREL      byte = 6
+	PUBCOMP     byte = 7
+	SUBSCRIBE   byte = 8
+	SUBACK      byte = 9
+	UNSUBSCRIBE byte = 10
+	UNSUBACK    byte = 11
+	PINGREQ     byte = 12
+	PINGRESP    byte = 13
+	DISCONNECT  byte = 14
+	AUTH        byte = 15
+)
+
+// MaxSize is the largest packet that's read, which is the most the
+// remaining length can express.
+const MaxSize = 268435455
+
+// ErrMalformed is returned for packets that can't be decoded.
+var ErrMalformed = errors.New("malformed packet")
+
+// Packet is one of the control packets in this package.
+type Packet interface {
+	// Type returns the control packet type
+	Type() byte
+}
+
+// Connect is sent by a client to open a session.
+type Connect struct {
+	Version    byte
+	ClientID   string
+	CleanStart bool
+	KeepAlive  uint16
+	Username   *string
+	Password   []byte
+	Will       *Will
+	Properties Properties
+}
+
+// Will is the message the server publishes when a client disconnects
+// without sending a Disconnect.
+type Will struct {
+	Topic      string
+	Payload    []byte
+	QoS        byte
+	Retain     bool
+	Properties Properties
+}
+
+// Connack acknowledges a Connect. For version 4 the reason code is the
+// connect return code.
+type Connack struct {
+	SessionPresent bool
+	ReasonCode     ReasonCode
+	Properties     Properties
+}
+
+// Publish carries an application message.
+type Publish struct {
+	Dup        bool
+	QoS        byte
+	Retain     bool
+	Topic      string
+	PacketID   uint16
+	Properties Properties
+	Payload    []byte
+}
+
+// Ack is a Puback, Pubrec, Pubrel or Pubcomp, depending on Kind.
+type Ack struct {
+	Kind       byte
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+// Subscription is a topic filter to subscribe to with its options.
+type Subscription struct {
+	Filter            string
+	QoS               byte
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+// Subscribe requests subscriptions.
+type Subscribe struct {
+	PacketID      uint16
+	Properties    Properties
+	Subscriptions []Subscription
+}
+
+// Suback acknowledges a Subscribe with a reason code per subscription. For
+// version 4 these are the granted QoS or 0x80 for a failure.
+type Suback struct {
+	PacketID    uint16
+	Properties  Properties
+	ReasonCodes []ReasonCode
+}
+
+// Unsubscribe removes subscriptions.
+type Unsubscribe struct {
+	PacketID   uint16
+	Properties Properties
+	Filters    []string
+}
+
+// Unsuback acknowledges an Unsubscribe. Version 4 has no reason codes.
+type Unsuback struct {
+	PacketID    uint16
+	Properties  Properties
+	ReasonCodes []ReasonCode
+}
+
+// Pingreq and Pingresp keep a connection alive.
+type (
+	Pingreq  struct{}
+	Pingresp struct{}
+)
+
+// Disconnect closes a connection. Version 4 has no reason code, and only
+// clients send it.
+type Disconnect struct {
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+// Auth is used for extended authentication in version 5.
+type Auth struct {
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (*Connect) Type() byte     { return CONNECT }
+func (*Connack) Type() byte     { return CONNACK }
+func (*Publish) Type() byte     { return PUBLISH }
+func (a *Ack) Type() byte       { return a.Kind }
+func (*Subscribe) Type() byte   { return SUBSCRIBE }
+func (*Suback) Type() byte      { return SUBACK }
+func (*Unsubscribe) Type() byte { return UNSUBSCRIBE }
+func (*Unsuback) Type() byte    { return UNSUBACK }
+func (*Pingreq) Type() byte     { return PINGREQ }
+func (*Pingresp) Type() byte    { return PINGRESP }
+func (*Disconnect) Type() byte  { return DISCONNECT }
+func (*Auth) Type() byte        { return AUTH }
+
+// Write encodes p for the protocol version and writes it to w.
+func Write(w io.Writer, p Packet, version byte) error {
+	var e encoder
+	e.v5 = version == Version5
+	var flags byte
+	switch p := p.(type) {
+	case *Connect:
+		p.encode(&e)
+	case *Connack:
+		e.bool(p.SessionPresent)
+		e.byte(byte(p.ReasonCode))
+		e.properties(p.Properties)
+	case *Publish:
+		flags = p.QoS << 1
+		if p.Dup {
+			flags |= 0x08
+		}
+		if p.Retain {
+			flags |= 0x01
+		}
+		e.string(p.Topic)
+		if p.QoS > 0 {
+			e.uint16(p.PacketID)
+		}
+		e.properties(p.Properties)
+		e.buf = append(e.buf, p.Payload...)
+	case *Ack:
+		if p.Kind == PUBREL {
+			flags = 0x02
+		}
+		e.uint16(p.PacketID)
+		if e.v5 && (p.ReasonCode != Success || !p.Properties.empty()) {
+			e.byte(byte(p.ReasonCode))
+			e.properties(p.Properties)
+		}
+	case *Subscribe:
+		flags = 0x02
+		e.uint16(p.PacketID)
+		e.properties(p.Properties)
+		for _, s := range p.Subscriptions {
+			e.string(s.Filter)
+			opts := s.QoS
+			if e.v5 {
+				if s.NoLocal {
+					opts |= 0x04
+				}
+				if s.RetainAsPublished {
+					opts |= 0x08
+				}
+				opts |= s.RetainHandling << 4
+			}
+			e.byte(opts)
+		}
+	case *Suback:
+		e.uint16(p.PacketID)
+		e.properties(p.Properties)
+		for _, rc := range p.ReasonCodes {
+			e.byte(byte(rc))
+		}
+	case *Unsubscribe:
+		flags = 0x02
+		e.uint16(p.PacketID)
+		e.properties(p.Properties)
+		for _, f := range p.Filters {
+			e.string(f)
+		}
+	case *Unsuback:
+		e.uint16(p.PacketID)
+		if e.v5 {
+			e.properties(p.Properties)
+			for _, rc := range p.ReasonCodes {
+				e.byte(byte(rc))
+			}
+		}
+	case *Pingreq, *Pingresp:
+	case *Disconnect:
+		if e.v5 && (p.ReasonCode != Success || !p.Properties.empty()) {
+			e.byte(byte(p.ReasonCode))
+			e.properties(p.Properties)
+		}
+	case *Auth:
+		if !e.v5 {
+			return errors.New("AUTH requires MQTT 5")
+		}
+		e.byte(byte(p.ReasonCode))
+		e.properties(p.Properties)
+	default:
+		return fmt.Errorf("unknown packet %T", p)
+	}
+
+	if len(e.buf) > MaxSize {
+		return errors.New("packet too large")
+	}
+	header := []byte{p.Type()<<4 | flags}
+	header = appendVarint(header, uint32(len(e.buf)))
+	_, err := w.Write(append(header, e.buf...))
+	return err
+}
+
+func (p *Connect) encode(e *encoder) {
+	e.string("MQTT")
+	e.byte(p.Version)
+	var flags byte
+	if p.CleanStart {
+		flags |= 0x02
+	}
+	if p.Will != nil {
+		flags |= 0x04 | p.Will.QoS<<3
+		if p.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if p.Password != nil {
+		flags |= 0x40
+	}
+	if p.Username != nil {
+		flags |= 0x80
+	}
+	e.byte(flags)
+	e.uint16(p.KeepAlive)
+	e.properties(p.Properties)
+	e.string(p.ClientID)
+	if p.Will != nil {
+		e.properties(p.Will.Properties)
+		e.string(p.Will.Topic)
+		e.binary(p.Will.Payload)
+	}
+	if p.Username != nil {
+		e.string(*p.Username)
+	}
+	if p.Password != nil {
+		e.binary(p.Password)
+	}
+}
+
+// Read reads and decodes a packet from r for the protocol version. A
+// Connect can be read before the version is known by passing 0, in which
+// case its Version tells the version to use from then on.
+//
+// Packets larger than maxSize bytes, counting their fixed header, aren't
+// read but return PacketTooLarge, which leaves the rest of the packet in r.
+func Read(r *bufio.Reader, version byte, maxSize int) (Packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if 1+len(appendVarint(nil, length))+int(length) > maxSize {
+		return nil, PacketTooLarge
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{buf: buf, v5: version == Version5}
+	kind, flags := first>>4, first&0x0f
+	var p Packet
+	switch kind {
+	case CONNECT:
+		p = decodeConnect(d)
+	case CONNACK:
+		p = &Connack{SessionPresent: d.byte()&0x01 != 0, ReasonCode: ReasonCode(d.byte()), Properties: d.properties()}
+	case PUBLISH:
+		pub := &Publish{Dup: flags&0x08 != 0, QoS: flags >> 1 & 0x03, Retain: flags&0x01 != 0}
+		if pub.QoS > 2 {
+			return nil, ErrMalformed
+		}
+		pub.Topic = d.string()
+		if pub.QoS > 0 {
+			pub.PacketID = d.uint16()
+		}
+		pub.Properties = d.properties()
+		pub.Payload = d.rest()
+		p = pub
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		ack := &Ack{Kind: kind, PacketID: d.uint16()}
+		if d.v5 && d.remaining() > 0 {
+			ack.ReasonCode = ReasonCode(d.byte())
+			if d.remaining() > 0 {
+				ack.Properties = d.properties()
+			}
+		}
+		p = ack
+	case SUBSCRIBE:
+		sub := &Subscribe{PacketID: d.uint16(), Properties: d.properties()}
+		for d.remaining() > 0 && d.err == nil {
+			s := Subscription{Filter: d.string()}
+			opts := d.byte()
+			s.QoS = opts & 0x03
+			if d.v5 {
+				s.NoLocal = opts&0x04 != 0
+				s.RetainAsPublished = opts&0x08 != 0
+				s.RetainHandling = opts >> 4 & 0x03
+			}
+			sub.Subscriptions = append(sub.Subscriptions, s)
+		}
+		p = sub
+	case SUBACK:
+		ack := &Suback{PacketID: d.uint16(), Properties: d.properties()}
+		for _, rc := range d.rest() {
+			ack.ReasonCodes = append(ack.ReasonCodes, ReasonCode(rc))
+		}
+		p = ack
+	case UNSUBSCRIBE:
+		unsub := &Unsubscribe{PacketID: d.uint16(), Properties: d.properties()}
+		for d.remaining() > 0 && d.err == nil {
+			unsub.Filters = append(unsub.Filters, d.string())
+		}
+		p = unsub
+	case UNSUBACK:
+		ack := &Unsuback{PacketID: d.uint16()}
+		if d.v5 {
+			ack.Properties = d.properties()
+			for _, rc := range d.rest() {
+				ack.ReasonCodes = append(ack.ReasonCodes, ReasonCode(rc))
+			}
+		}
+		p = ack
+	case PINGREQ:
+		p = &Pingreq{}
+	case PINGRESP:
+		p = &Pingresp{}
+	case DISCONNECT:
+		dis := &Disconnect{}
+		if d.v5 && d.remaining() > 0 {
+			dis.ReasonCode = ReasonCode(d.byte())
+			if d.remaining() > 0 {
+				dis.Properties = d.properties()
+			}
+		}
+		p = dis
+	case AUTH:
+		auth := &Auth{}
+		if d.remaining() > 0 {
+			auth.ReasonCode = ReasonCode(d.byte())
+			auth.Properties = d.properties()
+		}
+		p = auth
+	default:
+		return nil, ErrMalformed
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return p, nil
+}
+
+func decodeConnect(d *decoder) *Connect {
+	// MQIsdp is the name MQTT 3.1 used, read so its clients can be told
+	// their version isn't supported
+	if name := d.string(); name != "MQTT" && name != "MQIsdp" && d.err == nil {
+		d.err = ErrMalformed
+		return nil
+	}
+	c := &Connect{Version: d.byte()}
+	d.v5 = c.Version == Version5
+	flags := d.byte()
+	c.CleanStart = flags&0x02 != 0
+	c.KeepAlive = d.uint16()
+	c.Properties = d.properties()
+	c.ClientID = d.string()
+	if flags&0x04 != 0 {
+		c.Will = &Will{QoS: flags >> 3 & 0x03, Retain: flags&0x20 != 0}
+		c.Will.Properties = d.properties()
+		c.Will.Topic = d.string()
+		c.Will.Payload = d.binary()
+	}
+	if flags&0x80 != 0 {
+		username := d.string()
+		c.Username = &username
+	}
+	if flags&0x40 != 0 {
+		c.Password = d.binary()
+		if c.Password == nil {
+			c.Password = []byte{}
+		}
+	}
+	return c
+}
+
+func appendVarint(b []byte, v uint32) []byte {
+	for {
+		digit := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if v == 0 {
+			return b
+		}
+	}
+}
+
+func readVarint(r io.ByteReader) (uint32, error) {
+	var v uint32
+	for i := uint(0); i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint32(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, ErrMalformed
+}
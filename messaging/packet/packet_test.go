@@ -0,0 +1,172 @@
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func roundTrip(t *testing.T, p Packet, version byte) Packet {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Write(&buf, p, version); err != nil {
+		t.Fatalf("Could not write %T: %s", p, err)
+	}
+	res, err := Read(bufio.NewReader(&buf), version, MaxSize)
+	if err != nil {
+		t.Fatalf("Could not read %T: %s", p, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected all of %T to be read, %d bytes left", p, buf.Len())
+	}
+	return res
+}
+
+func TestRoundTrip(t *testing.T) {
+	user := "user"
+	packets := []Packet{
+		&Connect{
+			Version:    Version5,
+			ClientID:   "hemtjanst-1",
+			CleanStart: true,
+			KeepAlive:  30,
+			Username:   &user,
+			Password:   []byte("secret"),
+			Will: &Will{
+				Topic:      "leave",
+				Payload:    []byte("hemtjanst-1"),
+				QoS:        1,
+				Properties: Properties{WillDelay: Uint32(5)},
+			},
+			Properties: Properties{SessionExpiry: Uint32(60), ReceiveMaximum: Uint16(10)},
+		},
+		&Connack{SessionPresent: true, ReasonCode: Success, Properties: Properties{
+			AssignedClientID: "auto-1",
+			MaximumQoS:       Byte(1),
+			ServerKeepAlive:  Uint16(60),
+		}},
+		&Publish{
+			QoS:      1,
+			Retain:   true,
+			Topic:    "lightbulb/kitchen/on/get",
+			PacketID: 3,
+			Payload:  []byte("1"),
+			Properties: Properties{
+				ContentType:     "text/plain",
+				ResponseTopic:   "hemtjanst-1/response",
+				CorrelationData: []byte{1, 2, 3},
+				MessageExpiry:   Uint32(30),
+				SubscriptionIDs: []uint32{200},
+				UserProperties:  []UserProperty{{"a", "1"}, {"a", "2"}},
+			},
+		},
+		&Publish{Topic: "discover", Payload: []byte{}},
+		&Ack{Kind: PUBACK, PacketID: 3},
+		&Ack{Kind: PUBREC, PacketID: 4, ReasonCode: NoMatchingSubscribers},
+		&Ack{Kind: PUBREL, PacketID: 4, ReasonCode: PacketIDNotFound, Properties: Properties{ReasonString: "gone"}},
+		&Subscribe{PacketID: 5, Subscriptions: []Subscription{
+			{Filter: "announce/#", QoS: 1, NoLocal: true, RetainHandling: 2},
+			{Filter: "$share/group/leave", RetainAsPublished: true},
+		}},
+		&Suback{PacketID: 5, ReasonCodes: []ReasonCode{GrantedQoS1, NotAuthorized}},
+		&Unsubscribe{PacketID: 6, Filters: []string{"a", "b/+"}},
+		&Unsuback{PacketID: 6, ReasonCodes: []ReasonCode{Success, NoSubscriptionExisted}},
+		&Pingreq{},
+		&Pingresp{},
+		&Disconnect{},
+		&Disconnect{ReasonCode: ServerShuttingDown, Properties: Properties{ServerReference: "other:1883"}},
+		&Auth{ReasonCode: 0x18, Properties: Properties{AuthMethod: "SCRAM", AuthData: []byte{9}}},
+	}
+	for _, p := range packets {
+		if res := roundTrip(t, p, Version5); !reflect.DeepEqual(p, res) {
+			t.Errorf("Expected %#v, got %#v", p, res)
+		}
+	}
+}
+
+func TestRoundTrip311(t *testing.T) {
+	p := &Publish{QoS: 1, Topic: "a/b", PacketID: 1, Payload: []byte("x"),
+		Properties: Properties{ContentType: "text/plain"}}
+	res := roundTrip(t, p, Version311).(*Publish)
+	if res.Properties.ContentType != "" {
+		t.Error("Expected no properties in MQTT 3.1.1, got ", res.Properties)
+	}
+	if res.Topic != "a/b" || string(res.Payload) != "x" || res.PacketID != 1 {
+		t.Error("Expected publish to survive, got ", res)
+	}
+
+	sub := &Subscribe{PacketID: 2, Subscriptions: []Subscription{{Filter: "a/#", QoS: 1, NoLocal: true}}}
+	if res := roundTrip(t, sub, Version311).(*Subscribe); res.Subscriptions[0] != (Subscription{Filter: "a/#", QoS: 1}) {
+		t.Error("Expected MQTT 5 subscription options to be dropped, got ", res.Subscriptions)
+	}
+
+	unsuback := &Unsuback{PacketID: 3, ReasonCodes: []ReasonCode{Success}}
+	if res := roundTrip(t, unsuback, Version311).(*Unsuback); res.ReasonCodes != nil {
+		t.Error("Expected no reason codes in MQTT 3.1.1, got ", res.ReasonCodes)
+	}
+
+	var buf bytes.Buffer
+	Write(&buf, &Connect{Version: Version311, ClientID: "old"}, Version311)
+	if res, err := Read(bufio.NewReader(&buf), 0, MaxSize); err != nil || res.(*Connect).Version != Version311 {
+		t.Error("Expected to read a CONNECT before knowing the version, got ", res, err)
+	}
+
+	// MQTT 3.1, as sent by Paho retrying an older version
+	in := []byte{0x10, 0x0f, 0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', 0x03, 0x02, 0x00, 0x1e, 0x00, 0x01, 'a'}
+	if res, err := Read(bufio.NewReader(bytes.NewReader(in)), 0, MaxSize); err != nil || res.(*Connect).Version != 3 {
+		t.Error("Expected to read the version of an MQTT 3.1 CONNECT, got ", res, err)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	inputs := [][]byte{
+		{0x30, 0x02, 0x00, 0x05}, // topic longer than the packet
+		{0x36, 0x00},             // QoS 3
+		{0x10, 0x06, 0x00, 0x04, 'M', 'Q', 'T', 'X'},
+		{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f}, // remaining length of 5 bytes
+		{0x00, 0x00},
+	}
+	for _, in := range inputs {
+		if _, err := Read(bufio.NewReader(bytes.NewReader(in)), Version5, MaxSize); err == nil {
+			t.Errorf("Expected %x to be malformed", in)
+		}
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	// A PUBLISH claiming the largest remaining length, without the bytes
+	in := []byte{0x30, 0xff, 0xff, 0xff, 0x7f}
+	if _, err := Read(bufio.NewReader(bytes.NewReader(in)), Version5, 4096); err != PacketTooLarge {
+		t.Error("Expected the packet to be too large, got ", err)
+	}
+
+	var buf bytes.Buffer
+	Write(&buf, &Publish{Topic: "a", Payload: make([]byte, 10)}, Version5)
+	size := buf.Len()
+	if _, err := Read(bufio.NewReader(bytes.NewReader(buf.Bytes())), Version5, size); err != nil {
+		t.Error("Expected a packet of the largest size to be read, got ", err)
+	}
+	if _, err := Read(bufio.NewReader(&buf), Version5, size-1); err != PacketTooLarge {
+		t.Error("Expected a packet one byte too large to be refused, got ", err)
+	}
+}
+
+func TestReasonCode(t *testing.T) {
+	if Success.Failed() || NoMatchingSubscribers.Failed() {
+		t.Error("Expected success codes to not be failures")
+	}
+	if !NotAuthorized.Failed() {
+		t.Error("Expected not authorized to be a failure")
+	}
+	var err error = QuotaExceeded
+	if err.Error() != "quota exceeded" {
+		t.Error("Expected quota exceeded, got ", err)
+	}
+	if ReasonCode(0xfe).Error() != "reason code 0xfe" {
+		t.Error("Expected unknown code to be shown in hex, got ", ReasonCode(0xfe))
+	}
+	if ConnectReturnCode(5) != NotAuthorized {
+		t.Error("Expected return code 5 to be not authorized, got ", ConnectReturnCode(5))
+	}
+}
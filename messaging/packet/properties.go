@@ -0,0 +1,236 @@
+package packet
+
+// Property identifiers
+const (
+	propPayloadFormat        = 0x01
+	propMessageExpiry        = 0x02
+	propContentType          = 0x03
+	propResponseTopic        = 0x08
+	propCorrelationData      = 0x09
+	propSubscriptionID       = 0x0B
+	propSessionExpiry        = 0x11
+	propAssignedClientID     = 0x12
+	propServerKeepAlive      = 0x13
+	propAuthMethod           = 0x15
+	propAuthData             = 0x16
+	propRequestProblemInfo   = 0x17
+	propWillDelay            = 0x18
+	propRequestResponseInfo  = 0x19
+	propResponseInfo         = 0x1A
+	propServerReference      = 0x1C
+	propReasonString         = 0x1F
+	propReceiveMaximum       = 0x21
+	propTopicAliasMaximum    = 0x22
+	propTopicAlias           = 0x23
+	propMaximumQoS           = 0x24
+	propRetainAvailable      = 0x25
+	propUserProperty         = 0x26
+	propMaximumPacketSize    = 0x27
+	propWildcardSubAvailable = 0x28
+	propSubIDAvailable       = 0x29
+	propSharedSubAvailable   = 0x2A
+)
+
+// UserProperty is a name and value pair. A name can occur more than once.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties are the MQTT 5 properties of a packet. Which ones are allowed
+// depends on the packet, the ones that don't apply are left empty. Optional
+// numbers are pointers so that they can be told apart from zero.
+type Properties struct {
+	PayloadFormat        *byte
+	MessageExpiry        *uint32
+	ContentType          string
+	ResponseTopic        string
+	CorrelationData      []byte
+	SubscriptionIDs      []uint32
+	SessionExpiry        *uint32
+	AssignedClientID     string
+	ServerKeepAlive      *uint16
+	AuthMethod           string
+	AuthData             []byte
+	RequestProblemInfo   *byte
+	WillDelay            *uint32
+	RequestResponseInfo  *byte
+	ResponseInfo         string
+	ServerReference      string
+	ReasonString         string
+	ReceiveMaximum       *uint16
+	TopicAliasMaximum    *uint16
+	TopicAlias           *uint16
+	MaximumQoS           *byte
+	RetainAvailable      *byte
+	UserProperties       []UserProperty
+	MaximumPacketSize    *uint32
+	WildcardSubAvailable *byte
+	SubIDAvailable       *byte
+	SharedSubAvailable   *byte
+}
+
+// Byte, Uint16 and Uint32 return pointers to v, for setting optional
+// properties.
+func Byte(v byte) *byte       { return &v }
+func Uint16(v uint16) *uint16 { return &v }
+func Uint32(v uint32) *uint32 { return &v }
+
+func (p *Properties) empty() bool {
+	e := encoder{v5: true}
+	p.encode(&e)
+	return len(e.buf) == 0
+}
+
+func (p *Properties) encode(e *encoder) {
+	byteProps := []struct {
+		id byte
+		v  *byte
+	}{
+		{propPayloadFormat, p.PayloadFormat},
+		{propRequestProblemInfo, p.RequestProblemInfo},
+		{propRequestResponseInfo, p.RequestResponseInfo},
+		{propMaximumQoS, p.MaximumQoS},
+		{propRetainAvailable, p.RetainAvailable},
+		{propWildcardSubAvailable, p.WildcardSubAvailable},
+		{propSubIDAvailable, p.SubIDAvailable},
+		{propSharedSubAvailable, p.SharedSubAvailable},
+	}
+	for _, b := range byteProps {
+		if b.v != nil {
+			e.byte(b.id)
+			e.byte(*b.v)
+		}
+	}
+	uint16s := []struct {
+		id byte
+		v  *uint16
+	}{
+		{propServerKeepAlive, p.ServerKeepAlive},
+		{propReceiveMaximum, p.ReceiveMaximum},
+		{propTopicAliasMaximum, p.TopicAliasMaximum},
+		{propTopicAlias, p.TopicAlias},
+	}
+	for _, u := range uint16s {
+		if u.v != nil {
+			e.byte(u.id)
+			e.uint16(*u.v)
+		}
+	}
+	uint32s := []struct {
+		id byte
+		v  *uint32
+	}{
+		{propMessageExpiry, p.MessageExpiry},
+		{propSessionExpiry, p.SessionExpiry},
+		{propWillDelay, p.WillDelay},
+		{propMaximumPacketSize, p.MaximumPacketSize},
+	}
+	for _, u := range uint32s {
+		if u.v != nil {
+			e.byte(u.id)
+			e.uint32(*u.v)
+		}
+	}
+	stringProps := []struct {
+		id byte
+		v  string
+	}{
+		{propContentType, p.ContentType},
+		{propResponseTopic, p.ResponseTopic},
+		{propAssignedClientID, p.AssignedClientID},
+		{propAuthMethod, p.AuthMethod},
+		{propResponseInfo, p.ResponseInfo},
+		{propServerReference, p.ServerReference},
+		{propReasonString, p.ReasonString},
+	}
+	for _, s := range stringProps {
+		if s.v != "" {
+			e.byte(s.id)
+			e.string(s.v)
+		}
+	}
+	if p.CorrelationData != nil {
+		e.byte(propCorrelationData)
+		e.binary(p.CorrelationData)
+	}
+	if p.AuthData != nil {
+		e.byte(propAuthData)
+		e.binary(p.AuthData)
+	}
+	for _, id := range p.SubscriptionIDs {
+		e.byte(propSubscriptionID)
+		e.buf = appendVarint(e.buf, id)
+	}
+	for _, up := range p.UserProperties {
+		e.byte(propUserProperty)
+		e.string(up.Key)
+		e.string(up.Value)
+	}
+}
+
+func (p *Properties) decode(d *decoder) {
+	for d.remaining() > 0 && d.err == nil {
+		switch id := d.varint(); id {
+		case propPayloadFormat:
+			p.PayloadFormat = Byte(d.byte())
+		case propRequestProblemInfo:
+			p.RequestProblemInfo = Byte(d.byte())
+		case propRequestResponseInfo:
+			p.RequestResponseInfo = Byte(d.byte())
+		case propMaximumQoS:
+			p.MaximumQoS = Byte(d.byte())
+		case propRetainAvailable:
+			p.RetainAvailable = Byte(d.byte())
+		case propWildcardSubAvailable:
+			p.WildcardSubAvailable = Byte(d.byte())
+		case propSubIDAvailable:
+			p.SubIDAvailable = Byte(d.byte())
+		case propSharedSubAvailable:
+			p.SharedSubAvailable = Byte(d.byte())
+		case propServerKeepAlive:
+			p.ServerKeepAlive = Uint16(d.uint16())
+		case propReceiveMaximum:
+			p.ReceiveMaximum = Uint16(d.uint16())
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum = Uint16(d.uint16())
+		case propTopicAlias:
+			p.TopicAlias = Uint16(d.uint16())
+		case propMessageExpiry:
+			p.MessageExpiry = Uint32(d.uint32())
+		case propSessionExpiry:
+			p.SessionExpiry = Uint32(d.uint32())
+		case propWillDelay:
+			p.WillDelay = Uint32(d.uint32())
+		case propMaximumPacketSize:
+			p.MaximumPacketSize = Uint32(d.uint32())
+		case propContentType:
+			p.ContentType = d.string()
+		case propResponseTopic:
+			p.ResponseTopic = d.string()
+		case propAssignedClientID:
+			p.AssignedClientID = d.string()
+		case propAuthMethod:
+			p.AuthMethod = d.string()
+		case propResponseInfo:
+			p.ResponseInfo = d.string()
+		case propServerReference:
+			p.ServerReference = d.string()
+		case propReasonString:
+			p.ReasonString = d.string()
+		case propCorrelationData:
+			p.CorrelationData = d.binary()
+			if p.CorrelationData == nil {
+				p.CorrelationData = []byte{}
+			}
+		case propAuthData:
+			p.AuthData = d.binary()
+		case propSubscriptionID:
+			p.SubscriptionIDs = append(p.SubscriptionIDs, d.varint())
+		case propUserProperty:
+			p.UserProperties = append(p.UserProperties, UserProperty{Key: d.string(), Value: d.string()})
+		default:
+			d.err = ErrMalformed
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package packet
+
+import "fmt"
+
+// ReasonCode is the outcome of an operation as reported by MQTT 5. Codes
+// of 0x80 and above are failures, and a ReasonCode can be returned as an
+// error for them.
+type ReasonCode byte
+
+// Reason codes
+const (
+	Success                    ReasonCode = 0x00
+	GrantedQoS1                ReasonCode = 0x01
+	GrantedQoS2                ReasonCode = 0x02
+	DisconnectWithWill         ReasonCode = 0x04
+	NoMatchingSubscribers      ReasonCode = 0x10
+	NoSubscriptionExisted      ReasonCode = 0x11
+	UnspecifiedError           ReasonCode = 0x80
+	MalformedPacket            ReasonCode = 0x81
+	ProtocolError              ReasonCode = 0x82
+	ImplementationSpecific     ReasonCode = 0x83
+	UnsupportedProtocolVersion ReasonCode = 0x84
+	ClientIDNotValid           ReasonCode = 0x85
+	BadUsernameOrPassword      ReasonCode = 0x86
+	NotAuthorized              ReasonCode = 0x87
+	ServerUnavailable          ReasonCode = 0x88
+	ServerBusy                 ReasonCode = 0x89
+	Banned                     ReasonCode = 0x8A
+	ServerShuttingDown         ReasonCode = 0x8B
+	KeepAliveTimeout           ReasonCode = 0x8D
+	SessionTakenOver           ReasonCode = 0x8E
+	TopicFilterInvalid         ReasonCode = 0x8F
+	TopicNameInvalid           ReasonCode = 0x90
+	PacketIDInUse              ReasonCode = 0x91
+	PacketIDNotFound           ReasonCode = 0x92
+	ReceiveMaximumExceeded     ReasonCode = 0x93
+	PacketTooLarge             ReasonCode = 0x95
+	QuotaExceeded              ReasonCode = 0x97
+	PayloadFormatInvalid       ReasonCode = 0x99
+	RetainNotSupported         ReasonCode = 0x9A
+	QoSNotSupported            ReasonCode = 0x9B
+	SharedSubNotSupported      ReasonCode = 0x9E
+	SubIDsNotSupported         ReasonCode = 0xA1
+	WildcardSubNotSupported    ReasonCode = 0xA2
+)
+
+var reasonNames = map[ReasonCode]string{
+	Success:                    "success",
+	GrantedQoS1:                "granted QoS 1",
+	GrantedQoS2:                "granted QoS 2",
+	DisconnectWithWill:         "disconnect with will message",
+	NoMatchingSubscribers:      "no matching subscribers",
+	NoSubscriptionExisted:      "no subscription existed",
+	UnspecifiedError:           "unspecified error",
+	MalformedPacket:            "malformed packet",
+	ProtocolError:              "protocol error",
+	ImplementationSpecific:     "implementation specific error",
+	UnsupportedProtocolVersion: "unsupported protocol version",
+	ClientIDNotValid:           "client identifier not valid",
+	BadUsernameOrPassword:      "bad user name or password",
+	NotAuthorized:              "not authorized",
+	ServerUnavailable:          "server unavailable",
+	ServerBusy:                 "server busy",
+	Banned:                     "banned",
+	ServerShuttingDown:         "server shutting down",
+	KeepAliveTimeout:           "keep alive timeout",
+	SessionTakenOver:           "session taken over",
+	TopicFilterInvalid:         "topic filter invalid",
+	TopicNameInvalid:           "topic name invalid",
+	PacketIDInUse:              "packet identifier in use",
+	PacketIDNotFound:           "packet identifier not found",
+	ReceiveMaximumExceeded:     "receive maximum exceeded",
+	PacketTooLarge:             "packet too large",
+	QuotaExceeded:              "quota exceeded",
+	PayloadFormatInvalid:       "payload format invalid",
+	RetainNotSupported:         "retain not supported",
+	QoSNotSupported:            "QoS not supported",
+	SharedSubNotSupported:      "shared subscriptions not supported",
+	SubIDsNotSupported:         "subscription identifiers not supported",
+	WildcardSubNotSupported:    "wildcard subscriptions not supported",
+}
+
+// Failed returns whether rc reports a failure.
+func (rc ReasonCode) Failed() bool {
+	return rc >= 0x80
+}
+
+func (rc ReasonCode) Error() string {
+	if name, ok := reasonNames[rc]; ok {
+		return name
+	}
+	return fmt.Sprintf("reason code 0x%02x", byte(rc))
+}
+
+// ConnectReturnCode converts the return code of an MQTT 3.1.1 Connack to
+// the matching reason code.
+func ConnectReturnCode(rc byte) ReasonCode {
+	switch rc {
+	case 0:
+		return Success
+	case 1:
+		return UnsupportedProtocolVersion
+	case 2:
+		return ClientIDNotValid
+	case 3:
+		return ServerUnavailable
+	case 4:
+		return BadUsernameOrPassword
+	case 5:
+		return NotAuthorized
+	}
+	return UnspecifiedError
+}
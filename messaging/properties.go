@@ -0,0 +1,46 @@
+package messaging
+
+import (
+	"context"
+	"time"
+)
+
+// Properties are the MQTT 5 properties of a message. Transports that don't
+// support them drop them when publishing and have none on the messages they
+// deliver.
+type Properties struct {
+	ContentType string
+	// ResponseTopic is where the receiver of a request is asked to
+	// publish its response, with the same CorrelationData.
+	ResponseTopic   string
+	CorrelationData []byte
+	// MessageExpiry is how long the broker keeps the message for
+	// subscribers that haven't received it yet. Zero means forever.
+	MessageExpiry time.Duration
+	// UserProperties holds application defined metadata. MQTT allows a
+	// name more than once, only the last value of it is kept.
+	UserProperties map[string]string
+}
+
+// MessageProperties returns the properties msg was published with, or nil
+// if it has none.
+func MessageProperties(msg Message) *Properties {
+	if p, ok := msg.(interface{ Properties() *Properties }); ok {
+		return p.Properties()
+	}
+	return nil
+}
+
+// PropertiesPublisher is implemented by transports that can publish
+// messages with properties.
+type PropertiesPublisher interface {
+	PublishProperties(ctx context.Context, destination string, message []byte, qos int, persist bool, p *Properties) error
+}
+
+// Requester is implemented by transports that can tie a response to a
+// request. The request is published with a ResponseTopic and
+// CorrelationData set in p, and response is called with the first message
+// published back with that CorrelationData before the request expires.
+type Requester interface {
+	Request(ctx context.Context, destination string, message []byte, qos int, p *Properties, response func(Message)) error
+}
@@ -0,0 +1,321 @@
+package messaging
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Record is a message seen by a Recorder.
+type Record struct {
+	Time time.Time
+	// Received is true for messages delivered to a subscription and false
+	// for the ones published.
+	Received bool
+	Topic    string
+	Payload  []byte
+	Retain   bool
+	QoS      int
+}
+
+// recordJSON is how a Record is written. Payloads that aren't text, like
+// camera snapshots, are base64 encoded.
+type recordJSON struct {
+	Time     time.Time `json:"time"`
+	Received bool      `json:"received"`
+	Topic    string    `json:"topic"`
+	Payload  string    `json:"payload"`
+	Base64   bool      `json:"base64,omitempty"`
+	Retain   bool      `json:"retain"`
+	QoS      int       `json:"qos"`
+}
+
+func (r Record) MarshalJSON() ([]byte, error) {
+	js := recordJSON{
+		Time:     r.Time,
+		Received: r.Received,
+		Topic:    r.Topic,
+		Payload:  string(r.Payload),
+		Retain:   r.Retain,
+		QoS:      r.QoS,
+	}
+	if !utf8.Valid(r.Payload) {
+		js.Payload = base64.StdEncoding.EncodeToString(r.Payload)
+		js.Base64 = true
+	}
+	return json.Marshal(js)
+}
+
+func (r *Record) UnmarshalJSON(b []byte) error {
+	var js recordJSON
+	if err := json.Unmarshal(b, &js); err != nil {
+		return err
+	}
+	*r = Record{
+		Time:     js.Time,
+		Received: js.Received,
+		Topic:    js.Topic,
+		Payload:  []byte(js.Payload),
+		Retain:   js.Retain,
+		QoS:      js.QoS,
+	}
+	if js.Base64 {
+		p, err := base64.StdEncoding.DecodeString(js.Payload)
+		if err != nil {
+			return err
+		}
+		r.Payload = p
+	}
+	return nil
+}
+
+// Recorder writes the messages published and received through the
+// transports it wraps as a line of JSON each. A message matching several
+// subscriptions is recorded once.
+type Recorder struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+	err   error
+	// seen are the messages last recorded as received
+	seen []Message
+}
+
+// recentDeliveries is how many received messages a Recorder remembers to
+// tell whether a message was handed to another subscription already.
+const recentDeliveries = 16
+
+// NewRecorder returns a recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error writing a record. Once writing failed no
+// more records are written.
+func (r *Recorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(rec Record) {
+	rec.Time = time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return
+	}
+	if err := r.enc.Encode(rec); err != nil {
+		log.Print("Could not record message, stopped recording: ", err)
+		r.err = err
+	}
+}
+
+func (r *Recorder) published(topic string, payload []byte, qos int, retain bool) {
+	r.record(Record{Topic: topic, Payload: payload, QoS: qos, Retain: retain})
+}
+
+// received wraps callback to record the messages handed to it. Messages
+// that don't tell the QoS they were delivered with are recorded with the
+// QoS of the subscription.
+func (r *Recorder) received(qos int, callback func(Message)) func(Message) {
+	return func(msg Message) {
+		if r.delivered(msg) {
+			callback(msg)
+			return
+		}
+		rec := Record{
+			Received: true,
+			Topic:    msg.Topic(),
+			Payload:  msg.Payload(),
+			QoS:      qos,
+			Retain:   Retained(msg),
+		}
+		if q, ok := msg.(interface{ Qos() byte }); ok {
+			rec.QoS = int(q.Qos())
+		}
+		r.record(rec)
+		callback(msg)
+	}
+}
+
+// delivered returns whether msg was recorded for another subscription
+// already, and remembers it otherwise.
+func (r *Recorder) delivered(msg Message) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, seen := range r.seen {
+		if sameDelivery(seen, msg) {
+			return true
+		}
+	}
+	if len(r.seen) == recentDeliveries {
+		copy(r.seen, r.seen[1:])
+		r.seen = r.seen[:len(r.seen)-1]
+	}
+	r.seen = append(r.seen, msg)
+	return false
+}
+
+// sameDelivery returns whether a and b are the same message handed to
+// different subscriptions. Transports share the payload between them, or
+// the message itself when the payload is empty. As the recorder keeps the
+// messages it compares against, their payloads can't be reused for a new
+// message.
+func sameDelivery(a, b Message) bool {
+	if a.Topic() != b.Topic() || Retained(a) != Retained(b) {
+		return false
+	}
+	pa, pb := a.Payload(), b.Payload()
+	if len(pa) != len(pb) {
+		return false
+	}
+	if len(pa) > 0 {
+		return &pa[0] == &pb[0]
+	}
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// PublishSubscriber returns ps recording its messages. It's also a
+// ContextPublishSubscriber, PropertiesPublisher and Requester, which fall
+// back to what ps does support: properties are dropped and no response is
+// received when ps can't.
+func (r *Recorder) PublishSubscriber(ps PublishSubscriber) PublishSubscriber {
+	return &recordingMessenger{r: r, ps: ps}
+}
+
+type recordingMessenger struct {
+	r  *Recorder
+	ps PublishSubscriber
+}
+
+func (m *recordingMessenger) Publish(topic string, payload []byte, qos int, retain bool) {
+	m.r.published(topic, payload, qos, retain)
+	m.ps.Publish(topic, payload, qos, retain)
+}
+
+func (m *recordingMessenger) Subscribe(topic string, qos int, callback func(Message)) {
+	m.ps.Subscribe(topic, qos, m.r.received(qos, callback))
+}
+
+func (m *recordingMessenger) Unsubscribe(topics ...string) {
+	m.ps.Unsubscribe(topics...)
+}
+
+func (m *recordingMessenger) PublishContext(ctx context.Context, topic string, payload []byte, qos int, retain bool) error {
+	m.r.published(topic, payload, qos, retain)
+	return WithContext(m.ps).PublishContext(ctx, topic, payload, qos, retain)
+}
+
+func (m *recordingMessenger) SubscribeContext(ctx context.Context, topic string, qos int, callback func(Message)) error {
+	return WithContext(m.ps).SubscribeContext(ctx, topic, qos, m.r.received(qos, callback))
+}
+
+func (m *recordingMessenger) UnsubscribeContext(ctx context.Context, topics ...string) error {
+	return WithContext(m.ps).UnsubscribeContext(ctx, topics...)
+}
+
+func (m *recordingMessenger) PublishProperties(ctx context.Context, topic string, payload []byte, qos int, retain bool, p *Properties) error {
+	pp, ok := m.ps.(PropertiesPublisher)
+	if !ok {
+		return m.PublishContext(ctx, topic, payload, qos, retain)
+	}
+	m.r.published(topic, payload, qos, retain)
+	return pp.PublishProperties(ctx, topic, payload, qos, retain, p)
+}
+
+func (m *recordingMessenger) Request(ctx context.Context, topic string, payload []byte, qos int, p *Properties, response func(Message)) error {
+	req, ok := m.ps.(Requester)
+	if !ok {
+		return m.PublishProperties(ctx, topic, payload, qos, false, p)
+	}
+	m.r.published(topic, payload, qos, false)
+	return req.Request(ctx, topic, payload, qos, p, m.r.received(qos, response))
+}
+
+// Connection returns c recording its messages, for passing to
+// Handler.Connected.
+func (r *Recorder) Connection(c Connection) Connection {
+	return recordingConnection{r: r, c: c}
+}
+
+type recordingConnection struct {
+	r *Recorder
+	c Connection
+}
+
+func (c recordingConnection) Publish(topic string, payload []byte, qos int, retain bool) error {
+	c.r.published(topic, payload, qos, retain)
+	return c.c.Publish(topic, payload, qos, retain)
+}
+
+func (c recordingConnection) Subscribe(topic string, qos int, callback func(Message)) error {
+	return c.c.Subscribe(topic, qos, c.r.received(qos, callback))
+}
+
+// ReadRecords reads the records a Recorder wrote to r.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	var res []Record
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		res = append(res, rec)
+	}
+}
+
+// Replay publishes the received records through p, as if they came from
+// the devices that published them in the first place. The time between
+// them is kept, divided by speed. The published records are skipped, since
+// whatever published them is expected to do so again while replaying.
+//
+// It returns once all records are published, or with the error of ctx when
+// it's done first.
+func Replay(ctx context.Context, records []Record, p Publisher, speed float64) error {
+	if speed <= 0 {
+		return errors.New("replay speed must be above 0")
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	start := time.Now()
+	first := records[0].Time
+	for _, rec := range records {
+		if !rec.Received {
+			continue
+		}
+		at := start.Add(time.Duration(float64(rec.Time.Sub(first)) / speed))
+		if wait := time.Until(at); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		cp, ok := p.(ContextPublisher)
+		if !ok {
+			p.Publish(rec.Topic, rec.Payload, rec.QoS, rec.Retain)
+			continue
+		}
+		if err := cp.PublishContext(ctx, rec.Topic, rec.Payload, rec.QoS, rec.Retain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
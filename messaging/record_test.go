@@ -0,0 +1,105 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	b := NewMemoryBroker()
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	hemtjanst := rec.PublishSubscriber(b.NewClient())
+	r := &received{}
+	hemtjanst.Subscribe("lamp/#", 1, r.callback)
+
+	lamp := b.NewClient()
+	lamp.Publish("lamp/on", []byte("1"), 1, true)
+	b.Wait()
+	hemtjanst.Publish("lamp/on/set", []byte("0"), 1, false)
+	b.Wait()
+	lamp.Publish("lamp/snapshot", []byte{0xff, 0xd8, 0xff}, 0, false)
+	b.Wait()
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Record{
+		{Received: true, Topic: "lamp/on", Payload: []byte("1"), QoS: 1},
+		{Topic: "lamp/on/set", Payload: []byte("0"), QoS: 1},
+		{Received: true, Topic: "lamp/on/set", Payload: []byte("0"), QoS: 1},
+		{Received: true, Topic: "lamp/snapshot", Payload: []byte{0xff, 0xd8, 0xff}, QoS: 0},
+	}
+	if len(records) != len(exp) {
+		t.Fatalf("Expected %d records, got %d", len(exp), len(records))
+	}
+	for i, e := range exp {
+		got := records[i]
+		if got.Received != e.Received || got.Topic != e.Topic || !bytes.Equal(got.Payload, e.Payload) || got.QoS != e.QoS || got.Time.IsZero() {
+			t.Errorf("Expected record %d to be %+v, got %+v", i, e, got)
+		}
+	}
+
+	// Replaying feeds the received messages to a fresh broker
+	replay := NewMemoryBroker()
+	r = &received{}
+	replay.NewClient().Subscribe("lamp/#", 1, r.callback)
+	start := time.Now()
+	if err := Replay(context.Background(), records, replay.NewClient(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	replay.Wait()
+	if time.Since(start) > time.Second {
+		t.Error("Expected the replay to be sped up")
+	}
+	if exp := []string{"lamp/on", "lamp/on/set", "lamp/snapshot"}; !equalTopics(r.topics(), exp) {
+		t.Errorf("Expected %v to be replayed, got %v", exp, r.topics())
+	}
+}
+
+func TestRecordOnce(t *testing.T) {
+	b := NewMemoryBroker()
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	hemtjanst := rec.PublishSubscriber(b.NewClient())
+	r := &received{}
+	hemtjanst.Subscribe("lamp/#", 1, r.callback)
+	hemtjanst.Subscribe("lamp/on", 1, r.callback)
+
+	lamp := b.NewClient()
+	lamp.Publish("lamp/on", []byte("1"), 1, false)
+	lamp.Publish("lamp/on", []byte("1"), 1, false)
+	lamp.Publish("lamp/on", nil, 1, false)
+	b.Wait()
+
+	records, err := ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.topics()) != 6 {
+		t.Errorf("Expected every message to reach both subscriptions, got %v", r.topics())
+	}
+	if len(records) != 3 {
+		t.Errorf("Expected every message to be recorded once, got %+v", records)
+	}
+}
+
+func TestReplayCancel(t *testing.T) {
+	now := time.Now()
+	records := []Record{
+		{Time: now, Received: true, Topic: "a"},
+		{Time: now.Add(time.Hour), Received: true, Topic: "b"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	b := NewMemoryBroker()
+	if err := Replay(ctx, records, b.NewClient(), 1); err != context.DeadlineExceeded {
+		t.Errorf("Expected the replay to stop with the context, got %v", err)
+	}
+}
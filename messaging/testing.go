@@ -1,6 +1,7 @@
 package messaging
 
 import (
+	"context"
 	"time"
 
 	mq "github.com/eclipse/paho.mqtt.golang"
@@ -15,6 +16,9 @@ type TestingMessenger struct {
 	Qos      int
 	Persist  bool
 	Callback func(Message)
+	// Err is returned by the methods taking a context, to act like a
+	// transport that fails
+	Err error
 }
 
 func NewTestingMessenger(client mq.Client) PublishSubscriber {
@@ -39,6 +43,30 @@ func (tm *TestingMessenger) Unsubscribe(topics ...string) {
 	tm.Topic = topics
 }
 
+func (tm *TestingMessenger) PublishContext(ctx context.Context, topic string, message []byte, qos int, persist bool) error {
+	if tm.Err != nil {
+		return tm.Err
+	}
+	tm.Publish(topic, message, qos, persist)
+	return nil
+}
+
+func (tm *TestingMessenger) SubscribeContext(ctx context.Context, topic string, qos int, callback func(Message)) error {
+	if tm.Err != nil {
+		return tm.Err
+	}
+	tm.Subscribe(topic, qos, callback)
+	return nil
+}
+
+func (tm *TestingMessenger) UnsubscribeContext(ctx context.Context, topics ...string) error {
+	if tm.Err != nil {
+		return tm.Err
+	}
+	tm.Unsubscribe(topics...)
+	return nil
+}
+
 // TestingMQTTToken can be used in place of an mq.Token. It is meant to be
 // used in tests
 type TestingMQTTToken struct {
@@ -0,0 +1,60 @@
+package messaging
+
+import "strings"
+
+// Match returns whether topic matches the subscription filter, which can
+// contain the wildcards + for a single level and # for any number of
+// levels at its end. Shared subscriptions, $share/<group>/<filter>, match
+// what their filter does. As in MQTT, wildcards at the first level don't
+// match topics starting with $.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return i == len(fs)-1
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// ValidTopic returns whether messages can be published on topic, which
+// can't be empty or contain wildcards.
+func ValidTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// ValidFilter returns whether filter can be subscribed to. A wildcard has
+// to take up a whole level and # can only be the last one.
+func ValidFilter(filter string) bool {
+	if filter == "" || strings.Contains(filter, "\x00") {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
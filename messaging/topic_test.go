@@ -0,0 +1,49 @@
+package messaging
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"announce/#", "announce/lightbulb/kitchen", true},
+		{"announce/#", "announce", true},
+		{"announce/#", "announcements", false},
+		{"sensor/+/get", "sensor/temperature/get", true},
+		{"sensor/+/get", "sensor/get", false},
+		{"sensor/+/get", "sensor/a/b/get", false},
+		{"+/+", "a/b", true},
+		{"+", "/a", false},
+		{"leave", "leave", true},
+		{"leave", "leave/now", false},
+		{"#", "anything/at/all", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$share/hemtjanst/sensor/+/get", "sensor/temperature/get", true},
+		{"$share/hemtjanst", "hemtjanst", false},
+	}
+	for _, test := range tests {
+		if m := Match(test.filter, test.topic); m != test.match {
+			t.Errorf("Expected match of %s on %s to be %t, got %t", test.filter, test.topic, test.match, m)
+		}
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	for filter, valid := range map[string]bool{
+		"#":       true,
+		"a/+/b":   true,
+		"a/#":     true,
+		"a/#/b":   false,
+		"a/b#":    false,
+		"a/b+/c":  false,
+		"":        false,
+		"+/+/+/#": true,
+	} {
+		if ValidFilter(filter) != valid {
+			t.Errorf("Expected ValidFilter(%q) to be %t", filter, valid)
+		}
+	}
+}